@@ -303,6 +303,26 @@ func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	return &lr, nil
 }
 
+// LibraryTags lists the tags of a model available in the registry, including
+// the quantization and size of each tag.
+func (c *Client) LibraryTags(ctx context.Context, model string) (*LibraryTagsResponse, error) {
+	var resp LibraryTagsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/library/"+model+"/tags", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Render renders the prompt a chat request would be given to a model with,
+// without loading the model.
+func (c *Client) Render(ctx context.Context, req *RenderRequest) (*RenderResponse, error) {
+	var resp RenderResponse
+	if err := c.do(ctx, http.MethodPost, "/api/render", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // List running models.
 func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	var lr ProcessResponse
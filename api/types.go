@@ -1,12 +1,17 @@
 package api
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
+	"net/http"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -47,6 +52,10 @@ type GenerateRequest struct {
 	// Prompt is the textual prompt to send to the model.
 	Prompt string `json:"prompt"`
 
+	// Suffix is the text after the completion for fill in the middle code
+	// completion, where Prompt is the text before it.
+	Suffix string `json:"suffix"`
+
 	// System overrides the model's default system message/prompt.
 	System string `json:"system"`
 
@@ -100,6 +109,10 @@ type ChatRequest struct {
 	// Tools is an optional list of tools the model has access to.
 	Tools []Tool `json:"tools,omitempty"`
 
+	// ToolChoice controls whether the model calls Tools. The model is free to
+	// choose if it's nil.
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -112,46 +125,466 @@ type Message struct {
 	Content   string      `json:"content,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// Name tells apart the assistants of a conversation with more than one,
+	// e.g. "{{ .Name }}: {{ .Content }}" in a template
+	Name string `json:"name,omitempty"`
+
+	// ToolCallID is the ID of the tool call a message with the role "tool"
+	// is the result of, for templates of models which echo the ID
+	ToolCallID string `json:"tool_call_id,omitempty"`
+
+	// Thinking is the reasoning of a reasoning model before its content,
+	// e.g. "<think>{{ .Thinking }}</think>{{ .Content }}" in a template
+	Thinking string `json:"thinking,omitempty"`
+
+	// When is set on messages stored in a model which are only used for
+	// requests with tools ("tools"), without tools ("no-tools"), or for
+	// every request ("always"). it's ignored in requests
+	When string `json:"when,omitempty"`
+
+	// Parts is set if the content was given as a list of text and image
+	// parts, e.g. by OpenAI compatible clients. Content holds the text of the
+	// parts, one per line, and Images their images. templates render the
+	// images where they appear among the text
+	Parts []ContentPart `json:"-"`
+}
+
+// ContentPart is a part of the content of a message given as a list, e.g.
+// {"type": "text", "text": "What's this?"} or {"type": "image_url",
+// "image_url": {"url": "data:image/png;base64,..."}}. only base64 data URLs
+// are supported for images
+type ContentPart struct {
+	// Type is "text" or "image_url"
+	Type  string
+	Text  string
+	Image ImageData
+}
+
+func (p *ContentPart) UnmarshalJSON(b []byte) error {
+	var part struct {
+		Type     string          `json:"type"`
+		Text     string          `json:"text"`
+		ImageURL json.RawMessage `json:"image_url"`
+	}
+
+	if err := json.Unmarshal(b, &part); err != nil {
+		return err
+	}
+
+	switch part.Type {
+	case "text":
+		*p = ContentPart{Type: part.Type, Text: part.Text}
+		return nil
+	case "image_url":
+		// the URL is given either as is or in an object
+		var url string
+		if err := json.Unmarshal(part.ImageURL, &url); err != nil {
+			var obj struct {
+				URL string `json:"url"`
+			}
+
+			if err := json.Unmarshal(part.ImageURL, &obj); err != nil {
+				return fmt.Errorf("invalid image_url: %w", err)
+			}
+
+			url = obj.URL
+		}
+
+		mediaType, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ";base64,")
+		if !ok || !strings.HasPrefix(url, "data:") || !strings.HasPrefix(mediaType, "image/") {
+			return errors.New("invalid image_url: only base64 data URLs of images are supported")
+		}
+
+		img, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return fmt.Errorf("invalid image_url: %w", err)
+		}
+
+		*p = ContentPart{Type: part.Type, Image: img}
+		return nil
+	default:
+		return fmt.Errorf("unsupported content part type %q", part.Type)
+	}
+}
+
+func (p ContentPart) MarshalJSON() ([]byte, error) {
+	if p.Type == "image_url" {
+		type imageURL struct {
+			URL string `json:"url"`
+		}
+
+		return json.Marshal(struct {
+			Type     string   `json:"type"`
+			ImageURL imageURL `json:"image_url"`
+		}{p.Type, imageURL{"data:" + http.DetectContentType(p.Image) + ";base64," + base64.StdEncoding.EncodeToString(p.Image)}})
+	}
+
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}{p.Type, p.Text})
 }
 
 type ToolCall struct {
 	ID       string `json:"id"`
 	Type     string `json:"type"`
 	Function struct {
-		Name      string         `json:"name"`
-		Arguments map[string]any `json:"arguments"`
+		Name      string                    `json:"name"`
+		Arguments ToolCallFunctionArguments `json:"arguments"`
 	} `json:"function"`
 }
 
+// ToolCallFunctionArguments are the arguments of a tool call. Unlike a map,
+// they keep the order their keys were decoded or set in, as do objects nested
+// in them, so tool calls render back into prompts byte for byte.
+type ToolCallFunctionArguments struct {
+	keys   []string
+	values map[string]any
+}
+
+// NewToolCallFunctionArguments returns arguments holding the values of kv.
+// Since a map has no order, its keys are sorted.
+func NewToolCallFunctionArguments(kv map[string]any) ToolCallFunctionArguments {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	a := ToolCallFunctionArguments{values: make(map[string]any, len(kv))}
+	for _, k := range keys {
+		a.Set(k, kv[k])
+	}
+
+	return a
+}
+
+// Get returns the value of key, or nil if there's no such argument.
+func (a ToolCallFunctionArguments) Get(key string) any {
+	return a.values[key]
+}
+
+// Set sets the value of key. New keys are added after the existing ones.
+func (a *ToolCallFunctionArguments) Set(key string, value any) {
+	if a.values == nil {
+		a.values = make(map[string]any)
+	}
+
+	if _, ok := a.values[key]; !ok {
+		a.keys = append(a.keys, key)
+	}
+
+	a.values[key] = value
+}
+
+// Len returns the number of arguments.
+func (a ToolCallFunctionArguments) Len() int {
+	return len(a.keys)
+}
+
+// Keys returns the names of the arguments in order.
+func (a ToolCallFunctionArguments) Keys() []string {
+	return slices.Clone(a.keys)
+}
+
+// Map returns the arguments as a map, converting nested objects to maps too.
+// It's nil if a is.
+func (a ToolCallFunctionArguments) Map() map[string]any {
+	if a.values == nil {
+		return nil
+	}
+
+	m := make(map[string]any, len(a.values))
+	for k, v := range a.values {
+		m[k] = unorderedArgument(v)
+	}
+
+	return m
+}
+
+func unorderedArgument(v any) any {
+	switch v := v.(type) {
+	case ToolCallFunctionArguments:
+		return v.Map()
+	case []any:
+		s := make([]any, len(v))
+		for i := range v {
+			s[i] = unorderedArgument(v[i])
+		}
+
+		return s
+	}
+
+	return v
+}
+
+// String formats the arguments as a map, e.g. map[location:Paris], as they
+// were formatted before they kept their order.
+func (a ToolCallFunctionArguments) String() string {
+	return fmt.Sprint(a.Map())
+}
+
+// Equal reports whether a and b hold the same arguments regardless of order.
+func (a ToolCallFunctionArguments) Equal(b ToolCallFunctionArguments) bool {
+	return reflect.DeepEqual(a.Map(), b.Map())
+}
+
+func (a ToolCallFunctionArguments) MarshalJSON() ([]byte, error) {
+	if a.values == nil {
+		return []byte("null"), nil
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range a.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(a.values[k])
+		if err != nil {
+			return nil, err
+		}
+
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func (a *ToolCallFunctionArguments) UnmarshalJSON(b []byte) error {
+	v, err := decodeArgument(json.NewDecoder(bytes.NewReader(b)))
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*a = ToolCallFunctionArguments{}
+	case ToolCallFunctionArguments:
+		*a = v
+	default:
+		return fmt.Errorf("tool call arguments must be an object, got %T", v)
+	}
+
+	return nil
+}
+
+// decodeArgument decodes the next JSON value from d, decoding objects as
+// ToolCallFunctionArguments to keep their order
+func decodeArgument(d *json.Decoder) (any, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case json.Delim('{'):
+		a := ToolCallFunctionArguments{values: make(map[string]any)}
+		for d.More() {
+			t, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			key, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object key %v", t)
+			}
+
+			v, err := decodeArgument(d)
+			if err != nil {
+				return nil, err
+			}
+
+			a.Set(key, v)
+		}
+
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+
+		return a, nil
+	case json.Delim('['):
+		s := []any{}
+		for d.More() {
+			v, err := decodeArgument(d)
+			if err != nil {
+				return nil, err
+			}
+
+			s = append(s, v)
+		}
+
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	return t, nil
+}
+
 type Tool struct {
 	Type     string `json:"type"`
 	Function struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
-		Parameters  struct {
+
+		// Category groups related tools, e.g. for templates which render
+		// large tool sets in sections
+		Category string `json:"category,omitempty"`
+
+		Parameters struct {
 			Type       string   `json:"type"`
 			Required   []string `json:"required"`
 			Properties map[string]struct {
 				Type        string   `json:"type"`
 				Description string   `json:"description"`
 				Enum        []string `json:"enum,omitempty"`
+				Examples    []any    `json:"examples,omitempty"`
 			} `json:"properties"`
 		} `json:"parameters"`
 	} `json:"function"`
 }
 
+// ToolChoice controls whether the model calls tools. It's given as "auto",
+// "none" or "required", or as {"type": "function", "function": {"name": "x"}}
+// to require calling a specific function.
+type ToolChoice struct {
+	// Mode is "auto", "none", "required" or "function".
+	Mode string
+
+	// Name is the name of the function the model must call if Mode is
+	// "function".
+	Name string
+}
+
+func (c ToolChoice) MarshalJSON() ([]byte, error) {
+	if c.Mode != "function" {
+		return json.Marshal(c.Mode)
+	}
+
+	var f struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+
+	f.Type = "function"
+	f.Function.Name = c.Name
+	return json.Marshal(f)
+}
+
+func (c *ToolChoice) UnmarshalJSON(b []byte) error {
+	var mode string
+	if err := json.Unmarshal(b, &mode); err == nil {
+		switch mode {
+		case "auto", "none", "required":
+			*c = ToolChoice{Mode: mode}
+			return nil
+		}
+
+		return fmt.Errorf("invalid tool choice %q", mode)
+	}
+
+	var f struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+
+	if f.Type != "function" || f.Function.Name == "" {
+		return errors.New("tool choice must be \"auto\", \"none\", \"required\" or name a function")
+	}
+
+	*c = ToolChoice{Mode: "function", Name: f.Function.Name}
+	return nil
+}
+
 func (m *Message) UnmarshalJSON(b []byte) error {
 	type Alias Message
-	var a Alias
+	var a struct {
+		Alias
+		// Content is either a string or a list of parts
+		Content json.RawMessage `json:"content,omitempty"`
+	}
+
 	if err := json.Unmarshal(b, &a); err != nil {
 		return err
 	}
 
-	*m = Message(a)
+	*m = Message(a.Alias)
 	m.Role = strings.ToLower(m.Role)
+
+	switch content := bytes.TrimSpace(a.Content); {
+	case len(content) == 0, bytes.Equal(content, []byte("null")):
+		return nil
+	case content[0] != '[':
+		return json.Unmarshal(content, &m.Content)
+	}
+
+	if err := json.Unmarshal(a.Content, &m.Parts); err != nil {
+		return err
+	}
+
+	var text []string
+	var images []ImageData
+	for _, p := range m.Parts {
+		switch p.Type {
+		case "text":
+			text = append(text, p.Text)
+		case "image_url":
+			images = append(images, p.Image)
+		}
+	}
+
+	if len(images) > 0 && len(m.Images) > 0 {
+		return errors.New("images can't be given both in content and images")
+	}
+
+	m.Content = strings.Join(text, "\n")
+	m.Images = append(m.Images, images...)
 	return nil
 }
 
+// MarshalJSON writes the content as a list of parts if it was given as one.
+// images of the parts aren't repeated in images
+func (m Message) MarshalJSON() ([]byte, error) {
+	type Alias Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(Alias(m))
+	}
+
+	a := struct {
+		Alias
+		Content []ContentPart `json:"content"`
+	}{Alias(m), m.Parts}
+
+	if slices.ContainsFunc(m.Parts, func(p ContentPart) bool { return p.Type == "image_url" }) {
+		a.Images = nil
+	}
+
+	return json.Marshal(a)
+}
+
 // ChatResponse is the response returned by [Client.Chat]. Its fields are
 // similar to [GenerateResponse].
 type ChatResponse struct {
@@ -183,6 +616,7 @@ type Options struct {
 	NumKeep          int      `json:"num_keep,omitempty"`
 	Seed             int      `json:"seed,omitempty"`
 	NumPredict       int      `json:"num_predict,omitempty"`
+	MaxDuration      Duration `json:"max_duration,omitempty"`
 	TopK             int      `json:"top_k,omitempty"`
 	TopP             float32  `json:"top_p,omitempty"`
 	TFSZ             float32  `json:"tfs_z,omitempty"`
@@ -197,6 +631,11 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// SeparateMessages renders consecutive messages of the same role as
+	// separate turns rather than merging them into one for templates that
+	// range over messages. legacy templates always merge
+	SeparateMessages bool `json:"separate_messages,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -229,14 +668,58 @@ type EmbedRequest struct {
 
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// Chunking splits inputs longer than the context into chunks instead of
+	// truncating them.
+	Chunking *EmbedChunking `json:"chunking,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
 
+// EmbedChunking controls how inputs longer than the context are split.
+type EmbedChunking struct {
+	// Overlap is the number of tokens shared by consecutive chunks.
+	Overlap int `json:"overlap,omitempty"`
+
+	// Pool combines the chunks of each input into a single embedding. The
+	// only supported value is "mean". If empty, every chunk is returned as
+	// its own embedding.
+	Pool string `json:"pool,omitempty"`
+}
+
 // EmbedResponse is the response from [Client.Embed].
 type EmbedResponse struct {
 	Model      string      `json:"model"`
 	Embeddings [][]float32 `json:"embeddings"`
+
+	// Chunks describes each embedding when chunks aren't pooled.
+	Chunks []EmbedChunk `json:"chunks,omitempty"`
+
+	// Inputs holds token counts for each input.
+	Inputs []EmbedInputStats `json:"inputs,omitempty"`
+}
+
+// EmbedChunk is the span of tokens of an input an embedding was generated
+// from.
+type EmbedChunk struct {
+	// Input is the index of the input the chunk belongs to.
+	Input int `json:"input"`
+
+	// Start and End are the token offsets of the chunk in the input.
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// EmbedInputStats describes how an input was embedded.
+type EmbedInputStats struct {
+	// Tokens is the number of tokens in the input.
+	Tokens int `json:"tokens"`
+
+	// Truncated is the number of tokens dropped from the end of the input.
+	Truncated int `json:"truncated,omitempty"`
+
+	// Chunks is the number of chunks the input was split into.
+	Chunks int `json:"chunks,omitempty"`
 }
 
 // EmbeddingRequest is the request passed to [Client.Embeddings].
@@ -268,6 +751,10 @@ type CreateRequest struct {
 	Stream    *bool  `json:"stream,omitempty"`
 	Quantize  string `json:"quantize,omitempty"`
 
+	// Pack lists the models to group into a model pack. Modelfile and Path
+	// are ignored when it's set
+	Pack []string `json:"pack,omitempty"`
+
 	// Name is deprecated, see Model
 	Name string `json:"name"`
 
@@ -279,10 +766,51 @@ type CreateRequest struct {
 type DeleteRequest struct {
 	Model string `json:"model"`
 
+	// Members also deletes the members of the model pack Model that no other
+	// pack references
+	Members bool `json:"members,omitempty"`
+
 	// Name is deprecated, see Model
 	Name string `json:"name"`
 }
 
+// RenderRequest is the request passed to [Client.Render].
+type RenderRequest struct {
+	// Model is the model name, as in [GenerateRequest].
+	Model string `json:"model"`
+
+	// Messages, Tools and ToolChoice are rendered as they would be by
+	// [Client.Chat].
+	Messages   []Message   `json:"messages"`
+	Tools      []Tool      `json:"tools,omitempty"`
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
+	// Trace maps each region of the prompt to the template node and message
+	// that rendered it.
+	Trace bool `json:"trace,omitempty"`
+}
+
+// RenderResponse is the response returned from [Client.Render].
+type RenderResponse struct {
+	Model  string        `json:"model"`
+	Prompt string        `json:"prompt"`
+	Trace  []RenderTrace `json:"trace,omitempty"`
+}
+
+// RenderTrace is a region of the prompt in [RenderResponse]. Start and End
+// are byte offsets into the prompt.
+type RenderTrace struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+
+	// Node is the line:col in the template of the node that rendered the
+	// region. It's empty for text the template doesn't render.
+	Node string `json:"node,omitempty"`
+
+	// Message is the index of the message the region belongs to, or -1.
+	Message int `json:"message"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -310,6 +838,16 @@ type ShowResponse struct {
 	ModelInfo     map[string]any `json:"model_info,omitempty"`
 	ProjectorInfo map[string]any `json:"projector_info,omitempty"`
 	ModifiedAt    time.Time      `json:"modified_at,omitempty"`
+
+	// Members lists the models of a model pack
+	Members []PackMember `json:"members,omitempty"`
+}
+
+// PackMember is a model in a model pack. Digest is the digest of the model's
+// manifest when the pack was created.
+type PackMember struct {
+	Model  string `json:"model"`
+	Digest string `json:"digest"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -326,10 +864,30 @@ type PullRequest struct {
 	Password string `json:"password"`
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// Quantize selects the tag of Model holding this quantization, e.g. q8_0
+	Quantize string `json:"quantize,omitempty"`
+
+	// Pack also pulls the members of the model pack Model
+	Pack bool `json:"pack,omitempty"`
+
 	// Name is deprecated, see Model
 	Name string `json:"name"`
 }
 
+// LibraryTagsResponse is the response from [Client.LibraryTags].
+type LibraryTagsResponse struct {
+	Model string       `json:"model"`
+	Tags  []LibraryTag `json:"tags"`
+}
+
+// LibraryTag is a single tag of a model in the registry in [LibraryTagsResponse].
+type LibraryTag struct {
+	Name         string `json:"name"`
+	Quantization string `json:"quantization,omitempty"`
+	Size         int64  `json:"size"`
+	Digest       string `json:"digest"`
+}
+
 // ProgressResponse is the response passed to progress functions like
 // [PullProgressFunc] and [PushProgressFunc].
 type ProgressResponse struct {
@@ -369,6 +927,9 @@ type ListModelResponse struct {
 	Size       int64        `json:"size"`
 	Digest     string       `json:"digest"`
 	Details    ModelDetails `json:"details,omitempty"`
+
+	// Members lists the models of a model pack
+	Members []PackMember `json:"members,omitempty"`
 }
 
 // ProcessModelResponse is a single model description in [ProcessResponse].
@@ -380,6 +941,18 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// Clients lists the requests of each client for the model when fair
+	// scheduling across clients is enabled
+	Clients []ProcessClientResponse `json:"clients,omitempty"`
+}
+
+// ProcessClientResponse is the number of requests a client has running and
+// waiting on a model in [ProcessModelResponse].
+type ProcessClientResponse struct {
+	Client string `json:"client"`
+	Active int    `json:"active"`
+	Queued int    `json:"queued"`
 }
 
 type RetrieveModelResponse struct {
@@ -530,6 +1103,30 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
+			case reflect.Struct:
+				if field.Type() != reflect.TypeOf(Duration{}) {
+					return fmt.Errorf("unknown type loading config params: %v %v", field.Kind(), field.Type())
+				}
+
+				var d time.Duration
+				switch t := val.(type) {
+				case string:
+					var err error
+					if d, err = time.ParseDuration(t); err != nil {
+						return fmt.Errorf("option %q must be a duration: %w", key, err)
+					}
+				case float64:
+					// plain numbers are in seconds like keep_alive
+					d = time.Duration(t * float64(time.Second))
+				default:
+					return fmt.Errorf("option %q must be of type duration", key)
+				}
+
+				if d < 0 {
+					return fmt.Errorf("option %q must not be negative", key)
+				}
+
+				field.Set(reflect.ValueOf(Duration{d}))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -680,6 +1277,16 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.Slice:
 					// TODO: only string slices are supported right now
 					out[key] = vals
+				case reflect.Struct:
+					if field.Type() != reflect.TypeOf(Duration{}) {
+						return nil, fmt.Errorf("unknown type %s for %s", field.Kind(), key)
+					}
+
+					if _, err := time.ParseDuration(vals[0]); err != nil {
+						return nil, fmt.Errorf("invalid duration value %s", vals)
+					}
+
+					out[key] = vals[0]
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
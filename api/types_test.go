@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -209,6 +210,47 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestMaxDurationParsing(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  time.Duration
+		err  bool
+	}{
+		{name: "Undefined", req: `{ }`},
+		{name: "String", req: `{ "max_duration": "10s" }`, exp: 10 * time.Second},
+		{name: "Seconds", req: `{ "max_duration": 1.5 }`, exp: 1500 * time.Millisecond},
+		{name: "Negative", req: `{ "max_duration": "-1s" }`, err: true},
+		{name: "Invalid", req: `{ "max_duration": "soon" }`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]interface{}
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.MaxDuration.Duration)
+		})
+	}
+
+	t.Run("FormatParams", func(t *testing.T) {
+		resp, err := FormatParams(map[string][]string{"max_duration": {"10s"}})
+		require.NoError(t, err)
+		assert.Equal(t, "10s", resp["max_duration"])
+
+		_, err = FormatParams(map[string][]string{"max_duration": {"soon"}})
+		require.Error(t, err)
+	})
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -231,3 +273,160 @@ func TestMessage_UnmarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageContentJSON(t *testing.T) {
+	// a 1x1 PNG
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNk+A8AAQUBAScY42YAAAAASUVORK5CYII="
+	img, err := base64.StdEncoding.DecodeString(png)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		input    string
+		expected Message
+	}{
+		{
+			name:     "string",
+			input:    `{"role":"user","content":"What's this?"}`,
+			expected: Message{Role: "user", Content: "What's this?"},
+		},
+		{
+			name:  "text parts",
+			input: `{"role":"user","content":[{"type":"text","text":"What's this?"},{"type":"text","text":"Be brief."}]}`,
+			expected: Message{Role: "user", Content: "What's this?\nBe brief.", Parts: []ContentPart{
+				{Type: "text", Text: "What's this?"},
+				{Type: "text", Text: "Be brief."},
+			}},
+		},
+		{
+			name:  "image parts",
+			input: `{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,` + png + `"}}]}`,
+			expected: Message{Role: "user", Images: []ImageData{img}, Parts: []ContentPart{
+				{Type: "image_url", Image: img},
+			}},
+		},
+		{
+			name:  "mixed",
+			input: `{"role":"user","content":[{"type":"text","text":"Is"},{"type":"image_url","image_url":{"url":"data:image/png;base64,` + png + `"}},{"type":"text","text":"the same as"},{"type":"image_url","image_url":{"url":"data:image/png;base64,` + png + `"}},{"type":"text","text":"?"}]}`,
+			expected: Message{Role: "user", Content: "Is\nthe same as\n?", Images: []ImageData{img, img}, Parts: []ContentPart{
+				{Type: "text", Text: "Is"},
+				{Type: "image_url", Image: img},
+				{Type: "text", Text: "the same as"},
+				{Type: "image_url", Image: img},
+				{Type: "text", Text: "?"},
+			}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Message
+			require.NoError(t, json.Unmarshal([]byte(tt.input), &m))
+			assert.Equal(t, tt.expected, m)
+
+			b, err := json.Marshal(m)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.input, string(b))
+		})
+	}
+
+	t.Run("image url string", func(t *testing.T) {
+		var m Message
+		require.NoError(t, json.Unmarshal([]byte(`{"role":"user","content":[{"type":"image_url","image_url":"data:image/jpeg;base64,`+png+`"}]}`), &m))
+		assert.Equal(t, []ImageData{img}, m.Images)
+	})
+
+	for _, input := range []string{
+		`{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}`,
+		`{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:text/plain;base64,aGk="}}]}`,
+		`{"role":"user","content":[{"type":"audio","audio":"..."}]}`,
+		`{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,` + png + `"}}],"images":["` + png + `"]}`,
+		`{"role":"user","content":1}`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			var m Message
+			assert.Error(t, json.Unmarshal([]byte(input), &m))
+		})
+	}
+}
+
+func TestToolChoiceJSON(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected ToolChoice
+	}{
+		{`"auto"`, ToolChoice{Mode: "auto"}},
+		{`"none"`, ToolChoice{Mode: "none"}},
+		{`"required"`, ToolChoice{Mode: "required"}},
+		{`{"type":"function","function":{"name":"get_current_weather"}}`, ToolChoice{Mode: "function", Name: "get_current_weather"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.input, func(t *testing.T) {
+			var c ToolChoice
+			if err := json.Unmarshal([]byte(tt.input), &c); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.expected, c)
+
+			b, err := json.Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.input, string(b))
+		})
+	}
+
+	for _, input := range []string{`"always"`, `{"type":"function"}`, `{"type":"tool","function":{"name":"x"}}`, `1`} {
+		t.Run(input, func(t *testing.T) {
+			var c ToolChoice
+			if err := json.Unmarshal([]byte(input), &c); err == nil {
+				t.Errorf("expected error, got %+v", c)
+			}
+		})
+	}
+}
+
+func TestToolCallFunctionArgumentsJSON(t *testing.T) {
+	input := `{"b":1,"a":{"d":[{"f":true,"e":null}],"c":"x"}}`
+
+	var args ToolCallFunctionArguments
+	if err := json.Unmarshal([]byte(input), &args); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"b", "a"}, args.Keys())
+	assert.Equal(t, float64(1), args.Get("b"))
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, input, string(b))
+	assert.Equal(t, "map[a:map[c:x d:[map[e:<nil> f:true]]] b:1]", args.String())
+
+	// arguments are equal regardless of order
+	assert.True(t, args.Equal(NewToolCallFunctionArguments(map[string]any{
+		"a": map[string]any{"c": "x", "d": []any{map[string]any{"e": nil, "f": true}}},
+		"b": float64(1),
+	})))
+
+	var empty ToolCallFunctionArguments
+	if err := json.Unmarshal([]byte(`null`), &empty); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, empty.Len())
+
+	for _, input := range []string{`"a"`, `[1]`, `1`} {
+		t.Run(input, func(t *testing.T) {
+			var args ToolCallFunctionArguments
+			if err := json.Unmarshal([]byte(input), &args); err == nil {
+				t.Errorf("expected error, got %v", args.Map())
+			}
+		})
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -45,6 +46,10 @@ import (
 )
 
 func CreateHandler(cmd *cobra.Command, args []string) error {
+	if pack, _ := cmd.Flags().GetStringSlice("pack"); len(pack) > 0 {
+		return createPack(cmd, args[0], pack)
+	}
+
 	filename, _ := cmd.Flags().GetString("file")
 	filename, err := filepath.Abs(filename)
 	if err != nil {
@@ -79,6 +84,27 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	spinner := progress.NewSpinner(status)
 	p.Add(status, spinner)
 
+	// directories are read in place by a server on this machine rather than
+	// zipped and uploaded. dirs holds the commands referring to them
+	local := isLocalHost(envconfig.Host.Host)
+	var dirs []int
+	uploadDir := func(i int) error {
+		// this is likely a safetensors or pytorch directory, or a peft adapter
+		tempfile, err := tempZipFiles(modelfile.Commands[i].Args)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tempfile)
+
+		digest, err := createBlob(cmd, client, tempfile)
+		if err != nil {
+			return err
+		}
+
+		modelfile.Commands[i].Args = "@" + digest
+		return nil
+	}
+
 	for i := range modelfile.Commands {
 		switch modelfile.Commands[i].Name {
 		case "model", "adapter":
@@ -101,15 +127,14 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 			}
 
 			if fi.IsDir() {
-				// this is likely a safetensors or pytorch directory
-				// TODO make this work w/ adapters
-				tempfile, err := tempZipFiles(path)
-				if err != nil {
+				modelfile.Commands[i].Args = path
+				if local {
+					dirs = append(dirs, i)
+				} else if err := uploadDir(i); err != nil {
 					return err
 				}
-				defer os.RemoveAll(tempfile)
 
-				path = tempfile
+				continue
 			}
 
 			digest, err := createBlob(cmd, client, path)
@@ -148,11 +173,61 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	quantize, _ := cmd.Flags().GetString("quantize")
 
 	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize}
-	if err := client.Create(cmd.Context(), &request, fn); err != nil {
+	err = client.Create(cmd.Context(), &request, fn)
+	if err != nil && len(dirs) > 0 && strings.Contains(err.Error(), "invalid model reference") {
+		// the server can't see this filesystem, e.g. since it runs in a
+		// container, so the directories are uploaded after all
+		for _, i := range dirs {
+			if err := uploadDir(i); err != nil {
+				return err
+			}
+		}
+
+		request.Modelfile = modelfile.String()
+		err = client.Create(cmd.Context(), &request, fn)
+	}
+
+	return err
+}
+
+// isLocalHost reports whether host is this machine, in which case the server
+// is likely to share its filesystem
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(host)
+	return err == nil && (addr.IsLoopback() || addr.IsUnspecified())
+}
+
+func createPack(cmd *cobra.Command, name string, members []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	var status string
+	var spinner *progress.Spinner
+	fn := func(resp api.ProgressResponse) error {
+		if status != resp.Status {
+			if spinner != nil {
+				spinner.Stop()
+			}
+
+			status = resp.Status
+			spinner = progress.NewSpinner(status)
+			p.Add(status, spinner)
+		}
+
+		return nil
+	}
+
+	request := api.CreateRequest{Name: name, Pack: members}
+	return client.Create(cmd.Context(), &request, fn)
 }
 
 func tempZipFiles(path string) (string, error) {
@@ -198,7 +273,13 @@ func tempZipFiles(path string) (string, error) {
 	}
 
 	var files []string
-	if st, _ := glob(filepath.Join(path, "model*.safetensors"), "application/octet-stream"); len(st) > 0 {
+	if gs, _ := glob(filepath.Join(path, "*.gguf"), "application/octet-stream"); len(gs) > 0 {
+		// an already converted model is used as is by the server
+		files = append(files, gs...)
+	} else if st, _ := glob(filepath.Join(path, "adapter_model.safetensors"), "application/octet-stream"); len(st) > 0 {
+		// peft adapters are converted against the base model by the server
+		files = append(files, st...)
+	} else if st, _ := glob(filepath.Join(path, "model*.safetensors"), "application/octet-stream"); len(st) > 0 {
 		// safetensors files might be unresolved git lfs references; skip if they are
 		// covers model-x-of-y.safetensors, model.fp32-x-of-y.safetensors, model.safetensors
 		files = append(files, st...)
@@ -211,7 +292,7 @@ func tempZipFiles(path string) (string, error) {
 		// covers consolidated.x.pth, consolidated.pth
 		files = append(files, pt...)
 	} else {
-		return "", errors.New("no safetensors or torch files found")
+		return "", errors.New("no gguf, safetensors or torch files found")
 	}
 
 	// add configuration files, json files are detected as text/plain
@@ -362,7 +443,12 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 
 	opts.MultiModal = slices.Contains(info.Details.Families, "clip")
 	opts.ParentModel = info.Details.ParentModel
-	opts.Messages = append(opts.Messages, info.Messages...)
+	for _, msg := range info.Messages {
+		// the server adds messages with a condition itself
+		if msg.When == "" {
+			opts.Messages = append(opts.Messages, msg)
+		}
+	}
 
 	if interactive {
 		return generateInteractive(cmd, opts)
@@ -495,6 +581,9 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 	for _, m := range models.Models {
 		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
 			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
+			for _, member := range m.Members {
+				data = append(data, []string{"  " + member.Model, "", "", ""})
+			}
 		}
 	}
 
@@ -564,8 +653,13 @@ func DeleteHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	members, err := cmd.Flags().GetBool("members")
+	if err != nil {
+		return err
+	}
+
 	for _, name := range args {
-		req := api.DeleteRequest{Name: name}
+		req := api.DeleteRequest{Name: name, Members: members}
 		if err := client.Delete(cmd.Context(), &req); err != nil {
 			return err
 		}
@@ -647,6 +741,11 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	if len(resp.Members) > 0 {
+		showPack(resp)
+		return nil
+	}
+
 	showInfo(resp)
 
 	return nil
@@ -713,6 +812,21 @@ func showInfo(resp *api.ShowResponse) {
 	table.Render()
 }
 
+func showPack(resp *api.ShowResponse) {
+	var data [][]string
+	for _, member := range resp.Members {
+		data = append(data, []string{member.Model, strings.TrimPrefix(member.Digest, "sha256:")[:12]})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	table.SetBorder(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.Append([]string{"Pack"})
+	table.Append([]string{renderSubTable(data, false)})
+	table.Render()
+}
+
 func renderSubTable(data [][]string, file bool) string {
 	var buf bytes.Buffer
 	table := tablewriter.NewWriter(&buf)
@@ -825,7 +939,16 @@ func PullHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	request := api.PullRequest{Name: args[0], Insecure: insecure}
+	pack, err := cmd.Flags().GetBool("pack")
+	if err != nil {
+		return err
+	}
+
+	request := api.PullRequest{Name: args[0], Insecure: insecure, Pack: pack}
+	if flag := cmd.Flags().Lookup("quant"); flag != nil {
+		request.Quantize = flag.Value.String()
+	}
+
 	if err := client.Pull(cmd.Context(), &request, fn); err != nil {
 		return err
 	}
@@ -1224,6 +1347,7 @@ func NewCLI() *cobra.Command {
 
 	createCmd.Flags().StringP("file", "f", "Modelfile", "Name of the Modelfile")
 	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_0)")
+	createCmd.Flags().StringSlice("pack", nil, "Create a model pack of these local models instead of using a Modelfile")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -1269,6 +1393,8 @@ func NewCLI() *cobra.Command {
 	}
 
 	pullCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pullCmd.Flags().String("quant", "", "Pull the tag of MODEL with this quantization (e.g. q8_0)")
+	pullCmd.Flags().Bool("pack", false, "Pull the members of the model pack MODEL")
 
 	pushCmd := &cobra.Command{
 		Use:     "push MODEL",
@@ -1311,6 +1437,8 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	deleteCmd.Flags().Bool("members", false, "Also remove the members of a model pack that no other pack uses")
+
 	envVars := envconfig.AsMap()
 
 	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"]}
@@ -1335,12 +1463,20 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_DEBUG"],
 				envVars["OLLAMA_HOST"],
 				envVars["OLLAMA_KEEP_ALIVE"],
+				envVars["OLLAMA_MAX_CLIENT_PARALLEL"],
+				envVars["OLLAMA_CLIENT_WEIGHTS"],
+				envVars["OLLAMA_IMPORT_PROGRESS_INTERVAL"],
+				envVars["OLLAMA_MAX_IMPORT_COMPRESSION_RATIO"],
+				envVars["OLLAMA_MAX_IMPORT_ENTRIES"],
+				envVars["OLLAMA_MAX_IMPORT_ENTRY_SIZE"],
+				envVars["OLLAMA_MAX_IMPORT_SIZE"],
 				envVars["OLLAMA_MAX_LOADED_MODELS"],
 				envVars["OLLAMA_MAX_QUEUE"],
 				envVars["OLLAMA_MODELS"],
 				envVars["OLLAMA_NUM_PARALLEL"],
 				envVars["OLLAMA_NOPRUNE"],
 				envVars["OLLAMA_ORIGINS"],
+				envVars["OLLAMA_STABLE_TOOL_CALL_IDS"],
 				envVars["OLLAMA_TMPDIR"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
 				envVars["OLLAMA_LLM_LIBRARY"],
@@ -14,8 +14,10 @@ import (
 
 	"google.golang.org/protobuf/proto"
 
+	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/convert/sentencepiece"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/version"
 )
 
 const (
@@ -49,9 +51,18 @@ type Params struct {
 
 	PreTokenizer string
 
+	// ScratchSize is the size of the buffer used to stream each tensor from
+	// the source files into the output. DefaultScratchSize is used if unset
+	ScratchSize int `json:"-"`
+	// Progress, if set, is called after each tensor is written
+	Progress func(api.ProgressResponse) `json:"-"`
+
 	ByteOrder
 }
 
+// DefaultScratchSize is the default size of the buffer used to stream tensors
+const DefaultScratchSize = 4 << 20
+
 type ByteOrder interface {
 	binary.ByteOrder
 	binary.AppendByteOrder
@@ -97,6 +108,50 @@ func GetModelFormat(dirname string) (ModelFormat, error) {
 	return nil, fmt.Errorf("couldn't determine model format")
 }
 
+type writerToFunc func(io.Writer) (int64, error)
+
+func (fn writerToFunc) WriteTo(w io.Writer) (int64, error) {
+	return fn(w)
+}
+
+// writeGGUF encodes kv and the model's tensors into ws, reporting progress
+// through Params.Progress as each tensor is written
+func (m *ModelData) writeGGUF(ws io.WriteSeeker, kv llm.KV) error {
+	kv["general.converter"] = "ollama " + version.Version
+
+	tensors := m.Tensors
+	if m.Params.Progress != nil {
+		var total, completed uint64
+		for _, t := range m.Tensors {
+			total += t.Size()
+		}
+
+		tensors = make([]llm.Tensor, len(m.Tensors))
+		for i, t := range m.Tensors {
+			wt := t.WriterTo
+			t.WriterTo = writerToFunc(func(w io.Writer) (int64, error) {
+				n, err := wt.WriteTo(w)
+				if err != nil {
+					return n, err
+				}
+
+				completed += t.Size()
+				m.Params.Progress(api.ProgressResponse{
+					Status:    "converting model",
+					Total:     int64(total),
+					Completed: int64(completed),
+				})
+
+				return n, nil
+			})
+
+			tensors[i] = t
+		}
+	}
+
+	return llm.NewGGUFV3(m.Params.ByteOrder).Encode(ws, kv, tensors)
+}
+
 // Details on gguf's tokenizer can be found at:
 // https://github.com/ggerganov/ggml/blob/master/docs/gguf.md#tokenizer
 type Vocab struct {
@@ -103,7 +103,7 @@ func (m *LlamaModel) WriteGGUF(ws io.WriteSeeker) error {
 		kv["tokenizer.ggml.scores"] = m.Vocab.Scores
 	}
 
-	return llm.NewGGUFV3(m.Params.ByteOrder).Encode(ws, kv, m.Tensors)
+	return m.writeGGUF(ws, kv)
 }
 
 func (m *LlamaModel) Repack(name string, data []float32, shape []uint64) ([]float32, error) {
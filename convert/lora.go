@@ -0,0 +1,260 @@
+package convert
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// AdapterParams is the configuration of a PEFT LoRA adapter from adapter_config.json
+type AdapterParams struct {
+	PeftType      string   `json:"peft_type"`
+	R             int      `json:"r"`
+	Alpha         float64  `json:"lora_alpha"`
+	TargetModules []string `json:"target_modules"`
+	BaseModel     string   `json:"base_model_name_or_path"`
+}
+
+// IsAdapter reports whether dirpath holds a PEFT adapter rather than a model
+func IsAdapter(dirpath string) bool {
+	_, err := os.Stat(filepath.Join(dirpath, "adapter_config.json"))
+	return err == nil
+}
+
+func GetAdapterParams(dirpath string) (*AdapterParams, error) {
+	f, err := os.Open(filepath.Join(dirpath, "adapter_config.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var params AdapterParams
+	if err := json.NewDecoder(f).Decode(&params); err != nil {
+		return nil, err
+	}
+
+	if params.PeftType != "" && params.PeftType != "LORA" {
+		return nil, fmt.Errorf("unsupported adapter type: %s", params.PeftType)
+	}
+
+	if params.R <= 0 {
+		return nil, fmt.Errorf("invalid adapter rank: %d", params.R)
+	}
+
+	return &params, nil
+}
+
+// adapterModules are the modules a LoRA adapter can target
+var adapterModules = []string{"q_proj", "k_proj", "v_proj", "o_proj", "gate_proj", "up_proj", "down_proj"}
+
+type loraPair struct {
+	a, b *loraTensor
+}
+
+type loraTensor struct {
+	shape []uint64
+	data  []float32
+}
+
+// ConvertAdapter converts the PEFT LoRA adapter in dirpath to a GGLA adapter
+// for the base model described by kv and tensors. the adapter is rejected if
+// it doesn't fit the base model. lora_B is scaled by lora_alpha/r so the
+// adapter is written with alpha equal to r
+func ConvertAdapter(dirpath string, w io.Writer, kv llm.KV, tensors llm.Tensors) error {
+	params, err := GetAdapterParams(dirpath)
+	if err != nil {
+		return err
+	}
+
+	for _, module := range params.TargetModules {
+		if !slices.Contains(adapterModules, module) {
+			return fmt.Errorf("unsupported adapter target module: %s", module)
+		}
+	}
+
+	fn := filepath.Join(dirpath, "adapter_model.safetensors")
+	n, headers, err := readSafetensorHeader(fn)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var format SafetensorFormat
+	pairs := make(map[string]*loraPair)
+	for key, value := range headers {
+		if key == "__metadata__" {
+			continue
+		}
+
+		key = strings.Replace(key, ".default.weight", ".weight", 1)
+		key = strings.TrimPrefix(key, "base_model.model.")
+
+		var suffix string
+		switch {
+		case strings.HasSuffix(key, ".lora_A.weight"):
+			suffix = ".lora_A.weight"
+		case strings.HasSuffix(key, ".lora_B.weight"):
+			suffix = ".lora_B.weight"
+		default:
+			return fmt.Errorf("unexpected adapter tensor: %s", key)
+		}
+
+		name, err := format.GetLayerName(strings.TrimSuffix(key, suffix) + ".weight")
+		if err != nil {
+			return err
+		}
+
+		if len(value.Shape) != 2 {
+			return fmt.Errorf("%s: expected 2 dimensions, got %d", key, len(value.Shape))
+		}
+
+		wt := safetensorWriterTo{dtype: value.Type, bo: binary.LittleEndian}
+		switch value.Type {
+		case "F32", "F16", "BF16":
+		default:
+			return fmt.Errorf("%s: unknown data type: %s", key, value.Type)
+		}
+
+		b := make([]byte, value.Offsets[1]-value.Offsets[0])
+		if _, err := f.ReadAt(b, 8+n+value.Offsets[0]); err != nil {
+			return err
+		}
+
+		t := &loraTensor{shape: value.Shape, data: wt.decode(nil, b)}
+
+		p, ok := pairs[name]
+		if !ok {
+			p = &loraPair{}
+			pairs[name] = p
+		}
+
+		if suffix == ".lora_A.weight" {
+			p.a = t
+		} else {
+			p.b = t
+		}
+	}
+
+	if len(pairs) == 0 {
+		return errors.New("adapter has no tensors")
+	}
+
+	names := make([]string, 0, len(pairs))
+	for name := range pairs {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	scale := float32(params.Alpha / float64(params.R))
+	if params.Alpha == 0 {
+		scale = 1
+	}
+
+	gw := &ggla{w: w}
+	gw.header(uint32(params.R))
+	for _, name := range names {
+		p := pairs[name]
+		if p.a == nil || p.b == nil {
+			return fmt.Errorf("%s: adapter is missing lora_A or lora_B", name)
+		}
+
+		// lora_A is r x in and lora_B is out x r
+		r, in, out := p.a.shape[0], p.a.shape[1], p.b.shape[0]
+		if r != uint64(params.R) || p.b.shape[1] != r {
+			return fmt.Errorf("%s: adapter rank doesn't match r=%d", name, params.R)
+		}
+
+		i := slices.IndexFunc(tensors, func(t *llm.Tensor) bool { return t.Name == name })
+		if i < 0 {
+			return fmt.Errorf("adapter doesn't match the base model: %s not found in %s model", name, kv.Architecture())
+		} else if base := tensors[i]; base.Shape[0] != in || base.Shape[1] != out {
+			return fmt.Errorf("adapter doesn't match the base model: %s is %dx%d in the adapter but %dx%d in the %s model", name, out, in, base.Shape[1], base.Shape[0], kv.Architecture())
+		}
+
+		b := p.b.data
+		for i := range b {
+			b[i] *= scale
+		}
+
+		if kv.Architecture() == "llama" && (strings.HasSuffix(name, "attn_q.weight") || strings.HasSuffix(name, "attn_k.weight")) {
+			// match the permutation applied to the base model's q and k weights
+			b, err = llamaRepack(name, &Params{
+				AttentionHeads: int(kv.HeadCount()),
+				KeyValHeads:    int(kv.HeadCountKV()),
+			}, b, p.b.shape)
+			if err != nil {
+				return err
+			}
+		}
+
+		// lora_A is stored transposed
+		a := make([]float32, len(p.a.data))
+		for row := range r {
+			for col := range in {
+				a[col*r+row] = p.a.data[row*in+col]
+			}
+		}
+
+		gw.tensor(name+".loraA", []uint64{in, r}, a)
+		gw.tensor(name+".loraB", []uint64{out, r}, b)
+	}
+
+	return gw.err
+}
+
+// ggla writes the GGLA adapter format read by llama.cpp
+type ggla struct {
+	w      io.Writer
+	offset int64
+	err    error
+}
+
+func (g *ggla) write(v any) {
+	if g.err != nil {
+		return
+	}
+
+	g.err = binary.Write(g.w, binary.LittleEndian, v)
+	g.offset += int64(binary.Size(v))
+}
+
+func (g *ggla) header(r uint32) {
+	g.write(uint32(llm.FILE_MAGIC_GGLA))
+	g.write(uint32(1))
+	g.write(r)
+	// alpha is r since lora_B is already scaled
+	g.write(r)
+}
+
+// tensor writes an F32 tensor. shape is in row major order
+func (g *ggla) tensor(name string, shape []uint64, data []float32) {
+	g.write(uint32(len(shape)))
+	g.write(uint32(len(name)))
+	g.write(uint32(0))
+	for i := range shape {
+		// ggla tensor shape is reversed
+		g.write(uint32(shape[len(shape)-1-i]))
+	}
+
+	g.write([]byte(name))
+	g.write(make([]byte, (g.offset+31)&-32-g.offset))
+
+	for _, f := range data {
+		g.write(math.Float32bits(f))
+	}
+}
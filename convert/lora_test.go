@@ -0,0 +1,232 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func writeAdapter(t *testing.T, p string, params AdapterParams, tensors map[string]loraTensor) {
+	t.Helper()
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(p, "adapter_config.json"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var data bytes.Buffer
+	headers := make(map[string]any)
+	headers["__metadata__"] = map[string]string{"format": "pt"}
+	for name, tensor := range tensors {
+		offset := int64(data.Len())
+		if err := binary.Write(&data, binary.LittleEndian, tensor.data); err != nil {
+			t.Fatal(err)
+		}
+
+		headers[name] = safetensorMetadata{
+			Type:    "F32",
+			Shape:   tensor.shape,
+			Offsets: []int64{offset, int64(data.Len())},
+		}
+	}
+
+	header, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(p, "adapter_model.safetensors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := binary.Write(f, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write(data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sequence(n int) []float32 {
+	s := make([]float32, n)
+	for i := range s {
+		s[i] = float32(i + 1)
+	}
+
+	return s
+}
+
+var loraKV = llm.KV{
+	"general.architecture":          "llama",
+	"llama.attention.head_count":    uint32(2),
+	"llama.attention.head_count_kv": uint32(2),
+}
+
+// loraBase is a base model with a 4 -> 8 attn_q and a 4 -> 4 attn_v
+var loraBase = llm.Tensors{
+	{Name: "blk.0.attn_q.weight", Shape: []uint64{4, 8}},
+	{Name: "blk.0.attn_v.weight", Shape: []uint64{4, 4}},
+}
+
+func TestConvertAdapter(t *testing.T) {
+	p := t.TempDir()
+	writeAdapter(t, p, AdapterParams{PeftType: "LORA", R: 2, Alpha: 4, TargetModules: []string{"q_proj", "v_proj"}}, map[string]loraTensor{
+		"base_model.model.model.layers.0.self_attn.q_proj.lora_A.weight": {shape: []uint64{2, 4}, data: sequence(8)},
+		"base_model.model.model.layers.0.self_attn.q_proj.lora_B.weight": {shape: []uint64{8, 2}, data: sequence(16)},
+		"base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight": {shape: []uint64{2, 4}, data: sequence(8)},
+		"base_model.model.model.layers.0.self_attn.v_proj.lora_B.weight": {shape: []uint64{4, 2}, data: sequence(8)},
+	})
+
+	var b bytes.Buffer
+	if err := ConvertAdapter(p, &b, loraKV, loraBase); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(b.Bytes())
+	ggml, _, err := llm.DecodeGGML(r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ggml.Name() != "ggla" {
+		t.Fatalf("expected ggla, got %s", ggml.Name())
+	}
+
+	// lora_B is scaled by alpha/r so alpha is written as r
+	if kv := ggml.KV(); kv["r"] != uint32(2) || kv["alpha"] != uint32(2) {
+		t.Errorf("unexpected r=%v alpha=%v", kv["r"], kv["alpha"])
+	}
+
+	// lora_A is transposed
+	a := []float32{1, 5, 2, 6, 3, 7, 4, 8}
+	expected := map[string]loraTensor{
+		"blk.0.attn_q.weight.loraA": {shape: []uint64{4, 2}, data: a},
+		// rows of each head are permuted like the base attn_q
+		"blk.0.attn_q.weight.loraB": {shape: []uint64{8, 2}, data: []float32{
+			2, 4, 10, 12, 6, 8, 14, 16,
+			18, 20, 26, 28, 22, 24, 30, 32,
+		}},
+		"blk.0.attn_v.weight.loraA": {shape: []uint64{4, 2}, data: a},
+		"blk.0.attn_v.weight.loraB": {shape: []uint64{4, 2}, data: []float32{2, 4, 6, 8, 10, 12, 14, 16}},
+	}
+
+	var names []string
+	actual := make(map[string]loraTensor)
+	for _, tensor := range ggml.Tensors() {
+		names = append(names, tensor.Name)
+
+		if tensor.Kind != 0 {
+			t.Errorf("%s: expected kind 0, got %d", tensor.Name, tensor.Kind)
+		}
+
+		if tensor.Offset%32 != 0 {
+			t.Errorf("%s: expected aligned offset, got %d", tensor.Name, tensor.Offset)
+		}
+
+		data := make([]float32, tensor.Size()/4)
+		if err := binary.Read(bytes.NewReader(b.Bytes()[tensor.Offset:]), binary.LittleEndian, data); err != nil {
+			t.Fatal(err)
+		}
+
+		actual[tensor.Name] = loraTensor{shape: tensor.Shape, data: data}
+	}
+
+	if diff := cmp.Diff([]string{
+		"blk.0.attn_q.weight.loraA",
+		"blk.0.attn_q.weight.loraB",
+		"blk.0.attn_v.weight.loraA",
+		"blk.0.attn_v.weight.loraB",
+	}, names); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(expected, actual, cmp.AllowUnexported(loraTensor{})); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConvertAdapterErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		params  AdapterParams
+		tensors map[string]loraTensor
+		err     string
+	}{
+		{
+			name:   "shape mismatch",
+			params: AdapterParams{R: 2, Alpha: 2},
+			tensors: map[string]loraTensor{
+				"base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight": {shape: []uint64{2, 8}, data: sequence(16)},
+				"base_model.model.model.layers.0.self_attn.v_proj.lora_B.weight": {shape: []uint64{4, 2}, data: sequence(8)},
+			},
+			err: "blk.0.attn_v.weight is 4x8 in the adapter but 4x4 in the llama model",
+		},
+		{
+			name:   "missing base tensor",
+			params: AdapterParams{R: 2, Alpha: 2},
+			tensors: map[string]loraTensor{
+				"base_model.model.model.layers.1.self_attn.v_proj.lora_A.weight": {shape: []uint64{2, 4}, data: sequence(8)},
+				"base_model.model.model.layers.1.self_attn.v_proj.lora_B.weight": {shape: []uint64{4, 2}, data: sequence(8)},
+			},
+			err: "blk.1.attn_v.weight not found in llama model",
+		},
+		{
+			name:   "missing lora_B",
+			params: AdapterParams{R: 2, Alpha: 2},
+			tensors: map[string]loraTensor{
+				"base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight": {shape: []uint64{2, 4}, data: sequence(8)},
+			},
+			err: "missing lora_A or lora_B",
+		},
+		{
+			name:   "rank mismatch",
+			params: AdapterParams{R: 4, Alpha: 2},
+			tensors: map[string]loraTensor{
+				"base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight": {shape: []uint64{2, 4}, data: sequence(8)},
+				"base_model.model.model.layers.0.self_attn.v_proj.lora_B.weight": {shape: []uint64{4, 2}, data: sequence(8)},
+			},
+			err: "adapter rank doesn't match r=4",
+		},
+		{
+			name:   "unsupported module",
+			params: AdapterParams{R: 2, Alpha: 2, TargetModules: []string{"lm_head"}},
+			err:    "unsupported adapter target module: lm_head",
+		},
+		{
+			name:   "unsupported type",
+			params: AdapterParams{PeftType: "IA3", R: 2},
+			err:    "unsupported adapter type: IA3",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := t.TempDir()
+			writeAdapter(t, p, tt.params, tt.tensors)
+
+			err := ConvertAdapter(p, &bytes.Buffer{}, loraKV, loraBase)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package convert
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -40,50 +43,111 @@ type safetensorMetadata struct {
 type SafetensorFormat struct{}
 
 func (m *SafetensorFormat) GetTensors(dirpath string, params *Params) ([]llm.Tensor, error) {
-	var tensors []llm.Tensor
-	matches, err := filepath.Glob(filepath.Join(dirpath, "*.safetensors"))
+	weights, err := readSafetensorIndex(dirpath)
 	if err != nil {
 		return nil, err
 	}
 
+	var matches []string
+	if weights != nil {
+		// only read the shards named by the index
+		for _, shard := range weights {
+			if p := filepath.Join(dirpath, shard); !slices.Contains(matches, p) {
+				matches = append(matches, p)
+			}
+		}
+
+		slices.Sort(matches)
+	} else {
+		matches, err = filepath.Glob(filepath.Join(dirpath, "*.safetensors"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// missing holds the keys of the weight map not yet found in their shard
+	missing := make(map[string]struct{}, len(weights))
+	for key := range weights {
+		missing[key] = struct{}{}
+	}
+
+	var tensors []llm.Tensor
 	var offset uint64
 	for _, f := range matches {
 		var t []llm.Tensor
 		var err error
-		t, offset, err = m.readTensors(f, offset, params)
+		t, offset, err = m.readTensors(f, offset, params, weights, missing)
 		if err != nil {
 			return nil, err
 		}
 
 		tensors = append(tensors, t...)
 	}
+
+	if len(missing) > 0 {
+		keys := make([]string, 0, len(missing))
+		for key := range missing {
+			keys = append(keys, key)
+		}
+
+		slices.Sort(keys)
+		return nil, fmt.Errorf("tensor '%s' not found in %s", keys[0], weights[keys[0]])
+	}
+
 	return tensors, nil
 }
 
-func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params) ([]llm.Tensor, uint64, error) {
-	f, err := os.Open(fn)
-	if err != nil {
-		return nil, 0, err
+// readSafetensorIndex reads the weight map of a sharded model from
+// model.safetensors.index.json, mapping each tensor to the shard holding it.
+// a nil map is returned if the model isn't sharded
+func readSafetensorIndex(dirpath string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dirpath, "model.safetensors.index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 	defer f.Close()
 
-	var n int64
-	if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
-		return nil, 0, err
+	var index struct {
+		WeightMap map[string]string `json:"weight_map"`
 	}
 
-	b := bytes.NewBuffer(make([]byte, 0, n))
-	if _, err = io.CopyN(b, f, n); err != nil {
-		return nil, 0, err
+	if err := json.NewDecoder(f).Decode(&index); err != nil {
+		return nil, err
 	}
 
-	var headers map[string]safetensorMetadata
-	if err := json.NewDecoder(b).Decode(&headers); err != nil {
+	for _, shard := range index.WeightMap {
+		if !filepath.IsLocal(shard) {
+			return nil, fmt.Errorf("%w: %s", zip.ErrInsecurePath, shard)
+		}
+
+		if _, err := os.Stat(filepath.Join(dirpath, shard)); errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("shard '%s' in model.safetensors.index.json not found", shard)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return index.WeightMap, nil
+}
+
+// readTensors reads the tensors in the safetensors file fn. if weights is set,
+// tensors the weight map places in a different shard are skipped and the
+// ones found in fn are removed from missing
+func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params, weights map[string]string, missing map[string]struct{}) ([]llm.Tensor, uint64, error) {
+	n, headers, err := readSafetensorHeader(fn)
+	if err != nil {
 		return nil, 0, err
 	}
 
 	var keys []string
 	for key := range headers {
+		if shard, ok := weights[key]; weights != nil && (!ok || shard != filepath.Base(fn)) {
+			continue
+		}
+
+		delete(missing, key)
 		if !strings.HasSuffix(key, "self_attn.rotary_embd.inv_freq") {
 			keys = append(keys, key)
 		}
@@ -140,6 +204,34 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 	return tensors, offset, nil
 }
 
+// readSafetensorHeader reads the header of the safetensors file fn, returning
+// its length and the metadata of each tensor. tensor data offsets are
+// relative to the end of the header
+func readSafetensorHeader(fn string) (int64, map[string]safetensorMetadata, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	var n int64
+	if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
+		return 0, nil, err
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, n))
+	if _, err = io.CopyN(b, f, n); err != nil {
+		return 0, nil, err
+	}
+
+	var headers map[string]safetensorMetadata
+	if err := json.NewDecoder(b).Decode(&headers); err != nil {
+		return 0, nil, err
+	}
+
+	return n, headers, nil
+}
+
 func (m *SafetensorFormat) GetParams(dirpath string) (*Params, error) {
 	f, err := os.Open(filepath.Join(dirpath, "config.json"))
 	if err != nil {
@@ -197,6 +289,10 @@ func (m *SafetensorFormat) GetLayerName(n string) (string, error) {
 	return "", fmt.Errorf("couldn't find a layer name for '%s'", n)
 }
 
+// WriteTo streams the tensor from its file into w, converting it a chunk at
+// a time so no more than Params.ScratchSize bytes of the source are held in
+// memory. tensors which need repacking are read whole since repacking
+// permutes the entire tensor
 func (r safetensorWriterTo) WriteTo(w io.Writer) (n int64, err error) {
 	f, err := os.Open(r.filename)
 	if err != nil {
@@ -208,54 +304,93 @@ func (r safetensorWriterTo) WriteTo(w io.Writer) (n int64, err error) {
 		return 0, err
 	}
 
-	var f32s []float32
+	var elementSize int64
 	switch r.dtype {
 	case "F32":
-		f32s = make([]float32, r.size/4)
-		if err = binary.Read(f, r.bo, f32s); err != nil {
-			return 0, err
+		elementSize = 4
+	case "F16", "BF16":
+		elementSize = 2
+	default:
+		return 0, fmt.Errorf("unknown data type: %s", r.dtype)
+	}
+
+	chunkSize := r.size
+	if r.repacker == nil {
+		scratchSize := int64(r.params.ScratchSize)
+		if scratchSize <= 0 {
+			scratchSize = DefaultScratchSize
 		}
-	case "F16":
-		u16s := make([]uint16, r.size/2)
-		if err = binary.Read(f, r.bo, u16s); err != nil {
-			return 0, err
+
+		// chunks must hold whole elements
+		chunkSize = min(r.size, max(scratchSize/elementSize, 1)*elementSize)
+	}
+
+	buf := make([]byte, chunkSize)
+
+	var f32s []float32
+	var out []byte
+	for remaining := r.size; remaining > 0; remaining -= int64(len(buf)) {
+		buf = buf[:min(remaining, chunkSize)]
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return n, err
 		}
 
-		for _, b := range u16s {
-			f32s = append(f32s, float16.Frombits(b).Float32())
+		f32s = r.decode(f32s[:0], buf)
+		if r.repacker != nil {
+			f32s, err = r.repacker(r.t.Name, f32s, r.t.Shape)
+			if err != nil {
+				return n, err
+			}
 		}
 
-	case "BF16":
-		u8s := make([]uint8, r.size)
-		if err = binary.Read(f, r.bo, u8s); err != nil {
-			return 0, err
+		if out, err = r.encode(out[:0], f32s); err != nil {
+			return n, err
 		}
 
-		f32s = bfloat16.DecodeFloat32(u8s)
-	default:
-		return 0, fmt.Errorf("unknown data type: %s", r.dtype)
+		written, err := w.Write(out)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
 	}
 
-	if r.repacker != nil {
-		f32s, err = r.repacker(r.t.Name, f32s, r.t.Shape)
-		if err != nil {
-			return 0, err
+	return n, nil
+}
+
+// decode appends the elements of b, stored as r.dtype, to f32s
+func (r safetensorWriterTo) decode(f32s []float32, b []byte) []float32 {
+	switch r.dtype {
+	case "F32":
+		for i := 0; i < len(b); i += 4 {
+			f32s = append(f32s, math.Float32frombits(r.bo.Uint32(b[i:])))
 		}
+	case "F16":
+		for i := 0; i < len(b); i += 2 {
+			f32s = append(f32s, float16.Frombits(r.bo.Uint16(b[i:])).Float32())
+		}
+	case "BF16":
+		f32s = append(f32s, bfloat16.DecodeFloat32(b)...)
 	}
 
+	return f32s
+}
+
+// encode appends f32s to b in the tensor's storage type
+func (r safetensorWriterTo) encode(b []byte, f32s []float32) ([]byte, error) {
 	switch r.t.Kind {
 	case 0:
-		return 0, binary.Write(w, r.bo, f32s)
+		for _, f := range f32s {
+			b = r.bo.AppendUint32(b, math.Float32bits(f))
+		}
 	case 1:
-		f16s := make([]uint16, len(f32s))
-		for i := range f32s {
-			f16s[i] = float16.Fromfloat32(f32s[i]).Bits()
+		for _, f := range f32s {
+			b = r.bo.AppendUint16(b, float16.Fromfloat32(f).Bits())
 		}
-
-		return 0, binary.Write(w, r.bo, f16s)
 	default:
-		return 0, fmt.Errorf("unknown storage type: %d", r.t.Kind)
+		return nil, fmt.Errorf("unknown storage type: %d", r.t.Kind)
 	}
+
+	return b, nil
 }
 
 func (m *SafetensorFormat) GetModelArch(name, dirPath string, params *Params) (ModelArch, error) {
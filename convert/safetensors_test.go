@@ -0,0 +1,435 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func writeSafetensors(t *testing.T, fn string, tensors map[string][]float32) {
+	t.Helper()
+
+	var data bytes.Buffer
+	headers := make(map[string]safetensorMetadata)
+	for name, values := range tensors {
+		offset := int64(data.Len())
+		if err := binary.Write(&data, binary.LittleEndian, values); err != nil {
+			t.Fatal(err)
+		}
+
+		headers[name] = safetensorMetadata{
+			Type:    "F32",
+			Shape:   []uint64{uint64(len(values))},
+			Offsets: []int64{offset, int64(data.Len())},
+		}
+	}
+
+	header, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := binary.Write(f, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write(data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeSafetensorIndex(t *testing.T, p string, weights map[string]string) {
+	t.Helper()
+
+	b, err := json.Marshal(map[string]any{"weight_map": weights})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(p, "model.safetensors.index.json"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTensorsSharded(t *testing.T) {
+	p := t.TempDir()
+
+	writeSafetensors(t, filepath.Join(p, "model-00001-of-00002.safetensors"), map[string][]float32{
+		"model.embed_tokens.weight": {1, 2, 3, 4},
+		"model.norm.weight":         {5, 6},
+	})
+
+	writeSafetensors(t, filepath.Join(p, "model-00002-of-00002.safetensors"), map[string][]float32{
+		"lm_head.weight": {7, 8, 9},
+		// a stale copy the index doesn't point to
+		"model.norm.weight": {0, 0},
+	})
+
+	writeSafetensorIndex(t, p, map[string]string{
+		"model.embed_tokens.weight": "model-00001-of-00002.safetensors",
+		"model.norm.weight":         "model-00001-of-00002.safetensors",
+		"lm_head.weight":            "model-00002-of-00002.safetensors",
+	})
+
+	var m SafetensorFormat
+	tensors, err := m.GetTensors(p, &Params{ByteOrder: binary.LittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]float32{
+		"token_embd.weight":  {1, 2, 3, 4},
+		"output_norm.weight": {5, 6},
+		"output.weight":      {7, 8, 9},
+	}
+
+	actual := make(map[string][]float32)
+	for _, tensor := range tensors {
+		var b bytes.Buffer
+		if _, err := tensor.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		values := make([]float32, b.Len()/4)
+		if err := binary.Read(&b, binary.LittleEndian, values); err != nil {
+			t.Fatal(err)
+		}
+
+		actual[tensor.Name] = values
+	}
+
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestGetTensorsMissingShard(t *testing.T) {
+	p := t.TempDir()
+
+	writeSafetensors(t, filepath.Join(p, "model-00001-of-00002.safetensors"), map[string][]float32{
+		"model.embed_tokens.weight": {1, 2, 3, 4},
+	})
+
+	writeSafetensorIndex(t, p, map[string]string{
+		"model.embed_tokens.weight": "model-00001-of-00002.safetensors",
+		"lm_head.weight":            "model-00002-of-00002.safetensors",
+	})
+
+	var m SafetensorFormat
+	_, err := m.GetTensors(p, &Params{ByteOrder: binary.LittleEndian})
+	if err == nil || !strings.Contains(err.Error(), "model-00002-of-00002.safetensors") {
+		t.Errorf("expected missing shard error, got %v", err)
+	}
+}
+
+func TestGetTensorsInsecureShard(t *testing.T) {
+	p := t.TempDir()
+
+	writeSafetensors(t, filepath.Join(p, "model.safetensors"), map[string][]float32{
+		"model.embed_tokens.weight": {1, 2, 3, 4},
+	})
+
+	writeSafetensorIndex(t, p, map[string]string{
+		"model.embed_tokens.weight": "../model.safetensors",
+	})
+
+	var m SafetensorFormat
+	if _, err := m.GetTensors(p, &Params{ByteOrder: binary.LittleEndian}); !errors.Is(err, zip.ErrInsecurePath) {
+		t.Errorf("expected %v, got %v", zip.ErrInsecurePath, err)
+	}
+}
+
+func TestGetTensorsShardedScalar(t *testing.T) {
+	p := t.TempDir()
+
+	writeSafetensors(t, filepath.Join(p, "model-00001-of-00001.safetensors"), map[string][]float32{
+		"model.embed_tokens.weight": {1, 2, 3, 4},
+	})
+
+	// add a 0-dim tensor to the shard which isn't converted
+	fn := filepath.Join(p, "model-00001-of-00001.safetensors")
+	_, headers, err := readSafetensorHeader(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers["model.scale"] = safetensorMetadata{Type: "F32", Shape: []uint64{}, Offsets: []int64{16, 20}}
+	header, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Write(header)
+	if err := binary.Write(&b, binary.LittleEndian, []float32{1, 2, 3, 4, 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fn, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeSafetensorIndex(t, p, map[string]string{
+		"model.embed_tokens.weight": "model-00001-of-00001.safetensors",
+		"model.scale":               "model-00001-of-00001.safetensors",
+	})
+
+	var m SafetensorFormat
+	tensors, err := m.GetTensors(p, &Params{ByteOrder: binary.LittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tensors) != 1 || tensors[0].Name != "token_embd.weight" {
+		t.Errorf("expected only token_embd.weight, got %v", tensors)
+	}
+}
+
+// newSafetensorWriterTo writes values to a file as dtype and returns a writer
+// for the tensor it holds
+func newSafetensorWriterTo(t *testing.T, dtype string, kind uint32, values []float32, scratchSize int) safetensorWriterTo {
+	t.Helper()
+
+	var b []byte
+	for _, v := range values {
+		switch dtype {
+		case "F32":
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+		case "F16":
+			b = binary.LittleEndian.AppendUint16(b, float16.Fromfloat32(v).Bits())
+		case "BF16":
+			b = binary.LittleEndian.AppendUint16(b, uint16(math.Float32bits(v)>>16))
+		}
+	}
+
+	fn := filepath.Join(t.TempDir(), "tensor")
+	if err := os.WriteFile(fn, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return safetensorWriterTo{
+		t:        &llm.Tensor{Name: "tensor", Kind: kind, Shape: []uint64{uint64(len(values))}},
+		params:   &Params{ByteOrder: binary.LittleEndian, ScratchSize: scratchSize},
+		bo:       binary.LittleEndian,
+		filename: fn,
+		dtype:    dtype,
+		size:     int64(len(b)),
+	}
+}
+
+func TestSafetensorWriterToStreaming(t *testing.T) {
+	// values which are exact in every dtype
+	values := make([]float32, 1000)
+	for i := range values {
+		values[i] = float32(i%64) - 32
+	}
+
+	for _, dtype := range []string{"F32", "F16", "BF16"} {
+		for _, kind := range []uint32{0, 1} {
+			var expected bytes.Buffer
+			for _, v := range values {
+				if kind == 0 {
+					binary.Write(&expected, binary.LittleEndian, v)
+				} else {
+					binary.Write(&expected, binary.LittleEndian, float16.Fromfloat32(v).Bits())
+				}
+			}
+
+			// a scratch size larger than the tensor reads it whole like repacked tensors
+			for _, scratchSize := range []int{0, 1, 6, 1000, 1 << 20} {
+				t.Run(fmt.Sprintf("%s/%d/%d", dtype, kind, scratchSize), func(t *testing.T) {
+					wt := newSafetensorWriterTo(t, dtype, kind, values, scratchSize)
+
+					var b bytes.Buffer
+					n, err := wt.WriteTo(&b)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if n != int64(b.Len()) {
+						t.Errorf("expected %d bytes written, got %d", b.Len(), n)
+					}
+
+					if !bytes.Equal(expected.Bytes(), b.Bytes()) {
+						t.Error("output mismatch")
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSafetensorWriterToRepack(t *testing.T) {
+	values := make([]float32, 1000)
+	for i := range values {
+		values[i] = float32(i)
+	}
+
+	wt := newSafetensorWriterTo(t, "F32", 0, values, 16)
+	wt.repacker = func(_ string, data []float32, _ []uint64) ([]float32, error) {
+		if len(data) != len(values) {
+			return nil, fmt.Errorf("expected the whole tensor, got %d values", len(data))
+		}
+
+		return data, nil
+	}
+
+	if _, err := wt.WriteTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafetensorWriterToMemory(t *testing.T) {
+	// 16MiB of F32 values converted to F16
+	values := make([]float32, 4<<20)
+	wt := newSafetensorWriterTo(t, "F32", 1, values, 64<<10)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	if _, err := wt.WriteTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	// reading the tensor whole would allocate at least 16MiB for the source
+	// alone. streaming should stay near a few times the scratch size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2<<20 {
+		t.Errorf("expected at most %d bytes allocated, got %d", 2<<20, allocated)
+	}
+}
+
+func TestWriteGGUFProgress(t *testing.T) {
+	p := t.TempDir()
+
+	writeSafetensors(t, filepath.Join(p, "model.safetensors"), map[string][]float32{
+		"model.embed_tokens.weight": {1, 2, 3, 4},
+		"model.norm.weight":         {5, 6},
+		"lm_head.weight":            {7, 8, 9},
+	})
+
+	var responses []api.ProgressResponse
+	params := &Params{ByteOrder: binary.LittleEndian, Progress: func(resp api.ProgressResponse) {
+		responses = append(responses, resp)
+	}}
+
+	var m SafetensorFormat
+	tensors, err := m.GetTensors(p, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(p, "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	md := ModelData{Params: params, Tensors: tensors}
+	if err := md.writeGGUF(f, llm.KV{"general.architecture": "llama"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(responses) != len(tensors) {
+		t.Fatalf("expected %d progress responses, got %d", len(tensors), len(responses))
+	}
+
+	if last := responses[len(responses)-1]; last.Completed != last.Total || last.Total != 36 {
+		t.Errorf("unexpected final progress %+v", last)
+	}
+}
+
+func TestWriteGGUFReproducible(t *testing.T) {
+	p := t.TempDir()
+
+	writeSafetensors(t, filepath.Join(p, "model.safetensors"), map[string][]float32{
+		"model.embed_tokens.weight":             {1, 2, 3, 4},
+		"model.layers.0.mlp.down_proj.weight":   {5, 6, 7},
+		"model.layers.0.input_layernorm.weight": {8},
+		"model.norm.weight":                     {9, 10},
+		"lm_head.weight":                        {11, 12, 13, 14, 15},
+	})
+
+	var m SafetensorFormat
+	params := &Params{ByteOrder: binary.LittleEndian}
+	tensors, err := m.GetTensors(p, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func(tensors []llm.Tensor) string {
+		f, err := os.CreateTemp(p, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		md := ModelData{Params: params, Tensors: tensors}
+		if err := md.writeGGUF(f, llm.KV{
+			"general.architecture": "llama",
+			"general.name":         "test",
+			"general.file_type":    uint32(1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			t.Fatal(err)
+		}
+
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	expected := digest(tensors)
+
+	for range 5 {
+		shuffled := slices.Clone(tensors)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+
+		if actual := digest(shuffled); actual != expected {
+			t.Fatalf("expected digest %s, got %s", expected, actual)
+		}
+	}
+}
@@ -29,16 +29,30 @@ var ErrInvalidHostPort = errors.New("invalid port specified in OLLAMA_HOST")
 var (
 	// Set via OLLAMA_ORIGINS in the environment
 	AllowOrigins []string
+	// Set via OLLAMA_CLIENT_WEIGHTS in the environment
+	ClientWeights map[string]int
 	// Set via OLLAMA_DEBUG in the environment
 	Debug bool
 	// Experimental flash attention
 	FlashAttention bool
 	// Set via OLLAMA_HOST in the environment
 	Host *OllamaHost
+	// Set via OLLAMA_IMPORT_PROGRESS_INTERVAL in the environment
+	ImportProgressInterval time.Duration
 	// Set via OLLAMA_KEEP_ALIVE in the environment
 	KeepAlive time.Duration
 	// Set via OLLAMA_LLM_LIBRARY in the environment
 	LLMLibrary string
+	// Set via OLLAMA_MAX_CLIENT_PARALLEL in the environment
+	MaxClientParallel int
+	// Set via OLLAMA_MAX_IMPORT_COMPRESSION_RATIO in the environment
+	MaxImportCompressionRatio uint64
+	// Set via OLLAMA_MAX_IMPORT_ENTRIES in the environment
+	MaxImportEntries int
+	// Set via OLLAMA_MAX_IMPORT_ENTRY_SIZE in the environment
+	MaxImportEntrySize uint64
+	// Set via OLLAMA_MAX_IMPORT_SIZE in the environment
+	MaxImportSize uint64
 	// Set via OLLAMA_MAX_LOADED_MODELS in the environment
 	MaxRunners int
 	// Set via OLLAMA_MAX_QUEUE in the environment
@@ -57,6 +71,8 @@ var (
 	RunnersDir string
 	// Set via OLLAMA_SCHED_SPREAD in the environment
 	SchedSpread bool
+	// Set via OLLAMA_STABLE_TOOL_CALL_IDS in the environment
+	StableToolCallIDs bool
 	// Set via OLLAMA_TMPDIR in the environment
 	TmpDir string
 	// Set via OLLAMA_INTEL_GPU in the environment
@@ -82,22 +98,30 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
-		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug, "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
-		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention, "Enabled flash attention"},
-		"OLLAMA_HOST":              {"OLLAMA_HOST", Host, "IP Address for the ollama server (default 127.0.0.1:11434)"},
-		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive, "The duration that models stay loaded in memory (default \"5m\")"},
-		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary, "Set LLM library to bypass autodetection"},
-		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners, "Maximum number of loaded models per GPU"},
-		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueuedRequests, "Maximum number of queued requests"},
-		"OLLAMA_MAX_VRAM":          {"OLLAMA_MAX_VRAM", MaxVRAM, "Maximum VRAM"},
-		"OLLAMA_MODELS":            {"OLLAMA_MODELS", ModelsDir, "The path to the models directory"},
-		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory, "Do not preserve readline history"},
-		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune, "Do not prune model blobs on startup"},
-		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel, "Maximum number of parallel requests"},
-		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", AllowOrigins, "A comma separated list of allowed origins"},
-		"OLLAMA_RUNNERS_DIR":       {"OLLAMA_RUNNERS_DIR", RunnersDir, "Location for runners"},
-		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread, "Always schedule model across all GPUs"},
-		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir, "Location for temporary files"},
+		"OLLAMA_CLIENT_WEIGHTS":               {"OLLAMA_CLIENT_WEIGHTS", ClientWeights, "A comma separated list of client=weight pairs giving clients a larger share of a model when OLLAMA_MAX_CLIENT_PARALLEL is set"},
+		"OLLAMA_DEBUG":                        {"OLLAMA_DEBUG", Debug, "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_FLASH_ATTENTION":              {"OLLAMA_FLASH_ATTENTION", FlashAttention, "Enabled flash attention"},
+		"OLLAMA_HOST":                         {"OLLAMA_HOST", Host, "IP Address for the ollama server (default 127.0.0.1:11434)"},
+		"OLLAMA_IMPORT_PROGRESS_INTERVAL":     {"OLLAMA_IMPORT_PROGRESS_INTERVAL", ImportProgressInterval, "Minimum time between progress updates while unpacking an imported model archive (default \"100ms\")"},
+		"OLLAMA_KEEP_ALIVE":                   {"OLLAMA_KEEP_ALIVE", KeepAlive, "The duration that models stay loaded in memory (default \"5m\")"},
+		"OLLAMA_LLM_LIBRARY":                  {"OLLAMA_LLM_LIBRARY", LLMLibrary, "Set LLM library to bypass autodetection"},
+		"OLLAMA_MAX_CLIENT_PARALLEL":          {"OLLAMA_MAX_CLIENT_PARALLEL", MaxClientParallel, "Maximum number of parallel requests per client, scheduling clients fairly"},
+		"OLLAMA_MAX_IMPORT_COMPRESSION_RATIO": {"OLLAMA_MAX_IMPORT_COMPRESSION_RATIO", MaxImportCompressionRatio, "Maximum compression ratio of a file larger than 1 MiB in an imported model archive, 0 for no limit (default 100)"},
+		"OLLAMA_MAX_IMPORT_ENTRIES":           {"OLLAMA_MAX_IMPORT_ENTRIES", MaxImportEntries, "Maximum number of files in an imported model archive (default 1024)"},
+		"OLLAMA_MAX_IMPORT_ENTRY_SIZE":        {"OLLAMA_MAX_IMPORT_ENTRY_SIZE", MaxImportEntrySize, "Maximum uncompressed size in bytes of a file in an imported model archive"},
+		"OLLAMA_MAX_IMPORT_SIZE":              {"OLLAMA_MAX_IMPORT_SIZE", MaxImportSize, "Maximum uncompressed size in bytes of an imported model archive (default the free space of the volume it's extracted to)"},
+		"OLLAMA_MAX_LOADED_MODELS":            {"OLLAMA_MAX_LOADED_MODELS", MaxRunners, "Maximum number of loaded models per GPU"},
+		"OLLAMA_MAX_QUEUE":                    {"OLLAMA_MAX_QUEUE", MaxQueuedRequests, "Maximum number of queued requests"},
+		"OLLAMA_MAX_VRAM":                     {"OLLAMA_MAX_VRAM", MaxVRAM, "Maximum VRAM"},
+		"OLLAMA_MODELS":                       {"OLLAMA_MODELS", ModelsDir, "The path to the models directory"},
+		"OLLAMA_NOHISTORY":                    {"OLLAMA_NOHISTORY", NoHistory, "Do not preserve readline history"},
+		"OLLAMA_NOPRUNE":                      {"OLLAMA_NOPRUNE", NoPrune, "Do not prune model blobs on startup"},
+		"OLLAMA_NUM_PARALLEL":                 {"OLLAMA_NUM_PARALLEL", NumParallel, "Maximum number of parallel requests"},
+		"OLLAMA_ORIGINS":                      {"OLLAMA_ORIGINS", AllowOrigins, "A comma separated list of allowed origins"},
+		"OLLAMA_RUNNERS_DIR":                  {"OLLAMA_RUNNERS_DIR", RunnersDir, "Location for runners"},
+		"OLLAMA_SCHED_SPREAD":                 {"OLLAMA_SCHED_SPREAD", SchedSpread, "Always schedule model across all GPUs"},
+		"OLLAMA_STABLE_TOOL_CALL_IDS":         {"OLLAMA_STABLE_TOOL_CALL_IDS", StableToolCallIDs, "Derive tool call IDs from their content instead of generating them randomly"},
+		"OLLAMA_TMPDIR":                       {"OLLAMA_TMPDIR", TmpDir, "Location for temporary files"},
 	}
 	if runtime.GOOS != "darwin" {
 		ret["CUDA_VISIBLE_DEVICES"] = EnvVar{"CUDA_VISIBLE_DEVICES", CudaVisibleDevices, "Set which NVIDIA devices are visible"}
@@ -228,6 +252,15 @@ func LoadConfig() {
 		}
 	}
 
+	if stable := clean("OLLAMA_STABLE_TOOL_CALL_IDS"); stable != "" {
+		s, err := strconv.ParseBool(stable)
+		if err != nil {
+			slog.Error("invalid setting, ignoring", "OLLAMA_STABLE_TOOL_CALL_IDS", stable, "error", err)
+		} else {
+			StableToolCallIDs = s
+		}
+	}
+
 	if noprune := clean("OLLAMA_NOPRUNE"); noprune != "" {
 		NoPrune = true
 	}
@@ -260,6 +293,33 @@ func LoadConfig() {
 		}
 	}
 
+	if mcp := clean("OLLAMA_MAX_CLIENT_PARALLEL"); mcp != "" {
+		m, err := strconv.Atoi(mcp)
+		if err != nil || m < 0 {
+			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_CLIENT_PARALLEL", mcp, "error", err)
+		} else {
+			MaxClientParallel = m
+		}
+	}
+
+	ClientWeights = nil
+	if cw := clean("OLLAMA_CLIENT_WEIGHTS"); cw != "" {
+		weights := make(map[string]int)
+		for _, pair := range strings.Split(cw, ",") {
+			client, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			w, err := strconv.Atoi(weight)
+			if !ok || client == "" || err != nil || w <= 0 {
+				slog.Error("invalid setting, ignoring", "OLLAMA_CLIENT_WEIGHTS", cw, "error", err)
+				weights = nil
+				break
+			}
+
+			weights[client] = w
+		}
+
+		ClientWeights = weights
+	}
+
 	if onp := os.Getenv("OLLAMA_MAX_QUEUE"); onp != "" {
 		p, err := strconv.Atoi(onp)
 		if err != nil || p <= 0 {
@@ -269,6 +329,56 @@ func LoadConfig() {
 		}
 	}
 
+	MaxImportEntries = 1024
+	if mie := clean("OLLAMA_MAX_IMPORT_ENTRIES"); mie != "" {
+		m, err := strconv.Atoi(mie)
+		if err != nil || m <= 0 {
+			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_IMPORT_ENTRIES", mie, "error", err)
+		} else {
+			MaxImportEntries = m
+		}
+	}
+
+	MaxImportCompressionRatio = 100
+	if micr := clean("OLLAMA_MAX_IMPORT_COMPRESSION_RATIO"); micr != "" {
+		m, err := strconv.ParseUint(micr, 10, 64)
+		if err != nil {
+			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_IMPORT_COMPRESSION_RATIO", micr, "error", err)
+		} else {
+			MaxImportCompressionRatio = m
+		}
+	}
+
+	MaxImportEntrySize = 0
+	if mies := clean("OLLAMA_MAX_IMPORT_ENTRY_SIZE"); mies != "" {
+		m, err := strconv.ParseUint(mies, 10, 64)
+		if err != nil {
+			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_IMPORT_ENTRY_SIZE", mies, "error", err)
+		} else {
+			MaxImportEntrySize = m
+		}
+	}
+
+	MaxImportSize = 0
+	if mis := clean("OLLAMA_MAX_IMPORT_SIZE"); mis != "" {
+		m, err := strconv.ParseUint(mis, 10, 64)
+		if err != nil {
+			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_IMPORT_SIZE", mis, "error", err)
+		} else {
+			MaxImportSize = m
+		}
+	}
+
+	ImportProgressInterval = 100 * time.Millisecond
+	if ipi := clean("OLLAMA_IMPORT_PROGRESS_INTERVAL"); ipi != "" {
+		d, err := time.ParseDuration(ipi)
+		if err != nil || d < 0 {
+			slog.Error("invalid setting, ignoring", "OLLAMA_IMPORT_PROGRESS_INTERVAL", ipi, "error", err)
+		} else {
+			ImportProgressInterval = d
+		}
+	}
+
 	ka := clean("OLLAMA_KEEP_ALIVE")
 	if ka != "" {
 		loadKeepAlive(ka)
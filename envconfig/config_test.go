@@ -40,6 +40,19 @@ func TestConfig(t *testing.T) {
 	t.Setenv("OLLAMA_KEEP_ALIVE", "-1")
 	LoadConfig()
 	require.Equal(t, time.Duration(math.MaxInt64), KeepAlive)
+	t.Setenv("OLLAMA_CLIENT_WEIGHTS", "key-0123456789abcdef=3, 10.0.0.1=2")
+	LoadConfig()
+	require.Equal(t, map[string]int{"key-0123456789abcdef": 3, "10.0.0.1": 2}, ClientWeights)
+	t.Setenv("OLLAMA_CLIENT_WEIGHTS", "10.0.0.1=0")
+	LoadConfig()
+	require.Nil(t, ClientWeights)
+	StableToolCallIDs = false
+	t.Setenv("OLLAMA_STABLE_TOOL_CALL_IDS", "yes")
+	LoadConfig()
+	require.False(t, StableToolCallIDs)
+	t.Setenv("OLLAMA_STABLE_TOOL_CALL_IDS", "true")
+	LoadConfig()
+	require.True(t, StableToolCallIDs)
 }
 
 func TestClientFromEnvironment(t *testing.T) {
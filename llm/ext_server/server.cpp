@@ -202,13 +202,14 @@ struct server_slot {
     }
 
     bool has_budget(gpt_params &global_params) {
-        if (params.n_predict == -1 && global_params.n_predict == -1) {
+        // -2 is limited by the context rather than a budget
+        if (params.n_predict < 0 && global_params.n_predict == -1) {
             return true; // limitless
         }
 
         n_remaining = -1;
 
-        if (params.n_predict != -1) {
+        if (params.n_predict >= 0) {
             n_remaining = params.n_predict - n_decoded;
         } else if (global_params.n_predict != -1) {
             n_remaining = global_params.n_predict - n_decoded;
@@ -996,6 +997,13 @@ struct llama_server_context
             slot.has_next_token = false;
         }
 
+        // n_predict -2 predicts until the context is full instead of shifting it
+        if (slot.params.n_predict == -2 && slot.has_next_token && system_tokens.size() + slot.n_past + 1 >= (size_t) slot.n_ctx)
+        {
+            slot.stopped_limit = true;
+            slot.has_next_token = false;
+        }
+
         if (!slot.cache_tokens.empty() && llama_token_is_eog(model, result.tok))
         {
             slot.stopped_eos = true;
@@ -2,10 +2,12 @@ package llm
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 )
 
@@ -502,6 +504,7 @@ var ggufKVOrder = map[string][]string{
 	"llama": {
 		"general.architecture",
 		"general.name",
+		"general.converter",
 		"llama.vocab_size",
 		"llama.context_length",
 		"llama.embedding_length",
@@ -565,17 +568,24 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		return err
 	}
 
-	kvCheck := make(map[string]bool)
+	// write known keys in their conventional order followed by any others
+	// sorted so the output doesn't depend on map iteration order
+	keys := slices.DeleteFunc(slices.Clone(ggufKVOrder["llama"]), func(k string) bool {
+		_, ok := kv[k]
+		return !ok
+	})
+
+	var rest []string
 	for k := range kv {
-		kvCheck[k] = false
+		if !slices.Contains(keys, k) {
+			rest = append(rest, k)
+		}
 	}
 
-	for _, k := range ggufKVOrder["llama"] {
-		v, ok := kv[k]
-		if !ok {
-			continue
-		}
-		kvCheck[k] = true
+	slices.Sort(rest)
+
+	for _, k := range append(keys, rest...) {
+		v := kv[k]
 
 		if err := binary.Write(ws, llm.ByteOrder, uint64(len(k))); err != nil {
 			return err
@@ -631,10 +641,20 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		}
 	}
 
-	for k, v := range kvCheck {
-		if !v {
-			return fmt.Errorf("Didn't know how to write kv %s", k)
-		}
+	var alignment int64 = 32
+
+	// write tensors sorted by name with offsets computed from their sizes so
+	// the output doesn't depend on the order they were read in
+	tensors = slices.Clone(tensors)
+	slices.SortStableFunc(tensors, func(a, b Tensor) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	var offset uint64
+	for i := range tensors {
+		offset += uint64(llm.padding(int64(offset), alignment))
+		tensors[i].Offset = offset
+		offset += tensors[i].Size()
 	}
 
 	for _, tensor := range tensors {
@@ -672,7 +692,6 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		}
 	}
 
-	var alignment int64 = 32
 	for _, tensor := range tensors {
 		offset, err := ws.Seek(0, io.SeekCurrent)
 		if err != nil {
@@ -0,0 +1,95 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeGGUFDeterministic(t *testing.T) {
+	kv := KV{
+		"general.architecture": "llama",
+		"general.name":         "test",
+		"general.converter":    "test",
+		"zzz.custom":           uint32(1),
+		"aaa.custom":           "a",
+	}
+
+	tensor := func(name string, values ...float32) Tensor {
+		var b bytes.Buffer
+		if err := binary.Write(&b, binary.LittleEndian, values); err != nil {
+			t.Fatal(err)
+		}
+
+		return Tensor{Name: name, Kind: 0, Shape: []uint64{uint64(len(values))}, WriterTo: bytes.NewReader(b.Bytes())}
+	}
+
+	encode := func(tensors []Tensor) []byte {
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := NewGGUFV3(binary.LittleEndian).Encode(f, kv, tensors); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	}
+
+	// tensor sizes which aren't multiples of the alignment
+	a := encode([]Tensor{tensor("output.weight", 1, 2, 3), tensor("blk.0.attn_q.weight", 4), tensor("token_embd.weight", 5, 6)})
+	b := encode([]Tensor{tensor("token_embd.weight", 5, 6), tensor("output.weight", 1, 2, 3), tensor("blk.0.attn_q.weight", 4)})
+	if !bytes.Equal(a, b) {
+		t.Fatal("expected identical output for shuffled tensors")
+	}
+
+	ggml, n, err := DecodeGGML(bytes.NewReader(a), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tensors := ggml.Tensors()
+	last := tensors[len(tensors)-1]
+	start := uint64(n) - last.Offset - last.Size()
+
+	expect := map[string][]float32{
+		"blk.0.attn_q.weight": {4},
+		"output.weight":       {1, 2, 3},
+		"token_embd.weight":   {5, 6},
+	}
+
+	var names []string
+	for _, tensor := range tensors {
+		names = append(names, tensor.Name)
+
+		values := make([]float32, tensor.Shape[0])
+		if err := binary.Read(bytes.NewReader(a[start+tensor.Offset:]), binary.LittleEndian, values); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, v := range expect[tensor.Name] {
+			if values[i] != v {
+				t.Errorf("%s: expected %v, got %v", tensor.Name, expect[tensor.Name], values)
+				break
+			}
+		}
+	}
+
+	if names[0] != "blk.0.attn_q.weight" || names[1] != "output.weight" || names[2] != "token_embd.weight" {
+		t.Errorf("expected tensors sorted by name, got %v", names)
+	}
+
+	if kv := ggml.KV(); kv["aaa.custom"] != "a" || kv["zzz.custom"] != uint32(1) || kv["general.converter"] != "test" {
+		t.Errorf("unexpected kv %v", kv)
+	}
+}
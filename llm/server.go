@@ -57,6 +57,9 @@ type llmServer struct {
 	loadDuration time.Duration   // Record how long it took the model to load
 	loadProgress float32
 
+	// numParallel is the number of slots options.NumCtx is split between
+	numParallel int
+
 	sem *semaphore.Weighted
 }
 
@@ -338,6 +341,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			options:     opts,
 			estimate:    estimate,
 			sem:         semaphore.NewWeighted(int64(numParallel)),
+			numParallel: numParallel,
 			totalLayers: ggml.KV().BlockCount() + 1,
 			gpus:        gpus,
 			done:        make(chan error, 1),
@@ -688,6 +692,26 @@ type CompletionRequest struct {
 	Format  string
 	Images  []ImageData
 	Options *api.Options
+
+	// Started is called, if set, once the request has a slot on the runner
+	// and is about to be processed
+	Started func()
+}
+
+// effectiveNumPredict returns the number of tokens to predict in a context
+// window of numCtx tokens. a negative numPredict, the default, is sent to the
+// runner as -2 which predicts until the context window is full, counting the
+// prompt and any images, in which case bounded is true. larger values are
+// limited to 10 context windows to avoid the model running on forever
+func effectiveNumPredict(numPredict, numCtx int) (n int, bounded bool) {
+	switch {
+	case numPredict < 0:
+		return -2, true
+	case numPredict > 10*numCtx:
+		return 10 * numCtx, false
+	default:
+		return numPredict, false
+	}
 }
 
 type CompletionResponse struct {
@@ -707,11 +731,22 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	}
 	defer s.sem.Release(1)
 
-	// put an upper limit on num_predict to avoid the model running on forever
-	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
-		req.Options.NumPredict = 10 * s.options.NumCtx
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return err
+	} else if status != ServerStatusReady {
+		return fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	if req.Started != nil {
+		req.Started()
 	}
 
+	numCtx := s.options.NumCtx / max(s.numParallel, 1)
+	numPredict, bounded := effectiveNumPredict(req.Options.NumPredict, numCtx)
+	req.Options.NumPredict = numPredict
+
 	request := map[string]any{
 		"prompt":            req.Prompt,
 		"stream":            true,
@@ -737,14 +772,6 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"cache_prompt":      true,
 	}
 
-	// Make sure the server is ready
-	status, err := s.getServerStatusRetry(ctx)
-	if err != nil {
-		return err
-	} else if status != ServerStatusReady {
-		return fmt.Errorf("unexpected server status: %s", status.ToString())
-	}
-
 	if req.Format == "json" {
 		request["grammar"] = jsonGrammar
 		if !strings.Contains(strings.ToLower(req.Prompt), "json") {
@@ -836,6 +863,9 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				doneReason := "stop"
 				if c.StoppedLimit {
 					doneReason = "length"
+					if bounded {
+						slog.Warn("response truncated, the context window is full", "num_ctx", numCtx, "prompt", c.Timings.PromptN, "predicted", c.Timings.PredictedN)
+					}
 				}
 
 				fn(CompletionResponse{
@@ -0,0 +1,30 @@
+package llm
+
+import (
+	"testing"
+)
+
+func TestEffectiveNumPredict(t *testing.T) {
+	cases := []struct {
+		name       string
+		numPredict int
+		numCtx     int
+		expect     int
+		bounded    bool
+	}{
+		{"default", -1, 2048, -2, true},
+		{"fill context", -2, 2048, -2, true},
+		{"set", 128, 2048, 128, false},
+		{"set beyond context", 4096, 2048, 4096, false},
+		{"set beyond limit", 100000, 2048, 20480, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			n, bounded := effectiveNumPredict(tt.numPredict, tt.numCtx)
+			if n != tt.expect || bounded != tt.bounded {
+				t.Errorf("expected %d (bounded %t), got %d (bounded %t)", tt.expect, tt.bounded, n, bounded)
+			}
+		})
+	}
+}
@@ -29,8 +29,9 @@ type ErrorResponse struct {
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content any    `json:"content"`
+	Role       string `json:"role"`
+	Content    any    `json:"content"`
+	ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 type Choice struct {
@@ -276,9 +277,10 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	for _, msg := range r.Messages {
 		switch content := msg.Content.(type) {
 		case string:
-			messages = append(messages, api.Message{Role: msg.Role, Content: content})
+			messages = append(messages, api.Message{Role: msg.Role, Content: content, ToolCallID: msg.ToolCallID})
 		case []any:
 			message := api.Message{Role: msg.Role}
+			var text []string
 			for _, c := range content {
 				data, ok := c.(map[string]any)
 				if !ok {
@@ -286,11 +288,12 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 				}
 				switch data["type"] {
 				case "text":
-					text, ok := data["text"].(string)
+					t, ok := data["text"].(string)
 					if !ok {
 						return nil, fmt.Errorf("invalid message format")
 					}
-					message.Content = text
+					text = append(text, t)
+					message.Parts = append(message.Parts, api.ContentPart{Type: "text", Text: t})
 				case "image_url":
 					var url string
 					if urlMap, ok := data["image_url"].(map[string]any); ok {
@@ -323,10 +326,14 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 						return nil, fmt.Errorf("invalid message format")
 					}
 					message.Images = append(message.Images, img)
+					message.Parts = append(message.Parts, api.ContentPart{Type: "image_url", Image: img})
 				default:
 					return nil, fmt.Errorf("invalid message format")
 				}
 			}
+
+			// the parts keep the order of the text and images
+			message.Content = strings.Join(text, "\n")
 			messages = append(messages, message)
 		default:
 			return nil, fmt.Errorf("invalid message content type: %T", content)
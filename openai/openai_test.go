@@ -71,6 +71,40 @@ func TestMiddlewareRequests(t *testing.T) {
 				if chatReq.Messages[0].Content != "Hello" {
 					t.Fatalf("expected 'Hello', got %s", chatReq.Messages[0].Content)
 				}
+
+				// without max_tokens the model and server defaults apply
+				if _, ok := chatReq.Options["num_predict"]; ok {
+					t.Fatalf("expected num_predict to be unset, got %v", chatReq.Options["num_predict"])
+				}
+			},
+		},
+		{
+			Name:    "chat handler with max_tokens",
+			Method:  http.MethodPost,
+			Path:    "/api/chat",
+			Handler: ChatMiddleware,
+			Setup: func(t *testing.T, req *http.Request) {
+				maxTokens := 64
+				body := ChatCompletionRequest{
+					Model:     "test-model",
+					Messages:  []Message{{Role: "user", Content: "Hello"}},
+					MaxTokens: &maxTokens,
+				}
+
+				bodyBytes, _ := json.Marshal(body)
+
+				req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				req.Header.Set("Content-Type", "application/json")
+			},
+			Expected: func(t *testing.T, req *http.Request) {
+				var chatReq api.ChatRequest
+				if err := json.NewDecoder(req.Body).Decode(&chatReq); err != nil {
+					t.Fatal(err)
+				}
+
+				if chatReq.Options["num_predict"] != 64.0 {
+					t.Fatalf("expected 64, got %v", chatReq.Options["num_predict"])
+				}
 			},
 		},
 		{
@@ -115,6 +149,10 @@ func TestMiddlewareRequests(t *testing.T) {
 				if stopTokens[0] != "\n" || stopTokens[1] != "stop" {
 					t.Fatalf("expected ['\\n', 'stop'], got %v", stopTokens)
 				}
+
+				if _, ok := genReq.Options["num_predict"]; ok {
+					t.Fatalf("expected num_predict to be unset, got %v", genReq.Options["num_predict"])
+				}
 			},
 		},
 		{
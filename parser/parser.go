@@ -29,6 +29,10 @@ func (f File) String() string {
 type Command struct {
 	Name string
 	Args string
+
+	// When is the condition under which a message is used, e.g. tools for
+	// MESSAGE(when=tools). it's only set for messages
+	When string
 }
 
 func (c Command) String() string {
@@ -40,7 +44,11 @@ func (c Command) String() string {
 		fmt.Fprintf(&sb, "%s %s", strings.ToUpper(c.Name), quote(c.Args))
 	case "message":
 		role, message, _ := strings.Cut(c.Args, ": ")
-		fmt.Fprintf(&sb, "MESSAGE %s %s", role, quote(message))
+		if c.When != "" {
+			fmt.Fprintf(&sb, "MESSAGE(when=%s) %s %s", c.When, role, quote(message))
+		} else {
+			fmt.Fprintf(&sb, "MESSAGE %s %s", role, quote(message))
+		}
 	default:
 		fmt.Fprintf(&sb, "PARAMETER %s %s", c.Name, quote(c.Args))
 	}
@@ -56,12 +64,15 @@ const (
 	stateValue
 	stateParameter
 	stateMessage
+	stateMessageCondition
+	stateMessageConditionEnd
 	stateComment
 )
 
 var (
 	errMissingFrom        = errors.New("no FROM line")
 	errInvalidMessageRole = errors.New("message role must be one of \"system\", \"user\", or \"assistant\"")
+	errInvalidMessageWhen = errors.New("message condition must be one of \"when=tools\", \"when=no-tools\", or \"when=always\"")
 	errInvalidCommand     = errors.New("command must be one of \"from\", \"license\", \"template\", \"system\", \"adapter\", \"parameter\", or \"message\"")
 )
 
@@ -99,6 +110,11 @@ func ParseFile(r io.Reader) (*File, error) {
 					return nil, errInvalidCommand
 				}
 
+				if next == stateMessageCondition && strings.ToLower(b.String()) != "message" {
+					// only messages take a condition
+					return nil, errInvalidCommand
+				}
+
 				// next state sometimes depends on the current buffer value
 				switch s := strings.ToLower(b.String()); s {
 				case "from":
@@ -107,8 +123,10 @@ func ParseFile(r io.Reader) (*File, error) {
 					// transition to stateParameter which sets command name
 					next = stateParameter
 				case "message":
-					// transition to stateMessage which validates the message role
-					next = stateMessage
+					if next != stateMessageCondition {
+						// transition to stateMessage which validates the message role
+						next = stateMessage
+					}
 					fallthrough
 				default:
 					cmd.Name = s
@@ -121,7 +139,14 @@ func ParseFile(r io.Reader) (*File, error) {
 				}
 
 				role = b.String()
-			case stateComment, stateNil:
+			case stateMessageCondition:
+				when, ok := strings.CutPrefix(b.String(), "when=")
+				if !ok || !isValidMessageWhen(when) {
+					return nil, errInvalidMessageWhen
+				}
+
+				cmd.When = when
+			case stateComment, stateNil, stateMessageConditionEnd:
 				// pass
 			case stateValue:
 				s, ok := unquote(strings.TrimSpace(b.String()))
@@ -140,6 +165,7 @@ func ParseFile(r io.Reader) (*File, error) {
 
 				cmd.Args = s
 				f.Commands = append(f.Commands, cmd)
+				cmd.When = ""
 			}
 
 			b.Reset()
@@ -199,6 +225,8 @@ func parseRuneForState(r rune, cs state) (state, rune, error) {
 			return stateName, r, nil
 		case isSpace(r):
 			return stateValue, 0, nil
+		case r == '(':
+			return stateMessageCondition, 0, nil
 		default:
 			return stateNil, 0, errInvalidCommand
 		}
@@ -229,6 +257,22 @@ func parseRuneForState(r rune, cs state) (state, rune, error) {
 		default:
 			return stateNil, 0, io.ErrUnexpectedEOF
 		}
+	case stateMessageCondition:
+		switch {
+		case isAlpha(r), r == '=', r == '-':
+			return stateMessageCondition, r, nil
+		case r == ')':
+			return stateMessageConditionEnd, 0, nil
+		default:
+			return stateNil, 0, errInvalidMessageWhen
+		}
+	case stateMessageConditionEnd:
+		switch {
+		case isSpace(r):
+			return stateMessage, 0, nil
+		default:
+			return stateNil, 0, io.ErrUnexpectedEOF
+		}
 	case stateComment:
 		switch {
 		case isNewline(r):
@@ -294,6 +338,10 @@ func isValidMessageRole(role string) bool {
 	return role == "system" || role == "user" || role == "assistant"
 }
 
+func isValidMessageWhen(when string) bool {
+	return when == "tools" || when == "no-tools" || when == "always"
+}
+
 func isValidCommand(cmd string) bool {
 	switch strings.ToLower(cmd) {
 	case "from", "license", "template", "system", "adapter", "parameter", "message":
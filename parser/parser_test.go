@@ -242,6 +242,55 @@ You are a multiline file parser. Always parse things.
 		{
 			`
 FROM foo
+MESSAGE(when=tools) user What's the weather in Paris?
+MESSAGE(when=no-tools) assistant """
+I can't check the weather.
+"""
+MESSAGE(when=always) user Hey there!
+`,
+			[]Command{
+				{Name: "model", Args: "foo"},
+				{Name: "message", Args: "user: What's the weather in Paris?", When: "tools"},
+				{Name: "message", Args: "assistant: \nI can't check the weather.\n", When: "no-tools"},
+				{Name: "message", Args: "user: Hey there!", When: "always"},
+			},
+			nil,
+		},
+		{
+			`
+FROM foo
+MESSAGE(when=sometimes) user Hey there!
+`,
+			nil,
+			errInvalidMessageWhen,
+		},
+		{
+			`
+FROM foo
+MESSAGE(if=tools) user Hey there!
+`,
+			nil,
+			errInvalidMessageWhen,
+		},
+		{
+			`
+FROM foo
+SYSTEM(when=tools) You are a file parser.
+`,
+			nil,
+			errInvalidCommand,
+		},
+		{
+			`
+FROM foo
+MESSAGE(when=tools
+`,
+			nil,
+			errInvalidMessageWhen,
+		},
+		{
+			`
+FROM foo
 MESSAGE badguy I'm a bad guy!
 `,
 			nil,
@@ -561,6 +610,14 @@ MESSAGE assistant Hello, I want to parse all the things!
 		`
 FROM foo
 SYSTEM ""
+`,
+		`
+FROM foo
+MESSAGE(when=tools) user What's the weather in Paris?
+MESSAGE(when=tools) assistant """
+Let me check.
+"""
+MESSAGE user Hey there!
 `,
 	}
 
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// clock is the source of time used to enforce max_duration
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+var defaultClock clock = realClock{}
+
+// completion runs a completion request on r. if the request sets
+// max_duration, the completion is cancelled once it has run for that long
+// and fn receives a final response with done reason "timeout" carrying the
+// metrics of what was generated so far. the clock starts when the runner
+// starts processing the request so time spent waiting for a slot isn't
+// counted
+func completion(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	d := req.Options.MaxDuration.Duration
+	if d <= 0 {
+		return r.Completion(ctx, req, fn)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var done, timedOut bool
+	var evalCount int
+	var start, firstToken time.Time
+	stop := func() bool { return false }
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stop()
+	}()
+
+	started := sync.OnceFunc(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		start = defaultClock.Now()
+		stop = defaultClock.AfterFunc(d, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !done {
+				timedOut = true
+				cancel()
+			}
+		})
+	})
+
+	req.Started = started
+
+	err := r.Completion(ctx, req, func(cr llm.CompletionResponse) {
+		// runners that don't report when they start are timed from their
+		// first response
+		started()
+		mu.Lock()
+		if timedOut {
+			mu.Unlock()
+			return
+		}
+
+		if cr.Content != "" {
+			if evalCount == 0 {
+				firstToken = defaultClock.Now()
+			}
+
+			evalCount++
+		}
+
+		done = cr.Done
+		mu.Unlock()
+
+		fn(cr)
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !timedOut {
+		return err
+	}
+
+	res := llm.CompletionResponse{
+		Done:       true,
+		DoneReason: "timeout",
+		EvalCount:  evalCount,
+	}
+
+	now := defaultClock.Now()
+	if evalCount > 0 {
+		res.PromptEvalDuration = firstToken.Sub(start)
+		res.EvalDuration = now.Sub(firstToken)
+	} else {
+		res.PromptEvalDuration = now.Sub(start)
+	}
+
+	// the runner doesn't report timings for cancelled requests so count the prompt here
+	if tokens, err := r.Tokenize(context.WithoutCancel(ctx), req.Prompt); err == nil {
+		res.PromptEvalCount = len(tokens)
+	}
+
+	fn(res)
+	return nil
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	f  func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), f: f})
+	i := len(c.timers) - 1
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		stopped := c.timers[i].f != nil
+		c.timers[i].f = nil
+		return stopped
+	}
+}
+
+// advance moves the clock forward, running any timers that expire
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var expired []func()
+	for i, t := range c.timers {
+		if t.f != nil && !t.at.After(c.now) {
+			expired = append(expired, t.f)
+			c.timers[i].f = nil
+		}
+	}
+	c.mu.Unlock()
+
+	for _, f := range expired {
+		f()
+	}
+}
+
+// slowLlm generates one token per second of clock time until cancelled or
+// num_predict tokens have been generated. it waits for a slot for queued of
+// clock time before it starts
+type slowLlm struct {
+	mockLlm
+	clock  *fakeClock
+	queued time.Duration
+}
+
+func (s *slowLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	s.clock.advance(s.queued)
+	if req.Started != nil {
+		req.Started()
+	}
+
+	for i := range 10 {
+		s.clock.advance(time.Second)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if req.Options.NumPredict > 0 && i == req.Options.NumPredict {
+			fn(llm.CompletionResponse{Done: true, DoneReason: "length", EvalCount: i})
+			return nil
+		}
+
+		fn(llm.CompletionResponse{Content: "a"})
+	}
+
+	fn(llm.CompletionResponse{Done: true, DoneReason: "stop", EvalCount: 10})
+	return nil
+}
+
+func TestCompletionMaxDuration(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	t.Cleanup(func() { defaultClock = realClock{} })
+	defaultClock = clock
+
+	cases := []struct {
+		name        string
+		maxDuration time.Duration
+		numPredict  int
+		queued      time.Duration
+		expected    llm.CompletionResponse
+		tokens      int
+	}{
+		{
+			name:        "timeout",
+			maxDuration: 2500 * time.Millisecond,
+			expected: llm.CompletionResponse{
+				Done:               true,
+				DoneReason:         "timeout",
+				PromptEvalCount:    3,
+				PromptEvalDuration: time.Second,
+				EvalCount:          2,
+				EvalDuration:       2 * time.Second,
+			},
+			tokens: 2,
+		},
+		{
+			name:        "num_predict first",
+			maxDuration: 10 * time.Second,
+			numPredict:  2,
+			expected:    llm.CompletionResponse{Done: true, DoneReason: "length", EvalCount: 2},
+			tokens:      2,
+		},
+		{
+			name:        "timeout before num_predict",
+			maxDuration: 1500 * time.Millisecond,
+			numPredict:  5,
+			expected: llm.CompletionResponse{
+				Done:               true,
+				DoneReason:         "timeout",
+				PromptEvalCount:    3,
+				PromptEvalDuration: time.Second,
+				EvalCount:          1,
+				EvalDuration:       time.Second,
+			},
+			tokens: 1,
+		},
+		{
+			name:        "queued",
+			maxDuration: 2500 * time.Millisecond,
+			queued:      time.Minute,
+			expected: llm.CompletionResponse{
+				Done:               true,
+				DoneReason:         "timeout",
+				PromptEvalCount:    3,
+				PromptEvalDuration: time.Second,
+				EvalCount:          2,
+				EvalDuration:       2 * time.Second,
+			},
+			tokens: 2,
+		},
+		{
+			name:     "no max duration",
+			expected: llm.CompletionResponse{Done: true, DoneReason: "stop", EvalCount: 10},
+			tokens:   10,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &slowLlm{mockLlm: mockLlm{tokenizeResp: []int{1, 2, 3}}, clock: clock, queued: tt.queued}
+
+			opts := api.DefaultOptions()
+			opts.MaxDuration = api.Duration{Duration: tt.maxDuration}
+			opts.NumPredict = tt.numPredict
+
+			var responses []llm.CompletionResponse
+			if err := completion(context.Background(), r, llm.CompletionRequest{Prompt: "hi", Options: &opts}, func(cr llm.CompletionResponse) {
+				responses = append(responses, cr)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(responses) != tt.tokens+1 {
+				t.Fatalf("expected %d responses, got %d", tt.tokens+1, len(responses))
+			}
+
+			if diff := cmp.Diff(tt.expected, responses[len(responses)-1]); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompletionMaxDurationCancelled(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	t.Cleanup(func() { defaultClock = realClock{} })
+	defaultClock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	opts := api.DefaultOptions()
+	opts.MaxDuration = api.Duration{Duration: time.Minute}
+
+	// a client going away isn't a timeout
+	err := completion(ctx, &slowLlm{clock: clock}, llm.CompletionRequest{Options: &opts}, func(llm.CompletionResponse) {
+		t.Error("unexpected response")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAvailableDiskSpace(t *testing.T) {
+	avail, err := availableDiskSpace(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if avail == 0 {
+		t.Error("expected available disk space")
+	}
+
+	if _, err := availableDiskSpace(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for a missing path")
+	}
+}
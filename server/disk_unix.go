@@ -0,0 +1,16 @@
+//go:build !windows
+
+package server
+
+import "syscall"
+
+// availableDiskSpace returns the number of bytes available to unprivileged
+// users on the volume containing path
+func availableDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,19 @@
+package server
+
+import "golang.org/x/sys/windows"
+
+// availableDiskSpace returns the number of bytes available to the current
+// user on the volume containing path
+func availableDiskSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var avail uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, nil, nil); err != nil {
+		return 0, err
+	}
+
+	return avail, nil
+}
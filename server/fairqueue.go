@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type clientContextKey struct{}
+
+// clientMiddleware tags the request context with an identifier for the
+// client making the request so the scheduler can share runners fairly
+// between clients. clients are identified by their API key, if any, or
+// their remote address
+func clientMiddleware(c *gin.Context) {
+	client := c.ClientIP()
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && token != "" {
+		// avoid keeping the key itself around since the identifier is reported by /api/ps
+		client = fmt.Sprintf("key-%x", sha256.Sum256([]byte(token)))[:16]
+	}
+
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), clientContextKey{}, client))
+	c.Next()
+}
+
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientContextKey{}).(string)
+	return client
+}
+
+// fairQueue admits requests for a single model in weighted round-robin order
+// across clients rather than first come first served so one client sending
+// many requests at once can't monopolize the model's parallel slots
+type fairQueue struct {
+	mu sync.Mutex
+
+	// capacity is the total number of requests admitted at once
+	capacity int
+	// perClient is the number of requests admitted at once for any one client
+	perClient int
+	// maxQueued is the total number of requests waiting for admission
+	maxQueued int
+	// weights is the number of requests admitted for a client in each of its
+	// turns. clients not listed have a weight of 1
+	weights map[string]int
+
+	active, queued int
+	clients        map[string]*fairClient
+	// ring holds clients in arrival order. next is the position in ring to
+	// consider first when a slot frees up and served is the number of
+	// requests admitted for that client in its current turn
+	ring   []string
+	next   int
+	served int
+}
+
+type fairClient struct {
+	weight  int
+	active  int
+	waiters []chan struct{}
+}
+
+func newFairQueue(capacity, perClient, maxQueued int, weights map[string]int) *fairQueue {
+	return &fairQueue{
+		capacity:  max(capacity, 1),
+		perClient: perClient,
+		maxQueued: maxQueued,
+		weights:   weights,
+		clients:   make(map[string]*fairClient),
+	}
+}
+
+// resize sets the number of requests admitted at once, admitting waiting
+// requests if it grows
+func (q *fairQueue) resize(capacity int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.capacity = max(capacity, 1)
+	q.dispatch()
+}
+
+// acquire blocks until the client is admitted or ctx is done. every
+// successful acquire must be paired with a release
+func (q *fairQueue) acquire(ctx context.Context, client string) error {
+	q.mu.Lock()
+	if q.queued >= q.maxQueued {
+		q.mu.Unlock()
+		return ErrMaxQueue
+	}
+
+	c, ok := q.clients[client]
+	if !ok {
+		c = &fairClient{weight: 1}
+		if w, ok := q.weights[client]; ok && w > 0 {
+			c.weight = w
+		}
+
+		q.clients[client] = c
+		q.ring = append(q.ring, client)
+	}
+
+	ch := make(chan struct{})
+	c.waiters = append(c.waiters, ch)
+	q.queued++
+	q.dispatch()
+	q.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		select {
+		case <-ch:
+			// admitted while giving up so hand the slot to the next client
+			q.releaseLocked(client)
+		default:
+			c.waiters = slices.DeleteFunc(c.waiters, func(w chan struct{}) bool { return w == ch })
+			q.queued--
+			q.forget(client)
+		}
+
+		return ctx.Err()
+	}
+}
+
+func (q *fairQueue) release(client string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(client)
+}
+
+func (q *fairQueue) releaseLocked(client string) {
+	if c, ok := q.clients[client]; ok && c.active > 0 {
+		c.active--
+		q.active--
+		q.forget(client)
+		q.dispatch()
+	}
+}
+
+// dispatch admits waiting requests, up to each client's weight in turn, until
+// there are no free slots
+func (q *fairQueue) dispatch() {
+	for q.active < q.capacity {
+		admitted := false
+		for range len(q.ring) {
+			client := q.ring[q.next]
+			c := q.clients[client]
+			if len(c.waiters) == 0 || (q.perClient > 0 && c.active >= q.perClient) {
+				q.advance()
+				continue
+			}
+
+			close(c.waiters[0])
+			c.waiters = c.waiters[1:]
+			c.active++
+			q.active++
+			q.queued--
+			admitted = true
+
+			if q.served++; q.served >= c.weight {
+				q.advance()
+			}
+
+			break
+		}
+
+		if !admitted {
+			return
+		}
+	}
+}
+
+// advance ends the current client's turn
+func (q *fairQueue) advance() {
+	q.next = (q.next + 1) % len(q.ring)
+	q.served = 0
+}
+
+// forget drops a client with no active or waiting requests
+func (q *fairQueue) forget(client string) {
+	if c := q.clients[client]; c.active > 0 || len(c.waiters) > 0 {
+		return
+	}
+
+	delete(q.clients, client)
+	i := slices.Index(q.ring, client)
+	q.ring = slices.Delete(q.ring, i, i+1)
+	if i < q.next {
+		q.next--
+	} else if i == q.next {
+		q.served = 0
+	}
+
+	if q.next >= len(q.ring) {
+		q.next = 0
+	}
+}
+
+// status reports the active and queued requests of each client
+func (q *fairQueue) status() []api.ProcessClientResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var clients []api.ProcessClientResponse
+	for _, client := range q.ring {
+		c := q.clients[client]
+		clients = append(clients, api.ProcessClientResponse{Client: client, Active: c.active, Queued: len(c.waiters)})
+	}
+
+	return clients
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairQueue(t *testing.T) {
+	q := newFairQueue(3, 2, 10, nil)
+
+	for range 2 {
+		if err := q.acquire(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a is capped at 2 requests so its third waits even though there's a free slot
+	admitted := make(chan string, 3)
+	go func() {
+		if err := q.acquire(context.Background(), "a"); err == nil {
+			admitted <- "a"
+		}
+	}()
+
+	waitFor := func(fn func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); !fn(); {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor(func() bool {
+		clients := q.status()
+		return len(clients) == 1 && clients[0].Active == 2 && clients[0].Queued == 1
+	})
+
+	if err := q.acquire(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := q.acquire(context.Background(), "b"); err == nil {
+			admitted <- "b"
+		}
+	}()
+
+	waitFor(func() bool {
+		clients := q.status()
+		return len(clients) == 2 && clients[1].Queued == 1
+	})
+
+	// a and b are both waiting so freed slots alternate between them
+	q.release("b")
+	if client := <-admitted; client != "b" {
+		t.Errorf("expected b to be admitted, got %s", client)
+	}
+
+	q.release("a")
+	if client := <-admitted; client != "a" {
+		t.Errorf("expected a to be admitted, got %s", client)
+	}
+}
+
+func TestFairQueueCancel(t *testing.T) {
+	q := newFairQueue(1, 0, 1, nil)
+	if err := q.acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := q.acquire(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// the cancelled request no longer counts against the queue
+	if clients := q.status(); len(clients) != 1 || clients[0].Client != "a" {
+		t.Fatalf("unexpected clients %v", clients)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- q.acquire(context.Background(), "c")
+	}()
+
+	// the queue only holds one waiting request
+	time.Sleep(10 * time.Millisecond)
+	if err := q.acquire(context.Background(), "d"); !errors.Is(err, ErrMaxQueue) {
+		t.Fatalf("expected max queue, got %v", err)
+	}
+
+	q.release("a")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	q := newFairQueue(1, 0, 10, map[string]int{"a": 2})
+	if err := q.acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan string)
+	for _, client := range []string{"a", "a", "a", "b", "b"} {
+		go func() {
+			if err := q.acquire(context.Background(), client); err == nil {
+				admitted <- client
+			}
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		clients := q.status()
+		return len(clients) == 2 && clients[0].Queued == 3 && clients[1].Queued == 2
+	}, time.Second, time.Millisecond)
+
+	// a is admitted twice for each turn of b
+	var order []string
+	last := "a"
+	for range 5 {
+		q.release(last)
+		last = <-admitted
+		order = append(order, last)
+	}
+
+	if diff := cmp.Diff([]string{"a", "b", "a", "a", "b"}, order); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFairQueueResize(t *testing.T) {
+	q := newFairQueue(1, 0, 10, nil)
+	if err := q.acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- q.acquire(context.Background(), "b")
+	}()
+
+	require.Eventually(t, func() bool {
+		clients := q.status()
+		return len(clients) == 2 && clients[1].Queued == 1
+	}, time.Second, time.Millisecond)
+
+	// growing the queue admits the waiting request without a release
+	q.resize(2)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -34,13 +34,17 @@ import (
 	"github.com/ollama/ollama/version"
 )
 
-var errCapabilityCompletion = errors.New("completion")
+var (
+	errCapabilityCompletion = errors.New("completion")
+	errCapabilityInsert     = errors.New("insert")
+)
 
 type Capability string
 
 const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
+	CapabilityInsert     = Capability("insert")
 )
 
 type registryOptions struct {
@@ -92,9 +96,13 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 				errs = append(errs, errCapabilityCompletion)
 			}
 		case CapabilityTools:
-			if !slices.Contains(m.Template.Vars(), "tools") {
+			if !m.Template.Capabilities().Tools {
 				errs = append(errs, errors.New("tools"))
 			}
+		case CapabilityInsert:
+			if !m.Template.Capabilities().Insert {
+				errs = append(errs, errCapabilityInsert)
+			}
 		default:
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
@@ -108,6 +116,23 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 	return nil
 }
 
+// conditionalMessages returns the model's messages whose condition applies to
+// a request with or without tools. messages without a condition aren't
+// included since clients add those themselves from /api/show
+func (m *Model) conditionalMessages(tools bool) []api.Message {
+	var msgs []api.Message
+	for _, msg := range m.Messages {
+		switch {
+		case msg.When == "always",
+			msg.When == "tools" && tools,
+			msg.When == "no-tools" && !tools:
+			msgs = append(msgs, api.Message{Role: msg.Role, Content: msg.Content})
+		}
+	}
+
+	return msgs
+}
+
 func (m *Model) String() string {
 	var modelfile parser.File
 
@@ -171,7 +196,8 @@ func (m *Model) String() string {
 	for _, msg := range m.Messages {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "message",
-			Args: fmt.Sprintf("%s %s", msg.Role, msg.Content),
+			Args: fmt.Sprintf("%s: %s", msg.Role, msg.Content),
+			When: msg.When,
 		})
 	}
 
@@ -181,6 +207,7 @@ func (m *Model) String() string {
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	When    string `json:"when,omitempty"`
 }
 
 type ConfigV2 struct {
@@ -190,6 +217,10 @@ type ConfigV2 struct {
 	ModelType     string   `json:"model_type"`
 	FileType      string   `json:"file_type"`
 
+	// AdapterTargetModules are the modules of the base model a PEFT adapter
+	// converted on import applies to, from its adapter_config.json
+	AdapterTargetModules []string `json:"adapter_target_modules,omitempty"`
+
 	// required by spec
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
@@ -282,7 +313,13 @@ func GetModel(name string) (*Model, error) {
 				return nil, err
 			}
 
-			model.Template, err = template.Parse(string(bts))
+			// builtin templates are parsed once rather than on every load
+			if t, ok := template.Builtin(string(bts)); ok {
+				model.Template, err = t.Parsed()
+			} else {
+				model.Template, err = template.Parse(string(bts))
+			}
+
 			if err != nil {
 				return nil, err
 			}
@@ -326,6 +363,11 @@ func GetModel(name string) (*Model, error) {
 	return model, nil
 }
 
+func isDir(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
+
 func realpath(rel, from string) string {
 	abspath, err := filepath.Abs(from)
 	if err != nil {
@@ -364,6 +406,8 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 	parameters := make(map[string]any)
 
 	var layers []*Layer
+	// baseModel is the model an adapter is converted against
+	var baseModel *llm.GGML
 	for _, c := range modelfile.Commands {
 		mediatype := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
 
@@ -404,14 +448,19 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				}
 				defer blob.Close()
 
-				baseLayers, err = parseFromFile(ctx, blob, digest, fn)
+				baseLayers, err = parseFromFile(ctx, blob, digest, baseModel, fn)
+				if err != nil {
+					return err
+				}
+			} else if p := realpath(modelFileDir, c.Args); isDir(p) {
+				baseLayers, err = parseFromDir(ctx, p, baseModel, fn)
 				if err != nil {
 					return err
 				}
-			} else if file, err := os.Open(realpath(modelFileDir, c.Args)); err == nil {
+			} else if file, err := os.Open(p); err == nil {
 				defer file.Close()
 
-				baseLayers, err = parseFromFile(ctx, file, "", fn)
+				baseLayers, err = parseFromFile(ctx, file, "", baseModel, fn)
 				if err != nil {
 					return err
 				}
@@ -470,6 +519,16 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 					}
 				}
 
+				if baseLayer.MediaType == "application/vnd.ollama.image.model" && baseLayer.GGML != nil {
+					baseModel = baseLayer.GGML
+				}
+
+				if baseLayer.GGML != nil {
+					if modules, ok := baseLayer.GGML.KV()[adapterTargetModulesKey].([]string); ok {
+						config.AdapterTargetModules = append(config.AdapterTargetModules, modules...)
+					}
+				}
+
 				if baseLayer.GGML != nil {
 					config.ModelFormat = cmp.Or(config.ModelFormat, baseLayer.GGML.Name())
 					config.ModelFamily = cmp.Or(config.ModelFamily, baseLayer.GGML.KV().Architecture())
@@ -481,6 +540,22 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				layers = append(layers, baseLayer.Layer)
 			}
 		case "license", "template", "system":
+			if c.Name == "template" {
+				tmpl, err := template.Parse(c.Args)
+				if err != nil {
+					return err
+				}
+
+				if err := tmpl.Validate(); err != nil {
+					return err
+				}
+
+				for _, w := range tmpl.Lint() {
+					slog.Warn("template", "code", w.Code, "position", w.Pos, "warning", w.Message)
+					fn(api.ProgressResponse{Status: "warning: " + w.String()})
+				}
+			}
+
 			if c.Name != "license" {
 				// replace
 				layers = slices.DeleteFunc(layers, func(layer *Layer) bool {
@@ -509,7 +584,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				return fmt.Errorf("invalid message: %s", c.Args)
 			}
 
-			messages = append(messages, &api.Message{Role: role, Content: content})
+			messages = append(messages, &api.Message{Role: role, Content: content, When: c.When})
 		default:
 			ps, err := api.FormatParams(map[string][]string{c.Name: {c.Args}})
 			if err != nil {
@@ -773,6 +848,35 @@ func PruneLayers() error {
 
 	slog.Info(fmt.Sprintf("total unused blobs removed: %d", len(deleteMap)))
 
+	return pruneImports()
+}
+
+// pruneImports removes extracted imports kept to resume from once the blob
+// they were extracted from is gone
+func pruneImports() error {
+	p := filepath.Join(envconfig.ModelsDir, "imports")
+	entries, err := os.ReadDir(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		blob, err := GetBlobsPath(strings.Replace(name, "-", ":", 1))
+		if err == nil {
+			if _, err = os.Stat(blob); err == nil {
+				continue
+			}
+		}
+
+		slog.Info("removing stale import", "name", entry.Name())
+		if err := os.RemoveAll(filepath.Join(p, entry.Name())); err != nil {
+			slog.Error("couldn't remove import", "name", entry.Name(), "error", err)
+		}
+	}
+
 	return nil
 }
 
@@ -858,7 +962,12 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
 	mp := ParseModelPath(name)
+	return pullModel(ctx, mp, mp.Tag, regOpts, fn)
+}
 
+// pullModel pulls the manifest reference, either a tag or a digest, of mp
+// and its layers and writes it as mp
+func pullModel(ctx context.Context, mp ModelPath, reference string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
 	var manifest *Manifest
 	var err error
 	var noprune string
@@ -886,7 +995,7 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	fn(api.ProgressResponse{Status: "pulling manifest"})
 
-	manifest, err = pullModelManifest(ctx, mp, regOpts)
+	manifest, err = pullModelManifest(ctx, mp, reference, regOpts)
 	if err != nil {
 		return fmt.Errorf("pull model manifest: %s", err)
 	}
@@ -966,8 +1075,10 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	return nil
 }
 
-func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*Manifest, error) {
-	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+// pullModelManifest fetches the manifest reference of mp. reference is a tag
+// or a digest, in which case the manifest must match it
+func pullModelManifest(ctx context.Context, mp ModelPath, reference string, regOpts *registryOptions) (*Manifest, error) {
+	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", reference)
 
 	headers := make(http.Header)
 	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
@@ -977,11 +1088,23 @@ func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptio
 	}
 	defer resp.Body.Close()
 
+	sha256sum := sha256.New()
 	var m *Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+	if err := json.NewDecoder(io.TeeReader(resp.Body, sha256sum)).Decode(&m); err != nil {
 		return nil, err
 	}
 
+	if digest, ok := strings.CutPrefix(reference, "sha256:"); ok {
+		// read the rest of the body in case the decoder stopped short of it
+		if _, err := io.Copy(sha256sum, resp.Body); err != nil {
+			return nil, err
+		}
+
+		if fmt.Sprintf("%x", sha256sum.Sum(nil)) != digest {
+			return nil, fmt.Errorf("manifest %w", errDigestMismatch)
+		}
+	}
+
 	return m, err
 }
 
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+// libraryTagsTTL is how long a registry tag listing is cached before it is fetched again
+const libraryTagsTTL = 15 * time.Minute
+
+// maxLibraryTags is the most repositories whose tag listings are cached
+const maxLibraryTags = 64
+
+var (
+	errQuantizationNotFound  = errors.New("quantization not found")
+	errQuantizationAmbiguous = errors.New("quantization is ambiguous")
+)
+
+type libraryTags struct {
+	tags      []api.LibraryTag
+	expiresAt time.Time
+}
+
+var libraryTagsCache = struct {
+	sync.Mutex
+	m map[string]libraryTags
+}{m: make(map[string]libraryTags)}
+
+// getLibraryTags lists the tags of a repository in the registry along with
+// the quantization and total size of each tag. listings are cached for libraryTagsTTL
+func getLibraryTags(ctx context.Context, mp ModelPath, regOpts *registryOptions) ([]api.LibraryTag, error) {
+	key := mp.BaseURL().JoinPath(mp.GetNamespaceRepository()).String()
+
+	libraryTagsCache.Lock()
+	cached, ok := libraryTagsCache.m[key]
+	libraryTagsCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.tags, nil
+	}
+
+	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "tags", "list")
+	resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, nil, nil, regOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	tags := make([]api.LibraryTag, len(list.Tags))
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(8)
+	for i, tag := range list.Tags {
+		g.Go(func() error {
+			mp := mp
+			mp.Tag = tag
+
+			// copy the registry options so concurrent requests don't race on the token
+			regOpts := *regOpts
+			m, err := pullModelManifest(ctx, mp, mp.Tag, &regOpts)
+			if err != nil {
+				return fmt.Errorf("%s: %w", tag, err)
+			}
+
+			tags[i] = api.LibraryTag{
+				Name:         tag,
+				Quantization: quantizationFromTag(tag),
+				Size:         m.Size(),
+				Digest:       m.Config.Digest,
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(tags, func(a, b api.LibraryTag) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	libraryTagsCache.Lock()
+	defer libraryTagsCache.Unlock()
+
+	// drop expired listings, then the one closest to expiring if the cache
+	// is still full
+	now := time.Now()
+	var oldest string
+	for k, v := range libraryTagsCache.m {
+		if now.After(v.expiresAt) {
+			delete(libraryTagsCache.m, k)
+		} else if oldest == "" || v.expiresAt.Before(libraryTagsCache.m[oldest].expiresAt) {
+			oldest = k
+		}
+	}
+
+	if _, ok := libraryTagsCache.m[key]; !ok && len(libraryTagsCache.m) >= maxLibraryTags {
+		delete(libraryTagsCache.m, oldest)
+	}
+
+	libraryTagsCache.m[key] = libraryTags{tags: tags, expiresAt: now.Add(libraryTagsTTL)}
+
+	return tags, nil
+}
+
+// quantizationFromTag returns the quantization suffix of a tag, e.g. q8_0 for
+// 8b-instruct-q8_0, or an empty string if the tag doesn't end in a known
+// quantization
+func quantizationFromTag(tag string) string {
+	suffix := tag[strings.LastIndex(tag, "-")+1:]
+
+	s := strings.ToUpper(suffix)
+	if s == "FP16" || s == "FP32" {
+		// the library uses fpXX where llama.cpp uses fXX
+		s = strings.Replace(s, "FP", "F", 1)
+	}
+
+	if _, err := llm.ParseFileType(s); err != nil {
+		return ""
+	}
+
+	return suffix
+}
+
+// resolveQuantizationTag finds the tag holding quantization quant of the
+// model mp refers to. tags without a quantization, e.g. 8b or latest, are
+// matched through the fully qualified tag they alias, e.g. 8b-instruct-q4_0
+func resolveQuantizationTag(ctx context.Context, mp ModelPath, quant string, regOpts *registryOptions) (string, error) {
+	tags, err := getLibraryTags(ctx, mp, regOpts)
+	if err != nil {
+		return "", err
+	}
+
+	i := slices.IndexFunc(tags, func(t api.LibraryTag) bool { return t.Name == mp.Tag })
+	if i < 0 {
+		return "", fmt.Errorf("tag %q not found", mp.Tag)
+	}
+
+	base := tags[i]
+
+	// collect the stems the tag is known by, e.g. 8b-instruct for 8b-instruct-q4_0
+	var stems []string
+	for _, t := range tags {
+		if t.Quantization != "" && (t.Name == base.Name || t.Digest == base.Digest) {
+			if stem := strings.TrimSuffix(t.Name, "-"+t.Quantization); !slices.Contains(stems, stem) {
+				stems = append(stems, stem)
+			}
+		}
+	}
+
+	var candidates, available []string
+	for _, t := range tags {
+		if t.Quantization == "" {
+			continue
+		}
+
+		if stem := strings.TrimSuffix(t.Name, "-"+t.Quantization); len(stems) > 0 && !slices.Contains(stems, stem) {
+			continue
+		} else if len(stems) == 0 && stem != base.Name && !strings.HasPrefix(stem, base.Name+"-") {
+			// the tag doesn't alias a quantized tag so match any tag it prefixes
+			continue
+		}
+
+		if strings.EqualFold(t.Quantization, quant) {
+			candidates = append(candidates, t.Name)
+		} else if !slices.Contains(available, t.Quantization) {
+			available = append(available, t.Quantization)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("%w: %s is not available for %s, available quantizations: %s", errQuantizationNotFound, quant, mp.GetShortTagname(), strings.Join(available, ", "))
+	case 1:
+		return candidates[0], nil
+	default:
+		return "", fmt.Errorf("%w: %s matches %s", errQuantizationAmbiguous, quant, strings.Join(candidates, ", "))
+	}
+}
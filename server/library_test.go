@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T, tags map[string]string) string {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/library/llama3.1/tags/list":
+			var list struct {
+				Tags []string `json:"tags"`
+			}
+
+			for tag := range tags {
+				list.Tags = append(list.Tags, tag)
+			}
+
+			json.NewEncoder(w).Encode(list)
+		case strings.HasPrefix(r.URL.Path, "/v2/library/llama3.1/manifests/"):
+			digest, ok := tags[strings.TrimPrefix(r.URL.Path, "/v2/library/llama3.1/manifests/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			json.NewEncoder(w).Encode(Manifest{
+				Config: &Layer{Digest: digest, Size: 10},
+				Layers: []*Layer{{Digest: "sha256:model-" + digest, Size: int64(len(digest)) * 100}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Host
+}
+
+func TestQuantizationFromTag(t *testing.T) {
+	cases := map[string]string{
+		"latest":              "",
+		"8b":                  "",
+		"8b-instruct-q4_0":    "q4_0",
+		"8b-instruct-q4_K_M":  "q4_K_M",
+		"8b-instruct-fp16":    "fp16",
+		"70b-text-q8_0":       "q8_0",
+		"8b-instruct-unknown": "",
+		"8b-q4_0-instruct":    "",
+		"q4_0":                "q4_0",
+	}
+
+	for tag, expected := range cases {
+		t.Run(tag, func(t *testing.T) {
+			if actual := quantizationFromTag(tag); actual != expected {
+				t.Errorf("expected %q, got %q", expected, actual)
+			}
+		})
+	}
+}
+
+func TestResolveQuantizationTag(t *testing.T) {
+	host := newTestRegistry(t, map[string]string{
+		"latest":            "sha256:a",
+		"8b":                "sha256:a",
+		"8b-instruct-q4_0":  "sha256:a",
+		"8b-instruct-q8_0":  "sha256:b",
+		"8b-instruct-fp16":  "sha256:c",
+		"8b-text-q4_0":      "sha256:d",
+		"8b-text-q8_0":      "sha256:e",
+		"70b":               "sha256:f",
+		"70b-instruct-q8_0": "sha256:g",
+		"70b-text-q8_0":     "sha256:h",
+	})
+
+	cases := []struct {
+		name     string
+		quant    string
+		expected string
+		err      error
+	}{
+		{"llama3.1:8b", "q8_0", "8b-instruct-q8_0", nil},
+		{"llama3.1:latest", "fp16", "8b-instruct-fp16", nil},
+		{"llama3.1:8b-text-q4_0", "Q8_0", "8b-text-q8_0", nil},
+		{"llama3.1:8b", "q3_K_S", "", errQuantizationNotFound},
+		{"llama3.1:70b", "q8_0", "", errQuantizationAmbiguous},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name+"/"+tt.quant, func(t *testing.T) {
+			mp := ParseModelPath(host + "/library/" + tt.name)
+			actual, err := resolveQuantizationTag(context.Background(), mp, tt.quant, &registryOptions{Insecure: true})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if actual != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, actual)
+			}
+		})
+	}
+
+	t.Run("available", func(t *testing.T) {
+		mp := ParseModelPath(host + "/library/llama3.1:8b")
+		_, err := resolveQuantizationTag(context.Background(), mp, "q3_K_S", &registryOptions{Insecure: true})
+		if err == nil || !strings.Contains(err.Error(), "available quantizations: fp16, q4_0, q8_0") {
+			t.Errorf("expected available quantizations in error, got %v", err)
+		}
+	})
+}
+
+func TestGetLibraryTags(t *testing.T) {
+	host := newTestRegistry(t, map[string]string{
+		"8b":               "sha256:a",
+		"8b-instruct-q4_0": "sha256:a",
+	})
+
+	mp := ParseModelPath(host + "/library/llama3.1")
+	tags, err := getLibraryTags(context.Background(), mp, &registryOptions{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 2 {
+		t.Fatalf("expected 2 tags, got %d", len(tags))
+	}
+
+	if tags[0].Name != "8b" || tags[0].Quantization != "" || tags[0].Size != 810 {
+		t.Errorf("unexpected tag %+v", tags[0])
+	}
+
+	if tags[1].Name != "8b-instruct-q4_0" || tags[1].Quantization != "q4_0" || tags[1].Digest != "sha256:a" {
+		t.Errorf("unexpected tag %+v", tags[1])
+	}
+}
+
+func TestGetLibraryTagsCacheBound(t *testing.T) {
+	host := newTestRegistry(t, map[string]string{"8b": "sha256:a"})
+
+	libraryTagsCache.Lock()
+	clear(libraryTagsCache.m)
+	for i := range maxLibraryTags {
+		libraryTagsCache.m[fmt.Sprintf("https://example.com/library/model%d", i)] = libraryTags{expiresAt: time.Now().Add(time.Duration(i+1) * time.Minute)}
+	}
+
+	libraryTagsCache.m["https://example.com/library/expired"] = libraryTags{expiresAt: time.Now().Add(-time.Minute)}
+	libraryTagsCache.Unlock()
+
+	t.Cleanup(func() {
+		libraryTagsCache.Lock()
+		clear(libraryTagsCache.m)
+		libraryTagsCache.Unlock()
+	})
+
+	mp := ParseModelPath(host + "/library/llama3.1")
+	if _, err := getLibraryTags(context.Background(), mp, &registryOptions{Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	libraryTagsCache.Lock()
+	defer libraryTagsCache.Unlock()
+
+	if len(libraryTagsCache.m) != maxLibraryTags {
+		t.Errorf("expected %d cached listings, got %d", maxLibraryTags, len(libraryTagsCache.m))
+	}
+
+	// the expired listing and the one closest to expiring make room
+	for _, key := range []string{"https://example.com/library/expired", "https://example.com/library/model0"} {
+		if _, ok := libraryTagsCache.m[key]; ok {
+			t.Errorf("expected %s to be evicted", key)
+		}
+	}
+}
@@ -3,24 +3,34 @@ package server
 import (
 	"archive/zip"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"slices"
 	"strings"
-	"text/template/parse"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/convert"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/tools"
 	"github.com/ollama/ollama/types/model"
 )
 
@@ -82,7 +92,82 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	return layers, nil
 }
 
-func extractFromZipFile(p string, file *os.File, fn func(api.ProgressResponse)) error {
+// ErrArchiveTooLarge is returned when an imported archive exceeds the
+// configured size, entry count or compression ratio limits
+var ErrArchiveTooLarge = errors.New("archive is too large")
+
+// importState records the archive entries fully extracted by an import
+type importState struct {
+	Entries map[string]importEntry `json:"entries"`
+}
+
+type importEntry struct {
+	Size  uint64 `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+func readImportState(p string) (*importState, error) {
+	st := importState{Entries: make(map[string]importEntry)}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return &st, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &st); err != nil {
+		// a corrupt state only means starting over
+		slog.Warn("ignoring import state", "path", p, "error", err)
+		return &importState{Entries: make(map[string]importEntry)}, nil
+	}
+
+	if st.Entries == nil {
+		st.Entries = make(map[string]importEntry)
+	}
+
+	return &st, nil
+}
+
+func (st *importState) write(p string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(p+".tmp", b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// extracted reports whether f was fully extracted to n by a previous import.
+// the file on disk must match the size and checksum in the zip header
+func (st *importState) extracted(f *zip.File, n string) bool {
+	e, ok := st.Entries[f.Name]
+	if !ok || e.Size != f.UncompressedSize64 || e.CRC32 != f.CRC32 {
+		return false
+	}
+
+	file, err := os.Open(n)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	h := crc32.NewIEEE()
+	if copied, err := io.Copy(h, file); err != nil || uint64(copied) != e.Size {
+		return false
+	}
+
+	return h.Sum32() == e.CRC32
+}
+
+// extractFromZipFile extracts file into p. if state is set, extracted entries
+// are recorded there and entries recorded by a previous call are kept rather
+// than extracted again
+func extractFromZipFile(ctx context.Context, p, state string, file *os.File, fn func(api.ProgressResponse)) (err error) {
 	stat, err := file.Stat()
 	if err != nil {
 		return err
@@ -93,12 +178,134 @@ func extractFromZipFile(p string, file *os.File, fn func(api.ProgressResponse))
 		return err
 	}
 
-	fn(api.ProgressResponse{Status: "unpacking model metadata"})
+	if len(r.File) > envconfig.MaxImportEntries {
+		return fmt.Errorf("%w: %d files exceeds the limit of %d", ErrArchiveTooLarge, len(r.File), envconfig.MaxImportEntries)
+	}
+
+	maxSize := cmp.Or(envconfig.MaxImportSize, math.MaxInt64)
+	maxEntrySize := cmp.Or(envconfig.MaxImportEntrySize, maxSize)
+
+	// check the sizes in the central directory before writing anything
+	var size, weights uint64
 	for _, f := range r.File {
+		if f.UncompressedSize64 > maxEntrySize {
+			return fmt.Errorf("%w: %s is %d bytes which exceeds the limit of %d", ErrArchiveTooLarge, f.Name, f.UncompressedSize64, maxEntrySize)
+		}
+
+		// model files hardly compress so a large file which expands far more
+		// than its compressed size is likely crafted to fill the disk. small
+		// files can't fill the disk within the entry count limit
+		if ratio := envconfig.MaxImportCompressionRatio; ratio > 0 && f.UncompressedSize64 > format.MebiByte && f.UncompressedSize64/max(f.CompressedSize64, 1) > ratio {
+			return fmt.Errorf("%w: %s expands from %d to %d bytes which exceeds the compression ratio limit of %d", ErrArchiveTooLarge, f.Name, f.CompressedSize64, f.UncompressedSize64, ratio)
+		}
+
+		size += f.UncompressedSize64
+		if size > maxSize {
+			return fmt.Errorf("%w: more than %d bytes uncompressed", ErrArchiveTooLarge, maxSize)
+		}
+
+		switch strings.ToLower(filepath.Ext(f.Name)) {
+		case ".safetensors", ".bin", ".pth":
+			weights += f.UncompressedSize64
+		}
+	}
+
+	links, err := zipSymlinks(r)
+	if err != nil {
+		return err
+	}
+
+	// symlinks are materialized as copies of their targets
+	for _, link := range links {
+		size += link.size
+		if size > maxSize {
+			return fmt.Errorf("%w: more than %d bytes uncompressed", ErrArchiveTooLarge, maxSize)
+		}
+	}
+
+	st := &importState{Entries: make(map[string]importEntry)}
+	if state != "" {
+		if st, err = readImportState(state); err != nil {
+			return err
+		}
+	}
+
+	var completed uint64
+	done := make(map[string]bool)
+	for _, f := range r.File {
+		if filepath.IsLocal(f.Name) && st.extracted(f, filepath.Join(p, f.Name)) {
+			done[f.Name] = true
+			completed += f.UncompressedSize64
+		}
+	}
+
+	// without OLLAMA_MAX_IMPORT_SIZE the archive is limited to the free space
+	// of the volume it's extracted to along with what's already extracted
+	if envconfig.MaxImportSize == 0 {
+		if avail, err := availableSpace(p); err == nil {
+			maxSize = avail + completed
+			if size > maxSize {
+				return fmt.Errorf("%w: more than %d bytes uncompressed", ErrArchiveTooLarge, maxSize)
+			}
+		}
+	}
+
+	// the converted model is written next to the extracted files and is
+	// at most as large as the weights it's converted from
+	if err := checkDiskSpace(p, size-completed+weights, fn); err != nil {
+		return err
+	}
+
+	// remove anything written if extraction fails. recorded entries are
+	// removed from the list since they're kept to resume from
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, n := range written {
+				os.Remove(n)
+			}
+		}
+	}()
+
+	// progress is reported in bytes as files are written, at most every
+	// ImportProgressInterval and once at least 1% more is extracted, so
+	// archives of many small files don't flood fn. an interval of 0 reports
+	// every write
+	total := size
+	var reported time.Time
+	var reportedCompleted uint64
+	progress := func(force bool) {
+		now := defaultClock.Now()
+		if interval := envconfig.ImportProgressInterval; !force && interval > 0 && (now.Sub(reported) < interval || completed-reportedCompleted < total/100) {
+			return
+		}
+
+		reported, reportedCompleted = now, completed
+		fn(api.ProgressResponse{Status: "unpacking model metadata", Total: int64(total), Completed: int64(completed)})
+	}
+
+	progress(true)
+	size = 0
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		if !filepath.IsLocal(f.Name) {
 			return fmt.Errorf("%w: %s", zip.ErrInsecurePath, f.Name)
 		}
 
+		if done[f.Name] {
+			size += f.UncompressedSize64
+			continue
+		}
+
+		if isZipSymlink(&f.FileHeader) {
+			// the link is done once it's resolved. its target is copied below
+			completed += f.UncompressedSize64
+			continue
+		}
+
 		n := filepath.Join(p, f.Name)
 		if err := os.MkdirAll(filepath.Dir(n), 0o750); err != nil {
 			return err
@@ -110,6 +317,7 @@ func extractFromZipFile(p string, file *os.File, fn func(api.ProgressResponse))
 			return err
 		}
 		defer outfile.Close()
+		written = append(written, n)
 
 		infile, err := f.Open()
 		if err != nil {
@@ -117,10 +325,22 @@ func extractFromZipFile(p string, file *os.File, fn func(api.ProgressResponse))
 		}
 		defer infile.Close()
 
-		if _, err = io.Copy(outfile, infile); err != nil {
+		// enforce the limits while copying in case the header is wrong
+		limit := min(maxEntrySize, maxSize-size)
+		copied, err := io.Copy(&countingWriter{Writer: outfile, fn: func(n int) {
+			completed += uint64(n)
+			progress(false)
+		}}, io.LimitReader(infile, int64(min(limit, math.MaxInt64-1))+1))
+		if err != nil {
 			return err
 		}
 
+		if uint64(copied) > limit {
+			return fmt.Errorf("%w: %s is larger than its header claims", ErrArchiveTooLarge, f.Name)
+		}
+
+		size += uint64(copied)
+
 		if err := outfile.Close(); err != nil {
 			return err
 		}
@@ -128,33 +348,343 @@ func extractFromZipFile(p string, file *os.File, fn func(api.ProgressResponse))
 		if err := infile.Close(); err != nil {
 			return err
 		}
+
+		if state != "" {
+			st.Entries[f.Name] = importEntry{Size: uint64(copied), CRC32: f.CRC32}
+			if err := st.write(state); err != nil {
+				return err
+			}
+
+			written = written[:0]
+		}
+	}
+
+	for _, link := range links {
+		n := filepath.Join(p, link.name)
+		written = append(written, n)
+		if err := copyFile(filepath.Join(p, link.target), n); err != nil {
+			return err
+		}
+
+		completed += link.size
+		progress(false)
+	}
+
+	// the last bytes may have been extracted since the last update
+	if completed != reportedCompleted {
+		progress(true)
 	}
 
 	return nil
 }
 
-func parseFromZipFile(_ context.Context, file *os.File, digest string, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
-	tempDir, err := os.MkdirTemp(filepath.Dir(file.Name()), "")
+// countingWriter calls fn with the number of bytes of each write
+type countingWriter struct {
+	io.Writer
+	fn func(int)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.fn(n)
+	return n, err
+}
+
+// isZipSymlink reports whether fh is a symlink entry. zip archives written on
+// unix mark symlinks in the mode bits of the entry's external attributes and
+// hold the link's target as its content
+func isZipSymlink(fh *zip.FileHeader) bool {
+	return fh.Mode()&fs.ModeSymlink != 0
+}
+
+type zipSymlink struct {
+	name, target string
+	size         uint64
+}
+
+// zipSymlinks resolves the symlink entries in r to the regular files they
+// point to. symlinks pointing outside of the archive are rejected with
+// zip.ErrInsecurePath
+func zipSymlinks(r *zip.Reader) ([]zipSymlink, error) {
+	files := make(map[string]*zip.File)
+	targets := make(map[string]string)
+	var names []string
+	for _, f := range r.File {
+		name := path.Clean(f.Name)
+		files[name] = f
+		if !isZipSymlink(&f.FileHeader) {
+			continue
+		}
+
+		if !filepath.IsLocal(f.Name) {
+			return nil, fmt.Errorf("%w: %s", zip.ErrInsecurePath, f.Name)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := io.ReadAll(io.LimitReader(rc, 4096))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		target := string(b)
+		if path.IsAbs(target) || filepath.IsAbs(target) {
+			return nil, fmt.Errorf("%w: %s links to %s", zip.ErrInsecurePath, f.Name, target)
+		}
+
+		resolved := path.Join(path.Dir(name), filepath.ToSlash(target))
+		if !filepath.IsLocal(filepath.FromSlash(resolved)) {
+			return nil, fmt.Errorf("%w: %s links to %s", zip.ErrInsecurePath, f.Name, target)
+		}
+
+		targets[name] = resolved
+		names = append(names, name)
+	}
+
+	var links []zipSymlink
+	for _, name := range names {
+		// follow links to links until a regular file
+		target := targets[name]
+		for range len(targets) {
+			next, ok := targets[target]
+			if !ok {
+				break
+			}
+
+			target = next
+		}
+
+		f, ok := files[target]
+		if !ok {
+			return nil, fmt.Errorf("%s links to %s which isn't in the archive", name, target)
+		} else if isZipSymlink(&f.FileHeader) {
+			return nil, fmt.Errorf("%s is a symlink loop", name)
+		} else if f.FileInfo().IsDir() {
+			return nil, fmt.Errorf("%s links to directory %s", name, target)
+		}
+
+		links = append(links, zipSymlink{name: filepath.FromSlash(name), target: filepath.FromSlash(target), size: f.UncompressedSize64})
+	}
+
+	return links, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// ErrInsufficientDiskSpace is returned when there isn't enough disk space to
+// import a model
+var ErrInsufficientDiskSpace = errors.New("not enough disk space")
+
+// availableSpace returns the free space on the volume containing a path
+var availableSpace = availableDiskSpace
+
+// checkDiskSpace fails if the volume containing p has less than required bytes
+// available. it's skipped if the available space can't be determined
+func checkDiskSpace(p string, required uint64, fn func(api.ProgressResponse)) error {
+	avail, err := availableSpace(p)
+	if err != nil {
+		slog.Warn("failed to get available disk space", "path", p, "error", err)
+		return nil
+	}
+
+	if required > avail {
+		msg := fmt.Sprintf("%s required, %s available", format.HumanBytes2(required), format.HumanBytes2(avail))
+		fn(api.ProgressResponse{Status: "not enough disk space to import model: " + msg})
+		return fmt.Errorf("%w to import model: %s", ErrInsufficientDiskSpace, msg)
+	}
+
+	return nil
+}
+
+// importLocks holds a *sync.Mutex for each blob digest being imported since
+// imports of the same blob share a directory
+var importLocks sync.Map
+
+func parseFromZipFile(ctx context.Context, file *os.File, digest string, base *llm.GGML, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	var tempDir, state string
+	if digest != "" {
+		mu, _ := importLocks.LoadOrStore(digest, &sync.Mutex{})
+		mu.(*sync.Mutex).Lock()
+		defer mu.(*sync.Mutex).Unlock()
+
+		// extract blobs to a directory named after the digest so an
+		// interrupted import can be resumed by a later create
+		tempDir = importsPath(digest)
+		if err := os.MkdirAll(tempDir, 0o750); err != nil {
+			return nil, err
+		}
+
+		state = tempDir + ".json"
+	} else {
+		tempDir, err = os.MkdirTemp(filepath.Dir(file.Name()), "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defer func() {
+		if state != "" && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			return
+		}
+
+		os.RemoveAll(tempDir)
+		if state != "" {
+			os.Remove(state)
+		}
+	}()
+
+	if err := extractFromZipFile(ctx, tempDir, state, file, fn); err != nil {
+		return nil, err
+	}
+
+	return convertFromDir(ctx, tempDir, tempDir, digest, base, fn)
+}
+
+// importsPath is the directory a zip blob is extracted to when it's imported
+func importsPath(digest string) string {
+	return filepath.Join(envconfig.ModelsDir, "imports", strings.ReplaceAll(digest, ":", "-"))
+}
+
+// parseFromDir imports an unpacked model directory the same way as a zip file
+// without extracting it first. intermediate files are written to the blobs
+// directory rather than into dir
+func parseFromDir(ctx context.Context, dir string, base *llm.GGML, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	files, size, weights, err := checkImportDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fn(api.ProgressResponse{Status: fmt.Sprintf("reading %d files (%s)", files, format.HumanBytes2(size)), Total: int64(size)})
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	tempDir, err := os.MkdirTemp(blobs, "")
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(tempDir)
 
-	if err := extractFromZipFile(tempDir, file, fn); err != nil {
+	if err := checkDiskSpace(tempDir, weights, fn); err != nil {
 		return nil, err
 	}
 
-	mf, err := convert.GetModelFormat(tempDir)
+	return convertFromDir(ctx, dir, tempDir, "", base, fn)
+}
+
+// checkImportDir walks dir returning the number of files, their total size and
+// the size of the weights among them. symlinks resolving outside of dir are
+// rejected
+func checkImportDir(dir string) (files int, size, weights uint64, err error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return err
+			}
+
+			if r, err := filepath.Rel(root, target); err != nil || !filepath.IsLocal(r) {
+				return fmt.Errorf("%w: %s links outside of the model directory", zip.ErrInsecurePath, rel)
+			}
+		} else if d.IsDir() {
+			return nil
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		} else if fi.IsDir() {
+			return nil
+		}
+
+		files++
+		size += uint64(fi.Size())
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".safetensors", ".bin", ".pth", ".gguf":
+			weights += uint64(fi.Size())
+		}
+
+		return nil
+	})
+
+	return files, size, weights, err
+}
+
+// convertFromDir imports the gguf, adapter or model in dir writing any
+// intermediate files to tempDir
+func convertFromDir(ctx context.Context, dir, tempDir, digest string, base *llm.GGML, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	ggufs, err := findGGUFs(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	params, err := mf.GetParams(tempDir)
+	switch len(ggufs) {
+	case 0:
+	case 1:
+		return parseGGUFFromDir(ctx, dir, ggufs[0], base, fn)
+	default:
+		return nil, fmt.Errorf("found multiple gguf files, use FROM with the path of one of them: %s", strings.Join(ggufs, ", "))
+	}
+
+	if convert.IsAdapter(dir) {
+		return parseAdapterFromDir(dir, tempDir, digest, base, fn)
+	}
+
+	mf, err := convert.GetModelFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := mf.GetParams(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	mArch, err := mf.GetModelArch("", tempDir, params)
+	params.Progress = fn
+
+	mArch, err := mf.GetModelArch("", dir, params)
 	if err != nil {
 		return nil, err
 	}
@@ -209,7 +739,131 @@ func parseFromZipFile(_ context.Context, file *os.File, digest string, fn func(a
 	return detectChatTemplate(layers)
 }
 
-func parseFromFile(ctx context.Context, file *os.File, digest string, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+// findGGUFs returns the paths, relative to dir, of the gguf files in dir
+func findGGUFs(dir string) ([]string, error) {
+	var ggufs []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".gguf") {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+
+			ggufs = append(ggufs, rel)
+		}
+
+		return nil
+	})
+
+	return ggufs, err
+}
+
+// parseGGUFFromDir uses an already converted model in dir as is
+func parseGGUFFromDir(ctx context.Context, dir, name string, base *llm.GGML, fn func(api.ProgressResponse)) ([]*layerGGML, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := checkGGUF(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	fn(api.ProgressResponse{Status: "copying gguf"})
+	return parseFromFile(ctx, f, "", base, fn)
+}
+
+// checkGGUF verifies rs starts with the magic and a known version of a gguf
+// file and rewinds it
+func checkGGUF(rs io.ReadSeeker) error {
+	var magic uint32
+	if err := binary.Read(rs, binary.LittleEndian, &magic); err != nil {
+		return err
+	}
+
+	var bo binary.ByteOrder
+	switch magic {
+	case llm.FILE_MAGIC_GGUF_LE:
+		bo = binary.LittleEndian
+	case llm.FILE_MAGIC_GGUF_BE:
+		bo = binary.BigEndian
+	default:
+		return errors.New("invalid gguf magic")
+	}
+
+	var version uint32
+	if err := binary.Read(rs, bo, &version); err != nil {
+		return err
+	}
+
+	if version < 1 || version > 3 {
+		return fmt.Errorf("unsupported gguf version %d", version)
+	}
+
+	_, err := rs.Seek(0, io.SeekStart)
+	return err
+}
+
+// adapterTargetModulesKey holds the target_modules of a converted PEFT adapter
+// in the KV of its layer
+const adapterTargetModulesKey = "adapter.lora.target_modules"
+
+func parseAdapterFromDir(dir, tempDir, digest string, base *llm.GGML, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	if base == nil {
+		return nil, errors.New("converting an adapter requires a base model, add a FROM command before ADAPTER")
+	}
+
+	params, err := convert.GetAdapterParams(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fn(api.ProgressResponse{Status: "converting adapter"})
+
+	temp, err := os.CreateTemp(tempDir, "ggla")
+	if err != nil {
+		return nil, err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	if err := convert.ConvertAdapter(dir, temp, base.KV(), base.Tensors()); err != nil {
+		return nil, err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	layer, err := NewLayer(temp, "application/vnd.ollama.image.adapter")
+	if err != nil {
+		return nil, err
+	}
+
+	bin, err := layer.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bin.Close()
+
+	ggml, _, err := llm.DecodeGGML(bin, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// ggla has no metadata so the target modules are kept alongside it for
+	// the model config. the converted adapter isn't cached as an intermediate
+	// blob of digest since it depends on the base model it's converted against
+	ggml.KV()[adapterTargetModulesKey] = params.TargetModules
+	return []*layerGGML{{layer, ggml}}, nil
+}
+
+func parseFromFile(ctx context.Context, file *os.File, digest string, base *llm.GGML, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
 	sr := io.NewSectionReader(file, 0, 512)
 	contentType, err := detectContentType(sr)
 	if err != nil {
@@ -220,7 +874,7 @@ func parseFromFile(ctx context.Context, file *os.File, digest string, fn func(ap
 	case "gguf", "ggla":
 		// noop
 	case "application/zip":
-		return parseFromZipFile(ctx, file, digest, fn)
+		return parseFromZipFile(ctx, file, digest, base, fn)
 	default:
 		return nil, fmt.Errorf("unsupported content type: %s", contentType)
 	}
@@ -295,102 +949,168 @@ func detectContentType(r io.Reader) (string, error) {
 	return "unknown", nil
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
-// mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
-	// create a subtree from the node that ranges over .ToolCalls
-	tmpl := m.Template.Subtree(func(n parse.Node) bool {
-		if t, ok := n.(*parse.RangeNode); ok {
-			return slices.Contains(template.Identifiers(t.Pipe), "ToolCalls")
+// parseToolCalls parses the tool calls in s in the format of the model's
+// template along with the text around them. ids generates the IDs of the tool
+// calls unless they're derived from their content. see [tools.Parser.Parse]
+func (m *Model) parseToolCalls(s string, ids *tools.IDGenerator) (tools.Result, error) {
+	p, err := tools.NewParser(m.Template)
+	if errors.Is(err, tools.ErrNoToolCalls) {
+		return tools.Result{Prefix: s}, nil
+	} else if err != nil {
+		return tools.Result{Prefix: s}, err
+	}
+
+	p.IDs = ids
+	r, err := p.ParseContent(s)
+	if envconfig.StableToolCallIDs {
+		for i := range r.ToolCalls {
+			r.ToolCalls[i].ID = toolCallID(r.ToolCalls[i], i)
 		}
+	}
 
-		return false
-	})
+	return r, err
+}
+
+// toolCallStream splits a streamed response into the text before its tool
+// calls, which is sent as it's generated, and the tool calls, which are parsed
+// once the response is complete. text is sent a line at a time since the line
+// tool calls start on isn't part of the content
+type toolCallStream struct {
+	m   *Model
+	p   *tools.Parser
+	ids *tools.IDGenerator
+
+	sb strings.Builder
+	// sent is the length of the text that's been sent
+	sent int
+	// held is set once the rest of the response may be a tool call
+	held bool
+}
 
-	if tmpl == nil {
-		return nil, false
+func (m *Model) toolCallStream(ids *tools.IDGenerator) *toolCallStream {
+	t := toolCallStream{m: m, ids: ids}
+	if p, err := tools.NewParser(m.Template); err == nil {
+		t.p = p
 	}
 
-	var b bytes.Buffer
-	if err := tmpl.Execute(&b, map[string][]map[string]any{
-		"ToolCalls": {
-			{
-				"Function": map[string]any{
-					"Name":      "@@name@@",
-					"Arguments": "@@arguments@@",
-				},
-			},
-		},
-	}); err != nil {
-		return nil, false
-	}
-
-	var kv map[string]string
-	// execute the subtree with placeholders to identify the keys
-	if err := json.Unmarshal(b.Bytes(), &kv); err != nil {
-		return nil, false
-	}
-
-	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
-	for k, v := range kv {
-		switch v {
-		case "@@name@@":
-			name = k
-		case "@@arguments@@":
-			arguments = k
-		}
-	}
-
-	var sm []map[string]any
-	decoder := json.NewDecoder(strings.NewReader(s))
-	for {
-		// incrementally decode the JSON into a list of JSON objects
-		// skipping over any invalid tokens
-		if err := decoder.Decode(&sm); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+	return &t
+}
 
-			if errors.As(err, new(*json.SyntaxError)) {
-				r := decoder.Buffered()
-				if _, err := r.Read(make([]byte, decoder.InputOffset()+1)); err != nil {
-					break
-				}
+// write adds s to the response and returns the text that can be sent
+func (t *toolCallStream) write(s string) string {
+	t.sb.WriteString(s)
+	if t.p == nil {
+		// the template doesn't render tool calls so there's nothing to hold
+		t.sent += len(s)
+		return s
+	} else if t.held {
+		return ""
+	}
 
-				decoder = json.NewDecoder(r)
-				continue
-			}
+	pending := t.sb.String()[t.sent:]
+	n := strings.LastIndex(pending, "\n") + 1
+	if i := t.p.Start(pending[:n]); i >= 0 {
+		t.held = true
+		n = strings.LastIndex(pending[:i], "\n") + 1
+	}
 
-			return nil, false
-		}
+	t.sent += n
+	return pending[:n]
+}
 
-		// break as soon as a valid object is decoded
-		break
+// close parses the complete response and returns the text which hasn't been
+// sent, which is what's left of the content once any tool calls are taken
+// out, along with the tool calls
+func (t *toolCallStream) close() (string, []api.ToolCall) {
+	s := t.sb.String()
+	r, err := t.m.parseToolCalls(s, t.ids)
+	if err != nil {
+		slog.Debug("failed to parse tool calls", "error", err)
 	}
 
-	var toolCalls []api.ToolCall
-	for _, kv := range sm {
-		call := api.ToolCall{
-			ID:   uuid.New().String(),
-			Type: "function",
-		}
+	if len(r.ToolCalls) == 0 {
+		return s[t.sent:], nil
+	}
 
-		for k, v := range kv {
-			switch k {
-			case name:
-				call.Function.Name = v.(string)
-			case arguments:
-				call.Function.Arguments = v.(map[string]any)
+	content, sent := r.Content(), strings.TrimSpace(s[:t.sent])
+	if !strings.HasPrefix(content, sent) {
+		// part of a tool call was sent as text, which can't be taken back
+		return "", r.ToolCalls
+	}
+
+	return content[len(sent):], r.ToolCalls
+}
+
+// parseThinking splits s into the thinking and the content of a response in
+// the tags the model's template wraps thinking in, e.g. <think></think>. s is
+// all content if the template doesn't render thinking in tags
+func (m *Model) parseThinking(s string) (thinking, content string) {
+	openTag, closeTag, ok := m.Template.ThinkingTags()
+	if !ok {
+		return "", s
+	}
+
+	return splitThinking(s, openTag, closeTag)
+}
+
+// splitThinking returns the text between the first openTag and its matching
+// closeTag as thinking and the text around them as content. tags nested in the
+// thinking are kept as part of it, and thinking which isn't closed, e.g. when
+// the model stopped early, runs to the end of s
+func splitThinking(s, openTag, closeTag string) (thinking, content string) {
+	start := strings.Index(s, openTag)
+	if start < 0 {
+		return "", s
+	}
+
+	depth := 1
+	for i := start + len(openTag); i < len(s); {
+		rest := s[i:]
+		o, c := strings.Index(rest, openTag), strings.Index(rest, closeTag)
+		switch {
+		case c < 0:
+			i = len(s)
+		case o >= 0 && o < c:
+			depth++
+			i += o + len(openTag)
+		default:
+			depth--
+			i += c + len(closeTag)
+			if depth == 0 {
+				thinking = s[start+len(openTag) : i-len(closeTag)]
+				return strings.TrimSpace(thinking), strings.TrimSpace(s[:start] + s[i:])
 			}
 		}
+	}
 
-		toolCalls = append(toolCalls, call)
+	return strings.TrimSpace(s[start+len(openTag):]), strings.TrimSpace(s[:start])
+}
+
+// toolCallID derives an ID for the tool call at index i of a response from
+// its name and arguments so the same output always yields the same IDs.
+// identical calls within one response are told apart by their index
+func toolCallID(call api.ToolCall, i int) string {
+	h := sha256.New()
+	h.Write([]byte(call.Function.Name))
+	h.Write([]byte{0})
+	// the arguments are hashed as a map, whose keys are sorted when
+	// marshalled, so the ID doesn't depend on the order they're given in
+	if err := json.NewEncoder(h).Encode(call.Function.Arguments.Map()); err != nil {
+		// fall back to the formatted arguments which also sort map keys
+		fmt.Fprint(h, call.Function.Arguments)
 	}
+	fmt.Fprintf(h, "%d", i)
+	// 18 bytes encode to the 24 characters of a generated ID
+	return "call_" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18])
+}
 
-	if len(toolCalls) > 0 {
-		return toolCalls, true
+// toolCallIDs returns the generator of the IDs of the tool calls of a
+// response. the IDs are derived from the request's seed, if it has one, and
+// its prompt
+func toolCallIDs(opts *api.Options, prompt string) *tools.IDGenerator {
+	if opts != nil && opts.Seed >= 0 {
+		return tools.NewSeededIDGenerator(int64(opts.Seed), prompt)
 	}
 
-	return nil, false
+	return tools.NewIDGenerator()
 }
@@ -3,18 +3,28 @@ package server
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
 )
 
@@ -79,7 +89,7 @@ func TestExtractFromZipFile(t *testing.T) {
 			defer f.Close()
 
 			tempDir := t.TempDir()
-			if err := extractFromZipFile(tempDir, f, func(api.ProgressResponse) {}); !errors.Is(err, tt.err) {
+			if err := extractFromZipFile(context.TODO(), tempDir, "", f, func(api.ProgressResponse) {}); !errors.Is(err, tt.err) {
 				t.Fatal(err)
 			}
 
@@ -115,9 +125,1049 @@ func TestExtractFromZipFile(t *testing.T) {
 	}
 }
 
+func createZipFileWithFiles(t *testing.T, files map[string][]byte) *os.File {
+	t.Helper()
+
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zf := zip.NewWriter(f)
+	defer zf.Close()
+
+	for name, b := range files {
+		zh, err := zf.CreateHeader(&zip.FileHeader{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := zh.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return f
+}
+
+func TestExtractFromZipFileLimits(t *testing.T) {
+	cases := []struct {
+		name  string
+		env   map[string]string
+		files map[string][]byte
+	}{
+		{
+			name:  "entries",
+			env:   map[string]string{"OLLAMA_MAX_IMPORT_ENTRIES": "2"},
+			files: map[string][]byte{"a": nil, "b": nil, "c": nil},
+		},
+		{
+			name:  "entry size",
+			env:   map[string]string{"OLLAMA_MAX_IMPORT_ENTRY_SIZE": "10"},
+			files: map[string][]byte{"a": make([]byte, 10), "b": make([]byte, 11)},
+		},
+		{
+			name:  "size",
+			env:   map[string]string{"OLLAMA_MAX_IMPORT_SIZE": "15"},
+			files: map[string][]byte{"a": make([]byte, 10), "b": make([]byte, 10)},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			envconfig.LoadConfig()
+
+			f := createZipFileWithFiles(t, tt.files)
+			defer f.Close()
+
+			tempDir := t.TempDir()
+			if err := extractFromZipFile(context.TODO(), tempDir, "", f, func(api.ProgressResponse) {}); !errors.Is(err, ErrArchiveTooLarge) {
+				t.Fatalf("expected ErrArchiveTooLarge, got %v", err)
+			}
+
+			if entries, err := os.ReadDir(tempDir); err != nil {
+				t.Fatal(err)
+			} else if len(entries) > 0 {
+				t.Errorf("expected nothing to be extracted, got %d files", len(entries))
+			}
+		})
+	}
+}
+
+func TestExtractFromZipFileCrafted(t *testing.T) {
+	envconfig.LoadConfig()
+
+	// raw writes an entry stored as is with the given header sizes
+	raw := func(zf *zip.Writer, name string, b []byte, size uint64) {
+		w, err := zf.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(b),
+			CompressedSize64:   uint64(len(b)),
+			UncompressedSize64: size,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		write func(*zip.Writer)
+		err   error
+	}{
+		{
+			name: "compression ratio",
+			write: func(zf *zip.Writer) {
+				w, err := zf.CreateHeader(&zip.FileHeader{Name: "model.safetensors", Method: zip.Deflate})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := w.Write(make([]byte, 4<<20)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: ErrArchiveTooLarge,
+		},
+		{
+			name: "declared size",
+			write: func(zf *zip.Writer) {
+				raw(zf, "model.safetensors", []byte("a"), 1<<40)
+			},
+			err: ErrArchiveTooLarge,
+		},
+		{
+			// the first file is extracted before the second turns out to be
+			// larger than its header claims
+			name: "partial",
+			write: func(zf *zip.Writer) {
+				raw(zf, "config.json", []byte("{}"), 2)
+				raw(zf, "model.safetensors", bytes.Repeat([]byte("a"), 1024), 16)
+			},
+			err: zip.ErrFormat,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			zf := zip.NewWriter(f)
+			tt.write(zf)
+			if err := zf.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tempDir := t.TempDir()
+			if err := extractFromZipFile(context.TODO(), tempDir, "", f, func(api.ProgressResponse) {}); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			if entries, err := os.ReadDir(tempDir); err != nil {
+				t.Fatal(err)
+			} else if len(entries) > 0 {
+				t.Errorf("expected extracted files to be removed, got %d files", len(entries))
+			}
+		})
+	}
+
+	t.Run("no ratio limit", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_IMPORT_COMPRESSION_RATIO", "0")
+		envconfig.LoadConfig()
+
+		f, err := os.CreateTemp(t.TempDir(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		zf := zip.NewWriter(f)
+		cases[0].write(zf)
+		if err := zf.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := extractFromZipFile(context.TODO(), t.TempDir(), "", f, func(api.ProgressResponse) {}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// tickingClock is a fakeClock which moves forward every time it's read
+type tickingClock struct {
+	*fakeClock
+	tick time.Duration
+}
+
+func (c tickingClock) Now() time.Time {
+	c.advance(c.tick)
+	return c.fakeClock.Now()
+}
+
+func TestExtractFromZipFileProgress(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := range 100 {
+		files[fmt.Sprintf("%03d", i)] = make([]byte, 10)
+	}
+
+	cases := []struct {
+		name     string
+		interval string
+		updates  int
+	}{
+		// the clock ticks 10ms per file so every fifth file, including the
+		// last, is reported after the start
+		{"throttled", "50ms", 21},
+		{"every file", "0", 101},
+	}
+
+	clock := defaultClock
+	t.Cleanup(func() { defaultClock = clock })
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_IMPORT_PROGRESS_INTERVAL", tt.interval)
+			envconfig.LoadConfig()
+
+			defaultClock = tickingClock{&fakeClock{now: time.Unix(0, 0)}, 10 * time.Millisecond}
+
+			f := createZipFileWithFiles(t, files)
+			defer f.Close()
+
+			var updates []api.ProgressResponse
+			if err := extractFromZipFile(context.TODO(), t.TempDir(), "", f, func(p api.ProgressResponse) {
+				if p.Status == "unpacking model metadata" {
+					updates = append(updates, p)
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(updates) != tt.updates {
+				t.Errorf("expected %d updates, got %d", tt.updates, len(updates))
+			}
+
+			for i := 1; i < len(updates); i++ {
+				if updates[i].Completed < updates[i-1].Completed {
+					t.Errorf("expected cumulative progress, got %d after %d", updates[i].Completed, updates[i-1].Completed)
+				}
+			}
+
+			if last := updates[len(updates)-1]; last.Completed != 1000 || last.Total != 1000 {
+				t.Errorf("expected the final update to be complete, got %d of %d", last.Completed, last.Total)
+			}
+		})
+	}
+}
+
+func TestExtractFromZipFileByteProgress(t *testing.T) {
+	envconfig.LoadConfig()
+
+	// the interval elapses between any two writes so only the 1% change
+	// throttles updates
+	clock := defaultClock
+	t.Cleanup(func() { defaultClock = clock })
+	defaultClock = tickingClock{&fakeClock{now: time.Unix(0, 0)}, time.Second}
+
+	f := createZipFileWithFiles(t, map[string][]byte{
+		"config.json":       []byte(`{"architectures": ["LlamaForCausalLM"]}`),
+		"model.safetensors": bytes.Repeat([]byte("a"), 1<<20),
+	})
+	defer f.Close()
+
+	var updates []api.ProgressResponse
+	if err := extractFromZipFile(context.TODO(), t.TempDir(), "", f, func(p api.ProgressResponse) {
+		if p.Status == "unpacking model metadata" {
+			updates = append(updates, p)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the weights are reported as they're written rather than once they're done
+	if len(updates) < 10 {
+		t.Fatalf("expected progress while extracting the weights, got %d updates", len(updates))
+	}
+
+	total := updates[0].Total
+	for i := 1; i < len(updates); i++ {
+		if delta := updates[i].Completed - updates[i-1].Completed; delta < total/100 && i < len(updates)-1 {
+			t.Errorf("expected updates at least 1%% apart, got %d after %d", updates[i].Completed, updates[i-1].Completed)
+		}
+	}
+
+	if last := updates[len(updates)-1]; last.Completed != total {
+		t.Errorf("expected the final update to be complete, got %d of %d", last.Completed, total)
+	}
+}
+
+func TestExtractFromZipFileDiskSpace(t *testing.T) {
+	envconfig.LoadConfig()
+	availableSpace = func(string) (uint64, error) { return 100, nil }
+	t.Cleanup(func() { availableSpace = availableDiskSpace })
+
+	cases := []struct {
+		name  string
+		files map[string][]byte
+		err   error
+	}{
+		{
+			// 50 bytes extracted and at most 48 more converted
+			name:  "enough",
+			files: map[string][]byte{"config.json": []byte("{}"), "model.safetensors": make([]byte, 48)},
+		},
+		{
+			// 62 bytes extracted and at most 60 more converted
+			name:  "not enough",
+			files: map[string][]byte{"config.json": []byte("{}"), "model.safetensors": make([]byte, 60)},
+			err:   ErrInsufficientDiskSpace,
+		},
+		{
+			// without OLLAMA_MAX_IMPORT_SIZE the free space is the limit
+			name:  "too large",
+			files: map[string][]byte{"config.json": []byte("{}"), "model.safetensors": make([]byte, 120)},
+			err:   ErrArchiveTooLarge,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createZipFileWithFiles(t, tt.files)
+			defer f.Close()
+
+			var statuses []string
+			tempDir := t.TempDir()
+			err := extractFromZipFile(context.TODO(), tempDir, "", f, func(resp api.ProgressResponse) {
+				statuses = append(statuses, resp.Status)
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			entries, err := os.ReadDir(tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.err == nil {
+				if len(entries) != len(tt.files) {
+					t.Errorf("expected %d files, got %d", len(tt.files), len(entries))
+				}
+
+				return
+			}
+
+			if len(entries) > 0 {
+				t.Errorf("expected nothing to be extracted, got %d files", len(entries))
+			}
+
+			if tt.err == ErrInsufficientDiskSpace && (len(statuses) == 0 || statuses[len(statuses)-1] != "not enough disk space to import model: 122 B required, 100 B available") {
+				t.Errorf("unexpected statuses %v", statuses)
+			}
+		})
+	}
+}
+
+func TestExtractFromZipFileResume(t *testing.T) {
+	// report every file to cancel after the first one
+	t.Setenv("OLLAMA_IMPORT_PROGRESS_INTERVAL", "0")
+	envconfig.LoadConfig()
+
+	files := map[string][]byte{
+		"config.json":       []byte(`{"architectures": ["LlamaForCausalLM"]}`),
+		"model.safetensors": bytes.Repeat([]byte("a"), 1024),
+		"tokenizer.json":    []byte("{}"),
+	}
+
+	cases := []struct {
+		name    string
+		corrupt bool
+	}{
+		{name: "resume"},
+		{name: "corrupt", corrupt: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createZipFileWithFiles(t, files)
+			defer f.Close()
+
+			tempDir := t.TempDir()
+			state := filepath.Join(t.TempDir(), "state.json")
+
+			// cancel once the first entry is extracted
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+
+			if err := extractFromZipFile(ctx, tempDir, state, f, func(resp api.ProgressResponse) {
+				if resp.Completed > 0 {
+					cancel()
+				}
+			}); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected %v, got %v", context.Canceled, err)
+			}
+
+			entries, err := os.ReadDir(tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != 1 {
+				t.Fatalf("expected 1 extracted file, got %d", len(entries))
+			}
+
+			name := entries[0].Name()
+			n := filepath.Join(tempDir, name)
+			if tt.corrupt {
+				b := bytes.Repeat([]byte("x"), len(files[name]))
+				if err := os.WriteFile(n, b, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			old := time.Now().Add(-time.Hour).Truncate(time.Second)
+			if err := os.Chtimes(n, old, old); err != nil {
+				t.Fatal(err)
+			}
+
+			var first *api.ProgressResponse
+			if err := extractFromZipFile(context.TODO(), tempDir, state, f, func(resp api.ProgressResponse) {
+				if first == nil {
+					first = &resp
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var total int
+			for _, b := range files {
+				total += len(b)
+			}
+
+			resumed := int64(len(files[name]))
+			if tt.corrupt {
+				resumed = 0
+			}
+
+			if first == nil || first.Total != int64(total) || first.Completed != resumed {
+				t.Errorf("expected progress to start at %d of %d, got %v", resumed, total, first)
+			}
+
+			fi, err := os.Stat(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if touched := !fi.ModTime().Equal(old); touched != tt.corrupt {
+				t.Errorf("expected %s to be extracted again: %t, got %t", name, tt.corrupt, touched)
+			}
+
+			for name, expect := range files {
+				b, err := os.ReadFile(filepath.Join(tempDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(b, expect) {
+					t.Errorf("%s: unexpected content %q", name, b)
+				}
+			}
+		})
+	}
+}
+
+func TestIsZipSymlink(t *testing.T) {
+	link := zip.FileHeader{Name: "vocab.txt"}
+	link.SetMode(fs.ModeSymlink | 0o777)
+
+	dir := zip.FileHeader{Name: "tokenizer/"}
+	dir.SetMode(fs.ModeDir | 0o755)
+
+	cases := []struct {
+		name   string
+		header *zip.FileHeader
+		expect bool
+	}{
+		{"file", &zip.FileHeader{Name: "vocab.json"}, false},
+		{"directory", &dir, false},
+		{"symlink", &link, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isZipSymlink(tt.header); got != tt.expect {
+				t.Errorf("expected %t, got %t", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestExtractFromZipFileSymlinks(t *testing.T) {
+	cases := []struct {
+		name   string
+		link   string
+		target string
+		err    error
+	}{
+		{name: "relative", link: "tokenizer/vocab.json", target: "../vocab.json"},
+		{name: "chained", link: "tokenizer.json", target: "tokenizer/vocab.json"},
+		{name: "absolute", link: "vocab.txt", target: "/etc/passwd", err: zip.ErrInsecurePath},
+		{name: "nested absolute", link: "tokenizer/passwd", target: "/etc/passwd", err: zip.ErrInsecurePath},
+		{name: "escape", link: "tokenizer/vocab.txt", target: "../../vocab.json", err: zip.ErrInsecurePath},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			zf := zip.NewWriter(f)
+			if zh, err := zf.Create("vocab.json"); err != nil {
+				t.Fatal(err)
+			} else if _, err := zh.Write([]byte(`{"a": 1}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			links := [][2]string{{tt.link, tt.target}}
+			if tt.name == "chained" {
+				links = [][2]string{{"tokenizer/vocab.json", "../vocab.json"}, {tt.link, tt.target}}
+			}
+
+			for _, link := range links {
+				fh := zip.FileHeader{Name: link[0]}
+				fh.SetMode(fs.ModeSymlink | 0o777)
+				if zh, err := zf.CreateHeader(&fh); err != nil {
+					t.Fatal(err)
+				} else if _, err := zh.Write([]byte(link[1])); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := zf.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tempDir := t.TempDir()
+			err = extractFromZipFile(context.TODO(), tempDir, "", f, func(api.ProgressResponse) {})
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+
+				if entries, err := os.ReadDir(tempDir); err != nil {
+					t.Fatal(err)
+				} else if len(entries) > 0 {
+					t.Errorf("expected nothing to be extracted, got %d files", len(entries))
+				}
+
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// links are materialized as copies so no symlink is ever created
+			if err := filepath.WalkDir(tempDir, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if d.Type()&fs.ModeSymlink != 0 {
+					t.Errorf("expected %s to be a regular file, got a symlink", p)
+				}
+
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if b := readFile(t, tempDir, tt.link); b.String() != `{"a": 1}` {
+				t.Errorf("expected the content of the target, got %q", b)
+			}
+		})
+	}
+}
+
+func TestExtractFromZipFileWrongHeader(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zf := zip.NewWriter(f)
+	if zh, err := zf.Create("good"); err != nil {
+		t.Fatal(err)
+	} else if _, err := zh.Write([]byte("good")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the header claims 1 byte but the entry holds 1024
+	bad := make([]byte, 1024)
+	zh, err := zf.CreateRaw(&zip.FileHeader{
+		Name:               "bad",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(bad),
+		CompressedSize64:   uint64(len(bad)),
+		UncompressedSize64: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := zh.Write(bad); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_MAX_IMPORT_SIZE", "16")
+	envconfig.LoadConfig()
+
+	tempDir := t.TempDir()
+	if err := extractFromZipFile(context.TODO(), tempDir, "", f, func(api.ProgressResponse) {}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if entries, err := os.ReadDir(tempDir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) > 0 {
+		t.Errorf("expected extracted files to be removed, got %d files", len(entries))
+	}
+}
+
+func TestParseFromZipFileGGUF(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	gguf, err := os.ReadFile(createBinFile(t, map[string]any{"general.architecture": "llama"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := createZipFileWithFiles(t, map[string][]byte{
+		"model.gguf":            gguf,
+		"tokenizer.json":        []byte("{}"),
+		"tokenizer_config.json": []byte("{}"),
+	})
+	defer f.Close()
+
+	var statuses []string
+	layers, err := parseFromZipFile(context.TODO(), f, "", nil, func(resp api.ProgressResponse) {
+		statuses = append(statuses, resp.Status)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(layers))
+	}
+
+	if layers[0].MediaType != "application/vnd.ollama.image.model" {
+		t.Errorf("unexpected media type %s", layers[0].MediaType)
+	}
+
+	if layers[0].Size != int64(len(gguf)) {
+		t.Errorf("expected the gguf to be used as is, got %d bytes instead of %d", layers[0].Size, len(gguf))
+	}
+
+	if !slices.Contains(statuses, "copying gguf") {
+		t.Errorf("expected copying gguf status, got %v", statuses)
+	}
+}
+
+func TestParseFromZipFileConcurrent(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	gguf, err := os.ReadFile(createBinFile(t, map[string]any{"general.architecture": "llama"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := createZipFileWithFiles(t, map[string][]byte{
+		"model.gguf":     gguf,
+		"tokenizer.json": []byte("{}"),
+	})
+	defer f.Close()
+
+	// creates of the same blob share its import directory
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			zf, err := os.Open(f.Name())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer zf.Close()
+
+			_, errs[i] = parseFromZipFile(context.TODO(), zf, digest, nil, func(api.ProgressResponse) {})
+		}()
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := os.Stat(importsPath(digest)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the import directory to be removed, got %v", err)
+	}
+}
+
+func TestPruneImports(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	kept := "sha256:" + strings.Repeat("a", 64)
+	stale := "sha256:" + strings.Repeat("b", 64)
+
+	blob, err := GetBlobsPath(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(blob, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, digest := range []string{kept, stale} {
+		if err := os.MkdirAll(importsPath(digest), 0o750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(importsPath(digest)+".json", []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneImports(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(envconfig.ModelsDir, "imports"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	if diff := cmp.Diff([]string{"sha256-" + strings.Repeat("a", 64), "sha256-" + strings.Repeat("a", 64) + ".json"}, names); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFromZipFileGGUFErrors(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	gguf, err := os.ReadFile(createBinFile(t, map[string]any{"general.architecture": "llama"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		files map[string][]byte
+		err   string
+	}{
+		{
+			name: "multiple",
+			files: map[string][]byte{
+				"model-q4_0.gguf": gguf,
+				"model-f16.gguf":  gguf,
+			},
+			err: "found multiple gguf files, use FROM with the path of one of them: model-f16.gguf, model-q4_0.gguf",
+		},
+		{
+			name:  "magic",
+			files: map[string][]byte{"model.gguf": []byte("not a gguf file")},
+			err:   "model.gguf: invalid gguf magic",
+		},
+		{
+			name:  "version",
+			files: map[string][]byte{"model.gguf": append([]byte("GGUF"), 9, 0, 0, 0)},
+			err:   "model.gguf: unsupported gguf version 9",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createZipFileWithFiles(t, tt.files)
+			defer f.Close()
+
+			_, err := parseFromZipFile(context.TODO(), f, "", nil, func(api.ProgressResponse) {})
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
 type function struct {
-	Name      string         `json:"name"`
-	Arguments map[string]any `json:"arguments"`
+	Name      string                        `json:"name"`
+	Arguments api.ToolCallFunctionArguments `json:"arguments"`
+}
+
+// writeImportDir writes files to a new directory and zips them
+func writeImportDir(t *testing.T, files map[string][]byte) (string, *os.File) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, b := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, createZipFileWithFiles(t, files)
+}
+
+// safetensors encodes F32 tensors as a safetensors file
+func safetensors(t *testing.T, tensors map[string][]uint64) []byte {
+	t.Helper()
+
+	var data bytes.Buffer
+	headers := make(map[string]any)
+	for name, shape := range tensors {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		offset := data.Len()
+		for i := range n {
+			if err := binary.Write(&data, binary.LittleEndian, float32(i+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		headers[name] = map[string]any{"dtype": "F32", "shape": shape, "data_offsets": []int{offset, data.Len()}}
+	}
+
+	header, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Write(header)
+	b.Write(data.Bytes())
+	return b.Bytes()
+}
+
+func TestParseFromDir(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	gguf, err := os.ReadFile(createBinFile(t, map[string]any{"general.architecture": "llama"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(createBinFile(t, map[string]any{
+		"general.architecture":          "llama",
+		"llama.attention.head_count":    uint32(2),
+		"llama.attention.head_count_kv": uint32(2),
+	}, []llm.Tensor{
+		{Name: "blk.0.attn_v.weight", Shape: []uint64{4, 4}, WriterTo: bytes.NewReader(make([]byte, 64))},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	base, _, err := llm.DecodeGGML(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		files map[string][]byte
+		media string
+	}{
+		{
+			name: "gguf",
+			files: map[string][]byte{
+				"model.gguf":            gguf,
+				"tokenizer/config.json": []byte("{}"),
+			},
+			media: "application/vnd.ollama.image.model",
+		},
+		{
+			name: "adapter",
+			files: map[string][]byte{
+				"adapter_config.json": []byte(`{"peft_type": "LORA", "r": 2, "lora_alpha": 4, "target_modules": ["v_proj"]}`),
+				"adapter_model.safetensors": safetensors(t, map[string][]uint64{
+					"base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight": {2, 4},
+					"base_model.model.model.layers.0.self_attn.v_proj.lora_B.weight": {4, 2},
+				}),
+			},
+			media: "application/vnd.ollama.image.adapter",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, zf := writeImportDir(t, tt.files)
+			defer zf.Close()
+
+			digest := "sha256:" + tt.name
+			fromZip, err := parseFromZipFile(context.TODO(), zf, digest, base, func(api.ProgressResponse) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var statuses []string
+			fromDir, err := parseFromDir(context.TODO(), dir, base, func(resp api.ProgressResponse) {
+				statuses = append(statuses, resp.Status)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fromDir) != 1 || fromDir[0].MediaType != tt.media {
+				t.Fatalf("expected one %s layer, got %v", tt.media, fromDir)
+			}
+
+			if len(fromZip) != 1 || fromZip[0].Digest != fromDir[0].Digest {
+				t.Errorf("expected identical layers, got %v from the zip and %v from the directory", fromZip, fromDir)
+			}
+
+			if tt.media == "application/vnd.ollama.image.adapter" {
+				// the adapter is converted against the base so it can't be reused for another one
+				if blob, ok := intermediateBlobs[digest]; ok {
+					t.Errorf("expected adapter not to be cached, got %s", blob)
+				}
+
+				if diff := cmp.Diff([]string{"v_proj"}, fromDir[0].GGML.KV()[adapterTargetModulesKey]); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+			}
+
+			var size int
+			for _, b := range tt.files {
+				size += len(b)
+			}
+
+			if status := fmt.Sprintf("reading %d files (%s)", len(tt.files), format.HumanBytes2(uint64(size))); !slices.Contains(statuses, status) {
+				t.Errorf("expected status %q, got %v", status, statuses)
+			}
+
+			// the directory is left as is
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != len(tt.files) {
+				t.Errorf("expected %d entries in the directory, got %d", len(tt.files), len(entries))
+			}
+		})
+	}
+}
+
+func TestParseFromDirSymlinks(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	gguf, err := os.ReadFile(createBinFile(t, map[string]any{"general.architecture": "llama"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(outside, gguf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("outside", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.Symlink(outside, filepath.Join(dir, "model.gguf")); err != nil {
+			t.Skip(err)
+		}
+
+		_, err := parseFromDir(context.TODO(), dir, nil, func(api.ProgressResponse) {})
+		if !errors.Is(err, zip.ErrInsecurePath) {
+			t.Errorf("expected %v, got %v", zip.ErrInsecurePath, err)
+		}
+	})
+
+	t.Run("relative", func(t *testing.T) {
+		dir := t.TempDir()
+		rel, err := filepath.Rel(dir, outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink(rel, filepath.Join(dir, "model.gguf")); err != nil {
+			t.Skip(err)
+		}
+
+		_, err = parseFromDir(context.TODO(), dir, nil, func(api.ProgressResponse) {})
+		if !errors.Is(err, zip.ErrInsecurePath) {
+			t.Errorf("expected %v, got %v", zip.ErrInsecurePath, err)
+		}
+	})
+
+	t.Run("inside", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "weights"), gguf, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink("weights", filepath.Join(dir, "model.gguf")); err != nil {
+			t.Skip(err)
+		}
+
+		layers, err := parseFromDir(context.TODO(), dir, nil, func(api.ProgressResponse) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(layers) != 1 || layers[0].Size != int64(len(gguf)) {
+			t.Errorf("expected the gguf to be used as is, got %v", layers)
+		}
+	})
 }
 
 func readFile(t *testing.T, base, name string) *bytes.Buffer {
@@ -134,13 +1184,14 @@ func readFile(t *testing.T, base, name string) *bytes.Buffer {
 func TestExecuteWithTools(t *testing.T) {
 	p := filepath.Join("testdata", "tools")
 	cases := []struct {
-		model  string
-		output string
+		model   string
+		output  string
+		content string
 	}{
-		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`},
+		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, ""},
 		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]
 
-The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`},
+The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`, "The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C."},
 		{"command-r-plus", "Action: ```json" + `
 [
     {
@@ -158,8 +1209,51 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
         }
     }
 ]
-` + "```"},
-		{"firefunction", ` functools[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`},
+` + "```", ""},
+		{"command-r-plus", "I will look up the weather in San Francisco and Toronto.\nAction: ```json" + `
+[
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {
+            "format": "fahrenheit",
+            "location": "San Francisco, CA"
+        }
+    },
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {
+            "format": "celsius",
+            "location": "Toronto, Canada"
+        }
+    }
+]
+` + "```", "I will look up the weather in San Francisco and Toronto."},
+		{"mistral", "```\n" + `[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]` + "\n```", ""},
+		{"mistral", "```tool_code\n" + `[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]` + "\n```", ""},
+		{"firefunction", ` functools[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, ""},
+		{"hermes", `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+</tool_call><tool_call>
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`, ""},
+		{"hermes", `<tool_call>{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}</tool_call>
+
+<tool_call>  {"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}`, ""},
+		{"qwen2.5", `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`, ""},
+		{"signatures", `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+</tool_call><tool_call>
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`, ""},
+		{"qwen2.5", `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+</tool_call>
+<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`, ""},
 	}
 
 	var tools []api.Tool
@@ -177,20 +1271,20 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
 			Type: "function",
 			Function: function{
 				Name: "get_current_weather",
-				Arguments: map[string]any{
+				Arguments: api.NewToolCallFunctionArguments(map[string]any{
 					"format":   "fahrenheit",
 					"location": "San Francisco, CA",
-				},
+				}),
 			},
 		},
 		{
 			Type: "function",
 			Function: function{
 				Name: "get_current_weather",
-				Arguments: map[string]any{
+				Arguments: api.NewToolCallFunctionArguments(map[string]any{
 					"format":   "celsius",
 					"location": "Toronto, Canada",
-				},
+				}),
 			},
 		},
 	}
@@ -202,6 +1296,12 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
 				t.Fatal(err)
 			}
 
+			t.Run("supports tools", func(t *testing.T) {
+				if !tmpl.SupportsTools() {
+					t.Error("expected template to support tools")
+				}
+			})
+
 			t.Run("template", func(t *testing.T) {
 				var actual bytes.Buffer
 				if err := tmpl.Execute(&actual, template.Values{Tools: tools, Messages: messages}); err != nil {
@@ -213,22 +1313,376 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`}
 				}
 			})
 
+			t.Run("isLast", func(t *testing.T) {
+				// the last message found with isLast renders the same as with slice
+				s := readFile(t, p, fmt.Sprintf("%s.gotmpl", tt.model)).String()
+				re := regexp.MustCompile(`eq \(len \(slice \$\.Messages (\$\w+)\)\) 1`)
+				if !re.MatchString(s) {
+					t.Skip("template doesn't find the last message with slice")
+				}
+
+				tmpl, err := template.Parse(re.ReplaceAllString(s, "isLast $1 $.Messages"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var actual bytes.Buffer
+				if err := tmpl.Execute(&actual, template.Values{Tools: tools, Messages: messages}); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(actual.String(), readFile(t, p, fmt.Sprintf("%s.out", tt.model)).String()); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+
 			t.Run("parse", func(t *testing.T) {
 				m := &Model{Template: tmpl}
-				actual, ok := m.parseToolCalls(tt.output)
-				if !ok {
-					t.Fatal("failed to parse tool calls")
+				actual, err := m.parseToolCalls(tt.output, nil)
+				if err != nil {
+					t.Fatal(err)
 				}
 
-				for i := range actual {
+				for i := range actual.ToolCalls {
 					// ID is randomly generated so clear it for comparison
-					actual[i].ID = ""
+					actual.ToolCalls[i].ID = ""
 				}
 
-				if diff := cmp.Diff(actual, calls); diff != "" {
+				if diff := cmp.Diff(actual.ToolCalls, calls); diff != "" {
 					t.Errorf("mismatch (-got +want):\n%s", diff)
 				}
+
+				if content := actual.Content(); content != tt.content {
+					t.Errorf("expected content %q, got %q", tt.content, content)
+				}
 			})
 		})
 	}
 }
+
+func TestSystemSubtree(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "command-r-plus.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := tmpl.SystemSubtree()
+	if sub == nil {
+		t.Fatal("expected a system subtree")
+	}
+
+	var b bytes.Buffer
+	if err := sub.Execute(&b, map[string]any{"System": "You are a helpful assistant."}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff("<|START_OF_TURN_TOKEN|><|SYSTEM_TOKEN|>You are a helpful assistant.<|END_OF_TURN_TOKEN|>", b.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestToolCallsRoundTrip(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+
+	var calls []api.ToolCall
+	for _, location := range []string{"San Francisco, CA", "Toronto, Canada"} {
+		var call api.ToolCall
+		call.Type = "function"
+		call.Function.Name = "get_current_weather"
+		call.Function.Arguments = api.NewToolCallFunctionArguments(map[string]any{"format": "celsius", "location": location})
+		calls = append(calls, call)
+	}
+
+	render := func(t *testing.T, tmpl *template.Template, calls []api.ToolCall) string {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, template.Values{Messages: []api.Message{
+			{Role: "user", Content: "What's the weather like today in San Francisco and Toronto?"},
+			{Role: "assistant", ToolCalls: calls},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.String()
+	}
+
+	for _, model := range []string{"command-r-plus", "firefunction", "hermes", "mistral", "qwen2.5"} {
+		t.Run(model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the rendered history is what the model would have emitted
+			expect := render(t, tmpl, calls)
+
+			m := &Model{Template: tmpl}
+			result, err := m.parseToolCalls(expect, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed := result.ToolCalls
+			for i := range parsed {
+				parsed[i].ID = ""
+			}
+
+			if diff := cmp.Diff(calls, parsed); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if actual := render(t, tmpl, parsed); actual != expect {
+				t.Errorf("expected re-rendered tool calls to be identical\nwant: %q\n got: %q", expect, actual)
+			}
+		})
+	}
+}
+
+func TestParseToolCallsArgumentKeys(t *testing.T) {
+	cases := []struct {
+		key      string
+		template string
+	}{
+		{"arguments", `{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}`},
+		{"parameters", `{{ range .ToolCalls }}{"tool_name": "{{ .Function.Name }}", "parameters": {{ json .Function.Arguments }}}{{ end }}`},
+		{"args", `{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "args": {{ json .Function.Arguments }}, "index": 0}{{ end }}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.key, func(t *testing.T) {
+			tmpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			name := "name"
+			if tt.key == "parameters" {
+				name = "tool_name"
+			}
+
+			result, err := m.parseToolCalls(fmt.Sprintf(`[{"%s": "get_current_weather", "%s": {"location": "Paris"}}]`, name, tt.key), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := result.ToolCalls
+
+			if len(actual) != 1 {
+				t.Fatalf("expected 1 tool call, got %d", len(actual))
+			}
+
+			if diff := cmp.Diff(function{
+				Name:      "get_current_weather",
+				Arguments: api.NewToolCallFunctionArguments(map[string]any{"location": "Paris"}),
+			}, function(actual[0].Function)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseToolCallsPartial(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Model{Template: tmpl}
+
+	t.Run("truncated", func(t *testing.T) {
+		actual, err := m.parseToolCalls(`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"cel`, nil)
+		if err == nil {
+			t.Error("expected error")
+		}
+
+		if actual.Content() != "" {
+			t.Errorf("expected no content, got %q", actual.Content())
+		}
+
+		if len(actual.ToolCalls) != 1 {
+			t.Fatalf("expected 1 tool call, got %d", len(actual.ToolCalls))
+		}
+
+		if actual.ToolCalls[0].Function.Arguments.Get("location") != "San Francisco, CA" {
+			t.Errorf("unexpected tool call %v", actual.ToolCalls[0])
+		}
+	})
+
+	t.Run("no tool calls", func(t *testing.T) {
+		actual, err := m.parseToolCalls("The temperature in San Francisco, CA is 70°F.", nil)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(actual.ToolCalls) > 0 {
+			t.Errorf("expected no tool calls, got %v", actual.ToolCalls)
+		}
+	})
+}
+
+func TestParseToolCallsStableIDs(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stable := envconfig.StableToolCallIDs
+	t.Cleanup(func() { envconfig.StableToolCallIDs = stable })
+	envconfig.StableToolCallIDs = true
+
+	m := &Model{Template: tmpl}
+	s := `[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"location":"San Francisco, CA","format":"fahrenheit"}}]`
+
+	r, err := m.parseToolCalls(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := r.ToolCalls
+
+	r, err = m.parseToolCalls(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := r.ToolCalls
+
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("mismatch (-first +second):\n%s", diff)
+	}
+
+	if len(first) != 2 {
+		t.Fatalf("expected 2 tool calls, got %d", len(first))
+	}
+
+	if !regexp.MustCompile(`^call_[A-Za-z0-9_-]{24}$`).MatchString(first[0].ID) {
+		t.Errorf("unexpected id %q", first[0].ID)
+	}
+
+	if first[0].ID == first[1].ID {
+		t.Errorf("expected identical calls to have distinct ids, got %q", first[0].ID)
+	}
+
+	// the order of the arguments doesn't change the id
+	if id := toolCallID(first[1], 0); id != first[0].ID {
+		t.Errorf("expected %q for reordered arguments, got %q", first[0].ID, id)
+	}
+}
+
+func TestParseThinking(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ if eq .Role "assistant" }}{{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ end }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Model{Template: tmpl}
+
+	cases := []struct {
+		name     string
+		output   string
+		thinking string
+		content  string
+	}{
+		{"none", "Paris is the capital of France.", "", "Paris is the capital of France."},
+		{"thinking", "<think>\nThe user asks about France.\n</think>\n\nParis.", "The user asks about France.", "Paris."},
+		{"nested", "<think>Maybe <think>again</think> then</think>Paris.", "Maybe <think>again</think> then", "Paris."},
+		{"unclosed", "<think>The user asks about", "The user asks about", ""},
+		{"unclosed nested", "<think>a <think>b</think> c", "a <think>b</think> c", ""},
+		{"leading text", "Sure. <think>hmm</think> Paris.", "hmm", "Sure.  Paris."},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			thinking, content := m.parseThinking(tt.output)
+			if diff := cmp.Diff(tt.thinking, thinking); diff != "" {
+				t.Errorf("thinking mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.content, content); diff != "" {
+				t.Errorf("content mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("untagged", func(t *testing.T) {
+		tmpl, err := template.Parse(`{{ range .Messages }}{{ .Content }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := &Model{Template: tmpl}
+		if thinking, content := m.parseThinking("<think>hmm</think>Paris."); thinking != "" || content != "<think>hmm</think>Paris." {
+			t.Errorf("expected the output as content, got %q and %q", thinking, content)
+		}
+	})
+}
+
+func TestToolCallStream(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Model{Template: tmpl}
+	call := `[{"name": "get_current_weather", "arguments": {"location": "Paris"}}]`
+
+	cases := []struct {
+		name   string
+		chunks []string
+		sent   []string
+		rest   string
+		calls  int
+	}{
+		{
+			name:   "text",
+			chunks: []string{"The weather ", "is nice.\n", "Enjoy!"},
+			sent:   []string{"", "The weather is nice.\n", ""},
+			rest:   "Enjoy!",
+		},
+		{
+			name:   "tool calls",
+			chunks: []string{"Let me ", "check.\n", "[TOOL_", "CALLS] " + call},
+			sent:   []string{"", "Let me check.\n", "", ""},
+			calls:  1,
+		},
+		{
+			name:   "text after tool calls",
+			chunks: []string{"Let me check.\n", "[TOOL_CALLS] " + call, "\nDone."},
+			sent:   []string{"Let me check.\n", "", ""},
+			rest:   "\n\nDone.",
+			calls:  1,
+		},
+		{
+			name:   "brackets",
+			chunks: []string{"It's [", "70°F].\n", "Enjoy!"},
+			sent:   []string{"", "", ""},
+			rest:   "It's [70°F].\nEnjoy!",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := m.toolCallStream(nil)
+
+			var sent []string
+			for _, chunk := range tt.chunks {
+				sent = append(sent, s.write(chunk))
+			}
+
+			if diff := cmp.Diff(tt.sent, sent); diff != "" {
+				t.Errorf("sent mismatch (-want +got):\n%s", diff)
+			}
+
+			rest, calls := s.close()
+			if diff := cmp.Diff(tt.rest, rest); diff != "" {
+				t.Errorf("rest mismatch (-want +got):\n%s", diff)
+			}
+
+			if len(calls) != tt.calls {
+				t.Fatalf("expected %d tool calls, got %d", tt.calls, len(calls))
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// packMediaType is the media type of the layer listing the members of a model pack
+const packMediaType = "application/vnd.ollama.image.pack"
+
+var errNotPack = errors.New("not a model pack")
+
+// members returns the members of the model pack m or nil if m isn't a pack
+func (m *Manifest) members() ([]api.PackMember, error) {
+	for _, layer := range m.Layers {
+		if layer.MediaType != packMediaType {
+			continue
+		}
+
+		f, err := layer.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		var members []api.PackMember
+		if err := json.NewDecoder(f).Decode(&members); err != nil {
+			return nil, err
+		}
+
+		return members, nil
+	}
+
+	return nil, nil
+}
+
+// manifestDigest is the digest of m as it's marshaled when pushed to a
+// registry. it doesn't depend on how the local manifest file was written but
+// may differ from the registry's digest of a manifest pushed by another client
+func manifestDigest(m *Manifest) (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b)), nil
+}
+
+// CreatePack creates the model pack name from the local models in members
+func CreatePack(name model.Name, members []model.Name, fn func(api.ProgressResponse)) error {
+	if len(members) == 0 {
+		return errors.New("a model pack needs at least one member")
+	}
+
+	var pack []api.PackMember
+	seen := map[string]bool{name.Filepath(): true}
+	for _, n := range members {
+		if seen[n.Filepath()] {
+			return fmt.Errorf("duplicate pack member %s", n.DisplayShortest())
+		}
+		seen[n.Filepath()] = true
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("adding %s", n.DisplayShortest())})
+		m, err := ParseNamedManifest(n)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("pack member %s not found", n.DisplayShortest())
+		} else if err != nil {
+			return err
+		}
+
+		if ms, err := m.members(); err != nil {
+			return err
+		} else if ms != nil {
+			return fmt.Errorf("pack member %s is a model pack", n.DisplayShortest())
+		}
+
+		digest, err := manifestDigest(m)
+		if err != nil {
+			return err
+		}
+
+		pack = append(pack, api.PackMember{Model: n.DisplayShortest(), Digest: digest})
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(pack); err != nil {
+		return err
+	}
+
+	layer, err := NewLayer(&b, packMediaType)
+	if err != nil {
+		return err
+	}
+
+	config := ConfigV2{
+		ModelFormat:  "pack",
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: RootFS{
+			Type:    "layers",
+			DiffIDs: []string{layer.Digest},
+		},
+	}
+
+	b.Reset()
+	if err := json.NewEncoder(&b).Encode(config); err != nil {
+		return err
+	}
+
+	configLayer, err := NewLayer(&b, "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "writing manifest"})
+	if err := WriteManifest(name, configLayer, []*Layer{layer}); err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "success"})
+	return nil
+}
+
+// PullPack pulls the model pack name and then each of its members by the
+// digest recorded in the pack
+func PullPack(ctx context.Context, name string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	// success is reported once every member is pulled
+	quiet := func(resp api.ProgressResponse) {
+		if resp.Status != "success" {
+			fn(resp)
+		}
+	}
+
+	if err := PullModel(ctx, name, regOpts, quiet); err != nil {
+		return err
+	}
+
+	m, _, err := GetManifest(ParseModelPath(name))
+	if err != nil {
+		return err
+	}
+
+	members, err := m.members()
+	if err != nil {
+		return err
+	} else if members == nil {
+		return fmt.Errorf("%s: %w", name, errNotPack)
+	}
+
+	for i, member := range members {
+		status := fmt.Sprintf("pulling %s (%d/%d)", member.Model, i+1, len(members))
+		fn(api.ProgressResponse{Status: status})
+		if err := pullModel(ctx, ParseModelPath(member.Model), member.Digest, regOpts, func(resp api.ProgressResponse) {
+			if resp.Digest == "" {
+				resp.Status = fmt.Sprintf("%s: %s", status, resp.Status)
+			}
+
+			quiet(resp)
+		}); err != nil {
+			return fmt.Errorf("pack member %s: %w", member.Model, err)
+		}
+	}
+
+	fn(api.ProgressResponse{Status: "success"})
+	return nil
+}
+
+// removePackMembers removes the members of the deleted model pack name which
+// aren't members of another pack. members which no longer match the pack are
+// kept since they've been replaced since the pack was created
+func removePackMembers(name model.Name, members []api.PackMember) error {
+	ms, err := Manifests()
+	if err != nil {
+		return err
+	}
+
+	shared := make(map[string]bool)
+	for n, m := range ms {
+		if n.Filepath() == name.Filepath() {
+			continue
+		}
+
+		others, err := m.members()
+		if err != nil {
+			slog.Warn("bad model pack", "name", n, "error", err)
+			continue
+		}
+
+		for _, member := range others {
+			shared[model.ParseName(member.Model).Filepath()] = true
+		}
+	}
+
+	for _, member := range members {
+		n := model.ParseName(member.Model)
+		if !n.IsValid() || shared[n.Filepath()] {
+			continue
+		}
+
+		m, err := ParseNamedManifest(n)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if digest, err := manifestDigest(m); err != nil {
+			return err
+		} else if digest != member.Digest {
+			slog.Debug("keeping replaced pack member", "name", n, "digest", digest)
+			continue
+		}
+
+		if err := m.Remove(); err != nil {
+			return err
+		}
+
+		if err := m.RemoveLayers(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
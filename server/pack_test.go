@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+// newPackRegistry serves the manifests and blobs in the models directory p
+// the way they would be pushed to a registry. manifests are served by tag or
+// by digest
+func newPackRegistry(t *testing.T, p string) string {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repository, reference, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+		if ok {
+			ns, repo, _ := strings.Cut(repository, "/")
+			tag := reference
+			if strings.HasPrefix(reference, "sha256:") {
+				tag = "*"
+			}
+
+			matches, _ := filepath.Glob(filepath.Join(p, "manifests", "*", ns, repo, tag))
+			for _, match := range matches {
+				f, err := os.Open(match)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				defer f.Close()
+
+				var m Manifest
+				if err := json.NewDecoder(f).Decode(&m); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				if digest, _ := manifestDigest(&m); tag != "*" || digest == reference {
+					b, _ := json.Marshal(m)
+					w.Write(b)
+					return
+				}
+			}
+
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, digest, ok := strings.Cut(r.URL.Path, "/blobs/"); ok {
+			http.ServeFile(w, r, filepath.Join(p, "blobs", strings.ReplaceAll(digest, ":", "-")))
+			return
+		}
+
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Host
+}
+
+func createPackMembers(t *testing.T, s *Server, names ...string) {
+	t.Helper()
+
+	for i, name := range names {
+		w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s\nSYSTEM %d", createBinFile(t, nil, nil), i),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestCreatePack(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+
+	var s Server
+	createPackMembers(t, &s, "chat", "embed")
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:   "team/stack:v1",
+		Pack:   []string{"chat", "embed"},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	w = createRequest(t, s.ShowModelHandler, api.ShowRequest{Model: "team/stack:v1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	var show api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&show); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, member := range show.Members {
+		names = append(names, member.Model)
+
+		m, err := ParseNamedManifest(model.ParseName(member.Model))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if digest, _ := manifestDigest(m); member.Digest != digest {
+			t.Errorf("expected digest %s for %s, got %s", digest, member.Model, member.Digest)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"chat:latest", "embed:latest"}, names); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if show.Details.Format != "pack" {
+		t.Errorf("expected format pack, got %q", show.Details.Format)
+	}
+
+	w = createRequest(t, s.ListModelsHandler, nil)
+	var list api.ListResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range list.Models {
+		if (m.Name == "team/stack:v1") != (len(m.Members) == 2) {
+			t.Errorf("unexpected members for %s: %v", m.Name, m.Members)
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name string
+			pack []string
+			err  string
+		}{
+			{"missing", []string{"chat", "rerank"}, "pack member rerank:latest not found"},
+			{"duplicate", []string{"chat", "chat:latest"}, "duplicate pack member chat:latest"},
+			{"self", []string{"chat", "other"}, "duplicate pack member other:latest"},
+			{"nested", []string{"team/stack:v1"}, "pack member team/stack:v1 is a model pack"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+					Name:   "other",
+					Pack:   tt.pack,
+					Stream: &stream,
+				})
+
+				if !strings.Contains(w.Body.String(), tt.err) {
+					t.Errorf("expected error containing %q, got %s", tt.err, w.Body.String())
+				}
+			})
+		}
+	})
+}
+
+func TestPullPack(t *testing.T) {
+	src := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", src)
+	envconfig.LoadConfig()
+
+	host := newPackRegistry(t, src)
+
+	var s Server
+	createPackMembers(t, &s, host+"/library/chat", host+"/library/embed")
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:   host + "/team/stack:v1",
+		Pack:   []string{host + "/library/chat", host + "/library/embed"},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	dst := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dst)
+	envconfig.LoadConfig()
+
+	t.Run("not a pack", func(t *testing.T) {
+		w := createRequest(t, s.PullModelHandler, api.PullRequest{
+			Model:    host + "/library/chat",
+			Insecure: true,
+			Pack:     true,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, actual %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	w = createRequest(t, s.PullModelHandler, api.PullRequest{
+		Model:    host + "/team/stack:v1",
+		Insecure: true,
+		Pack:     true,
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, name := range []string{"library/chat/latest", "library/embed/latest", "team/stack/v1"} {
+		matches, _ := filepath.Glob(filepath.Join(dst, "manifests", "*", filepath.FromSlash(name)))
+		if len(matches) != 1 {
+			t.Errorf("expected %s to be pulled", name)
+		}
+	}
+
+	m, err := ParseNamedManifest(model.ParseName(host + "/team/stack:v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := m.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range members {
+		mm, err := ParseNamedManifest(model.ParseName(member.Model))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if digest, _ := manifestDigest(mm); digest != member.Digest {
+			t.Errorf("expected digest %s for %s, got %s", member.Digest, member.Model, digest)
+		}
+	}
+}
+
+func TestPullModelManifestDigest(t *testing.T) {
+	b := []byte(`{"schemaVersion":2}`)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(b)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp := ParseModelPath(u.Host + "/library/chat")
+	mp.ProtocolScheme = "http"
+
+	if _, err := pullModelManifest(context.TODO(), mp, fmt.Sprintf("sha256:%x", sha256.Sum256(b)), &registryOptions{Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pullModelManifest(context.TODO(), mp, "sha256:"+strings.Repeat("0", 64), &registryOptions{Insecure: true}); !errors.Is(err, errDigestMismatch) {
+		t.Errorf("expected %v, got %v", errDigestMismatch, err)
+	}
+}
+
+func TestDeletePackMembers(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+
+	var s Server
+	createPackMembers(t, &s, "chat", "embed", "rerank")
+
+	for name, members := range map[string][]string{
+		"stack-a": {"chat", "embed"},
+		"stack-b": {"embed", "rerank"},
+	} {
+		w := createRequest(t, s.CreateModelHandler, api.CreateRequest{Name: name, Pack: members, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	manifests := func(names ...string) []string {
+		var paths []string
+		for _, name := range names {
+			paths = append(paths, filepath.Join(p, "manifests", "registry.ollama.ai", "library", name, "latest"))
+		}
+		return paths
+	}
+
+	// replacing rerank after the pack is created keeps it when the pack is deleted
+	createPackMembers(t, &s, "other", "rerank")
+
+	w := createRequest(t, s.DeleteModelHandler, api.DeleteRequest{Model: "stack-a", Members: true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	// embed is still a member of stack-b
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), manifests("embed", "other", "rerank", "stack-b"))
+
+	w = createRequest(t, s.DeleteModelHandler, api.DeleteRequest{Model: "stack-b"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), manifests("embed", "other", "rerank"))
+}
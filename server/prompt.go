@@ -15,7 +15,7 @@ type tokenizeFunc func(context.Context, string) ([]int, error)
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
 // latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, choice *api.ToolChoice) (prompt string, images []llm.ImageData, _ error) {
 	var system []api.Message
 	// always include the last message
 	n := len(msgs) - 1
@@ -29,7 +29,7 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		}
 
 		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools}); err != nil {
+		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools, ToolChoice: choice, KeepConsecutiveMessages: opts.SeparateMessages}); err != nil {
 			return "", nil, err
 		}
 
@@ -57,17 +57,22 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 
 	// truncate any messages that do not fit into the context window
 	var b bytes.Buffer
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[n:]...), Tools: tools}); err != nil {
+	values := template.Values{Messages: append(system, msgs[n:]...), Tools: tools, ToolChoice: choice, KeepConsecutiveMessages: opts.SeparateMessages}
+	if err := m.Template.Execute(&b, values); err != nil {
 		return "", nil, err
 	}
 
-	for _, m := range msgs[n:] {
-		for _, i := range m.Images {
-			images = append(images, llm.ImageData{
-				ID:   len(images),
-				Data: i,
-			})
-		}
+	var data []api.ImageData
+	for _, m := range values.Messages {
+		data = append(data, m.Images...)
+	}
+
+	// images are ordered by the tags referring to them in the prompt
+	for _, i := range m.Template.ImageIndexes(values) {
+		images = append(images, llm.ImageData{
+			ID:   len(images),
+			Data: data[i],
+		})
 	}
 
 	return b.String(), images, nil
@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -192,7 +194,7 @@ func TestChatPrompt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
 			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
-			prompt, images, err := chatPrompt(context.TODO(), &model, tokenize, &opts, tt.msgs, nil)
+			prompt, images, err := chatPrompt(context.TODO(), &model, tokenize, &opts, tt.msgs, nil, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -221,3 +223,78 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestChatPromptToolCallsDeterministic(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []api.Message
+	if err := json.Unmarshal([]byte(`[
+		{"role": "user", "content": "Book me a trip to Tokyo"},
+		{"role": "assistant", "tool_calls": [{"function": {"name": "book", "arguments": {"to": "Tokyo", "from": "Paris", "options": {"nights": 3, "class": "economy", "airports": ["NRT", "HND"]}}}}]},
+		{"role": "tool", "content": "booked"},
+		{"role": "user", "content": "Thanks!"}
+	]`), &msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+
+	var expect string
+	for i := range 50 {
+		prompt, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			expect = prompt
+			if !strings.Contains(prompt, `{"to":"Tokyo","from":"Paris","options":{"nights":3,"class":"economy","airports":["NRT","HND"]}}`) {
+				t.Fatalf("expected arguments in request order, got %q", prompt)
+			}
+		} else if prompt != expect {
+			t.Fatalf("render %d differs\nwant: %q\n got: %q", i, expect, prompt)
+		}
+	}
+}
+
+func TestChatPromptSeparateMessages(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}<|end|>{{ end }}<|assistant|>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "Translate: cat"},
+		{Role: "user", Content: "Translate: dog"},
+	}
+
+	cases := []struct {
+		name     string
+		separate bool
+		expect   string
+	}{
+		{"merged", false, "<|user|>Translate: cat\n\nTranslate: dog<|end|><|assistant|>"},
+		{"separate", true, "<|user|>Translate: cat<|end|><|user|>Translate: dog<|end|><|assistant|>"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.DefaultOptions()
+			opts.SeparateMessages = tt.separate
+
+			prompt, _, err := chatPrompt(context.TODO(), &model, tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
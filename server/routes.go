@@ -116,16 +116,23 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	if req.Format != "" && req.Format != "json" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be empty or \"json\""})
 		return
-	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
+	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0 || req.Suffix != "") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, context, or suffix"})
 		return
 	}
 
 	caps := []Capability{CapabilityCompletion}
+	if req.Suffix != "" && req.Template == "" {
+		caps = append(caps, CapabilityInsert)
+	}
+
 	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
+	} else if errors.Is(err, errCapabilityInsert) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support insert", req.Model)})
+		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -183,7 +190,15 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			b.WriteString(s)
 		}
 
-		if err := tmpl.Execute(&b, template.Values{Messages: msgs}); err != nil {
+		values := template.Values{Messages: msgs}
+		if req.Suffix != "" {
+			values.Prompt, values.Suffix = req.Prompt, req.Suffix
+		}
+
+		if err := tmpl.Execute(&b, values); errors.Is(err, template.ErrNoSuffix) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -198,7 +213,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+		if err := completion(c.Request.Context(), r, llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
 			Format:  req.Format,
@@ -265,9 +280,15 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
-		if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-			r.ToolCalls = toolCalls
-			r.Response = ""
+		parsed, err := m.parseToolCalls(sb.String(), toolCallIDs(opts, prompt))
+		if err != nil {
+			slog.Debug("failed to parse tool calls", "error", err)
+		}
+
+		if len(parsed.ToolCalls) > 0 {
+			// keep any text the model wrote around its tool calls
+			r.ToolCalls = parsed.ToolCalls
+			r.Response = parsed.Content()
 		}
 
 		c.JSON(http.StatusOK, r)
@@ -315,6 +336,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	if req.Chunking != nil && req.Chunking.Pool != "" && req.Chunking.Pool != "mean" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported chunking pool %q", req.Chunking.Pool)})
+		return
+	}
+
 	if len(input) == 0 {
 		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
 		return
@@ -332,47 +358,137 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+	if req.Chunking != nil && (req.Chunking.Overlap < 0 || req.Chunking.Overlap >= ctxLen) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunking overlap must be between 0 and %d", ctxLen-1)})
+		return
+	}
+
+	resp, err := embedInputs(c.Request.Context(), r, input, ctxLen, truncate, req.Chunking)
+	if errors.Is(err, errInputTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp.Model = req.Model
+	c.JSON(http.StatusOK, resp)
+}
+
+var errInputTooLong = errors.New("input length exceeds maximum context length")
+
+// embedInputs embeds each input with at most ctxLen tokens. Longer inputs are
+// split into chunks if chunking is set, truncated if truncate is set and
+// rejected otherwise
+func embedInputs(ctx context.Context, r llm.LlamaServer, input []string, ctxLen int, truncate bool, chunking *api.EmbedChunking) (*api.EmbedResponse, error) {
+	var texts []string
+	var chunks []api.EmbedChunk
+	stats := make([]api.EmbedInputStats, len(input))
 	for i, s := range input {
-		tokens, err := r.Tokenize(c.Request.Context(), s)
+		tokens, err := r.Tokenize(ctx, s)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return nil, err
 		}
 
-		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+		stats[i].Tokens = len(tokens)
+
+		spans := [][2]int{{0, len(tokens)}}
 		if len(tokens) > ctxLen {
-			if !truncate {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
-				return
+			switch {
+			case chunking != nil:
+				spans = chunkTokens(len(tokens), ctxLen, chunking.Overlap)
+			case truncate:
+				spans = [][2]int{{0, ctxLen}}
+				stats[i].Truncated = len(tokens) - ctxLen
+			default:
+				return nil, errInputTooLong
 			}
+		}
 
-			tokens = tokens[:ctxLen]
-			s, err = r.Detokenize(c.Request.Context(), tokens)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+		for _, span := range spans {
+			if span[1]-span[0] < len(tokens) {
+				s, err = r.Detokenize(ctx, tokens[span[0]:span[1]])
+				if err != nil {
+					return nil, err
+				}
 			}
+
+			texts = append(texts, s)
+			chunks = append(chunks, api.EmbedChunk{Input: i, Start: span[0], End: span[1]})
 		}
 
-		input[i] = s
+		if chunking != nil {
+			stats[i].Chunks = len(spans)
+		}
 	}
-	embeddings, err := r.Embed(c.Request.Context(), input)
 
+	embeddings, err := r.Embed(ctx, texts)
 	if err != nil {
 		slog.Error("embedding generation failed", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
-		return
+		return nil, errors.New("failed to generate embedding")
 	}
 
 	for i, e := range embeddings {
 		embeddings[i] = normalize(e)
 	}
 
-	resp := api.EmbedResponse{
-		Model:      req.Model,
-		Embeddings: embeddings,
+	resp := api.EmbedResponse{Embeddings: embeddings, Inputs: stats}
+	switch {
+	case chunking == nil:
+	case chunking.Pool == "mean":
+		pooled := make([][]float32, len(input))
+		for i := range input {
+			var vecs [][]float32
+			for j, chunk := range chunks {
+				if chunk.Input == i {
+					vecs = append(vecs, embeddings[j])
+				}
+			}
+
+			pooled[i] = meanPool(vecs)
+		}
+
+		resp.Embeddings = pooled
+	default:
+		resp.Chunks = chunks
 	}
-	c.JSON(http.StatusOK, resp)
+
+	return &resp, nil
+}
+
+// chunkTokens splits n tokens into spans of at most size tokens where
+// consecutive spans share overlap tokens. overlap must be less than size
+func chunkTokens(n, size, overlap int) [][2]int {
+	var spans [][2]int
+	for start := 0; ; start += size - overlap {
+		end := min(start+size, n)
+		spans = append(spans, [2]int{start, end})
+		if end == n {
+			return spans
+		}
+	}
+}
+
+// meanPool averages vecs and normalizes the result
+func meanPool(vecs [][]float32) []float32 {
+	if len(vecs) == 0 {
+		return nil
+	}
+
+	mean := make([]float32, len(vecs[0]))
+	for _, vec := range vecs {
+		for i, v := range vec {
+			mean[i] += v
+		}
+	}
+
+	for i := range mean {
+		mean[i] /= float32(len(vecs))
+	}
+
+	return normalize(mean)
 }
 
 func normalize(vec []float32) []float32 {
@@ -452,6 +568,30 @@ func (s *Server) PullModelHandler(c *gin.Context) {
 		return
 	}
 
+	regOpts := &registryOptions{
+		Insecure: req.Insecure,
+	}
+
+	if req.Quantize != "" {
+		tag, err := resolveQuantizationTag(c.Request.Context(), ParseModelPath(name.String()), req.Quantize, regOpts)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name.DisplayShortest())})
+			return
+		case errors.Is(err, errQuantizationNotFound):
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, errQuantizationAmbiguous):
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		name.Tag = tag
+	}
+
 	if err := checkNameExists(name); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -464,14 +604,17 @@ func (s *Server) PullModelHandler(c *gin.Context) {
 			ch <- r
 		}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
-		}
-
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
+		pull := PullModel
+		if req.Pack {
+			pull = PullPack
+		}
+
+		if err := pull(ctx, name.DisplayShortest(), regOpts, fn); errors.Is(err, errNotPack) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+		} else if err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
@@ -484,6 +627,36 @@ func (s *Server) PullModelHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+func (s *Server) LibraryTagsHandler(c *gin.Context) {
+	path, ok := strings.CutSuffix(strings.TrimPrefix(c.Param("model"), "/"), "/tags")
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	name := model.ParseName(path)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+		return
+	}
+
+	regOpts := &registryOptions{
+		Insecure: c.Query("insecure") == "true",
+	}
+
+	tags, err := getLibraryTags(c.Request.Context(), ParseModelPath(name.String()), regOpts)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", path)})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.LibraryTagsResponse{Model: path, Tags: tags})
+}
+
 func (s *Server) PushModelHandler(c *gin.Context) {
 	var req api.PushRequest
 	err := c.ShouldBindJSON(&req)
@@ -569,6 +742,11 @@ func (s *Server) CreateModelHandler(c *gin.Context) {
 		return
 	}
 
+	if len(r.Pack) > 0 {
+		s.createPack(c, name, r)
+		return
+	}
+
 	if r.Path == "" && r.Modelfile == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
 		return
@@ -603,7 +781,43 @@ func (s *Server) CreateModelHandler(c *gin.Context) {
 		defer cancel()
 
 		quantization := cmp.Or(r.Quantize, r.Quantization)
-		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); err != nil {
+		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); errors.Is(err, ErrArchiveTooLarge) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusRequestEntityTooLarge}
+		} else if errors.Is(err, ErrInsufficientDiskSpace) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusInsufficientStorage}
+		} else if errors.As(err, new(*template.SourceError)) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+		} else if err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if r.Stream != nil && !*r.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) createPack(c *gin.Context, name model.Name, r api.CreateRequest) {
+	members := make([]model.Name, len(r.Pack))
+	for i, member := range r.Pack {
+		members[i] = model.ParseName(member)
+		if !members[i].IsValid() {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("pack member %q is invalid", member)})
+			return
+		}
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(resp api.ProgressResponse) {
+			ch <- resp
+		}
+
+		if err := CreatePack(name, members, fn); err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
@@ -638,6 +852,15 @@ func (s *Server) DeleteModelHandler(c *gin.Context) {
 		return
 	}
 
+	var members []api.PackMember
+	if r.Members {
+		members, err = m.members()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if err := m.Remove(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -647,6 +870,11 @@ func (s *Server) DeleteModelHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	if err := removePackMembers(n, members); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 }
 
 func (s *Server) ShowModelHandler(c *gin.Context) {
@@ -692,6 +920,27 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		return nil, err
 	}
 
+	n := model.ParseName(req.Model)
+	if !n.IsValid() {
+		return nil, fmt.Errorf("invalid model name")
+	}
+
+	manifest, err := ParseNamedManifest(n)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := manifest.members()
+	if err != nil {
+		return nil, err
+	} else if members != nil {
+		return &api.ShowResponse{
+			Details:    api.ModelDetails{Format: m.Config.ModelFormat},
+			ModifiedAt: manifest.fi.ModTime(),
+			Members:    members,
+		}, nil
+	}
+
 	modelDetails := api.ModelDetails{
 		ParentModel:       m.ParentModel,
 		Format:            m.Config.ModelFormat,
@@ -707,17 +956,7 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 
 	msgs := make([]api.Message, len(m.Messages))
 	for i, msg := range m.Messages {
-		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
-	}
-
-	n := model.ParseName(req.Model)
-	if !n.IsValid() {
-		return nil, fmt.Errorf("invalid model name")
-	}
-
-	manifest, err := ParseNamedManifest(n)
-	if err != nil {
-		return nil, err
+		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content, When: msg.When}
 	}
 
 	resp := &api.ShowResponse{
@@ -820,6 +1059,11 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 			continue
 		}
 
+		members, err := m.members()
+		if err != nil {
+			slog.Warn("bad model pack", "name", n, "error", err)
+		}
+
 		// tag should never be masked
 		models = append(models, api.ListModelResponse{
 			Model:      n.DisplayShortest(),
@@ -834,6 +1078,7 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 				ParameterSize:     cf.ModelType,
 				QuantizationLevel: cf.FileType,
 			},
+			Members: members,
 		})
 	}
 
@@ -1045,11 +1290,14 @@ func (s *Server) GenerateRoutes() http.Handler {
 	r.Use(
 		cors.New(config),
 		allowedHostsMiddleware(s.addr),
+		clientMiddleware,
 	)
 
 	r.POST("/api/pull", s.PullModelHandler)
+	r.GET("/api/library/*model", s.LibraryTagsHandler)
 	r.POST("/api/generate", s.GenerateHandler)
 	r.POST("/api/chat", s.ChatHandler)
+	r.POST("/api/render", s.RenderHandler)
 	r.POST("/api/embed", s.EmbedHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
 	r.POST("/api/create", s.CreateModelHandler)
@@ -1191,7 +1439,12 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 			}
 		case gin.H:
 			if errorMsg, ok := r["error"].(string); ok {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": errorMsg})
+				status, ok := r["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				c.JSON(status, gin.H{"error": errorMsg})
 				return
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error format in progress response"})
@@ -1251,6 +1504,7 @@ func (s *Server) ProcessHandler(c *gin.Context) {
 			Digest:    model.Digest,
 			Details:   modelDetails,
 			ExpiresAt: v.expiresAt,
+			Clients:   s.sched.clients(v.modelPath),
 		}
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
@@ -1271,6 +1525,81 @@ func (s *Server) ProcessHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
+// RenderHandler renders the prompt a chat request would be given to the model
+// without loading it. the whole conversation is rendered since the messages
+// that fit in the context can't be counted without the model's tokenizer
+func (s *Server) RenderHandler(c *gin.Context) {
+	var req api.RenderRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	m, err := GetModel(req.Model)
+	switch {
+	case os.IsNotExist(err):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts, err := modelOptions(m, nil)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// render the messages as ChatHandler does
+	noTools := req.ToolChoice != nil && req.ToolChoice.Mode == "none"
+	if len(req.Messages) == 0 || req.Messages[0].Role != "system" {
+		req.Messages = append([]api.Message{{Role: "system", Content: m.System}}, req.Messages...)
+	}
+
+	if msgs := m.conditionalMessages(len(req.Tools) > 0 && !noTools); len(msgs) > 0 {
+		i := slices.IndexFunc(req.Messages, func(msg api.Message) bool { return msg.Role != "system" })
+		if i < 0 {
+			i = len(req.Messages)
+		}
+
+		req.Messages = slices.Insert(req.Messages, i, msgs...)
+	}
+
+	values := template.Values{Messages: req.Messages, Tools: req.Tools, ToolChoice: req.ToolChoice, KeepConsecutiveMessages: opts.SeparateMessages}
+
+	resp := api.RenderResponse{Model: req.Model}
+	if req.Trace {
+		var traces []template.Trace
+		resp.Prompt, traces, err = m.Template.ExecuteTrace(values)
+		for _, t := range traces {
+			resp.Trace = append(resp.Trace, api.RenderTrace{Start: t.Start, End: t.End, Node: t.Node, Message: t.Message})
+		}
+	} else {
+		var b strings.Builder
+		err = m.Template.Execute(&b, values)
+		resp.Prompt = b.String()
+	}
+
+	if errors.Is(err, template.ErrNoPrompt) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 
@@ -1283,8 +1612,21 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if choice := req.ToolChoice; choice != nil && choice.Mode == "function" && !slices.ContainsFunc(req.Tools, func(t api.Tool) bool {
+		return t.Function.Name == choice.Name
+	}) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tool choice %q is not one of the tools", choice.Name)})
+		return
+	} else if requiresToolCalls(choice) && len(req.Tools) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "tool choice requires tools"})
+		return
+	}
+
+	// tools aren't rendered if the tool choice is "none"
+	noTools := req.ToolChoice != nil && req.ToolChoice.Mode == "none"
+
 	caps := []Capability{CapabilityCompletion}
-	if req.Tools != nil {
+	if req.Tools != nil && !noTools {
 		caps = append(caps, CapabilityTools)
 	}
 
@@ -1314,43 +1656,108 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		req.Messages = append([]api.Message{{Role: "system", Content: m.System}}, req.Messages...)
 	}
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, req.Messages, req.Tools)
-	if err != nil {
+	if msgs := m.conditionalMessages(len(req.Tools) > 0 && !noTools); len(msgs) > 0 {
+		// add the model's examples after the system messages
+		i := slices.IndexFunc(req.Messages, func(msg api.Message) bool { return msg.Role != "system" })
+		if i < 0 {
+			i = len(req.Messages)
+		}
+
+		req.Messages = slices.Insert(req.Messages, i, msgs...)
+	}
+
+	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, req.Messages, req.Tools, req.ToolChoice)
+	if errors.Is(err, template.ErrNoPrompt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	slog.Debug("chat request", "images", len(images), "prompt", prompt)
 
+	completionReq := llm.CompletionRequest{
+		Prompt:  prompt,
+		Images:  images,
+		Format:  req.Format,
+		Options: opts,
+	}
+
+	chatResponse := func(r llm.CompletionResponse) api.ChatResponse {
+		res := api.ChatResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    api.Message{Role: "assistant", Content: r.Content},
+			Done:       r.Done,
+			DoneReason: r.DoneReason,
+			Metrics: api.Metrics{
+				PromptEvalCount:    r.PromptEvalCount,
+				PromptEvalDuration: r.PromptEvalDuration,
+				EvalCount:          r.EvalCount,
+				EvalDuration:       r.EvalDuration,
+			},
+		}
+
+		if r.Done {
+			res.TotalDuration = time.Since(checkpointStart)
+			res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+		}
+
+		return res
+	}
+
+	if requiresToolCalls(req.ToolChoice) {
+		// the response has to be complete to check its tool calls so it's
+		// returned in one piece even when streaming
+		parsed, last, err := completeToolCalls(c.Request.Context(), r, m, completionReq, req.ToolChoice, toolCallIDs(opts, prompt))
+		if errors.Is(err, errToolChoice) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "tool_choice": req.ToolChoice})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp := chatResponse(last)
+		resp.Message.Thinking, resp.Message.Content = m.parseThinking(parsed.Content())
+		resp.Message.ToolCalls = parsed.ToolCalls
+		if req.Stream != nil && !*req.Stream {
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+
+		ch := make(chan any, 1)
+		ch <- resp
+		close(ch)
+		streamResponse(c, ch)
+		return
+	}
+
+	// streamed responses hold back text which may be a tool call until the
+	// response is complete and return the tool calls in the final response
+	var toolCalls *toolCallStream
+	if len(req.Tools) > 0 && !noTools && (req.Stream == nil || *req.Stream) {
+		toolCalls = m.toolCallStream(toolCallIDs(opts, prompt))
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(r llm.CompletionResponse) {
-			res := api.ChatResponse{
-				Model:      req.Model,
-				CreatedAt:  time.Now().UTC(),
-				Message:    api.Message{Role: "assistant", Content: r.Content},
-				Done:       r.Done,
-				DoneReason: r.DoneReason,
-				Metrics: api.Metrics{
-					PromptEvalCount:    r.PromptEvalCount,
-					PromptEvalDuration: r.PromptEvalDuration,
-					EvalCount:          r.EvalCount,
-					EvalDuration:       r.EvalDuration,
-				},
-			}
-
-			if r.Done {
-				res.TotalDuration = time.Since(checkpointStart)
-				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+		if err := completion(c.Request.Context(), r, completionReq, func(r llm.CompletionResponse) {
+			resp := chatResponse(r)
+			if toolCalls != nil {
+				resp.Message.Content = toolCalls.write(r.Content)
+				if r.Done {
+					var rest string
+					rest, resp.Message.ToolCalls = toolCalls.close()
+					resp.Message.Content += rest
+				} else if resp.Message.Content == "" {
+					return
+				}
 			}
 
-			ch <- res
+			ch <- resp
 		}); err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
@@ -1379,11 +1786,18 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 
 		resp.Message.Content = sb.String()
-		if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-			resp.Message.ToolCalls = toolCalls
-			resp.Message.Content = ""
+		parsed, err := m.parseToolCalls(sb.String(), toolCallIDs(opts, prompt))
+		if err != nil {
+			slog.Debug("failed to parse tool calls", "error", err)
+		}
+
+		if len(parsed.ToolCalls) > 0 {
+			// keep any text the model wrote around its tool calls
+			resp.Message.ToolCalls = parsed.ToolCalls
+			resp.Message.Content = parsed.Content()
 		}
 
+		resp.Message.Thinking, resp.Message.Content = m.parseThinking(resp.Message.Content)
 		c.JSON(http.StatusOK, resp)
 		return
 	}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -110,6 +111,39 @@ func TestCreateFromBin(t *testing.T) {
 	})
 }
 
+func TestCreateFromDir(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+
+	gguf, err := os.ReadFile(createBinFile(t, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "model.gguf"), gguf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", dir),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	// the same blobs as creating from the gguf directly
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
+		filepath.Join(p, "blobs", "sha256-ca239d7bd8ea90e4a5d2e6bf88f8d74a47b14336e73eb4e18bed4dd325018116"),
+	})
+}
+
 func TestCreateFromModel(t *testing.T) {
 	p := t.TempDir()
 	t.Setenv("OLLAMA_MODELS", p)
@@ -479,6 +513,80 @@ func TestCreateTemplateSystem(t *testing.T) {
 	}
 }
 
+func TestCreateTemplateUndefined(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Sytem }} {{ .Prompt }}", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code == http.StatusOK {
+		t.Fatalf("expected an error, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "template uses undefined variables: .Sytem") {
+		t.Errorf("unexpected error %s", w.Body.String())
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
+}
+
+func TestCreateTemplateParseError(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"{{ range .Messages }}\n{{ .Content }\n{{ end }}\"\"\"", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(resp.Error, "template: line 2: ") || !strings.HasSuffix(resp.Error, "\n{{ .Content }") {
+		t.Errorf("unexpected error %q", resp.Error)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
+}
+
+func TestCreateTemplateWarnings(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Role }}: {{ end }}\"", createBinFile(t, nil, nil)),
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), `"status":"warning: template never renders message content (1:9)"`) {
+		t.Errorf("expected a warning, got %s", w.Body.String())
+	}
+}
+
 func TestCreateLicenses(t *testing.T) {
 	p := t.TempDir()
 	t.Setenv("OLLAMA_MODELS", p)
@@ -568,3 +676,24 @@ func TestCreateDetectTemplate(t *testing.T) {
 		})
 	})
 }
+
+func TestCreateFromZipTooLarge(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	t.Setenv("OLLAMA_MAX_IMPORT_ENTRIES", "1")
+	envconfig.LoadConfig()
+
+	f := createZipFileWithFiles(t, map[string][]byte{"config.json": []byte("{}"), "model.safetensors": nil})
+	f.Close()
+
+	var s Server
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", f.Name()),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status code 413, actual %d", w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestRender(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name: "test",
+		Modelfile: fmt.Sprintf(`FROM %s
+TEMPLATE """{{ range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}assistant:"""
+SYSTEM You are a pirate.`, createBinFile(t, nil, nil)),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	messages := []api.Message{{Role: "user", Content: "Hello!"}}
+
+	t.Run("prompt", func(t *testing.T) {
+		w := createRequest(t, s.RenderHandler, api.RenderRequest{Model: "test", Messages: messages})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.RenderResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.RenderResponse{Model: "test", Prompt: "system: You are a pirate.\nuser: Hello!\nassistant:"}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("trace", func(t *testing.T) {
+		w := createRequest(t, s.RenderHandler, api.RenderRequest{Model: "test", Messages: messages, Trace: true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.RenderResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Trace) == 0 || resp.Trace[len(resp.Trace)-1].End != len(resp.Prompt) {
+			t.Fatalf("expected the trace to cover the prompt, got %+v", resp.Trace)
+		}
+
+		// the user's content is traced to the second message
+		i := len("system: You are a pirate.\nuser: ")
+		for _, tr := range resp.Trace {
+			if tr.Start <= i && i < tr.End && tr.Message != 1 {
+				t.Errorf("expected offset %d to be traced to message 1, got %+v", i, tr)
+			}
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.RenderHandler, api.RenderRequest{Model: "missing", Messages: messages})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -12,9 +13,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -493,6 +496,94 @@ func TestShow(t *testing.T) {
 	}
 }
 
+func TestShowConditionalMessages(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name: "show-model",
+		Modelfile: fmt.Sprintf(
+			"FROM %s\nMESSAGE(when=tools) user \"What's the weather?\"\nMESSAGE(when=no-tools) assistant \"I can't check.\"\nMESSAGE user \"Hi\"",
+			createBinFile(t, llm.KV{"general.architecture": "test"}, nil),
+		),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.ShowModelHandler, api.ShowRequest{Name: "show-model"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []api.Message{
+		{Role: "user", Content: "What's the weather?", When: "tools"},
+		{Role: "assistant", Content: "I can't check.", When: "no-tools"},
+		{Role: "user", Content: "Hi"},
+	}
+
+	if diff := cmp.Diff(expect, resp.Messages); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// the modelfile round trips the conditions
+	modelfile, err := parser.ParseFile(strings.NewReader(resp.Modelfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []parser.Command
+	for _, c := range modelfile.Commands {
+		if c.Name == "message" {
+			messages = append(messages, c)
+		}
+	}
+
+	expectCommands := []parser.Command{
+		{Name: "message", Args: "user: What's the weather?", When: "tools"},
+		{Name: "message", Args: "assistant: I can't check.", When: "no-tools"},
+		{Name: "message", Args: "user: Hi"},
+	}
+
+	if diff := cmp.Diff(expectCommands, messages); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConditionalMessages(t *testing.T) {
+	m := Model{Messages: []Message{
+		{Role: "user", Content: "tools", When: "tools"},
+		{Role: "user", Content: "no tools", When: "no-tools"},
+		{Role: "user", Content: "always", When: "always"},
+		{Role: "user", Content: "unconditional"},
+	}}
+
+	cases := []struct {
+		tools  bool
+		expect []api.Message
+	}{
+		{true, []api.Message{{Role: "user", Content: "tools"}, {Role: "user", Content: "always"}}},
+		{false, []api.Message{{Role: "user", Content: "no tools"}, {Role: "user", Content: "always"}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("tools=%t", tt.tools), func(t *testing.T) {
+			if diff := cmp.Diff(tt.expect, m.conditionalMessages(tt.tools)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestNormalize(t *testing.T) {
 	type testCase struct {
 		input []float32
@@ -527,3 +618,189 @@ func TestNormalize(t *testing.T) {
 		})
 	}
 }
+
+func TestChunkTokens(t *testing.T) {
+	cases := []struct {
+		n, size, overlap int
+		expect           [][2]int
+	}{
+		{n: 3, size: 4, expect: [][2]int{{0, 3}}},
+		{n: 4, size: 4, expect: [][2]int{{0, 4}}},
+		{n: 10, size: 4, expect: [][2]int{{0, 4}, {4, 8}, {8, 10}}},
+		{n: 10, size: 4, overlap: 1, expect: [][2]int{{0, 4}, {3, 7}, {6, 10}}},
+		{n: 10, size: 4, overlap: 3, expect: [][2]int{{0, 4}, {1, 5}, {2, 6}, {3, 7}, {4, 8}, {5, 9}, {6, 10}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%d/%d/%d", tt.n, tt.size, tt.overlap), func(t *testing.T) {
+			if diff := cmp.Diff(tt.expect, chunkTokens(tt.n, tt.size, tt.overlap)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// wordLlm tokenizes inputs of space separated integers and embeds each text
+// as its first and last token
+type wordLlm struct {
+	mockLlm
+	texts []string
+}
+
+func (s *wordLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
+	var tokens []int
+	for _, f := range strings.Fields(content) {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, n)
+	}
+
+	return tokens, nil
+}
+
+func (s *wordLlm) Detokenize(ctx context.Context, tokens []int) (string, error) {
+	var sb strings.Builder
+	for i, n := range tokens {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+
+		sb.WriteString(strconv.Itoa(n))
+	}
+
+	return sb.String(), nil
+}
+
+func (s *wordLlm) Embed(ctx context.Context, input []string) ([][]float32, error) {
+	s.texts = append(s.texts, input...)
+
+	embeddings := make([][]float32, len(input))
+	for i, text := range input {
+		tokens, err := s.Tokenize(ctx, text)
+		if err != nil {
+			return nil, err
+		}
+
+		embeddings[i] = []float32{float32(tokens[0]), float32(tokens[len(tokens)-1])}
+	}
+
+	return embeddings, nil
+}
+
+func TestEmbedInputs(t *testing.T) {
+	input := []string{"1 2 3 4 5 6 7", "3 4"}
+
+	t.Run("truncate", func(t *testing.T) {
+		r := &wordLlm{}
+		resp, err := embedInputs(context.Background(), r, input, 4, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"1 2 3 4", "3 4"}, r.texts); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([]api.EmbedInputStats{{Tokens: 7, Truncated: 3}, {Tokens: 2}}, resp.Inputs); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if len(resp.Embeddings) != 2 || resp.Chunks != nil {
+			t.Errorf("expected 2 embeddings and no chunks, got %d and %v", len(resp.Embeddings), resp.Chunks)
+		}
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		_, err := embedInputs(context.Background(), &wordLlm{}, input, 4, false, nil)
+		if !errors.Is(err, errInputTooLong) {
+			t.Errorf("expected %v, got %v", errInputTooLong, err)
+		}
+	})
+
+	t.Run("chunks", func(t *testing.T) {
+		r := &wordLlm{}
+		resp, err := embedInputs(context.Background(), r, input, 4, false, &api.EmbedChunking{Overlap: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"1 2 3 4", "4 5 6 7", "3 4"}, r.texts); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([]api.EmbedChunk{
+			{Input: 0, Start: 0, End: 4},
+			{Input: 0, Start: 3, End: 7},
+			{Input: 1, Start: 0, End: 2},
+		}, resp.Chunks); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([]api.EmbedInputStats{{Tokens: 7, Chunks: 2}, {Tokens: 2, Chunks: 1}}, resp.Inputs); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([][]float32{normalize([]float32{1, 4}), normalize([]float32{4, 7}), normalize([]float32{3, 4})}, resp.Embeddings); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("mean", func(t *testing.T) {
+		r := &wordLlm{}
+		resp, err := embedInputs(context.Background(), r, input, 4, false, &api.EmbedChunking{Pool: "mean"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"1 2 3 4", "5 6 7", "3 4"}, r.texts); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.Chunks != nil {
+			t.Errorf("expected no chunks, got %v", resp.Chunks)
+		}
+
+		// 1 4 and 5 7 normalize to 0.2425 0.9701 and 0.5812 0.8137, their
+		// mean normalizes to 0.4192 0.9079
+		a, b := normalize([]float32{1, 4}), normalize([]float32{5, 7})
+		mean := normalize([]float32{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2})
+		if math.Abs(float64(mean[0])-0.4192) > 1e-4 || math.Abs(float64(mean[1])-0.9079) > 1e-4 {
+			t.Fatalf("unexpected mean %v", mean)
+		}
+
+		if diff := cmp.Diff([][]float32{mean, normalize([]float32{3, 4})}, resp.Embeddings); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestModelOptionsNumPredict(t *testing.T) {
+	cases := []struct {
+		name      string
+		modelfile map[string]any
+		request   map[string]any
+		expect    int
+	}{
+		{"default", nil, nil, -1},
+		{"modelfile", map[string]any{"num_predict": 256.0}, nil, 256},
+		{"request", nil, map[string]any{"num_predict": 64.0}, 64},
+		{"request overrides modelfile", map[string]any{"num_predict": 256.0}, map[string]any{"num_predict": 64.0}, 64},
+		{"request unbounds modelfile", map[string]any{"num_predict": 256.0}, map[string]any{"num_predict": -1.0}, -1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := modelOptions(&Model{Options: tt.modelfile}, tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if opts.NumPredict != tt.expect {
+				t.Errorf("expected num_predict %d, got %d", tt.expect, opts.NumPredict)
+			}
+		})
+	}
+}
@@ -39,6 +39,11 @@ type Scheduler struct {
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
+	// fair holds a queue per model path admitting requests across clients
+	// in turn. it's only used when envconfig.MaxClientParallel is set
+	fair   map[string]*fairQueue
+	fairMu sync.Mutex
+
 	loadFn       func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int)
 	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() gpu.GpuInfoList
@@ -65,6 +70,7 @@ func InitScheduler(ctx context.Context) *Scheduler {
 		expiredCh:     make(chan *runnerRef, envconfig.MaxQueuedRequests),
 		unloadedCh:    make(chan interface{}, envconfig.MaxQueuedRequests),
 		loaded:        make(map[string]*runnerRef),
+		fair:          make(map[string]*fairQueue),
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      gpu.GetGPUInfo,
 		getCpuFn:      gpu.GetCPUInfo,
@@ -89,6 +95,11 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		errCh:           make(chan error, 1),
 	}
 
+	if envconfig.MaxClientParallel > 0 {
+		go s.admit(req)
+		return req.successCh, req.errCh
+	}
+
 	select {
 	case s.pendingReqCh <- req:
 	default:
@@ -97,6 +108,55 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 	return req.successCh, req.errCh
 }
 
+// admit waits for the model's fair queue to admit the request's client
+// before queueing the request. the slot is released when the request is done
+func (s *Scheduler) admit(req *LlmRequest) {
+	q := s.fairQueue(req.model)
+	client := clientFromContext(req.ctx)
+	if err := q.acquire(req.ctx, client); err != nil {
+		req.errCh <- err
+		return
+	}
+
+	go func() {
+		<-req.ctx.Done()
+		q.release(client)
+	}()
+
+	select {
+	case s.pendingReqCh <- req:
+	default:
+		req.errCh <- ErrMaxQueue
+	}
+}
+
+func (s *Scheduler) fairQueue(model *Model) *fairQueue {
+	s.fairMu.Lock()
+	defer s.fairMu.Unlock()
+
+	q, ok := s.fair[model.ModelPath]
+	if !ok {
+		// only the request loading the runner is admitted until the runner
+		// is loaded and the queue is resized to its parallel slots
+		q = newFairQueue(1, envconfig.MaxClientParallel, envconfig.MaxQueuedRequests, envconfig.ClientWeights)
+		s.fair[model.ModelPath] = q
+	}
+
+	return q
+}
+
+// clients reports the requests of each client for a model
+func (s *Scheduler) clients(modelPath string) []api.ProcessClientResponse {
+	s.fairMu.Lock()
+	q, ok := s.fair[modelPath]
+	s.fairMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return q.status()
+}
+
 // Returns immediately, spawns go routines for the scheduler which will shutdown when ctx is done
 func (s *Scheduler) Run(ctx context.Context) {
 	slog.Debug("starting llm scheduler")
@@ -432,6 +492,11 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	runner.numParallel = numParallel
 	runner.refMu.Lock()
 
+	if envconfig.MaxClientParallel > 0 {
+		// admit as many requests as the runner processes in parallel
+		s.fairQueue(req.model).resize(numParallel)
+	}
+
 	s.loadedMu.Lock()
 	s.loaded[req.model.ModelPath] = runner
 	slog.Info("loaded runners", "count", len(s.loaded))
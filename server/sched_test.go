@@ -676,3 +676,69 @@ func (s *mockLlm) Close() error {
 func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
+
+func TestFairScheduling(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+
+	numParallel, maxClientParallel, maxQueuedRequests := envconfig.NumParallel, envconfig.MaxClientParallel, envconfig.MaxQueuedRequests
+	t.Cleanup(func() {
+		envconfig.NumParallel, envconfig.MaxClientParallel, envconfig.MaxQueuedRequests = numParallel, maxClientParallel, maxQueuedRequests
+	})
+	envconfig.NumParallel = 2
+	envconfig.MaxClientParallel = 2
+	envconfig.MaxQueuedRequests = 512
+
+	scenario := newScenario(t, ctx, "ollama-model-fair", 10)
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.newServerFn = scenario.newServer
+	s.Run(ctx)
+
+	admitted := make(chan string, 11)
+	request := func(client string) {
+		ctx, cancel := context.WithCancel(context.WithValue(ctx, clientContextKey{}, client))
+		successCh, errCh := s.GetRunner(ctx, scenario.req.model, scenario.req.opts, &api.Duration{Duration: time.Second})
+		go func() {
+			defer cancel()
+			select {
+			case <-successCh:
+				admitted <- client
+				time.Sleep(10 * time.Millisecond)
+			case err := <-errCh:
+				t.Error(err)
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// a greedy client fills both slots and queues the rest of its requests
+	for range 10 {
+		request("greedy")
+	}
+
+	require.Eventually(t, func() bool {
+		clients := s.clients(scenario.req.model.ModelPath)
+		return len(clients) == 1 && clients[0].Active == 2 && clients[0].Queued == 8
+	}, time.Second, time.Millisecond)
+
+	request("light")
+
+	// the light client should be admitted within a round of the greedy
+	// client rather than after all of its queued requests
+	var before int
+	for client := range admitted {
+		if client == "light" {
+			break
+		}
+
+		before++
+	}
+
+	require.LessOrEqual(t, before, 4)
+}
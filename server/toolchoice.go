@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tools"
+)
+
+// maxToolChoiceRetries is how many times a response is generated again when
+// it doesn't call the tools required by the request's tool choice
+var maxToolChoiceRetries = 2
+
+var errToolChoice = errors.New("response doesn't satisfy tool choice")
+
+// requiresToolCalls reports whether choice requires the response to call tools
+func requiresToolCalls(choice *api.ToolChoice) bool {
+	return choice != nil && (choice.Mode == "required" || choice.Mode == "function")
+}
+
+// checkToolChoice returns an error wrapping errToolChoice if calls don't
+// satisfy choice
+func checkToolChoice(choice *api.ToolChoice, calls []api.ToolCall) error {
+	if !requiresToolCalls(choice) {
+		return nil
+	}
+
+	if len(calls) == 0 {
+		return fmt.Errorf("%w: no tool calls", errToolChoice)
+	}
+
+	if choice.Mode == "function" {
+		for _, call := range calls {
+			if call.Function.Name != choice.Name {
+				return fmt.Errorf("%w: called %q instead of %q", errToolChoice, call.Function.Name, choice.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// completeToolCalls generates a response to req and parses its tool calls.
+// the response is generated again, up to maxToolChoiceRetries times, while its
+// tool calls don't satisfy choice. a fixed seed is advanced on each retry so
+// it doesn't reproduce the same response. the final chunk of the last
+// response is returned for its metrics
+func completeToolCalls(ctx context.Context, r llm.LlamaServer, m *Model, req llm.CompletionRequest, choice *api.ToolChoice, ids *tools.IDGenerator) (tools.Result, llm.CompletionResponse, error) {
+	seed := req.Options.Seed
+	for i := 0; ; i++ {
+		if seed >= 0 && i > 0 {
+			opts := *req.Options
+			opts.Seed = seed + i
+			req.Options = &opts
+		}
+
+		var sb strings.Builder
+		var last llm.CompletionResponse
+		if err := completion(ctx, r, req, func(cr llm.CompletionResponse) {
+			sb.WriteString(cr.Content)
+			last = cr
+		}); err != nil {
+			return tools.Result{}, last, err
+		}
+
+		parsed, err := m.parseToolCalls(sb.String(), ids)
+		if err != nil {
+			slog.Debug("failed to parse tool calls", "error", err)
+		}
+
+		err = checkToolChoice(choice, parsed.ToolCalls)
+		if err == nil || i >= maxToolChoiceRetries {
+			return parsed, last, err
+		}
+
+		slog.Debug("retrying response", "error", err, "attempt", i+1)
+	}
+}
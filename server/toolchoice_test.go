@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+// scriptedLlm responds to each completion with the next of its outputs,
+// repeating the last one once they run out
+type scriptedLlm struct {
+	mockLlm
+	outputs []string
+	calls   int
+	seeds   []int
+}
+
+func (s *scriptedLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	output := s.outputs[min(s.calls, len(s.outputs)-1)]
+	s.calls++
+	s.seeds = append(s.seeds, req.Options.Seed)
+	fn(llm.CompletionResponse{Content: output})
+	fn(llm.CompletionResponse{Done: true, DoneReason: "stop", EvalCount: s.calls})
+	return nil
+}
+
+func TestCompleteToolCalls(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Model{Template: tmpl}
+	weather := `[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"location": "Paris"}}]`
+	prose := "The weather in Paris is sunny."
+
+	cases := []struct {
+		name    string
+		choice  *api.ToolChoice
+		outputs []string
+		calls   int
+		err     error
+	}{
+		{"auto", &api.ToolChoice{Mode: "auto"}, []string{prose}, 1, nil},
+		{"none", &api.ToolChoice{Mode: "none"}, []string{prose}, 1, nil},
+		{"required", &api.ToolChoice{Mode: "required"}, []string{weather}, 1, nil},
+		{"required retry", &api.ToolChoice{Mode: "required"}, []string{prose, weather}, 2, nil},
+		{"required retry cap", &api.ToolChoice{Mode: "required"}, []string{prose}, 3, errToolChoice},
+		{"function", &api.ToolChoice{Mode: "function", Name: "get_current_weather"}, []string{weather}, 1, nil},
+		{"function retry", &api.ToolChoice{Mode: "function", Name: "get_current_weather"}, []string{`[TOOL_CALLS] [{"name": "get_current_time", "arguments": {}}]`, weather}, 2, nil},
+		{"function mismatch", &api.ToolChoice{Mode: "function", Name: "get_current_time"}, []string{weather}, 3, errToolChoice},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &scriptedLlm{outputs: tt.outputs}
+			opts := api.DefaultOptions()
+			parsed, last, err := completeToolCalls(context.Background(), r, m, llm.CompletionRequest{Options: &opts}, tt.choice, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if r.calls != tt.calls {
+				t.Errorf("expected %d completions, got %d", tt.calls, r.calls)
+			}
+
+			if !last.Done || last.EvalCount != r.calls {
+				t.Errorf("expected the final chunk of the last completion, got %+v", last)
+			}
+
+			if tt.err == nil && requiresToolCalls(tt.choice) && (len(parsed.ToolCalls) != 1 || parsed.ToolCalls[0].Function.Name != "get_current_weather") {
+				t.Errorf("unexpected tool calls %v", parsed.ToolCalls)
+			}
+		})
+	}
+}
+
+func TestCompleteToolCallsSeed(t *testing.T) {
+	tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		seed  int
+		seeds []int
+	}{
+		{"random", -1, []int{-1, -1, -1}},
+		{"fixed", 42, []int{42, 43, 44}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &scriptedLlm{outputs: []string{"The weather in Paris is sunny."}}
+			opts := api.DefaultOptions()
+			opts.Seed = tt.seed
+
+			if _, _, err := completeToolCalls(context.Background(), r, &Model{Template: tmpl}, llm.CompletionRequest{Options: &opts}, &api.ToolChoice{Mode: "required"}, nil); !errors.Is(err, errToolChoice) {
+				t.Fatalf("expected %v, got %v", errToolChoice, err)
+			}
+
+			if diff := cmp.Diff(tt.seeds, r.seeds); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			// the request's options are left as they were
+			if opts.Seed != tt.seed {
+				t.Errorf("expected seed %d, got %d", tt.seed, opts.Seed)
+			}
+		})
+	}
+}
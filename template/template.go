@@ -2,17 +2,28 @@ package template
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"text/template/parse"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/agnivade/levenshtein"
 	"github.com/ollama/ollama/api"
@@ -25,6 +36,9 @@ var indexBytes []byte
 //go:embed *.gotmpl
 var templatesFS embed.FS
 
+//go:embed fim/*.gotmpl
+var fimFS embed.FS
+
 var templatesOnce = sync.OnceValues(func() ([]*named, error) {
 	var templates []*named
 	if err := json.Unmarshal(indexBytes, &templates); err != nil {
@@ -39,6 +53,7 @@ var templatesOnce = sync.OnceValues(func() ([]*named, error) {
 
 		// normalize line endings
 		t.Bytes = bytes.ReplaceAll(bts, []byte("\r\n"), []byte("\n"))
+		t.normalized = normalizeWhitespace(t.Template)
 	}
 
 	return templates, nil
@@ -48,39 +63,177 @@ type named struct {
 	Name     string `json:"name"`
 	Template string `json:"template"`
 	Bytes    []byte
+
+	// normalized is Template with whitespace normalized for matching
+	normalized string
 }
 
 func (t named) Reader() io.Reader {
 	return bytes.NewReader(t.Bytes)
 }
 
+// parsedTemplates memoizes the parsed builtin templates by name
+var parsedTemplates sync.Map
+
+// Parsed returns the parsed template. it's parsed once and shared by every
+// caller so it must not be modified
+func (t *named) Parsed() (*Template, error) {
+	if tmpl, ok := parsedTemplates.Load(t.Name); ok {
+		return tmpl.(*Template), nil
+	}
+
+	tmpl, err := Parse(string(t.Bytes))
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := parsedTemplates.LoadOrStore(t.Name, tmpl)
+	return actual.(*Template), nil
+}
+
+// Builtin returns the builtin template whose text is s, e.g. a template
+// autodetected when the model was created
+func Builtin(s string) (*named, bool) {
+	templates, err := templatesOnce()
+	if err != nil {
+		return nil, false
+	}
+
+	for _, t := range templates {
+		if string(t.Bytes) == s {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
 func Named(s string) (*named, error) {
+	t, _, err := NamedWithThreshold(s, 100)
+	if err != nil {
+		return nil, fmt.Errorf("named template: %w", err)
+	}
+
+	return t, nil
+}
+
+// NamedWithThreshold returns the builtin template closest to s along with its
+// levenshtein distance from s. if the distance isn't under maxDistance, the
+// closest template and its distance are returned with an error
+func NamedWithThreshold(s string, maxDistance int) (*named, int, error) {
 	templates, err := templatesOnce()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
+	s = normalizeWhitespace(s)
+
 	var template *named
 	score := math.MaxInt
 	for _, t := range templates {
-		if s := levenshtein.ComputeDistance(s, t.Template); s < score {
+		if s := levenshtein.ComputeDistance(s, t.normalized); s < score {
 			score = s
 			template = t
 		}
 	}
 
+	if score < maxDistance {
+		return template, score, nil
+	}
+
+	return template, score, &NoMatchError{Closest: template.Name, Distance: score}
+}
+
+// FromJinja returns the builtin template equivalent to the Jinja chat template
+// jinja, e.g. the chat_template of a HuggingFace tokenizer_config.json. jinja
+// may be given JSON-escaped as it appears there. it isn't translated but
+// matched against the Jinja template of each builtin like Named, after
+// normalizing whitespace control, spacing inside tags and quotes
+func FromJinja(jinja string) (*named, error) {
+	if s := strings.TrimSpace(jinja); strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal([]byte(s), &jinja); err != nil {
+			return nil, fmt.Errorf("jinja template: %w", err)
+		}
+	}
+
+	templates, err := templatesOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	s := normalizeJinja(jinja)
+
+	var template *named
+	score := math.MaxInt
+	for _, t := range templates {
+		if d := levenshtein.ComputeDistance(s, normalizeJinja(t.Template)); d < score {
+			score = d
+			template = t
+		}
+	}
+
 	if score < 100 {
 		return template, nil
 	}
 
-	return nil, errors.New("no matching template found")
+	return nil, fmt.Errorf("jinja template: %w", &NoMatchError{Closest: template.Name, Distance: score})
+}
+
+// jinjaTag matches a Jinja expression, statement or comment along with its
+// whitespace control
+var jinjaTag = regexp.MustCompile(`(?s)\{([{%#])-?\s*(.*?)\s*-?([}%#])\}`)
+
+// normalizeJinja normalizes s so Jinja templates which only differ in
+// whitespace control, spacing inside tags or quotes compare equal
+func normalizeJinja(s string) string {
+	s = jinjaTag.ReplaceAllString(s, "{$1 $2 $3}")
+	return normalizeWhitespace(strings.ReplaceAll(s, `"`, "'"))
+}
+
+// NoMatchError is returned by Named, NamedWithThreshold and FromJinja when no
+// builtin template is close enough to match. it holds the closest template and its
+// levenshtein distance
+type NoMatchError struct {
+	Closest  string
+	Distance int
+}
+
+func (e *NoMatchError) Error() string {
+	return fmt.Sprintf("no builtin template matched; closest was %q at distance %d", e.Closest, e.Distance)
+}
+
+// normalizeWhitespace unifies line endings, collapses runs of whitespace within
+// each line and drops trailing whitespace so templates which differ only in
+// whitespace compare equal
+func normalizeWhitespace(s string) string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
 }
 
 var DefaultTemplate, _ = Parse("{{ .Prompt }}")
 
+// FIM returns the builtin fill in the middle template named name, e.g.
+// "codellama", which renders .Prompt and .Suffix between a code model's infill
+// tokens
+func FIM(name string) (*Template, error) {
+	bts, err := fimFS.ReadFile("fim/" + name + ".gotmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(string(bts))
+}
+
 type Template struct {
 	*template.Template
 	raw string
+
+	// appended is set if Parse appended {{ .Response }} to the template
+	appended bool
 }
 
 // response is a template node that can be added to templates that don't already have one
@@ -107,20 +260,245 @@ var funcs = template.FuncMap{
 		b, _ := json.Marshal(v)
 		return string(b)
 	},
+	// mustJSON is like json but fails template execution if v can't be marshaled
+	"mustJSON": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+
+		return string(b), nil
+	},
+	// propExample returns the first of a tool parameter property's examples as
+	// JSON or an empty string if it has none
+	"propExample": func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+
+		var p struct {
+			Examples []json.RawMessage `json:"examples"`
+		}
+
+		if err := json.Unmarshal(b, &p); err != nil || len(p.Examples) == 0 {
+			return ""
+		}
+
+		return string(p.Examples[0])
+	},
+	"wordwrap": wordwrap,
+	// toolSignatures, toolsJSON and toolNames render .Tools so templates
+	// don't need to loop over them
+	"toolSignatures": toolSignatures,
+	"toolsJSON":      toolsJSON,
+	"toolNames":      toolNames,
+	"groupBy":        groupBy,
+	// integer arithmetic, e.g. for index math when ranging over .Messages.
+	// comparisons use the builtin eq, ne, lt, le, gt and ge
+	"add": func(a, b int) int { return a + b },
+	"sub": func(a, b int) int { return a - b },
+	"mul": func(a, b int) int { return a * b },
+	"div": func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+
+		return a / b, nil
+	},
+	"mod": func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+
+		return a % b, nil
+	},
+	// isLast reports whether index is the last of list, e.g.
+	// {{ if isLast $index $.Messages }} to find the final message rather than
+	// eq (len (slice $.Messages $index)) 1
+	"isLast": func(index int, list any) (bool, error) {
+		v := reflect.ValueOf(list)
+		switch v.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+			return index == v.Len()-1, nil
+		}
+
+		return false, fmt.Errorf("isLast of %T", list)
+	},
+	// sha256 and shortHash return the hex SHA-256 digest of a string, e.g. to
+	// mark rendered content for tracing or caching. shortHash returns only the
+	// first n characters
+	"sha256": sha256Hex,
+	"shortHash": func(n int, s string) (string, error) {
+		if n < 0 {
+			return "", fmt.Errorf("negative hash length %d", n)
+		}
+
+		h := sha256Hex(s)
+		return h[:min(n, len(h))], nil
+	},
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// toolSignatures renders tools as Python function definitions with their
+// descriptions and arguments in docstrings. arguments are ordered by name
+func toolSignatures(tools []api.Tool) string {
+	var sb strings.Builder
+	for i, tool := range tools {
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+
+		props := tool.Function.Parameters.Properties
+		names := maps.Keys(props)
+		slices.Sort(names)
+
+		args := make([]string, len(names))
+		for j, name := range names {
+			args[j] = name + ": " + props[name].Type
+		}
+
+		fmt.Fprintf(&sb, "def %s(%s) -> List[Dict]:\n", tool.Function.Name, strings.Join(args, ", "))
+		fmt.Fprintf(&sb, "    \"\"\"%s\n", tool.Function.Description)
+		if len(names) > 0 {
+			sb.WriteString("\n    Args:\n")
+			for _, name := range names {
+				fmt.Fprintf(&sb, "        %s (%s): %s\n", name, props[name].Type, props[name].Description)
+			}
+		}
+
+		sb.WriteString("    \"\"\"\n    pass")
+	}
+
+	return sb.String()
+}
+
+// toolsJSON renders tools as JSON with the keys of every object sorted so the
+// prompt is the same for the same tools
+func toolsJSON(tools []api.Tool) (string, error) {
+	b, err := json.Marshal(tools)
+	if err != nil {
+		return "", err
+	}
+
+	// struct fields are marshaled in the order they're declared but map keys
+	// are sorted so round trip through a map
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return "", err
+	}
+
+	b, err = json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// toolNames returns the function names of tools
+func toolNames(tools []api.Tool) []string {
+	names := make([]string, len(tools))
+	for i, tool := range tools {
+		names[i] = tool.Function.Name
+	}
+
+	return names
+}
+
+// defaultGroup is the group of tools without a value for the key they're
+// grouped by
+const defaultGroup = "default"
+
+// groupBy groups tools by the value of key in their function, e.g.
+// {{ range $category, $tools := groupBy "category" .Tools }}. tools without a
+// string value for key are grouped under "default"
+func groupBy(key string, tools []api.Tool) (map[string][]api.Tool, error) {
+	groups := make(map[string][]api.Tool)
+	for _, tool := range tools {
+		b, err := json.Marshal(tool.Function)
+		if err != nil {
+			return nil, err
+		}
+
+		var fields map[string]any
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+
+		group, _ := fields[key].(string)
+		group = cmp.Or(group, defaultGroup)
+		groups[group] = append(groups[group], tool)
+	}
+
+	return groups, nil
+}
+
+// wordwrap wraps the lines of s at width runes on word boundaries. words
+// longer than width are broken and existing line breaks are kept
+func wordwrap(width int, s string) string {
+	if width <= 0 {
+		return s
+	}
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if utf8.RuneCountInString(line) <= width {
+			continue
+		}
+
+		var sb strings.Builder
+		var n int
+		for _, word := range strings.Fields(line) {
+			runes := []rune(word)
+			if n > 0 && n+1+len(runes) > width {
+				sb.WriteByte('\n')
+				n = 0
+			} else if n > 0 {
+				sb.WriteByte(' ')
+				n++
+			}
+
+			for len(runes) > width {
+				sb.WriteString(string(runes[:width]))
+				sb.WriteByte('\n')
+				runes = runes[width:]
+			}
+
+			sb.WriteString(string(runes))
+			n += len(runes)
+		}
+
+		lines[i] = sb.String()
+	}
+
+	return strings.Join(lines, "\n")
 }
 
 func Parse(s string) (*Template, error) {
+	// templates saved with a byte order mark, e.g. on Windows, would otherwise
+	// render it at the start of every prompt
+	s = strings.TrimPrefix(s, "\ufeff")
+
 	tmpl := template.New("").Option("missingkey=zero").Funcs(funcs)
 
 	tmpl, err := tmpl.Parse(s)
 	if err != nil {
-		return nil, err
+		return nil, sourceError(s, err)
 	}
 
 	t := Template{Template: tmpl, raw: s}
 	if vars := t.Vars(); !slices.Contains(vars, "messages") && !slices.Contains(vars, "response") {
 		// touch up the template and append {{ .Response }}
 		tmpl.Tree.Root.Nodes = append(tmpl.Tree.Root.Nodes, &response)
+		t.appended = true
 	}
 
 	return &t, nil
@@ -130,6 +508,95 @@ func (t *Template) String() string {
 	return t.raw
 }
 
+// AppendedResponse reports whether Parse appended {{ .Response }} to the
+// template because it renders neither .Response nor .Messages. String still
+// returns the template as written
+func (t *Template) AppendedResponse() bool {
+	return t.appended
+}
+
+// Canonical returns a normalized form of the template for comparing and
+// hashing templates. comments are dropped, runs of whitespace in text are
+// collapsed to a single space and trimmed, and templates defined with
+// {{ define }} follow the main template ordered by name
+func (t *Template) Canonical() string {
+	root := *t.Tree.Root
+	if t.appended {
+		// the implicit {{ .Response }} isn't part of a tree so it can't be printed
+		root.Nodes = root.Nodes[:len(root.Nodes)-1]
+	}
+
+	var sb strings.Builder
+	sb.WriteString(canonicalize(root.CopyList()).String())
+
+	var defined []*template.Template
+	for _, tt := range t.Templates() {
+		if tt.Name() != t.Name() && tt.Tree != nil {
+			defined = append(defined, tt)
+		}
+	}
+
+	slices.SortFunc(defined, func(a, b *template.Template) int {
+		return cmp.Compare(a.Name(), b.Name())
+	})
+
+	for _, tt := range defined {
+		fmt.Fprintf(&sb, "{{define %q}}%s{{end}}", tt.Name(), canonicalize(tt.Tree.Root.CopyList()))
+	}
+
+	return sb.String()
+}
+
+// canonicalize merges adjacent text nodes of l, which are split by comments,
+// and normalizes their whitespace. l is modified so it should be a copy
+func canonicalize(l *parse.ListNode) *parse.ListNode {
+	if l == nil {
+		return nil
+	}
+
+	var nodes []parse.Node
+	for _, n := range l.Nodes {
+		switch n := n.(type) {
+		case *parse.TextNode:
+			if last, ok := lastText(nodes); ok {
+				last.Text = append(last.Text, n.Text...)
+				continue
+			}
+		case *parse.IfNode:
+			n.List, n.ElseList = canonicalize(n.List), canonicalize(n.ElseList)
+		case *parse.RangeNode:
+			n.List, n.ElseList = canonicalize(n.List), canonicalize(n.ElseList)
+		case *parse.WithNode:
+			n.List, n.ElseList = canonicalize(n.List), canonicalize(n.ElseList)
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	l.Nodes = nodes[:0]
+	for _, n := range nodes {
+		if text, ok := n.(*parse.TextNode); ok {
+			text.Text = []byte(strings.Join(strings.Fields(string(text.Text)), " "))
+			if len(text.Text) == 0 {
+				continue
+			}
+		}
+
+		l.Nodes = append(l.Nodes, n)
+	}
+
+	return l
+}
+
+func lastText(nodes []parse.Node) (*parse.TextNode, bool) {
+	if len(nodes) == 0 {
+		return nil, false
+	}
+
+	text, ok := nodes[len(nodes)-1].(*parse.TextNode)
+	return text, ok
+}
+
 func (t *Template) Vars() []string {
 	var vars []string
 	for _, tt := range t.Templates() {
@@ -148,162 +615,2113 @@ func (t *Template) Vars() []string {
 	return vars
 }
 
-type Values struct {
-	Messages []api.Message
-	Tools    []api.Tool
-
-	// forceLegacy is a flag used to test compatibility with legacy templates
-	forceLegacy bool
+// Capabilities describes what a template can render
+type Capabilities struct {
+	// Tools is set if the template renders .Tools
+	Tools bool
+	// Images is set if the template renders message content or the prompt
+	// where images are referenced by [img-n] tags
+	Images bool
+	// System is set if the template renders .System or the role of each
+	// message in .Messages
+	System bool
+	// MultiTurn is set if the template renders .Messages or .Response so
+	// previous turns can be rendered
+	MultiTurn bool
+	// Insert is set if the template renders .Suffix for fill in the middle
+	// completion
+	Insert bool
 }
 
-func (t *Template) Subtree(fn func(parse.Node) bool) *template.Template {
-	var walk func(parse.Node) parse.Node
-	walk = func(n parse.Node) parse.Node {
-		if fn(n) {
-			return n
-		}
+// Capabilities reports what the template can render based on the identifiers
+// it references
+func (t *Template) Capabilities() Capabilities {
+	vars := t.Vars()
+	messages := slices.Contains(vars, "messages")
+	return Capabilities{
+		Tools:     slices.Contains(vars, "tools"),
+		Images:    slices.Contains(vars, "content") || slices.Contains(vars, "prompt"),
+		System:    slices.Contains(vars, "system") || messages && slices.Contains(vars, "role"),
+		MultiTurn: messages || slices.Contains(vars, "response"),
+		Insert:    slices.Contains(vars, "suffix"),
+	}
+}
 
-		switch t := n.(type) {
-		case *parse.ListNode:
-			for _, c := range t.Nodes {
-				if n := walk(c); n != nil {
-					return n
-				}
-			}
-		case *parse.BranchNode:
-			for _, n := range []*parse.ListNode{t.List, t.ElseList} {
-				if n != nil {
-					if n := walk(n); n != nil {
-						return n
-					}
-				}
-			}
+// SystemSubtree returns the first branch of the template gated on .System,
+// e.g. {{ if .System }}...{{ end }}, so the system prompt can be rendered on
+// its own. it returns nil if the template has no such branch
+func (t *Template) SystemSubtree() *template.Template {
+	return t.Subtree(func(n parse.Node) bool {
+		var pipe *parse.PipeNode
+		switch n := n.(type) {
 		case *parse.IfNode:
-			return walk(&t.BranchNode)
+			pipe = n.Pipe
 		case *parse.WithNode:
-			return walk(&t.BranchNode)
-		case *parse.RangeNode:
-			return walk(&t.BranchNode)
+			pipe = n.Pipe
 		}
 
-		return nil
+		return pipe != nil && slices.Contains(Identifiers(pipe), "System")
+	})
+}
+
+// WithSystem returns a copy of the template which renders the system prompt
+// with systemTmpl, e.g. "<<SYS>>{{ .System }}<</SYS>>", in place of the body
+// of its system branch. if the template has no system branch, systemTmpl is
+// rendered ahead of the template when there's a system prompt
+func (t *Template) WithSystem(systemTmpl string) (*Template, error) {
+	// parse the template again to modify a copy of its tree
+	base, err := Parse(t.raw)
+	if err != nil {
+		return nil, err
 	}
 
-	if n := walk(t.Tree.Root); n != nil {
-		return (&template.Template{
-			Tree: &parse.Tree{
-				Root: &parse.ListNode{
-					Nodes: []parse.Node{n},
-				},
-			},
-		}).Funcs(funcs)
+	sub := base.SystemSubtree()
+	if sub == nil {
+		return Parse("{{ if .System }}" + systemTmpl + "{{ end }}" + t.raw)
 	}
 
-	return nil
+	var branch *parse.BranchNode
+	switch n := sub.Tree.Root.Nodes[0].(type) {
+	case *parse.IfNode:
+		branch = &n.BranchNode
+	case *parse.WithNode:
+		branch = &n.BranchNode
+		// with sets dot to the system prompt so restore it for systemTmpl
+		systemTmpl = "{{ with $ }}" + systemTmpl + "{{ end }}"
+	}
+
+	system, err := template.New("").Funcs(funcs).Parse(systemTmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	branch.List = system.Tree.Root
+	return Parse(base.source())
 }
 
-func (t *Template) Execute(w io.Writer, v Values) error {
-	system, messages := collate(v.Messages)
-	if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
-		return t.Template.Execute(w, map[string]any{
-			"System":   system,
-			"Messages": messages,
-			"Tools":    v.Tools,
-		})
+// source returns the template text of the template's parse tree, e.g. after
+// the tree is modified. templates defined with {{ define }} follow the main
+// template ordered by name
+func (t *Template) source() string {
+	root := *t.Tree.Root
+	if t.appended {
+		// the implicit {{ .Response }} isn't part of a tree so it can't be printed
+		root.Nodes = root.Nodes[:len(root.Nodes)-1]
 	}
 
-	system = ""
-	var b bytes.Buffer
-	var prompt, response string
-	for _, m := range messages {
-		execute := func() error {
-			if err := t.Template.Execute(&b, map[string]any{
-				"System":   system,
-				"Prompt":   prompt,
-				"Response": response,
-			}); err != nil {
-				return err
-			}
+	var sb strings.Builder
+	sb.WriteString(root.String())
 
-			system = ""
+	var defined []*template.Template
+	for _, tt := range t.Templates() {
+		if tt.Name() != t.Name() && tt.Tree != nil {
+			defined = append(defined, tt)
+		}
+	}
+
+	slices.SortFunc(defined, func(a, b *template.Template) int {
+		return cmp.Compare(a.Name(), b.Name())
+	})
+
+	for _, tt := range defined {
+		fmt.Fprintf(&sb, "{{ define %q }}%s{{ end }}", tt.Name(), tt.Tree.Root)
+	}
+
+	return sb.String()
+}
+
+// SupportsTools reports whether the template branches on both .Tools, to
+// render the available tools, and .ToolCalls, to render the tool calls of
+// previous responses. a template which only references .Tools can't render
+// the tool calls a model makes
+func (t *Template) SupportsTools() bool {
+	branchesOn := func(name string) bool {
+		return t.Subtree(func(n parse.Node) bool {
+			var pipe *parse.PipeNode
+			switch n := n.(type) {
+			case *parse.IfNode:
+				pipe = n.Pipe
+			case *parse.RangeNode:
+				pipe = n.Pipe
+			case *parse.WithNode:
+				pipe = n.Pipe
+			}
+
+			return pipe != nil && slices.Contains(Identifiers(pipe), name)
+		}) != nil
+	}
+
+	return branchesOn("Tools") && branchesOn("ToolCalls")
+}
+
+type Values struct {
+	Messages []api.Message
+	Tools    []api.Tool
+
+	// Prompt and Suffix are the text before and after the completion for fill
+	// in the middle completion. if Suffix is set, they're rendered in place of
+	// Messages by templates which render .Suffix
+	Prompt string
+	Suffix string
+
+	// ToolChoice limits the tools rendered. "none" renders no tools and a
+	// function choice renders only that function
+	ToolChoice *api.ToolChoice
+
+	// Documents are retrieved documents for the model to cite. they're only
+	// available to templates which range over .Messages. each has a citation
+	// .Index starting at 1 in the order the documents are given
+	Documents []Document
+
+	// DropConsecutiveDuplicates drops any message identical to the message
+	// immediately preceding it, including its images, tool calls and thinking
+	DropConsecutiveDuplicates bool
+
+	// KeepConsecutiveMessages renders consecutive messages of the same role as
+	// separate turns rather than merging them, e.g. for few-shot examples
+	// given as back to back user messages. it's ignored by templates without
+	// .Messages which can only render one message of each role per turn
+	KeepConsecutiveMessages bool
+
+	// AppendEndMarker is written after the rendered messages to terminate a
+	// completed conversation, e.g. when rendering transcripts for training.
+	// it shouldn't be set when rendering a prompt for generation
+	AppendEndMarker string
+
+	// ResponsePrefix is written after the rendered prompt to seed the start of
+	// the model's response, e.g. "```json\n" to coax it into answering in JSON
+	ResponsePrefix string
+
+	// KeepSystemInline limits .System to the leading system messages. later
+	// system messages are only rendered in place by templates that range over
+	// .Messages. otherwise every system message is merged into .System. it's
+	// implied for templates which render the content of system messages in
+	// their range over .Messages, e.g. {{ if eq .Role "system" }}{{ .Content }}
+	KeepSystemInline bool
+
+	// RepeatSystemEachTurn renders the system messages, merged, before every
+	// user message rather than once at the top: a system message is put
+	// before each user message and templates that range over .Messages get an
+	// empty .System. it takes precedence over KeepSystemInline
+	RepeatSystemEachTurn bool
+
+	// RenderEmptyTurns renders a turn for every message even if its content is
+	// empty. otherwise templates without .Messages skip empty turns
+	RenderEmptyTurns bool
+
+	// ImageTag is the format of the placeholder added to a message for each of
+	// its images, e.g. "<image-%d>". it's formatted with the image's index and
+	// defaults to "[img-%d]" which is the placeholder the llama runner expects.
+	// [img] placeholders in the content are replaced with the tags of the
+	// message's images in order. see ImageIndexes for the image of each tag
+	ImageTag string
+
+	// RoundSeparator is written between consecutive rounds of tool calls, i.e.
+	// before an assistant message with tool calls which directly follows the
+	// results of the previous round's tool calls. it's only written by
+	// templates that range over .Messages
+	RoundSeparator string
+
+	// TurnHeader is a template rendered before the content of each message for
+	// models trained with turn metadata, e.g.
+	// "[Turn {{ add .Index 1 }}, {{ .Role }}, {{ .Time.Format "2006-01-02" }}] ".
+	// it's executed with the message's .Index among the collated messages, its
+	// .Role and .Name, and the .Time the prompt is rendered. messages which only
+	// carry tool calls don't get a header so their tool calls are still rendered
+	TurnHeader string
+
+	// TokenBudget is the most tokens the content of the messages may count
+	// with CountTokens. the oldest turns are dropped until they fit, except
+	// for system messages and the final user turn. it's ignored if either is
+	// unset
+	TokenBudget int
+	CountTokens func(string) int
+
+	// ValidateOutput checks the rendered prompt before writing it, returning an
+	// *OutputError if it's empty, doesn't have the template's assistant
+	// opener, e.g. "<|im_start|>assistant", or has an image tag without an
+	// image. it also fails if the template itself renders a stray {{ or }}
+	ValidateOutput bool
+
+	// forceLegacy is a flag used to test compatibility with legacy templates
+	forceLegacy bool
+
+	// chunked marks each iteration over .Messages so each message is written
+	// separately
+	chunked bool
+}
+
+// Document is a retrieved document, e.g. for retrieval augmented generation
+type Document struct {
+	Title   string
+	Content string
+}
+
+// citedDocument is a Document along with the index it's cited by
+type citedDocument struct {
+	Index int
+	Document
+}
+
+// documents returns v.Documents numbered for citations
+func (v Values) documents() []citedDocument {
+	docs := make([]citedDocument, len(v.Documents))
+	for i, doc := range v.Documents {
+		docs[i] = citedDocument{Index: i + 1, Document: doc}
+	}
+
+	return docs
+}
+
+// tools returns the tools to render according to v.ToolChoice
+func (v Values) tools() []api.Tool {
+	if v.ToolChoice == nil {
+		return v.Tools
+	}
+
+	switch v.ToolChoice.Mode {
+	case "none":
+		return nil
+	case "function":
+		var tools []api.Tool
+		for _, tool := range v.Tools {
+			if tool.Function.Name == v.ToolChoice.Name {
+				tools = append(tools, tool)
+			}
+		}
+
+		return tools
+	}
+
+	return v.Tools
+}
+
+// fields are the fields available at the top level of a template
+var fields = []string{"System", "Messages", "Prompt", "Suffix", "Response", "Tools", "Documents"}
+
+// messageFields are the fields available while ranging over .Messages
+var messageFields = func() []string {
+	var names []string
+	for _, f := range reflect.VisibleFields(reflect.TypeOf(api.Message{})) {
+		names = append(names, f.Name)
+	}
+
+	return names
+}()
+
+// Validate returns an error listing any field referenced at the top level of
+// the template, through $, or on a message while ranging over .Messages that
+// isn't available to templates, along with where it's first referenced. these
+// would otherwise silently render as empty. fields in allowed are accepted
+// wherever they're referenced, e.g. for templates executed with extra fields
+func (t *Template) Validate(allowed ...string) error {
+	var undefined []string
+	seen := make(map[string]bool)
+	check := func(field string, available []string, n parse.Node) {
+		if slices.Contains(available, field) || slices.Contains(allowed, field) || seen[field] {
+			return
+		}
+
+		seen[field] = true
+		undefined = append(undefined, fmt.Sprintf(".%s (%s)", field, position(t.Tree, n)))
+	}
+
+	// dot is the fields available on dot, or nil if they aren't known
+	var walk func(n parse.Node, dot []string)
+	walk = func(n parse.Node, dot []string) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					walk(c, dot)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, dot)
+		case *parse.TemplateNode:
+			if n.Pipe != nil {
+				walk(n.Pipe, dot)
+			}
+		case *parse.IfNode:
+			walk(n.Pipe, dot)
+			walk(n.List, dot)
+			walk(n.ElseList, dot)
+		case *parse.RangeNode:
+			walk(n.Pipe, dot)
+
+			var inner []string
+			if isField(n.Pipe, "Messages") && slices.Equal(dot, fields) {
+				inner = messageFields
+			}
+
+			walk(n.List, inner)
+			walk(n.ElseList, dot)
+		case *parse.WithNode:
+			walk(n.Pipe, dot)
+			walk(n.List, nil)
+			walk(n.ElseList, dot)
+		case *parse.PipeNode:
+			for _, c := range n.Cmds {
+				for _, a := range c.Args {
+					walk(a, dot)
+				}
+			}
+		case *parse.ChainNode:
+			walk(n.Node, dot)
+		case *parse.FieldNode:
+			if dot != nil {
+				check(n.Ident[0], dot, n)
+			}
+		case *parse.VariableNode:
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				check(n.Ident[1], fields, n)
+			}
+		}
+	}
+
+	walk(t.Tree.Root, fields)
+
+	if len(undefined) > 0 {
+		slices.Sort(undefined)
+		return fmt.Errorf("template uses undefined variables: %s", strings.Join(undefined, ", "))
+	}
+
+	return nil
+}
+
+// isField reports whether pipe is only the field of dot named field
+func isField(pipe *parse.PipeNode, field string) bool {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+
+	f, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	return ok && slices.Equal(f.Ident, []string{field})
+}
+
+// position returns the line and column of n in tree, e.g. "1:5"
+func position(tree *parse.Tree, n parse.Node) string {
+	location, _ := tree.ErrorContext(n)
+	return strings.TrimPrefix(location, tree.ParseName+":")
+}
+
+// Warning is a problem found by Lint which doesn't stop a template from
+// rendering but likely makes it render something unintended
+type Warning struct {
+	// Code identifies the kind of problem, e.g. "no-message-content"
+	Code string
+
+	Message string
+
+	// Pos is the line and column of the node the warning is about, e.g.
+	// "1:5". it's empty for warnings about the template as a whole
+	Pos string
+}
+
+func (w Warning) String() string {
+	if w.Pos == "" {
+		return w.Message
+	}
+
+	return fmt.Sprintf("%s (%s)", w.Message, w.Pos)
+}
+
+// Lint returns warnings for likely mistakes in the template: it never renders
+// .Response or .Messages, it ranges over .Messages without rendering their
+// content, it renders tool calls without their name or arguments, or it
+// renders .System inside the range over .Messages which also holds the system
+// messages
+func (t *Template) Lint() []Warning {
+	var warnings []Warning
+	if t.appended && !slices.Contains(t.Vars(), "suffix") {
+		warnings = append(warnings, Warning{
+			Code:    "implicit-response",
+			Message: "template never renders .Response or .Messages so .Response is added at its end",
+		})
+	}
+
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+
+		tree := tmpl.Tree
+		find(tree.Root, func(n parse.Node) bool {
+			r, ok := n.(*parse.RangeNode)
+			if !ok {
+				return false
+			}
+
+			switch names := t.identifiers(r.List, make(map[string]bool)); {
+			case isField(r.Pipe, "Messages"):
+				if !slices.Contains(names, "Content") {
+					warnings = append(warnings, Warning{
+						Code:    "no-message-content",
+						Message: "template never renders message content",
+						Pos:     position(tree, r),
+					})
+				}
+
+				if system := find(r.List, func(n parse.Node) bool {
+					v, ok := n.(*parse.VariableNode)
+					return ok && slices.Equal(v.Ident, []string{"$", "System"})
+				}); system != nil {
+					warnings = append(warnings, Warning{
+						Code:    "system-in-messages",
+						Message: "template renders .System inside the range over .Messages so the system prompt may be rendered twice",
+						Pos:     position(tree, system),
+					})
+				}
+			case slices.Contains(Identifiers(r.Pipe), "ToolCalls"):
+				if !slices.Contains(names, "Name") || !slices.Contains(names, "Arguments") {
+					warnings = append(warnings, Warning{
+						Code:    "incomplete-tool-calls",
+						Message: "template renders tool calls without both their name and arguments",
+						Pos:     position(tree, r),
+					})
+				}
+			}
+
+			return false
+		})
+	}
+
+	return warnings
+}
+
+// identifiers is like Identifiers but also returns the identifiers of the
+// templates invoked under n, each at most once
+func (t *Template) identifiers(n parse.Node, visited map[string]bool) []string {
+	names := Identifiers(n)
+	find(n, func(n parse.Node) bool {
+		if n, ok := n.(*parse.TemplateNode); ok && !visited[n.Name] {
+			visited[n.Name] = true
+			if tmpl := t.Lookup(n.Name); tmpl != nil && tmpl.Tree != nil {
+				names = append(names, t.identifiers(tmpl.Tree.Root, visited)...)
+			}
+		}
+
+		return false
+	})
+
+	return names
+}
+
+// find returns the first node under n, including n, for which fn returns
+// true, or nil if there's none
+func find(n parse.Node, fn func(parse.Node) bool) parse.Node {
+	if fn(n) {
+		return n
+	}
+
+	var children []parse.Node
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			children = n.Nodes
+		}
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			children = []parse.Node{n.Pipe}
+		}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.PipeNode:
+		for _, c := range n.Cmds {
+			children = append(children, c.Args...)
+		}
+	case *parse.ChainNode:
+		children = []parse.Node{n.Node}
+	}
+
+	for _, c := range children {
+		if found := find(c, fn); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// Subtree returns a template of the first node for which fn returns true.
+// templates invoked with {{ template "name" }} are searched where they're
+// invoked, each at most once so templates which invoke each other terminate
+func (t *Template) Subtree(fn func(parse.Node) bool) *template.Template {
+	lookup := t.Lookup
+	visited := make(map[string]bool)
+
+	var walk func(parse.Node) parse.Node
+	walk = func(n parse.Node) parse.Node {
+		if fn(n) {
+			return n
+		}
+
+		switch t := n.(type) {
+		case *parse.ListNode:
+			for _, c := range t.Nodes {
+				if n := walk(c); n != nil {
+					return n
+				}
+			}
+		case *parse.BranchNode:
+			for _, n := range []*parse.ListNode{t.List, t.ElseList} {
+				if n != nil {
+					if n := walk(n); n != nil {
+						return n
+					}
+				}
+			}
+		case *parse.IfNode:
+			return walk(&t.BranchNode)
+		case *parse.WithNode:
+			return walk(&t.BranchNode)
+		case *parse.RangeNode:
+			return walk(&t.BranchNode)
+		case *parse.TemplateNode:
+			if visited[t.Name] {
+				return nil
+			}
+
+			visited[t.Name] = true
+			if tt := lookup(t.Name); tt != nil && tt.Tree != nil {
+				return walk(tt.Tree.Root)
+			}
+		}
+
+		return nil
+	}
+
+	if n := walk(t.Tree.Root); n != nil {
+		return (&template.Template{
+			Tree: &parse.Tree{
+				Root: &parse.ListNode{
+					Nodes: []parse.Node{n},
+				},
+			},
+		}).Funcs(funcs)
+	}
+
+	return nil
+}
+
+// rendersSystemInline reports whether the template ranges over .Messages with
+// a branch on eq .Role "system" which renders the message's .Content, so system
+// messages are rendered where they are in the conversation
+func (t *Template) rendersSystemInline() bool {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+
+		if find(tmpl.Tree.Root, func(n parse.Node) bool {
+			r, ok := n.(*parse.RangeNode)
+			if !ok || !isField(r.Pipe, "Messages") {
+				return false
+			}
+
+			return find(r.List, func(n parse.Node) bool {
+				i, ok := n.(*parse.IfNode)
+				return ok && comparesRole(i.Pipe, "system") && slices.Contains(t.identifiers(i.List, make(map[string]bool)), "Content")
+			}) != nil
+		}) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// comparesRole reports whether pipe compares .Role to role, e.g.
+// eq .Role "system" or and (eq .Role "system") $i
+func comparesRole(pipe *parse.PipeNode, role string) bool {
+	return find(pipe, func(n parse.Node) bool {
+		p, ok := n.(*parse.PipeNode)
+		if !ok {
+			return false
+		}
+
+		for _, c := range p.Cmds {
+			if id, ok := c.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "eq" {
+				continue
+			}
+
+			var field, value bool
+			for _, a := range c.Args[1:] {
+				switch a := a.(type) {
+				case *parse.FieldNode:
+					field = field || slices.Equal(a.Ident, []string{"Role"})
+				case *parse.StringNode:
+					value = value || a.Text == role
+				}
+			}
+
+			if field && value {
+				return true
+			}
+		}
+
+		return false
+	}) != nil
+}
+
+// keepsThinking reports whether the template declares {{ $keepThinking := true }}
+// at its top level to render the thinking of every turn rather than only of
+// the turns after the last user message
+func (t *Template) keepsThinking() bool {
+	for _, n := range t.Tree.Root.Nodes {
+		a, ok := n.(*parse.ActionNode)
+		if !ok || len(a.Pipe.Decl) != 1 || a.Pipe.Decl[0].Ident[0] != "$keepThinking" || len(a.Pipe.Cmds) != 1 || len(a.Pipe.Cmds[0].Args) != 1 {
+			continue
+		}
+
+		if b, ok := a.Pipe.Cmds[0].Args[0].(*parse.BoolNode); ok {
+			return b.True
+		}
+	}
+
+	return false
+}
+
+// ThinkingTags returns the tags the template wraps thinking in, e.g. <think>
+// and </think>, from its branch on .Thinking. ok is false if the template
+// doesn't render thinking in tags
+func (t *Template) ThinkingTags() (openTag, closeTag string, ok bool) {
+	sub := t.Subtree(func(n parse.Node) bool {
+		var pipe *parse.PipeNode
+		switch n := n.(type) {
+		case *parse.IfNode:
+			pipe = n.Pipe
+		case *parse.WithNode:
+			pipe = n.Pipe
+		default:
+			return false
+		}
+
+		return slices.Contains(Identifiers(pipe), "Thinking")
+	})
+
+	if sub == nil {
+		return "", "", false
+	}
+
+	var b strings.Builder
+	if err := sub.Execute(&b, map[string]any{"Thinking": markerThinking}); err != nil {
+		return "", "", false
+	}
+
+	before, after, found := strings.Cut(b.String(), markerThinking)
+	openTag, closeTag = strings.TrimSpace(before), strings.TrimSpace(after)
+	return openTag, closeTag, found && openTag != "" && closeTag != ""
+}
+
+// ErrNoToolCallMarker is returned by ToolCallMarker for templates which don't
+// render a marker before tool calls
+var ErrNoToolCallMarker = errors.New("template doesn't render a tool call marker")
+
+// ToolCallMarker returns the text the template writes before tool calls, e.g.
+// [TOOL_CALLS] or <tool_call>, from its branch on .ToolCalls. it's found by
+// rendering the branch with a sample tool call and taking the literal text
+// before the call, less the JSON list or object opening it
+func (t *Template) ToolCallMarker() (string, error) {
+	sub := t.Subtree(func(n parse.Node) bool {
+		var pipe *parse.PipeNode
+		switch n := n.(type) {
+		case *parse.IfNode:
+			pipe = n.Pipe
+		case *parse.WithNode:
+			pipe = n.Pipe
+		case *parse.RangeNode:
+			pipe = n.Pipe
+		default:
+			return false
+		}
+
+		return slices.Contains(Identifiers(pipe), "ToolCalls")
+	})
+
+	if sub == nil {
+		return "", ErrNoToolCallMarker
+	}
+
+	var call api.ToolCall
+	call.Function.Name = markerToolCall
+
+	views, done := messageViews([]*api.Message{{Role: "assistant", ToolCalls: []api.ToolCall{call}}})
+	defer done()
+
+	var b strings.Builder
+	if err := sub.Execute(&b, views[0]); err != nil {
+		return "", err
+	}
+
+	before, _, ok := strings.Cut(b.String(), markerToolCall)
+	if !ok {
+		return "", ErrNoToolCallMarker
+	}
+
+	// drop the object holding the name, e.g. {"name": ", and the list of
+	// tool calls it's in
+	if i := strings.LastIndex(before, "{"); i >= 0 {
+		before = before[:i]
+	}
+
+	marker := strings.TrimSpace(strings.TrimRightFunc(before, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '['
+	}))
+
+	if marker == "" {
+		return "", ErrNoToolCallMarker
+	}
+
+	return marker, nil
+}
+
+// ImageIndexes returns the index of the image each image tag rendered by
+// Execute with v refers to, in the order of the tags, among the images of
+// v.Messages. images of messages dropped over v.TokenBudget or as duplicates
+// with v.DropConsecutiveDuplicates don't have a tag
+func (t *Template) ImageIndexes(v Values) []int {
+	if v.Suffix != "" {
+		return nil
+	}
+
+	var drop []bool
+	if v.TokenBudget > 0 && v.CountTokens != nil {
+		drop = dropOverBudget(v.Messages, v.CountTokens, v.TokenBudget)
+	}
+
+	// indexes holds the index in v.Messages of each image of msgs
+	var msgs []api.Message
+	var indexes []int
+	var n int
+	for i, m := range v.Messages {
+		if drop == nil || !drop[i] {
+			msgs = append(msgs, m)
+			for j := range m.Images {
+				indexes = append(indexes, n+j)
+			}
+		}
+
+		n += len(m.Images)
+	}
+
+	_, _, images := collate(msgs, v.DropConsecutiveDuplicates, false, true, "[img-%d]")
+	for i, j := range images {
+		images[i] = indexes[j]
+	}
+
+	return images
+}
+
+// ErrNoSuffix is returned by Execute for templates which don't render .Suffix
+// when Values.Suffix is set
+var ErrNoSuffix = errors.New("template doesn't support fill in the middle completion with a suffix")
+
+// ErrNoPrompt is returned by Execute for templates without .Messages when the
+// messages have an assistant message but no user message to prompt it
+var ErrNoPrompt = errors.New("conversation has an assistant message but no user message")
+
+func (t *Template) Execute(w io.Writer, v Values) error {
+	if v.ValidateOutput {
+		v.ValidateOutput = false
+
+		var b strings.Builder
+		if err := t.Execute(&b, v); err != nil {
+			return err
+		}
+
+		if err := t.validateOutput(b.String(), v); err != nil {
+			return err
+		}
+
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	if v.Suffix != "" {
+		if !slices.Contains(t.Vars(), "suffix") {
+			return ErrNoSuffix
+		}
+
+		return sourceError(t.raw, t.Template.Execute(w, map[string]any{
+			"Prompt":   v.Prompt,
+			"Suffix":   v.Suffix,
+			"Response": "",
+		}))
+	}
+
+	system, messages, err := t.collated(v)
+	if err != nil {
+		return err
+	}
+
+	return sourceError(t.raw, t.execute(w, v, system, messages))
+}
+
+// ExecuteWith renders v with both t and draft, e.g. a simpler template for
+// the draft model of speculative decoding. the messages are collated once, as
+// they would be for t, so both prompts render the same conversation
+func (t *Template) ExecuteWith(draft *Template, v Values) (main, draftOut string, err error) {
+	if v.Suffix != "" {
+		var b, d strings.Builder
+		if err := t.Execute(&b, v); err != nil {
+			return "", "", err
+		}
+
+		if err := draft.Execute(&d, v); err != nil {
+			return "", "", err
+		}
+
+		return b.String(), d.String(), nil
+	}
+
+	system, messages, err := t.collated(v)
+	if err != nil {
+		return "", "", err
+	}
+
+	// rendering modifies the messages, e.g. to find where a prefill stops, so
+	// each template renders its own copy
+	clone := func() []*api.Message {
+		c := make([]*api.Message, len(messages))
+		for i, m := range messages {
+			m := *m
+			c[i] = &m
+		}
+
+		return c
+	}
+
+	var b, d strings.Builder
+	if err := t.execute(&b, v, system, clone()); err != nil {
+		return "", "", sourceError(t.raw, err)
+	}
+
+	if err := draft.execute(&d, v, system, clone()); err != nil {
+		return "", "", sourceError(draft.raw, err)
+	}
+
+	if v.ValidateOutput {
+		if err := t.validateOutput(b.String(), v); err != nil {
+			return "", "", err
+		}
+
+		if err := draft.validateOutput(d.String(), v); err != nil {
+			return "", "", err
+		}
+	}
+
+	return b.String(), d.String(), nil
+}
+
+// collated returns the system prompt and the messages of v collated for t
+func (t *Template) collated(v Values) (string, []*api.Message, error) {
+	msgs := v.Messages
+	if v.TokenBudget > 0 && v.CountTokens != nil {
+		var dropped []api.Message
+		msgs, dropped = collateWithBudget(msgs, v.CountTokens, v.TokenBudget)
+		if len(dropped) > 0 {
+			slog.Debug("dropped messages over token budget", "dropped", len(dropped), "budget", v.TokenBudget)
+		}
+	}
+
+	inline := v.KeepSystemInline || t.rendersSystemInline()
+	merge := !v.KeepConsecutiveMessages || v.forceLegacy || !slices.Contains(t.Vars(), "messages")
+	system, messages, _ := collate(msgs, v.DropConsecutiveDuplicates, inline && !v.RepeatSystemEachTurn, merge, cmp.Or(v.ImageTag, "[img-%d]"))
+	if v.RepeatSystemEachTurn {
+		messages = repeatSystem(system, messages)
+	}
+
+	if v.TurnHeader != "" {
+		if err := turnHeaders(v.TurnHeader, messages); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return system, messages, nil
+}
+
+// message is the view templates get of a message. the arguments of its tool
+// calls are maps so templates can range over, index and access them like the
+// maps they used to be
+type message struct {
+	*api.Message
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+}
+
+type toolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string    `json:"name"`
+		Arguments arguments `json:"arguments"`
+	} `json:"function"`
+}
+
+// arguments is the view templates get of tool call arguments and of objects
+// nested in them. the order of their keys is kept in argumentOrder while the
+// template executes so they marshal in the order they were given in and
+// templates can range over them in order with .Keys
+type arguments map[string]any
+
+// argumentOrder holds the keys of the arguments of executing templates in
+// order, keyed by the pointer of their map
+var argumentOrder sync.Map
+
+// Keys returns the names of the arguments in order. it shadows an argument
+// named Keys, which can still be read with index
+func (a arguments) Keys() []string {
+	if keys, ok := argumentOrder.Load(reflect.ValueOf(a).UnsafePointer()); ok {
+		return keys.([]string)
+	}
+
+	keys := maps.Keys(a)
+	slices.Sort(keys)
+	return keys
+}
+
+// Get returns the value of key. like Keys, it shadows an argument named Get
+func (a arguments) Get(key string) any {
+	return a[key]
+}
+
+// Map returns the arguments as a plain map
+func (a arguments) Map() map[string]any {
+	return a
+}
+
+func (a arguments) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("null"), nil
+	} else if len(a) == 0 {
+		return []byte("{}"), nil
+	}
+
+	var ordered api.ToolCallFunctionArguments
+	for _, k := range a.Keys() {
+		ordered.Set(k, a[k])
+	}
+
+	return json.Marshal(ordered)
+}
+
+// messageViews returns the views templates get of msgs along with a func to
+// call once the template is executed to forget the order of their arguments
+func messageViews(msgs []*api.Message) ([]*message, func()) {
+	var keys []any
+	var view func(any) any
+	view = func(v any) any {
+		switch v := v.(type) {
+		case api.ToolCallFunctionArguments:
+			if v.Map() == nil {
+				return arguments(nil)
+			}
+
+			a := make(arguments, v.Len())
+			for _, k := range v.Keys() {
+				a[k] = view(v.Get(k))
+			}
+
+			key := reflect.ValueOf(a).UnsafePointer()
+			argumentOrder.Store(key, v.Keys())
+			keys = append(keys, key)
+			return a
+		case []any:
+			s := make([]any, len(v))
+			for i := range v {
+				s[i] = view(v[i])
+			}
+
+			return s
+		}
+
+		return v
+	}
+
+	views := make([]*message, len(msgs))
+	for i, m := range msgs {
+		views[i] = &message{Message: m}
+		for _, call := range m.ToolCalls {
+			var c toolCall
+			c.ID, c.Type, c.Function.Name = call.ID, call.Type, call.Function.Name
+			c.Function.Arguments = view(call.Function.Arguments).(arguments)
+			views[i].ToolCalls = append(views[i].ToolCalls, c)
+		}
+	}
+
+	return views, func() {
+		for _, key := range keys {
+			argumentOrder.Delete(key)
+		}
+	}
+}
+
+// execute renders the system prompt and messages collated from v
+func (t *Template) execute(w io.Writer, v Values, system string, messages []*api.Message) error {
+	if !t.keepsThinking() {
+		// reasoning models are usually trained without the thinking of previous
+		// turns so it's dropped up to the last user message
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role == "user" {
+				for _, m := range messages[:i] {
+					m.Thinking = ""
+				}
+				break
+			}
+		}
+	}
+
+	// a trailing assistant message is a prefill for the model to continue so
+	// nothing after its content is rendered, unless the conversation is
+	// complete and terminated with AppendEndMarker. an empty prefill renders
+	// the assistant turn up to where its content starts
+	var prefill *api.Message
+	if last := len(messages) - 1; v.AppendEndMarker == "" && last >= 0 && messages[last].Role == "assistant" && len(messages[last].ToolCalls) == 0 {
+		prefill = messages[last]
+	}
+
+	if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
+		var content string
+		if prefill != nil {
+			// messages are copies so the marker doesn't leak to the caller
+			content, prefill.Content = prefill.Content, markerPrefill
+		}
+
+		if v.RepeatSystemEachTurn {
+			// the system prompt is rendered with each user message instead
+			system = ""
+		}
+
+		views, done := messageViews(messages)
+		defer done()
+
+		data := map[string]any{
+			"System":    system,
+			"Messages":  views,
+			"Tools":     v.tools(),
+			"Documents": v.documents(),
+		}
+
+		pw := &promptWriter{w: w, chunked: v.chunked, prefill: content, hasPrefill: prefill != nil}
+		tmpl := t.Template
+		if v.RoundSeparator != "" || v.chunked {
+			var i int
+			var err error
+			tmpl, err = t.markIterations(func() {
+				// each message is written separately for ExecuteChan
+				pw.flush()
+				if i > 0 && i < len(messages) && messages[i].Role == "assistant" && len(messages[i].ToolCalls) > 0 && messages[i-1].Role == "tool" {
+					io.WriteString(pw, v.RoundSeparator)
+				}
+
+				i++
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := tmpl.Execute(pw, data); err != nil {
+			if pw.err != nil {
+				return pw.err
+			}
+
+			return err
+		}
+
+		pw.write([]byte(v.ResponsePrefix + v.AppendEndMarker))
+		pw.flush()
+		return pw.err
+	}
+
+	// legacy templates render a response after its prompt so assistant
+	// messages without any user message have no turn to be rendered in
+	roles := make(map[string]bool)
+	for _, m := range messages {
+		roles[m.Role] = true
+	}
+
+	if roles["assistant"] && !roles["user"] {
+		return ErrNoPrompt
+	}
+
+	system = ""
+	var b bytes.Buffer
+	var prompt, response string
+	// hasPrompt and hasResponse track empty turns for RenderEmptyTurns
+	var hasPrompt, hasResponse bool
+	for _, m := range messages {
+		execute := func() error {
+			if err := t.Template.Execute(&b, map[string]any{
+				"System":   system,
+				"Prompt":   prompt,
+				"Response": response,
+			}); err != nil {
+				return err
+			}
+
+			// write each turn as it's rendered rather than the whole prompt
+			if _, err := io.Copy(w, &b); err != nil {
+				return err
+			}
+
+			system = ""
 			prompt = ""
 			response = ""
+			hasPrompt = false
+			hasResponse = false
+			return nil
+		}
+
+		switch m.Role {
+		case "system":
+			if prompt != "" || response != "" || (v.RenderEmptyTurns && (hasPrompt || hasResponse)) {
+				if err := execute(); err != nil {
+					return err
+				}
+			}
+			system = m.Content
+		case "user":
+			if response != "" || (v.RenderEmptyTurns && hasResponse) {
+				if err := execute(); err != nil {
+					return err
+				}
+			}
+			prompt = m.Content
+			hasPrompt = true
+		case "assistant":
+			response = m.Content
+			hasResponse = true
+		}
+	}
+
+	isResponse := func(n parse.Node) bool {
+		field, ok := n.(*parse.FieldNode)
+		return ok && slices.Contains(field.Ident, "Response")
+	}
+
+	// templates may render .Response more than once, e.g. for thinking then
+	// an answer, so the last turn is cut at the last .Response. earlier ones
+	// are rendered like in previous turns
+	var total int
+	deleteNode(t.Template.Root.Copy(), func(n parse.Node) bool {
+		if isResponse(n) {
+			total++
+		}
+
+		return false
+	})
+
+	var seen int
+	nodes := deleteNode(t.Template.Root.Copy(), func(n parse.Node) bool {
+		if isResponse(n) {
+			seen++
+		}
+
+		return total > 0 && seen >= total
+	})
+
+	root, ok := nodes.(*parse.ListNode)
+	if !ok || len(root.Nodes) == 0 {
+		return errors.New("template has nothing to render before .Response")
+	}
+
+	tmpl, err := template.New("").Funcs(funcs).AddParseTree("", &parse.Tree{Root: root})
+	if err != nil {
+		return err
+	}
+
+	if err := tmpl.Execute(&b, map[string]any{
+		"System": system,
+		"Prompt": prompt,
+	}); err != nil {
+		return err
+	}
+
+	if prefill != nil {
+		// continue the trailing assistant message where .Response goes
+		b.WriteString(response)
+	}
+
+	b.WriteString(v.ResponsePrefix)
+	b.WriteString(v.AppendEndMarker)
+
+	_, err = io.Copy(w, &b)
+	return err
+}
+
+// SourceError is an error parsing or executing a template at a position in its
+// source. Error shows the line of the source with a caret under the column
+type SourceError struct {
+	// Line and Column are 1-based. Column is 0 for parse errors which only
+	// report the line
+	Line, Column int
+
+	// Action is the action which failed to execute, e.g. <.Foo.Bar>. it's
+	// empty for parse errors
+	Action string
+
+	Message string
+
+	// Source is the line of the template the error is on
+	Source string
+
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "template: line %d", e.Line)
+	if e.Column > 0 {
+		fmt.Fprintf(&sb, ", column %d", e.Column)
+	}
+
+	if e.Action != "" {
+		fmt.Fprintf(&sb, " at %s", e.Action)
+	}
+
+	fmt.Fprintf(&sb, ": %s", e.Message)
+	if e.Source != "" {
+		sb.WriteString("\n" + e.Source)
+		if e.Column > 0 {
+			// tabs are kept so the caret lines up with the source
+			indent := strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+
+				return ' '
+			}, e.Source[:min(e.Column-1, len(e.Source))])
+			sb.WriteString("\n" + indent + "^")
+		}
+	}
+
+	return sb.String()
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// sourceErrorRe matches the position text/template starts errors with, e.g.
+// `template: :2:14: executing "" at <.Foo>: ...` when executing or
+// `template: :2: unexpected EOF` when parsing. the column is a byte offset
+// from the start of the line
+var sourceErrorRe = regexp.MustCompile(`(?s)^template: [^:]*:(\d+)(?::(\d+))?: (?:executing "[^"]*" at (<.*?>): )?(.*)$`)
+
+// sourceError wraps err from parsing or executing source in a SourceError if
+// it has a position. other errors, including nil, are returned as is
+func sourceError(source string, err error) error {
+	if err == nil || errors.As(err, new(*SourceError)) {
+		return err
+	}
+
+	m := sourceErrorRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+
+	line, _ := strconv.Atoi(m[1])
+	e := SourceError{Line: line, Action: m[3], Message: m[4], Err: err}
+	if m[2] != "" {
+		column, _ := strconv.Atoi(m[2])
+		e.Column = column + 1
+	}
+
+	if lines := strings.Split(source, "\n"); line >= 1 && line <= len(lines) {
+		e.Source = strings.TrimSuffix(lines[line-1], "\r")
+	}
+
+	return &e
+}
+
+// OutputError is a problem with a rendered prompt found by
+// Values.ValidateOutput
+type OutputError struct {
+	// Code is "empty", "no-assistant-opener", "template-artifact" or
+	// "image-tag"
+	Code    string
+	Message string
+
+	// Offset is the byte offset of the problem in the prompt, or -1 if it's
+	// about the prompt as a whole
+	Offset int
+}
+
+func (e *OutputError) Error() string {
+	if e.Offset < 0 {
+		return "invalid prompt: " + e.Message
+	}
+
+	return fmt.Sprintf("invalid prompt: %s at offset %d", e.Message, e.Offset)
+}
+
+// validateOutput checks the prompt s rendered with v for signs of a broken
+// render
+func (t *Template) validateOutput(s string, v Values) error {
+	if strings.TrimSpace(s) == "" {
+		return &OutputError{Code: "empty", Message: "prompt is empty", Offset: -1}
+	}
+
+	if v.Suffix == "" {
+		// the opener is what the template renders after a lone prompt
+		var b strings.Builder
+		if err := t.Execute(&b, Values{Messages: []api.Message{{Role: "user", Content: markerOpener}}}); err != nil {
+			return err
+		}
+
+		_, opener, _ := strings.Cut(b.String(), markerOpener)
+		if opener = strings.TrimSpace(opener); opener != "" && !strings.Contains(s, opener) {
+			return &OutputError{Code: "no-assistant-opener", Message: fmt.Sprintf("prompt doesn't have the assistant opener %q", opener), Offset: -1}
+		}
+	}
+
+	// content may have braces of its own, e.g. code or the JSON of tools, so
+	// artifacts are looked for in a rendering with the content left out
+	var b strings.Builder
+	if err := t.Execute(&b, withoutContent(v)); err != nil {
+		return err
+	}
+
+	for _, artifact := range []string{"{{", "}}"} {
+		if i := strings.Index(b.String(), artifact); i >= 0 {
+			return &OutputError{Code: "template-artifact", Message: fmt.Sprintf("template renders a stray %q", artifact), Offset: -1}
+		}
+	}
+
+	var images int
+	for _, m := range v.Messages {
+		images += len(m.Images)
+	}
+
+	if i := strings.Index(s, "[img]"); i >= 0 {
+		return &OutputError{Code: "image-tag", Message: "prompt has an [img] tag without an image", Offset: i}
+	}
+
+	if before, after, ok := strings.Cut(cmp.Or(v.ImageTag, "[img-%d]"), "%d"); ok {
+		tag := regexp.MustCompile(regexp.QuoteMeta(before) + `(\d+)` + regexp.QuoteMeta(after))
+		for _, loc := range tag.FindAllStringSubmatchIndex(s, -1) {
+			if n, err := strconv.Atoi(s[loc[2]:loc[3]]); err == nil && n >= images {
+				return &OutputError{Code: "image-tag", Message: fmt.Sprintf("prompt has the tag %s without an image", s[loc[0]:loc[1]]), Offset: loc[0]}
+			}
+		}
+	}
+
+	return nil
+}
+
+// withoutContent returns v with its content replaced by a placeholder and its
+// tools and the arguments of its tool calls left out so that what's left of a
+// rendering comes from the template
+func withoutContent(v Values) Values {
+	v.ValidateOutput = false
+	v.TokenBudget = 0
+	v.Tools = nil
+
+	for _, s := range []*string{&v.Prompt, &v.Suffix, &v.ResponsePrefix} {
+		if *s != "" {
+			*s = markerOpener
+		}
+	}
+
+	v.Messages = slices.Clone(v.Messages)
+	for i, m := range v.Messages {
+		m.Content = markerOpener
+		m.ToolCalls = slices.Clone(m.ToolCalls)
+		for j := range m.ToolCalls {
+			m.ToolCalls[j].Function.Arguments = api.ToolCallFunctionArguments{}
+		}
+
+		v.Messages[i] = m
+	}
+
+	v.Documents = slices.Clone(v.Documents)
+	for i := range v.Documents {
+		v.Documents[i] = Document{Title: markerOpener, Content: markerOpener}
+	}
+
+	return v
+}
+
+// ExecuteChan executes the template like Execute, sending the prompt in chunks
+// as it's rendered rather than holding all of it. each chunk is usually the
+// rendering of one message. the chunks channel is closed once rendering stops,
+// after which the error channel yields the error rendering stopped with, if
+// any. rendering stops with ctx's error if ctx is done before the chunks are
+// received so callers which stop receiving early should cancel ctx
+func (t *Template) ExecuteChan(ctx context.Context, v Values) (<-chan []byte, <-chan error) {
+	chunks := make(chan []byte)
+	errc := make(chan error, 1)
+	go func() {
+		v.chunked = true
+		err := t.Execute(&chanWriter{ctx: ctx, c: chunks}, v)
+		close(chunks)
+		if err != nil {
+			errc <- err
+		}
+
+		close(errc)
+	}()
+
+	return chunks, errc
+}
+
+// chanWriter sends each write on c until ctx is done
+type chanWriter struct {
+	ctx context.Context
+	c   chan<- []byte
+}
+
+func (w *chanWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	select {
+	case w.c <- bytes.Clone(p):
+		return len(p), nil
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	}
+}
+
+// promptWriter writes a prompt to w as it's rendered. anything rendered after
+// markerPrefill is dropped and the prefill is written in its place. chunked
+// output is held until flush so each message is written at once
+type promptWriter struct {
+	w       io.Writer
+	chunked bool
+	buf     bytes.Buffer
+
+	prefill    string
+	hasPrefill bool
+	// done is set once markerPrefill is written
+	done bool
+	err  error
+}
+
+func (pw *promptWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+
+	n := len(p)
+	if pw.done {
+		return n, nil
+	}
+
+	if pw.hasPrefill {
+		if before, _, ok := bytes.Cut(p, []byte(markerPrefill)); ok {
+			pw.done = true
+			p = append(slices.Clip(before), pw.prefill...)
+		}
+	}
+
+	pw.write(p)
+	if pw.err != nil {
+		return 0, pw.err
+	}
+
+	return n, nil
+}
+
+func (pw *promptWriter) write(p []byte) {
+	if pw.err != nil || len(p) == 0 {
+		return
+	}
+
+	if pw.chunked {
+		pw.buf.Write(p)
+		return
+	}
+
+	_, pw.err = pw.w.Write(p)
+}
+
+func (pw *promptWriter) flush() {
+	if pw.err != nil || pw.buf.Len() == 0 {
+		return
+	}
+
+	_, pw.err = pw.w.Write(pw.buf.Bytes())
+	pw.buf.Reset()
+}
+
+// Span is a region of a prompt rendered by ExecuteDebug. Start and End are
+// byte offsets into the prompt
+type Span struct {
+	Start, End int
+	Source     string
+}
+
+// iterationFunc is the function markIterations calls at the start of each
+// iteration. it's only defined on the copy so templates can't call it
+const iterationFunc = "_iteration"
+
+// markIterations returns a copy of the template which calls fn at the start
+// of each iteration over .Messages
+func (t *Template) markIterations(fn func()) (*template.Template, error) {
+	tmpl, err := t.Template.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	tree := *t.Template.Tree
+
+	var instrument func(*parse.ListNode) *parse.ListNode
+	instrument = func(l *parse.ListNode) *parse.ListNode {
+		if l == nil {
 			return nil
 		}
 
-		switch m.Role {
-		case "system":
-			if prompt != "" || response != "" {
-				if err := execute(); err != nil {
-					return err
+		// build new lists rather than modifying the template
+		instrumented := &parse.ListNode{NodeType: parse.NodeList, Pos: l.Pos}
+		for _, n := range l.Nodes {
+			switch c := n.(type) {
+			case *parse.IfNode:
+				c2 := *c
+				c2.List, c2.ElseList = instrument(c.List), instrument(c.ElseList)
+				n = &c2
+			case *parse.WithNode:
+				c2 := *c
+				c2.List, c2.ElseList = instrument(c.List), instrument(c.ElseList)
+				n = &c2
+			case *parse.RangeNode:
+				c2 := *c
+				c2.List, c2.ElseList = instrument(c.List), instrument(c.ElseList)
+				if slices.Contains(Identifiers(c.Pipe), "Messages") {
+					call := &parse.ActionNode{NodeType: parse.NodeAction, Pos: c.Pos, Line: c.Line, Pipe: &parse.PipeNode{
+						NodeType: parse.NodePipe, Pos: c.Pos, Line: c.Line,
+						Cmds: []*parse.CommandNode{{NodeType: parse.NodeCommand, Pos: c.Pos, Args: []parse.Node{
+							parse.NewIdentifier(iterationFunc).SetTree(&tree).SetPos(c.Pos),
+						}}},
+					}}
+
+					c2.List.Nodes = append([]parse.Node{call}, c2.List.Nodes...)
 				}
+
+				n = &c2
 			}
-			system = m.Content
-		case "user":
-			if response != "" {
-				if err := execute(); err != nil {
-					return err
+
+			instrumented.Nodes = append(instrumented.Nodes, n)
+		}
+
+		return instrumented
+	}
+
+	tree.Root = instrument(t.Template.Tree.Root)
+	tmpl.Tree = &tree
+	return tmpl.Funcs(template.FuncMap{iterationFunc: func() string {
+		fn()
+		return ""
+	}}), nil
+}
+
+// markers delimit regions of the output while rendering with ExecuteDebug
+// or ExecuteTrace. they're in the private use area so they don't collide with
+// anything templates render
+const (
+	markerOpen  = "\ue000"
+	markerClose = "\ue001"
+	markerLabel = "\ue002"
+
+	// markerPrefill stands in for the content of a trailing assistant message
+	// to find where rendering stops
+	markerPrefill = "\ue004"
+
+	// markerOpener stands in for a prompt to find the assistant opener
+	// rendered after it
+	markerOpener = "\ue005"
+
+	// markerThinking stands in for thinking to find the tags around it
+	markerThinking = "\ue006"
+
+	// markerToolCall stands in for the name of a tool call to find the
+	// marker rendered before it
+	markerToolCall = "\ue007"
+)
+
+func mark(label, s string) string {
+	if s == "" {
+		return s
+	}
+
+	return markerOpen + label + markerLabel + s + markerClose + label + markerLabel
+}
+
+// markedValues marks the content of each message and the strings appended to
+// the prompt so they can be found in the output
+func markedValues(v Values) Values {
+	// dedupe here since marking makes every message distinct
+	msgs := make([]api.Message, 0, len(v.Messages))
+	for i, m := range v.Messages {
+		if v.DropConsecutiveDuplicates && i > 0 && m.Role == v.Messages[i-1].Role && m.Content == v.Messages[i-1].Content {
+			continue
+		}
+
+		m.Content = mark(fmt.Sprintf("message %d", i), m.Content)
+		msgs = append(msgs, m)
+	}
+
+	v.Messages = msgs
+	v.DropConsecutiveDuplicates = false
+	v.ResponsePrefix = mark("response prefix", v.ResponsePrefix)
+	v.AppendEndMarker = mark("end marker", v.AppendEndMarker)
+	return v
+}
+
+// marker is an open marker. n counts the times label was opened before
+type marker struct {
+	label string
+	n     int
+}
+
+// markedRegion is a region of unmarked output along with the markers open
+// around it, innermost last
+type markedRegion struct {
+	start, end int
+	markers    []marker
+}
+
+// unmark removes the markers from s and returns the regions between them
+func unmark(s string) (string, []markedRegion) {
+	var out strings.Builder
+	var regions []markedRegion
+	var open []marker
+	counts := make(map[string]int)
+
+	// pop closes label and anything opened after it. markers are closed out
+	// of order if a template breaks out of a node early
+	pop := func(label string) {
+		if i := slices.IndexFunc(open, func(m marker) bool { return m.label == label }); i >= 0 {
+			open = open[:i]
+		}
+	}
+
+	start := 0
+	for {
+		i := strings.IndexAny(s, markerOpen+markerClose)
+		if i < 0 {
+			out.WriteString(s)
+		} else {
+			out.WriteString(s[:i])
+		}
+
+		if out.Len() > start {
+			regions = append(regions, markedRegion{start: start, end: out.Len(), markers: slices.Clone(open)})
+			start = out.Len()
+		}
+
+		if i < 0 {
+			return out.String(), regions
+		}
+
+		isOpen := strings.HasPrefix(s[i:], markerOpen)
+		label, rest, _ := strings.Cut(s[i+len(markerOpen):], markerLabel)
+		pop(label)
+		if isOpen {
+			open = append(open, marker{label: label, n: counts[label]})
+			counts[label]++
+		}
+
+		s = rest
+	}
+}
+
+// ExecuteDebug renders the template like Execute and labels the regions of
+// the result by where they came from: "message N" for the content of the Nth
+// message, "response prefix", "end marker" or "template" for anything
+// rendered by the template itself
+func (t *Template) ExecuteDebug(v Values) (string, []Span, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, markedValues(v)); err != nil {
+		return "", nil, err
+	}
+
+	prompt, regions := unmark(b.String())
+
+	var spans []Span
+	for _, r := range regions {
+		source := "template"
+		if len(r.markers) > 0 {
+			source = r.markers[len(r.markers)-1].label
+		}
+
+		if n := len(spans); n > 0 && spans[n-1].Source == source {
+			spans[n-1].End = r.end
+			continue
+		}
+
+		spans = append(spans, Span{Start: r.start, End: r.end, Source: source})
+	}
+
+	return prompt, spans, nil
+}
+
+// Trace maps a region of a prompt rendered by ExecuteTrace to where it came
+// from. Start and End are byte offsets into the prompt
+type Trace struct {
+	Start, End int
+
+	// Node is the line:col in the template source of the innermost node that
+	// rendered the region. it's empty for text not rendered by the template
+	// such as the response prefix
+	Node string
+
+	// Message is the index of the message whose content is rendered or, for
+	// text rendered while ranging over .Messages, the index of the collated
+	// message. it's -1 otherwise
+	Message int
+}
+
+// ExecuteTrace renders the template like Execute and maps each region of the
+// result to the template node and message that produced it
+func (t *Template) ExecuteTrace(v Values) (string, []Trace, error) {
+	var nodes []parse.Node
+	var instrument func(*parse.ListNode) *parse.ListNode
+	instrument = func(l *parse.ListNode) *parse.ListNode {
+		if l == nil {
+			return nil
+		}
+
+		text := func(s string) parse.Node {
+			return &parse.TextNode{NodeType: parse.NodeText, Text: []byte(s)}
+		}
+
+		// build new lists rather than modifying the template
+		instrumented := &parse.ListNode{NodeType: parse.NodeList, Pos: l.Pos}
+		for _, n := range l.Nodes {
+			switch c := n.(type) {
+			case *parse.IfNode:
+				c2 := *c
+				c2.List, c2.ElseList = instrument(c.List), instrument(c.ElseList)
+				n = &c2
+			case *parse.WithNode:
+				c2 := *c
+				c2.List, c2.ElseList = instrument(c.List), instrument(c.ElseList)
+				n = &c2
+			case *parse.RangeNode:
+				c2 := *c
+				c2.List, c2.ElseList = instrument(c.List), instrument(c.ElseList)
+				if slices.Contains(Identifiers(c.Pipe), "Messages") {
+					// mark each iteration to count the messages
+					label := fmt.Sprintf("range %d", len(nodes))
+					c2.List.Nodes = append(append([]parse.Node{text(markerOpen + label + markerLabel)}, c2.List.Nodes...), text(markerClose+label+markerLabel))
 				}
+
+				n = &c2
 			}
-			prompt = m.Content
-		case "assistant":
-			response = m.Content
+
+			if n == parse.Node(&response) {
+				// the appended response isn't in the source
+				instrumented.Nodes = append(instrumented.Nodes, n)
+				continue
+			}
+
+			label := fmt.Sprintf("node %d", len(nodes))
+			nodes = append(nodes, n)
+			instrumented.Nodes = append(instrumented.Nodes, text(markerOpen+label+markerLabel), n, text(markerClose+label+markerLabel))
 		}
+
+		return instrumented
 	}
 
-	var cut bool
-	nodes := deleteNode(t.Template.Root.Copy(), func(n parse.Node) bool {
-		if field, ok := n.(*parse.FieldNode); ok && slices.Contains(field.Ident, "Response") {
-			cut = true
+	tmpl, err := t.Template.Clone()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tree := *t.Template.Tree
+	tree.Root = instrument(t.Template.Tree.Root)
+	tmpl.Tree = &tree
+
+	var b strings.Builder
+	if err := (&Template{Template: tmpl, raw: t.raw}).Execute(&b, markedValues(v)); err != nil {
+		return "", nil, err
+	}
+
+	prompt, regions := unmark(b.String())
+
+	var traces []Trace
+	for _, r := range regions {
+		trace := Trace{Start: r.start, End: r.end, Message: -1}
+		for i := len(r.markers) - 1; i >= 0; i-- {
+			m := r.markers[i]
+			var id int
+			switch {
+			case m.label == "response prefix" || m.label == "end marker":
+				// written after the template so any open node is stale
+				trace.Node = ""
+				i = -1
+			case strings.HasPrefix(m.label, "message "):
+				if trace.Message < 0 {
+					fmt.Sscanf(m.label, "message %d", &trace.Message)
+				}
+			case strings.HasPrefix(m.label, "range "):
+				if trace.Message < 0 {
+					trace.Message = m.n
+				}
+			case strings.HasPrefix(m.label, "node "):
+				if trace.Node == "" {
+					fmt.Sscanf(m.label, "node %d", &id)
+					loc, _ := t.Template.Tree.ErrorContext(nodes[id])
+					trace.Node = strings.TrimPrefix(loc, t.Template.Tree.ParseName+":")
+				}
+			}
 		}
 
-		return cut
-	})
+		if n := len(traces); n > 0 && traces[n-1].Node == trace.Node && traces[n-1].Message == trace.Message {
+			traces[n-1].End = r.end
+			continue
+		}
 
-	tree := parse.Tree{Root: nodes.(*parse.ListNode)}
-	if err := template.Must(template.New("").AddParseTree("", &tree)).Execute(&b, map[string]any{
-		"System": system,
-		"Prompt": prompt,
-	}); err != nil {
-		return err
+		traces = append(traces, trace)
 	}
 
-	_, err := io.Copy(w, &b)
-	return err
+	return prompt, traces, nil
+}
+
+// collateWithBudget drops the oldest turns until the content of msgs counts at
+// most budget tokens with countTokens. system messages and the final user
+// turn, i.e. the last user message and the messages after it, are never
+// dropped so the kept messages may still be over budget. the kept and dropped
+// messages are returned in their original order
+func collateWithBudget(msgs []api.Message, countTokens func(string) int, budget int) (kept, dropped []api.Message) {
+	drop := dropOverBudget(msgs, countTokens, budget)
+	for i, m := range msgs {
+		if drop[i] {
+			dropped = append(dropped, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+
+	return kept, dropped
+}
+
+// dropOverBudget reports which of msgs collateWithBudget drops
+func dropOverBudget(msgs []api.Message, countTokens func(string) int, budget int) []bool {
+	final := max(len(msgs)-1, 0)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			final = i
+			break
+		}
+	}
+
+	var total int
+	counts := make([]int, len(msgs))
+	for i, m := range msgs {
+		counts[i] = countTokens(m.Content)
+		total += counts[i]
+	}
+
+	drop := make([]bool, len(msgs))
+	for i := 0; i < final; i++ {
+		// whole turns are dropped so the kept messages don't start with the
+		// response to a dropped prompt
+		if total <= budget && (i == 0 || msgs[i].Role == "user") {
+			break
+		}
+
+		if msgs[i].Role != "system" {
+			drop[i] = true
+			total -= counts[i]
+		}
+	}
+
+	return drop
 }
 
 // collate messages based on role. consecutive messages of the same role are merged
 // into a single message. collate also collects and returns all system messages.
-// collate mutates message content adding image tags ([img-%d]) as needed
-func collate(msgs []api.Message) (string, []*api.Message) {
-	var n int
-
+// collate mutates message content adding image tags formatted with imageTag as
+// needed and returns the index of the image each tag refers to among the
+// images of msgs. if dedupe is set, messages identical to the preceding
+// message are dropped. if inline is set, only leading system messages are
+// collected
+func collate(msgs []api.Message, dedupe, inline, merge bool, imageTag string) (string, []*api.Message, []int) {
 	var system []string
 	var collated []*api.Message
+	var images []int
+	var offset int
+	// leading is set until the first message that isn't a system message
+	leading := true
 	for i := range msgs {
+		offset += len(msgs[i].Images)
+		if dedupe && i > 0 && duplicate(msgs[i], msgs[i-1]) {
+			continue
+		}
+
 		msg := msgs[i]
-		for range msg.Images {
-			imageTag := fmt.Sprintf("[img-%d]", n)
-			if !strings.Contains(msg.Content, "[img]") {
-				msg.Content = strings.TrimSpace("[img] " + msg.Content)
+		if len(msg.Images) > 0 {
+			tags := make([]string, len(msg.Images))
+			for j := range msg.Images {
+				tags[j] = fmt.Sprintf(imageTag, len(images))
+				images = append(images, offset-len(msg.Images)+j)
 			}
 
-			msg.Content = strings.Replace(msg.Content, "[img]", imageTag, 1)
-			n++
+			if content, ok := partTags(msg.Parts, tags); ok {
+				msg.Content = content
+			} else {
+				msg.Content = imageTags(msg.Content, tags)
+			}
 		}
 
-		if msg.Role == "system" {
+		// leading system messages are merged into the first collated message
+		if msg.Role == "system" && (!inline || leading) {
 			system = append(system, msg.Content)
+		} else if msg.Role != "system" {
+			leading = false
 		}
 
-		if len(collated) > 0 && collated[len(collated)-1].Role == msg.Role {
-			collated[len(collated)-1].Content += "\n\n" + msg.Content
+		// messages of differently named assistants or results of different
+		// tool calls aren't merged
+		if last := len(collated) - 1; merge && last >= 0 && collated[last].Role == msg.Role && collated[last].Name == msg.Name && collated[last].ToolCallID == msg.ToolCallID {
+			// the merged message is a copy so appending doesn't modify msgs
+			collated[last].Content += "\n\n" + msg.Content
+			collated[last].Images = append(slices.Clip(collated[last].Images), msg.Images...)
+			collated[last].ToolCalls = append(slices.Clip(collated[last].ToolCalls), msg.ToolCalls...)
+			if msg.Thinking != "" {
+				collated[last].Thinking = strings.TrimPrefix(collated[last].Thinking+"\n\n"+msg.Thinking, "\n\n")
+			}
 		} else {
 			collated = append(collated, &msg)
 		}
 	}
 
-	return strings.Join(system, "\n\n"), collated
+	return strings.Join(system, "\n\n"), collated, images
+}
+
+// duplicate reports whether a and b are the same message, including their
+// images and tool calls, so one of them can be dropped without losing anything
+func duplicate(a, b api.Message) bool {
+	if a.Role != b.Role || a.Name != b.Name || a.ToolCallID != b.ToolCallID || a.Content != b.Content || a.Thinking != b.Thinking {
+		return false
+	}
+
+	if !slices.EqualFunc(a.Images, b.Images, func(x, y api.ImageData) bool { return bytes.Equal(x, y) }) {
+		return false
+	}
+
+	if !slices.EqualFunc(a.Parts, b.Parts, func(x, y api.ContentPart) bool {
+		return x.Type == y.Type && x.Text == y.Text && bytes.Equal(x.Image, y.Image)
+	}) {
+		return false
+	}
+
+	return slices.EqualFunc(a.ToolCalls, b.ToolCalls, func(x, y api.ToolCall) bool {
+		return x.ID == y.ID && x.Type == y.Type && x.Function.Name == y.Function.Name && x.Function.Arguments.Equal(y.Function.Arguments)
+	})
+}
+
+// partTags returns the text of parts, one part per line, with the image parts
+// replaced by tags in order. ok is false unless there's an image part for each
+// of tags
+func partTags(parts []api.ContentPart, tags []string) (string, bool) {
+	var lines []string
+	var n int
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			lines = append(lines, p.Text)
+		case "image_url":
+			if n == len(tags) {
+				return "", false
+			}
+
+			lines = append(lines, tags[n])
+			n++
+		}
+	}
+
+	return strings.Join(lines, "\n"), n == len(tags)
+}
+
+// imageTags substitutes tags for the [img] placeholders in content in order.
+// tags without a placeholder are prepended if content has none, otherwise
+// they're appended so the tags stay in the order of the images. placeholders
+// without a tag are left as is
+func imageTags(content string, tags []string) string {
+	parts := strings.Split(content, "[img]")
+	if len(parts) == 1 {
+		return strings.TrimSpace(strings.Join(tags, " ") + " " + content)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(parts[0])
+	for i, part := range parts[1:] {
+		if i < len(tags) {
+			sb.WriteString(tags[i])
+		} else {
+			sb.WriteString("[img]")
+		}
+
+		sb.WriteString(part)
+	}
+
+	if rest := tags[min(len(parts)-1, len(tags)):]; len(rest) > 0 {
+		sb.WriteString(" " + strings.Join(rest, " "))
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// repeatSystem returns msgs with a system message of system before each user
+// message in place of the system messages of msgs
+func repeatSystem(system string, msgs []*api.Message) []*api.Message {
+	var repeated []*api.Message
+	for _, m := range msgs {
+		if m.Role == "system" {
+			continue
+		}
+
+		if m.Role == "user" && system != "" {
+			repeated = append(repeated, &api.Message{Role: "system", Content: system})
+		}
+
+		repeated = append(repeated, m)
+	}
+
+	return repeated
+}
+
+// now returns the time turn headers are rendered at
+var now = time.Now
+
+// turnHeaders prepends header, executed for each of msgs, to their content
+func turnHeaders(header string, msgs []*api.Message) error {
+	tmpl, err := template.New("header").Option("missingkey=zero").Funcs(funcs).Parse(header)
+	if err != nil {
+		return err
+	}
+
+	t := now()
+	for i, m := range msgs {
+		if m.Content == "" && len(m.ToolCalls) > 0 {
+			continue
+		}
+
+		var b strings.Builder
+		if err := tmpl.Execute(&b, map[string]any{
+			"Index": i,
+			"Role":  m.Role,
+			"Name":  m.Name,
+			"Time":  t,
+		}); err != nil {
+			return err
+		}
+
+		m.Content = b.String() + m.Content
+	}
+
+	return nil
 }
 
 // Identifiers walks the node tree returning any identifiers it finds along the way
@@ -317,6 +2735,10 @@ func Identifiers(n parse.Node) []string {
 
 		return names
 	case *parse.TemplateNode:
+		if n.Pipe == nil {
+			return nil
+		}
+
 		return Identifiers(n.Pipe)
 	case *parse.ActionNode:
 		return Identifiers(n.Pipe)
@@ -380,7 +2802,9 @@ func deleteNode(n parse.Node, fn func(parse.Node) bool) parse.Node {
 		case *parse.BranchNode:
 			t.List = walk(t.List).(*parse.ListNode)
 			if t.ElseList != nil {
-				t.ElseList = walk(t.ElseList).(*parse.ListNode)
+				// the else branch is deleted entirely if the cut is in the
+				// if branch
+				t.ElseList, _ = walk(t.ElseList).(*parse.ListNode)
 			}
 		case *parse.ActionNode:
 			n := walk(t.Pipe)
@@ -3,13 +3,18 @@ package template
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/ollama/ollama/api"
@@ -61,6 +66,205 @@ func TestNamed(t *testing.T) {
 	}
 }
 
+func TestNamedParsed(t *testing.T) {
+	r, err := Named("{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := r.Parsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := r.Parsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Error("expected the parsed template to be reused")
+	}
+
+	tmpl, err := Parse(string(r.Bytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Tree.Root.String() != tmpl.Tree.Root.String() {
+		t.Error("expected the parsed template to match parsing its bytes")
+	}
+
+	if b, ok := Builtin(string(r.Bytes)); !ok || b.Name != r.Name {
+		t.Errorf("expected %s to be found by its text", r.Name)
+	}
+
+	if _, ok := Builtin(r.Template); ok {
+		t.Error("expected the Jinja template not to be found")
+	}
+}
+
+func BenchmarkNamedParsed(b *testing.B) {
+	templates, err := templatesOnce()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	t := templates[0]
+
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := Parse(string(t.Bytes)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// only the first lookup parses the template
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := t.Parsed(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNamedWithThreshold(t *testing.T) {
+	templates, err := templatesOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := slices.IndexFunc(templates, func(t *named) bool { return t.Name == "chatml" })
+	if i < 0 {
+		t.Fatal("chatml template not found")
+	}
+
+	chatml := templates[i].Template
+
+	t.Run("identical", func(t *testing.T) {
+		r, score, err := NamedWithThreshold(chatml, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Name != "chatml" || score != 0 {
+			t.Errorf("expected chatml with score 0, got %s with score %d", r.Name, score)
+		}
+	})
+
+	t.Run("whitespace", func(t *testing.T) {
+		s := strings.ReplaceAll(chatml, "\n", "  \r\n") + "\n\n"
+		r, score, err := NamedWithThreshold(s, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Name != "chatml" || score != 0 {
+			t.Errorf("expected chatml with score 0, got %s with score %d", r.Name, score)
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		r, score, err := NamedWithThreshold(strings.Replace(chatml, "system_message", "sys_msg", 1), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Name != "chatml" || score == 0 {
+			t.Errorf("expected chatml with a nonzero score, got %s with score %d", r.Name, score)
+		}
+
+		// the same template is rejected with a tighter threshold
+		r, tight, err := NamedWithThreshold(strings.Replace(chatml, "system_message", "sys_msg", 1), score)
+		if err == nil {
+			t.Error("expected error")
+		}
+
+		if r == nil || r.Name != "chatml" || tight != score {
+			t.Errorf("expected chatml with score %d alongside the error, got %v with score %d", score, r, tight)
+		}
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		r, score, err := NamedWithThreshold("this is not a template at all", 100)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+
+		if r == nil || score < 100 {
+			t.Errorf("expected the closest template with its score, got %v with score %d", r, score)
+		}
+
+		var nomatch *NoMatchError
+		if !errors.As(err, &nomatch) || nomatch.Closest != r.Name || nomatch.Distance != score {
+			t.Errorf("expected a NoMatchError for %s with distance %d, got %v", r.Name, score, err)
+		}
+
+		_, err = Named("this is not a template at all")
+		if !errors.As(err, &nomatch) || nomatch.Closest == "" || nomatch.Distance < 100 {
+			t.Errorf("expected a NoMatchError from Named, got %v", err)
+		}
+	})
+}
+
+func TestFromJinja(t *testing.T) {
+	templates, err := templatesOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jinja := make(map[string]string)
+	for _, t := range templates {
+		jinja[t.Name] = t.Template
+	}
+
+	// restyle the templates as they're often written, with whitespace
+	// control, double quotes and no spaces inside tags
+	restyle := strings.NewReplacer("{% ", "{%- ", " %}", " -%}", "{{ ", "{{", " }}", "}}", "'", `"`)
+
+	escaped, err := json.Marshal(restyle.Replace(jinja["gemma-instruct"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		jinja  string
+		expect string
+	}{
+		{"llama3-instruct", jinja["llama3-instruct"], "llama3-instruct"},
+		{"restyled", restyle.Replace(jinja["llama3-instruct"]), "llama3-instruct"},
+		{"escaped", string(escaped), "gemma-instruct"},
+		{"chatml", "{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}", "chatml"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := FromJinja(tt.jinja)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Name != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, r.Name)
+			}
+		})
+	}
+
+	t.Run("unmatched", func(t *testing.T) {
+		_, err := FromJinja("{% for m in messages %}<<{{ m.role }}>> {{ m.content }}{% endfor %}")
+
+		var nomatch *NoMatchError
+		if !errors.As(err, &nomatch) || nomatch.Closest == "" {
+			t.Errorf("expected a NoMatchError, got %v", err)
+		}
+	})
+}
+
 func TestTemplate(t *testing.T) {
 	cases := make(map[string][]api.Message)
 	for _, mm := range [][]api.Message{
@@ -196,166 +400,3090 @@ func TestParse(t *testing.T) {
 	}
 }
 
-func TestExecuteWithMessages(t *testing.T) {
-	type template struct {
-		name     string
-		template string
+func TestParseBOM(t *testing.T) {
+	tmpl, err := Parse("\ufeff{{ .System }} \ufeff{{ .Prompt }}")
+	if err != nil {
+		t.Fatal(err)
 	}
-	cases := []struct {
-		name      string
-		templates []template
-		values    Values
-		expected  string
-	}{
-		{
-			"mistral",
-			[]template{
-				{"no response", `[INST] {{ if .System }}{{ .System }}
 
-{{ end }}{{ .Prompt }}[/INST] `},
-				{"response", `[INST] {{ if .System }}{{ .System }}
-
-{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
-				{"messages", `[INST] {{ if .System }}{{ .System }}
+	if diff := cmp.Diff("{{ .System }} \ufeff{{ .Prompt }}", tmpl.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
 
-{{ end }}
-{{- range .Messages }}
-{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
-{{- end }}`},
-			},
-			Values{
-				Messages: []api.Message{
-					{Role: "user", Content: "Hello friend!"},
-					{Role: "assistant", Content: "Hello human!"},
-					{Role: "user", Content: "What is your name?"},
-				},
-			},
-			`[INST] Hello friend![/INST] Hello human![INST] What is your name?[/INST] `,
-		},
-		{
-			"mistral system",
-			[]template{
-				{"no response", `[INST] {{ if .System }}{{ .System }}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, Values{Messages: []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello!"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
 
-{{ end }}{{ .Prompt }}[/INST] `},
-				{"response", `[INST] {{ if .System }}{{ .System }}
+	// only the leading byte order mark is stripped
+	if diff := cmp.Diff("You are a helpful assistant. \ufeffHello!", b.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
 
-{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
-				{"messages", `[INST] {{ if .System }}{{ .System }}
+func TestAppendedResponse(t *testing.T) {
+	cases := []struct {
+		template string
+		expected bool
+	}{
+		{`{{ .Prompt }} {{ .Response }}`, false},
+		{`{{ range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}`, false},
+		{`{{ .Prompt }}`, true},
+	}
 
-{{ end }}
-{{- range .Messages }}
-{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
-{{- end }}`},
-			},
-			Values{
-				Messages: []api.Message{
-					{Role: "system", Content: "You are a helpful assistant!"},
-					{Role: "user", Content: "Hello friend!"},
-					{Role: "assistant", Content: "Hello human!"},
-					{Role: "user", Content: "What is your name?"},
-				},
-			},
-			`[INST] You are a helpful assistant!
+	for _, tt := range cases {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-Hello friend![/INST] Hello human![INST] What is your name?[/INST] `,
-		},
-		{
-			"chatml",
-			[]template{
-				// this does not have a "no response" test because it's impossible to render the same output
-				{"response", `{{ if .System }}<|im_start|>system
-{{ .System }}<|im_end|>
-{{ end }}{{ if .Prompt }}<|im_start|>user
-{{ .Prompt }}<|im_end|>
-{{ end }}<|im_start|>assistant
-{{ .Response }}<|im_end|>
-`},
-				{"messages", `
-{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
-{{ .Content }}<|im_end|>
-{{ end }}<|im_start|>assistant
-`},
-			},
-			Values{
-				Messages: []api.Message{
-					{Role: "system", Content: "You are a helpful assistant!"},
-					{Role: "user", Content: "Hello friend!"},
-					{Role: "assistant", Content: "Hello human!"},
-					{Role: "user", Content: "What is your name?"},
-				},
-			},
-			`<|im_start|>system
-You are a helpful assistant!<|im_end|>
-<|im_start|>user
-Hello friend!<|im_end|>
-<|im_start|>assistant
-Hello human!<|im_end|>
-<|im_start|>user
-What is your name?<|im_end|>
-<|im_start|>assistant
-`,
-		},
-		{
-			"moondream",
-			[]template{
-				// this does not have a "no response" test because it's impossible to render the same output
-				{"response", `{{ if .Prompt }}Question: {{ .Prompt }}
+			if actual := tmpl.AppendedResponse(); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
 
-{{ end }}Answer: {{ .Response }}
+			if diff := cmp.Diff(tt.template, tmpl.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
 
-`},
-				{"messages", `
-{{- range .Messages }}
-{{- if eq .Role "user" }}Question: {{ .Content }}
+func TestMustJSON(t *testing.T) {
+	var call api.ToolCall
+	call.Function.Name = "get_current_weather"
+	call.Function.Arguments.Set("location", make(chan int))
 
-{{ else if eq .Role "assistant" }}Answer: {{ .Content }}
+	v := Values{
+		Messages: []api.Message{
+			{Role: "user", Content: "What's the weather like today?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+		},
+	}
 
-{{ end }}
-{{- end }}Answer: `},
-			},
-			Values{
-				Messages: []api.Message{
-					{Role: "user", Content: "What's in this image?", Images: []api.ImageData{[]byte("")}},
-					{Role: "assistant", Content: "It's a hot dog."},
-					{Role: "user", Content: "What's in _this_ image?"},
-					{Role: "user", Images: []api.ImageData{[]byte("")}},
-					{Role: "user", Content: "Is it a hot dog?"},
-				},
-			},
-			`Question: [img-0] What's in this image?
+	t.Run("json", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ range .ToolCalls }}{{ json .Function.Arguments }}{{ end }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-Answer: It's a hot dog.
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, v); err != nil {
+			t.Fatal(err)
+		}
 
-Question: What's in _this_ image?
+		if b.String() != "" {
+			t.Errorf("expected empty output, got %q", b.String())
+		}
+	})
 
-[img-1]
+	t.Run("mustJSON", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ range .ToolCalls }}{{ mustJSON .Function.Arguments }}{{ end }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-Is it a hot dog?
+		var b bytes.Buffer
+		var jsonErr *json.UnsupportedTypeError
+		if err := tmpl.Execute(&b, v); !errors.As(err, &jsonErr) {
+			t.Fatalf("expected unsupported type error, got %v", err)
+		}
+	})
+}
 
-Answer: `,
-		},
-	}
+func TestPropExample(t *testing.T) {
+	var tool api.Tool
+	if err := json.Unmarshal([]byte(`{
+		"type": "function",
+		"function": {
+			"name": "get_current_weather",
+			"parameters": {
+				"type": "object",
+				"properties": {
+					"days": {"type": "integer", "description": "Number of days", "examples": [3, 7]},
+					"location": {"type": "string", "description": "The city", "examples": ["Paris, France"]},
+					"unit": {"type": "string", "description": "The unit", "enum": ["celsius", "fahrenheit"]}
+				}
+			}
+		}
+	}`), &tool); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := Parse(`{{ range .Tools }}{{ range $name, $prop := .Function.Parameters.Properties }}{{ $name }}: {{ $prop.Description }}{{ with propExample $prop }} (e.g. {{ . }}){{ end }}
+{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Template.Execute(&b, map[string]any{"Tools": []api.Tool{tool}, "Response": ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `days: Number of days (e.g. 3)
+location: The city (e.g. "Paris, France")
+unit: The unit
+`
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	templates, err := templatesOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every builtin template is a legacy template with a system prompt
+	for _, n := range templates {
+		t.Run(n.Name, func(t *testing.T) {
+			tmpl, err := n.Parsed()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(Capabilities{Images: true, System: true, MultiTurn: true}, tmpl.Capabilities()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		expected Capabilities
+	}{
+		{
+			"tools",
+			`{{ if .Tools }}{{ json .Tools }}{{ end }}{{ range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}`,
+			Capabilities{Tools: true, Images: true, System: true, MultiTurn: true},
+		},
+		{
+			"messages without roles",
+			`{{ range .Messages }}{{ .Content }}{{ end }}`,
+			Capabilities{Images: true, MultiTurn: true},
+		},
+		{
+			"prompt",
+			`{{ .Prompt }}`,
+			Capabilities{Images: true, MultiTurn: true},
+		},
+		{
+			"static",
+			`Hello`,
+			Capabilities{MultiTurn: true},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, tmpl.Capabilities()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSupportsTools(t *testing.T) {
+	templates, err := templatesOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range templates {
+		t.Run(n.Name, func(t *testing.T) {
+			tmpl, err := n.Parsed()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tmpl.SupportsTools() {
+				t.Error("expected builtin template not to support tools")
+			}
+		})
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		expected bool
+	}{
+		{"default", DefaultTemplate.String(), false},
+		{"tools and tool calls", `{{ if .Tools }}{{ json .Tools }}{{ end }}{{ range .Messages }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}{{ end }}`, true},
+		{"variable", `{{ range .Messages }}{{ with $.Tools }}{{ json . }}{{ end }}{{ if .ToolCalls }}{{ json .ToolCalls }}{{ end }}{{ end }}`, true},
+		{"tools only", `{{ if .Tools }}{{ json .Tools }}{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`, false},
+		{"tool calls only", `{{ range .Messages }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}{{ end }}`, false},
+		{"unconditional", `{{ json .Tools }}{{ range .Messages }}{{ json .ToolCalls }}{{ end }}`, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual := tmpl.SupportsTools(); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSystemSubtree(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"default", DefaultTemplate.String(), ""},
+		{"if", `{{ if .System }}<|system|>{{ .System }}<|end|>{{ end }}<|user|>{{ .Prompt }}<|end|>`, "<|system|>You are a helpful assistant.<|end|>"},
+		{"with", `{{ range .Messages }}{{ with $.System }}[SYS]{{ . }}[/SYS]{{ end }}{{ .Content }}{{ end }}`, "[SYS]You are a helpful assistant.[/SYS]"},
+		{"unconditional", `{{ .System }} {{ .Prompt }}`, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sub := tmpl.SystemSubtree()
+			if tt.expected == "" {
+				if sub != nil {
+					t.Errorf("expected no system subtree, got %q", sub.Root.String())
+				}
+				return
+			} else if sub == nil {
+				t.Fatal("expected a system subtree")
+			}
+
+			var b bytes.Buffer
+			if err := sub.Execute(&b, map[string]any{"System": "You are a helpful assistant."}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWithSystem(t *testing.T) {
+	chatml, err := os.ReadFile("chatml.gotmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		system   string
+		expected string
+	}{
+		{
+			"if",
+			string(chatml),
+			"<|im_start|>system\n# Rules\n{{ .System }}<|im_end|>\n",
+			"<|im_start|>system\n# Rules\nYou are a helpful assistant.<|im_end|>\n<|im_start|>user\nHello friend!<|im_end|>\n<|im_start|>assistant\n",
+		},
+		{
+			"with",
+			`{{ with .System }}[SYS]{{ . }}[/SYS]{{ end }}{{ range .Messages }}{{ if ne .Role "system" }}[{{ .Role }}]{{ .Content }}{{ end }}{{ end }}`,
+			"<<SYS>>{{ .System }}<</SYS>>",
+			"<<SYS>>You are a helpful assistant.<</SYS>>[user]Hello friend!",
+		},
+		{
+			"no system",
+			`{{ range .Messages }}{{ if ne .Role "system" }}[{{ .Role }}]{{ .Content }}{{ end }}{{ end }}`,
+			"<<SYS>>{{ .System }}<</SYS>>",
+			"<<SYS>>You are a helpful assistant.<</SYS>>[user]Hello friend!",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			composed, err := tmpl.WithSystem(tt.system)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := composed.Execute(&b, Values{Messages: []api.Message{
+				{Role: "system", Content: "You are a helpful assistant."},
+				{Role: "user", Content: "Hello friend!"},
+			}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			// the receiver is left as is
+			if tmpl.String() != tt.template {
+				t.Errorf("expected the original template to be unchanged, got %q", tmpl.String())
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		tmpl, err := Parse(string(chatml))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tmpl.WithSystem("{{ .System "); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestCanonical(t *testing.T) {
+	chatml, err := os.ReadFile("chatml.gotmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		a, b string
+	}{
+		{"spaces", `{{ if .System }}{{ .System }}   {{ end }}{{ .Prompt }}`, "{{if .System}}{{.System}}\n{{end}}\n{{.Prompt}}"},
+		{"comments", `[INST] {{ .Prompt }} [/INST]`, `[INST] {{/* prompt */}}{{ .Prompt }} [/{{- /* end */ -}} INST]`},
+		{"trim", "{{ range .Messages }}\n{{ .Content }}\n{{ end }}", "{{- range .Messages }}{{ .Content }}{{ end -}}"},
+		{"define", `{{ define "b" }}B{{ end }}{{ define "a" }}A{{ end }}{{ template "a" }}{{ template "b" }}`, `{{ define "a" }}A{{ end }}{{ define "b" }}  B {{ end }}{{ template "a" }}{{ template "b" }}`},
+		{"files", string(chatml), "{{ if .System }}<|im_start|>system {{ .System }}<|im_end|> {{ end }}{{ if .Prompt }}<|im_start|>user {{ .Prompt }}<|im_end|> {{ end }}<|im_start|>assistant {{ .Response }}<|im_end|> "},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := Parse(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := Parse(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(a.Canonical(), b.Canonical()); diff != "" {
+				t.Errorf("mismatch (-a +b):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("different", func(t *testing.T) {
+		for _, pair := range [][2]string{
+			{`{{ .System }} {{ .Prompt }}`, `{{ .Prompt }} {{ .System }}`},
+			{`{{ define "a" }}A{{ end }}{{ template "a" }}`, `{{ define "a" }}B{{ end }}{{ template "a" }}`},
+		} {
+			a, err := Parse(pair[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := Parse(pair[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if a.Canonical() == b.Canonical() {
+				t.Errorf("expected %q and %q to differ, both are %q", pair[0], pair[1], a.Canonical())
+			}
+		}
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		tmpl, err := Parse("{{ if .System }}{{ .System }}\n\n{{ end }}{{ .Prompt }} {{ .Response }}")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := tmpl.Tree.Root.String()
+		tmpl.Canonical()
+		if after := tmpl.Tree.Root.String(); after != before {
+			t.Errorf("expected the template to be unchanged, got %q", after)
+		}
+	})
+}
+
+func TestExecuteDebug(t *testing.T) {
+	values := Values{
+		Messages: []api.Message{
+			{Role: "user", Content: "Hello!"},
+			{Role: "assistant", Content: "Hi there."},
+			{Role: "user", Content: "How are you?"},
+		},
+		ResponsePrefix: "I'm",
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		regions  [][2]string
+	}{
+		{
+			"messages",
+			`{{- range .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`,
+			[][2]string{
+				{"<|im_start|>user\n", "template"},
+				{"Hello!", "message 0"},
+				{"<|im_end|>\n<|im_start|>assistant\n", "template"},
+				{"Hi there.", "message 1"},
+				{"<|im_end|>\n<|im_start|>user\n", "template"},
+				{"How are you?", "message 2"},
+				{"<|im_end|>\n<|im_start|>assistant\n", "template"},
+				{"I'm", "response prefix"},
+			},
+		},
+		{
+			"response",
+			`{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`,
+			[][2]string{
+				{"<|im_start|>user\n", "template"},
+				{"Hello!", "message 0"},
+				{"<|im_end|>\n<|im_start|>assistant\n", "template"},
+				{"Hi there.", "message 1"},
+				{"<|im_end|>\n<|im_start|>user\n", "template"},
+				{"How are you?", "message 2"},
+				{"<|im_end|>\n<|im_start|>assistant\n", "template"},
+				{"I'm", "response prefix"},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, values); err != nil {
+				t.Fatal(err)
+			}
+
+			prompt, spans, err := tmpl.ExecuteDebug(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if prompt != b.String() {
+				t.Errorf("expected the same prompt as Execute\nwant: %q\n got: %q", b.String(), prompt)
+			}
+
+			var expect []Span
+			var offset int
+			for _, region := range tt.regions {
+				expect = append(expect, Span{Start: offset, End: offset + len(region[0]), Source: region[1]})
+				offset += len(region[0])
+			}
+
+			if diff := cmp.Diff(expect, spans); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExecuteTrace(t *testing.T) {
+	tmpl, err := Parse(`{{ if .System }}[{{ .System }}]
+{{ end }}{{ range .Messages }}<{{ .Role }}>{{ .Content }}
+{{ end }}>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := Values{
+		Messages: []api.Message{
+			{Role: "system", Content: "Be nice."},
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello"},
+		},
+		ResponsePrefix: "!",
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, values); err != nil {
+		t.Fatal(err)
+	}
+
+	prompt, traces, err := tmpl.ExecuteTrace(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prompt != b.String() {
+		t.Errorf("expected the same prompt as Execute\nwant: %q\n got: %q", b.String(), prompt)
+	}
+
+	regions := []struct {
+		text    string
+		node    string
+		message int
+	}{
+		// if
+		{"[", "1:16", -1},
+		{"Be nice.", "1:20", 0},
+		{"]\n", "1:30", -1},
+		// range
+		{"<", "2:30", 0},
+		{"system", "2:34", 0},
+		{">", "2:42", 0},
+		{"Be nice.", "2:46", 0},
+		{"\n", "2:57", 0},
+		{"<", "2:30", 1},
+		{"user", "2:34", 1},
+		{">", "2:42", 1},
+		{"Hi", "2:46", 1},
+		{"\n", "2:57", 1},
+		{"<", "2:30", 2},
+		{"assistant", "2:34", 2},
+		{">", "2:42", 2},
+		// the trailing assistant message is continued so rendering stops
+		// after its content
+		{"Hello", "2:46", 2},
+		// response prefix
+		{"!", "", -1},
+	}
+
+	var expect []Trace
+	var offset int
+	for _, r := range regions {
+		expect = append(expect, Trace{Start: offset, End: offset + len(r.text), Node: r.node, Message: r.message})
+		offset += len(r.text)
+	}
+
+	if diff := cmp.Diff(expect, traces); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		allowed  []string
+		err      string
+	}{
+		{"valid", `{{ if .System }}{{ .System }} {{ end }}{{ range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}`, nil, ""},
+		{"typo", `{{ if .Sytem }}{{ .Sytem }} {{ end }}{{ .Prompt }}`, nil, "template uses undefined variables: .Sytem (1:6)"},
+		{"root variable", `{{ range .Messages }}{{ $.Sytem }}{{ .Content }}{{ end }}`, nil, "template uses undefined variables: .Sytem (1:25)"},
+		{"multiple", `{{ .Promt }}{{ .Respnse }}`, nil, "template uses undefined variables: .Promt (1:3), .Respnse (1:15)"},
+		{"message typo", `{{ range .Messages }}{{ .Role }}:
+{{ .Contnet }}{{ end }}`, nil, "template uses undefined variables: .Contnet (2:3)"},
+		{"top level field on message", `{{ range .Messages }}{{ .System }}{{ end }}`, nil, "template uses undefined variables: .System (1:24)"},
+		{"message fields", `{{ range $i, $m := .Messages }}{{ if eq .Role "tool" }}{{ .ToolCallID }}{{ end }}{{ .Name }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}{{ len .Images }}{{ end }}`, nil, ""},
+		{"custom func", `{{ if .Tools }}{{ json .Tools }}{{ end }}{{ range .Messages }}{{ range .ToolCalls }}{{ json .Function.Arguments }}{{ end }}{{ end }}`, nil, ""},
+		{"with", `{{ with .Tools }}{{ .Function }}{{ else }}{{ .Prompt }}{{ end }}`, nil, ""},
+		{"allowed", `{{ .Date }}{{ range .Messages }}{{ .Time }}{{ .Content }}{{ end }}`, []string{"Date", "Time"}, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = tmpl.Validate(tt.allowed...)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("expected %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("named", func(t *testing.T) {
+		templates, err := templatesOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, n := range templates {
+			tmpl, err := n.Parsed()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tmpl.Validate(); err != nil {
+				t.Errorf("%s: %v", n.Name, err)
+			}
+		}
+	})
+}
+
+func TestCollateImages(t *testing.T) {
+	a, b, c := api.ImageData("a"), api.ImageData("b"), api.ImageData("c")
+
+	cases := []struct {
+		name   string
+		msgs   []api.Message
+		expect []*api.Message
+	}{
+		{
+			name: "no content",
+			msgs: []api.Message{
+				{Role: "user", Images: []api.ImageData{a, b}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "[img-0] [img-1]", Images: []api.ImageData{a, b}},
+			},
+		},
+		{
+			name: "no placeholders",
+			msgs: []api.Message{
+				{Role: "user", Content: "What do these show?", Images: []api.ImageData{a, b}},
+				{Role: "assistant", Content: "A cat and a dog."},
+				{Role: "user", Content: "And this one?", Images: []api.ImageData{c}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "[img-0] [img-1] What do these show?", Images: []api.ImageData{a, b}},
+				{Role: "assistant", Content: "A cat and a dog."},
+				{Role: "user", Content: "[img-2] And this one?", Images: []api.ImageData{c}},
+			},
+		},
+		{
+			name: "placeholders",
+			msgs: []api.Message{
+				{Role: "user", Content: "Is [img] bigger than [img]?", Images: []api.ImageData{a, b}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "Is [img-0] bigger than [img-1]?", Images: []api.ImageData{a, b}},
+			},
+		},
+		{
+			name: "fewer placeholders",
+			msgs: []api.Message{
+				{Role: "user", Content: "Compare [img] with these:", Images: []api.ImageData{a, b, c}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "Compare [img-0] with these: [img-1] [img-2]", Images: []api.ImageData{a, b, c}},
+			},
+		},
+		{
+			name: "more placeholders",
+			msgs: []api.Message{
+				{Role: "user", Content: "What's in [img]? Markdown images look like [img]", Images: []api.ImageData{a}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "What's in [img-0]? Markdown images look like [img]", Images: []api.ImageData{a}},
+			},
+		},
+		{
+			name: "parts",
+			msgs: []api.Message{
+				{Role: "user", Content: "Is [img]\nthe same as", Images: []api.ImageData{a, b}, Parts: []api.ContentPart{
+					{Type: "text", Text: "Is [img]"},
+					{Type: "image_url", Image: a},
+					{Type: "text", Text: "the same as"},
+					{Type: "image_url", Image: b},
+				}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "Is [img]\n[img-0]\nthe same as\n[img-1]", Images: []api.ImageData{a, b}, Parts: []api.ContentPart{
+					{Type: "text", Text: "Is [img]"},
+					{Type: "image_url", Image: a},
+					{Type: "text", Text: "the same as"},
+					{Type: "image_url", Image: b},
+				}},
+			},
+		},
+		{
+			name: "merged",
+			msgs: []api.Message{
+				{Role: "user", Images: []api.ImageData{a, b}},
+				{Role: "user", Content: "Which of [img] and [img] is a cat?", Images: []api.ImageData{c}},
+			},
+			expect: []*api.Message{
+				{Role: "user", Content: "[img-0] [img-1]\n\nWhich of [img-2] and [img] is a cat?", Images: []api.ImageData{a, b, c}},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, collated, images := collate(tt.msgs, false, false, true, "[img-%d]")
+			if diff := cmp.Diff(tt.expect, collated); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			// every image is tagged in order
+			var n int
+			for _, m := range tt.msgs {
+				n += len(m.Images)
+			}
+
+			for i, j := range images {
+				if i != j {
+					t.Errorf("expected tag %d to refer to image %d, got %d", i, i, j)
+				}
+			}
+
+			if len(images) != n {
+				t.Errorf("expected %d tags, got %d", n, len(images))
+			}
+		})
+	}
+}
+
+func TestImageIndexes(t *testing.T) {
+	tmpl, err := Parse(`{{ range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What's this?", Images: []api.ImageData{[]byte("a")}},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "And these?", Images: []api.ImageData{[]byte("b"), []byte("c")}},
+		{Role: "user", Content: "And these?", Images: []api.ImageData{[]byte("b"), []byte("c")}},
+		{Role: "assistant", Content: "Two dogs."},
+		{Role: "user", Content: "[img] or [img]?", Images: []api.ImageData{[]byte("d"), []byte("e")}},
+	}
+
+	cases := []struct {
+		name   string
+		values Values
+		expect []int
+	}{
+		{"all", Values{Messages: msgs}, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"deduplicated", Values{Messages: msgs, DropConsecutiveDuplicates: true}, []int{0, 1, 2, 5, 6}},
+		{"budget", Values{Messages: msgs, TokenBudget: 5, CountTokens: func(s string) int { return len(strings.Fields(s)) }}, []int{5, 6}},
+		{"suffix", Values{Messages: msgs, Prompt: "def", Suffix: "return"}, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.expect, tmpl.ImageIndexes(tt.values)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollateDropConsecutiveDuplicates(t *testing.T) {
+	call := func(name string) api.ToolCall {
+		var c api.ToolCall
+		c.Function.Name = name
+		return c
+	}
+
+	cases := []struct {
+		name   string
+		msgs   []api.Message
+		expect int
+	}{
+		{
+			"duplicates",
+			[]api.Message{
+				{Role: "user", Content: "Hello!", Images: []api.ImageData{[]byte("a")}},
+				{Role: "user", Content: "Hello!", Images: []api.ImageData{[]byte("a")}},
+			},
+			1,
+		},
+		{
+			"different tool calls",
+			[]api.Message{
+				{Role: "assistant", ToolCalls: []api.ToolCall{call("x")}},
+				{Role: "assistant", ToolCalls: []api.ToolCall{call("y")}},
+			},
+			2,
+		},
+		{
+			"different images",
+			[]api.Message{
+				{Role: "user", Content: "What's this?", Images: []api.ImageData{[]byte("a")}},
+				{Role: "user", Content: "What's this?", Images: []api.ImageData{[]byte("b")}},
+			},
+			2,
+		},
+		{
+			"different thinking",
+			[]api.Message{
+				{Role: "assistant", Content: "Paris.", Thinking: "France?"},
+				{Role: "assistant", Content: "Paris.", Thinking: "Texas?"},
+			},
+			2,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, collated, _ := collate(tt.msgs, true, false, false, "[img-%d]")
+			if len(collated) != tt.expect {
+				t.Errorf("expected %d messages, got %d", tt.expect, len(collated))
+			}
+		})
+	}
+}
+
+func TestCollateKeepSystemInline(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant!"},
+		{Role: "user", Content: "Hello friend!"},
+		{Role: "system", Content: "Answer in French."},
+		{Role: "user", Content: "What is your name?"},
+	}
+
+	expected := []*api.Message{
+		{Role: "system", Content: "You are a helpful assistant!"},
+		{Role: "user", Content: "Hello friend!"},
+		{Role: "system", Content: "Answer in French."},
+		{Role: "user", Content: "What is your name?"},
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		system, collated, _ := collate(msgs, false, false, true, "[img-%d]")
+		if system != "You are a helpful assistant!\n\nAnswer in French." {
+			t.Errorf("unexpected system %q", system)
+		}
+
+		if diff := cmp.Diff(expected, collated); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("inline", func(t *testing.T) {
+		system, collated, _ := collate(msgs, false, true, true, "[img-%d]")
+		if system != "You are a helpful assistant!" {
+			t.Errorf("unexpected system %q", system)
+		}
+
+		if diff := cmp.Diff(expected, collated); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("inline unmerged", func(t *testing.T) {
+		msgs := []api.Message{
+			{Role: "system", Content: "a"},
+			{Role: "system", Content: "b"},
+			{Role: "system", Content: "c"},
+			{Role: "user", Content: "Hello friend!"},
+			{Role: "system", Content: "d"},
+		}
+
+		// every leading system message is in .System, not only the first two
+		system, _, _ := collate(msgs, false, true, false, "[img-%d]")
+		if system != "a\n\nb\n\nc" {
+			t.Errorf("unexpected system %q", system)
+		}
+	})
+
+	// inline renders system messages after the first in place while hoisted
+	// only renders .System
+	inline := `{{ if .System }}<|system|>{{ .System }}{{ end }}
+{{- range $i, $_ := .Messages }}
+{{- if eq .Role "user" }}<|user|>{{ .Content }}
+{{- else if and (eq .Role "system") $i }}<|system|>{{ .Content }}
+{{- end }}
+{{- end }}<|assistant|>`
+	hoisted := `{{ if .System }}<|system|>{{ .System }}{{ end }}
+{{- range .Messages }}
+{{- if eq .Role "system" }}{{ continue }}{{ end }}<|{{ .Role }}|>{{ .Content }}
+{{- end }}<|assistant|>`
+
+	leading := []api.Message{msgs[0], msgs[1]}
+	trailing := []api.Message{msgs[1], msgs[2]}
+
+	cases := []struct {
+		name     string
+		template string
+		msgs     []api.Message
+		inline   bool
+		expected string
+	}{
+		{"inline leading", inline, leading, false, "<|system|>You are a helpful assistant!<|user|>Hello friend!<|assistant|>"},
+		{"inline mid", inline, msgs, false, "<|system|>You are a helpful assistant!<|user|>Hello friend!<|system|>Answer in French.<|user|>What is your name?<|assistant|>"},
+		{"inline trailing", inline, trailing, false, "<|user|>Hello friend!<|system|>Answer in French.<|assistant|>"},
+		{"hoisted leading", hoisted, leading, false, "<|system|>You are a helpful assistant!<|user|>Hello friend!<|assistant|>"},
+		{"hoisted mid", hoisted, msgs, false, "<|system|>You are a helpful assistant!\n\nAnswer in French.<|user|>Hello friend!<|user|>What is your name?<|assistant|>"},
+		{"hoisted trailing", hoisted, trailing, false, "<|system|>Answer in French.<|user|>Hello friend!<|assistant|>"},
+		{"hoisted mid kept inline", hoisted, msgs, true, "<|system|>You are a helpful assistant!<|user|>Hello friend!<|user|>What is your name?<|assistant|>"},
+	}
+
+	for _, tt := range cases {
+		t.Run("execute "+tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: tt.msgs, KeepSystemInline: tt.inline}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepeatSystemEachTurn(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "Answer in French."},
+		{Role: "user", Content: "Hello friend!"},
+		{Role: "assistant", Content: "Bonjour !"},
+		{Role: "user", Content: "What is your name?"},
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		repeat   bool
+		expected string
+	}{
+		{
+			"messages",
+			`{{ if .System }}<|system|>{{ .System }}{{ end }}{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}<|assistant|>`,
+			false,
+			"<|system|>Answer in French.<|system|>Answer in French.<|user|>Hello friend!<|assistant|>Bonjour !<|user|>What is your name?<|assistant|>",
+		},
+		{
+			"messages repeated",
+			`{{ if .System }}<|system|>{{ .System }}{{ end }}{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}<|assistant|>`,
+			true,
+			"<|system|>Answer in French.<|user|>Hello friend!<|assistant|>Bonjour !<|system|>Answer in French.<|user|>What is your name?<|assistant|>",
+		},
+		{
+			"response",
+			`{{ if .System }}<|system|>{{ .System }}{{ end }}<|user|>{{ .Prompt }}<|assistant|>{{ .Response }}`,
+			false,
+			"<|system|>Answer in French.<|user|>Hello friend!<|assistant|>Bonjour !<|user|>What is your name?<|assistant|>",
+		},
+		{
+			"response repeated",
+			`{{ if .System }}<|system|>{{ .System }}{{ end }}<|user|>{{ .Prompt }}<|assistant|>{{ .Response }}`,
+			true,
+			"<|system|>Answer in French.<|user|>Hello friend!<|assistant|>Bonjour !<|system|>Answer in French.<|user|>What is your name?<|assistant|>",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: msgs, RepeatSystemEachTurn: tt.repeat}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollateConsecutiveMessages(t *testing.T) {
+	var call api.ToolCall
+	call.Function.Name = "get_current_weather"
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What's in this picture?", Images: []api.ImageData{[]byte("a")}},
+		{Role: "user", Content: "And this one?", Images: []api.ImageData{[]byte("b")}},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+		{Role: "assistant", Content: "Let me check the weather too."},
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		_, collated, _ := collate(msgs, false, false, true, "[img-%d]")
+		if diff := cmp.Diff([]*api.Message{
+			{Role: "user", Content: "[img-0] What's in this picture?\n\n[img-1] And this one?", Images: []api.ImageData{[]byte("a"), []byte("b")}},
+			{Role: "assistant", Content: "\n\nLet me check the weather too.", ToolCalls: []api.ToolCall{call}},
+		}, collated); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if len(msgs[0].Images) != 1 || len(msgs[2].ToolCalls) != 1 {
+			t.Error("expected messages to be unchanged")
+		}
+	})
+
+	tmpl, err := Parse(`{{- range .Messages }}<|im_start|>{{ .Role }}
+{{ range .ToolCalls }}{{ .Function.Name }}(){{ end }}{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		keep     bool
+		expected string
+	}{
+		{"execute merged", false, `<|im_start|>user
+[img-0] What's in this picture?
+
+[img-1] And this one?<|im_end|>
+<|im_start|>assistant
+get_current_weather()
+
+Let me check the weather too.<|im_end|>
+<|im_start|>assistant
+`},
+		{"execute kept", true, `<|im_start|>user
+[img-0] What's in this picture?<|im_end|>
+<|im_start|>user
+[img-1] And this one?<|im_end|>
+<|im_start|>assistant
+get_current_weather()<|im_end|>
+<|im_start|>assistant
+Let me check the weather too.<|im_end|>
+<|im_start|>assistant
+`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: msgs, KeepConsecutiveMessages: tt.keep, AppendEndMarker: "<|endoftext|>"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected+"<|endoftext|>", b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		tmpl, err := Parse(`<|user|>{{ .Prompt }}<|assistant|>{{ .Response }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs[:2], KeepConsecutiveMessages: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		// templates without .Messages merge anyway so no message is lost
+		if diff := cmp.Diff("<|user|>[img-0] What's in this picture?\n\n[img-1] And this one?<|assistant|>", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestCollateNamedAssistants(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "user", Content: "Should we ship on Friday?"},
+		{Role: "assistant", Name: "planner", Content: "Yes, the release is ready."},
+		{Role: "assistant", Name: "reviewer", Content: "Not before the tests pass."},
+		{Role: "assistant", Name: "reviewer", Content: "They're still running."},
+	}
+
+	_, collated, _ := collate(msgs, false, false, true, "[img-%d]")
+	if diff := cmp.Diff([]*api.Message{
+		{Role: "user", Content: "Should we ship on Friday?"},
+		{Role: "assistant", Name: "planner", Content: "Yes, the release is ready."},
+		{Role: "assistant", Name: "reviewer", Content: "Not before the tests pass.\n\nThey're still running."},
+	}, collated); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	tmpl, err := Parse(`{{- range .Messages }}
+{{- if eq .Role "user" }}<|user|>{{ .Content }}
+{{ else }}<|assistant|>{{ .Name }}: {{ .Content }}
+{{ end }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, Values{Messages: append(msgs, api.Message{Role: "assistant", Content: "Unnamed."})}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<|user|>Should we ship on Friday?
+<|assistant|>planner: Yes, the release is ready.
+<|assistant|>reviewer: Not before the tests pass.
+
+They're still running.
+<|assistant|>: Unnamed.`
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestToolCallID(t *testing.T) {
+	var call api.ToolCall
+	call.ID = "call_0"
+	call.Function.Name = "get_current_weather"
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What's the weather in Paris and London?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call, call}},
+		{Role: "tool", ToolCallID: "call_0", Content: "22"},
+		{Role: "tool", ToolCallID: "call_1", Content: "18"},
+	}
+
+	tmpl, err := Parse(`{{- range .Messages }}
+{{- if eq .Role "tool" }}<|tool|>{{ .ToolCallID }}: {{ .Content }}
+{{ end }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, Values{Messages: msgs}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff("<|tool|>call_0: 22\n<|tool|>call_1: 18\n", b.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTurnHeader(t *testing.T) {
+	t.Cleanup(func() { now = time.Now })
+	now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+	var call api.ToolCall
+	call.Function.Name = "get_current_weather"
+	call.Function.Arguments.Set("location", "Paris")
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+		{Role: "tool", Content: "22"},
+		{Role: "assistant", Content: "It's 22 degrees."},
+		{Role: "user", Content: "Thanks!"},
+	}
+
+	header := `[Turn {{ add .Index 1 }}, {{ .Role }}, {{ .Time.Format "2006-01-02" }}] `
+
+	t.Run("messages", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ if .ToolCalls }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}{{ else }}{{ .Content }}{{ end }}
+{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs, TurnHeader: header}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(`[Turn 1, system, 2024-01-01] You are a helpful assistant.
+[Turn 2, user, 2024-01-01] What's the weather in Paris?
+get_current_weather
+[Turn 4, tool, 2024-01-01] 22
+[Turn 5, assistant, 2024-01-01] It's 22 degrees.
+[Turn 6, user, 2024-01-01] Thanks!
+`, b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		tmpl, err := Parse(`{{ if .Prompt }}USER: {{ .Prompt }}
+{{ end }}ASSISTANT: {{ .Response }}
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: []api.Message{
+			{Role: "user", Content: "Hello!"},
+			{Role: "assistant", Content: "Hi!"},
+			{Role: "user", Content: "Bye!"},
+		}, TurnHeader: "({{ .Index }}) "}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("USER: (0) Hello!\nASSISTANT: (1) Hi!\nUSER: (2) Bye!\nASSISTANT: ", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ .Content }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs[:2]}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("You are a helpful assistant.What's the weather in Paris?", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ .Content }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tmpl.Execute(io.Discard, Values{Messages: msgs, TurnHeader: "{{ .Index "}); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestPrefill(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Write a haiku about the sea."},
+		{Role: "assistant", Content: "Waves fold into foam,"},
+	}
+
+	templates := []struct {
+		name     string
+		template string
+	}{
+		{"response", `{{ if .System }}<|im_start|>system
+{{ .System }}<|im_end|>
+{{ end }}{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`},
+		{"messages", `
+{{- range $i, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}
+{{- if ne (index .Messages (sub (len .Messages) 1)).Role "assistant" }}<|im_start|>assistant
+{{ end }}`},
+	}
+
+	for _, tt := range templates {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: msgs}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(`<|im_start|>system
+You are a helpful assistant.<|im_end|>
+<|im_start|>user
+Write a haiku about the sea.<|im_end|>
+<|im_start|>assistant
+Waves fold into foam,`, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if msgs[2].Content != "Waves fold into foam," {
+				t.Errorf("expected messages to be unchanged, got %q", msgs[2].Content)
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		for _, tt := range templates {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: []api.Message{msgs[1], {Role: "assistant"}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff("<|im_start|>user\nWrite a haiku about the sea.<|im_end|>\n<|im_start|>assistant\n", b.String()); diff != "" {
+				t.Errorf("%s mismatch (-want +got):\n%s", tt.name, diff)
+			}
+		}
+	})
+
+	t.Run("embedded", func(t *testing.T) {
+		cases := []struct {
+			name   string
+			opener string
+		}{
+			{"chatml", "Write a haiku about the sea.<|im_end|>\n<|im_start|>assistant\n"},
+			{"llama3-instruct", "Write a haiku about the sea.<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n"},
+		}
+
+		for _, tt := range cases {
+			bts, err := os.ReadFile(tt.name + ".gotmpl")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tmpl, err := Parse(string(bts))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the prefill may end mid-word or with a space for the model to
+			// continue from so it's rendered exactly as is
+			for _, prefill := range []string{"Waves fold into foam,", "Waves fo", "Waves ", ""} {
+				var b bytes.Buffer
+				if err := tmpl.Execute(&b, Values{Messages: append(slices.Clone(msgs[:2]), api.Message{Role: "assistant", Content: prefill})}); err != nil {
+					t.Fatal(err)
+				}
+
+				if !strings.HasSuffix(b.String(), tt.opener+prefill) {
+					t.Errorf("%s: expected the prompt to end with %q, got %q", tt.name, tt.opener+prefill, b.String())
+				}
+			}
+		}
+	})
+
+	t.Run("end marker", func(t *testing.T) {
+		tmpl, err := Parse(templates[1].template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs, AppendEndMarker: "<|endoftext|>"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasSuffix(b.String(), "Waves fold into foam,<|im_end|>\n<|endoftext|>") {
+			t.Errorf("expected a complete conversation, got %q", b.String())
+		}
+	})
+
+	t.Run("tool calls", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ .Role }}: {{ range .ToolCalls }}{{ .Function.Name }}(){{ end }}{{ .Content }}
+{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var call api.ToolCall
+		call.Function.Name = "get_current_weather"
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: []api.Message{
+			{Role: "user", Content: "What's the weather?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("user: What's the weather?\nassistant: get_current_weather()\n", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestExecuteLegacyCut(t *testing.T) {
+	msgs := []api.Message{{Role: "user", Content: "Hello!"}}
+
+	t.Run("empty", func(t *testing.T) {
+		tmpl, err := Parse(`{{ .Response }}{{ .Prompt }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tmpl.Execute(io.Discard, Values{Messages: msgs}); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("else", func(t *testing.T) {
+		tmpl, err := Parse(`{{ if .Prompt }}USER: {{ .Prompt }} ASSISTANT: {{ .Response }}{{ else }}{{ .System }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("USER: Hello! ASSISTANT: ", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+	t.Run("last response", func(t *testing.T) {
+		tmpl, err := Parse(`<user>{{ .Prompt }}</user><think>{{ if .Response }}{{ .Response }}{{ end }}</think><answer>{{ .Response }}</answer>`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: []api.Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello"},
+			{Role: "user", Content: "How are you?"},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// only what follows the last .Response is cut from the last turn
+		if diff := cmp.Diff("<user>Hi</user><think>Hello</think><answer>Hello</answer><user>How are you?</user><think></think><answer>", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no user message", func(t *testing.T) {
+		tmpl, err := Parse(`{{ if .System }}<<SYS>>{{ .System }}<</SYS>>{{ end }}[INST] {{ .Prompt }} [/INST]{{ .Response }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msgs := range [][]api.Message{
+			{{Role: "assistant", Content: "Hello! How can I help?"}},
+			{{Role: "system", Content: "You are a helpful assistant."}, {Role: "assistant", Content: "Hello! How can I help?"}},
+		} {
+			if err := tmpl.Execute(io.Discard, Values{Messages: msgs}); !errors.Is(err, ErrNoPrompt) {
+				t.Errorf("expected ErrNoPrompt, got %v", err)
+			}
+		}
+
+		// only system messages render the system prompt for an empty prompt
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: []api.Message{
+			{Role: "system", Content: "You are a helpful assistant."},
+			{Role: "system", Content: "Be concise."},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("<<SYS>>You are a helpful assistant.\n\nBe concise.<</SYS>>[INST]  [/INST]", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// templates ranging over .Messages render the messages as they are
+		tmpl, err = Parse(`{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.Reset()
+		if err := tmpl.Execute(&b, Values{Messages: []api.Message{{Role: "assistant", Content: "Hello! How can I help?"}}, AppendEndMarker: "<|end|>"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("<|assistant|>Hello! How can I help?<|end|>", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestRoundSeparator(t *testing.T) {
+	tmpl, err := Parse(`{{- range .Messages }}
+{{- if eq .Role "user" }}<|user|>{{ .Content }}
+{{ else if eq .Role "assistant" }}<|assistant|>
+{{- if .ToolCalls }}{{ range .ToolCalls }}{{ .Function.Name }}({{ json .Function.Arguments }}){{ end }}
+{{- else }}{{ .Content }}{{ end }}
+{{ else if eq .Role "tool" }}<|tool|>{{ .Content }}
+{{ end }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(name, location string) []api.ToolCall {
+		var call api.ToolCall
+		call.Function.Name = name
+		call.Function.Arguments.Set("location", location)
+		return []api.ToolCall{call}
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "Is it warmer in Paris than where I am?"},
+		{Role: "assistant", ToolCalls: call("get_location", "me")},
+		{Role: "tool", Content: "London"},
+		{Role: "assistant", ToolCalls: call("get_current_weather", "London")},
+		{Role: "tool", Content: "18"},
+		{Role: "assistant", ToolCalls: call("get_current_weather", "Paris")},
+		{Role: "tool", Content: "22"},
+		{Role: "assistant", Content: "Yes, Paris is 4 degrees warmer."},
+		{Role: "user", Content: "And Rome?"},
+		{Role: "assistant", ToolCalls: call("get_current_weather", "Rome")},
+		{Role: "tool", Content: "25"},
+	}
+
+	cases := []struct {
+		name      string
+		separator string
+		expected  string
+	}{
+		{"none", "", `<|user|>Is it warmer in Paris than where I am?
+<|assistant|>get_location({"location":"me"})
+<|tool|>London
+<|assistant|>get_current_weather({"location":"London"})
+<|tool|>18
+<|assistant|>get_current_weather({"location":"Paris"})
+<|tool|>22
+<|assistant|>Yes, Paris is 4 degrees warmer.
+<|user|>And Rome?
+<|assistant|>get_current_weather({"location":"Rome"})
+<|tool|>25
+`},
+		{"separator", "---\n", `<|user|>Is it warmer in Paris than where I am?
+<|assistant|>get_location({"location":"me"})
+<|tool|>London
+---
+<|assistant|>get_current_weather({"location":"London"})
+<|tool|>18
+---
+<|assistant|>get_current_weather({"location":"Paris"})
+<|tool|>22
+<|assistant|>Yes, Paris is 4 degrees warmer.
+<|user|>And Rome?
+<|assistant|>get_current_weather({"location":"Rome"})
+<|tool|>25
+`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: msgs, RoundSeparator: tt.separator}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExecuteWithMessages(t *testing.T) {
+	type template struct {
+		name     string
+		template string
+	}
+	cases := []struct {
+		name      string
+		templates []template
+		values    Values
+		expected  string
+	}{
+		{
+			"mistral",
+			[]template{
+				{"no response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] `},
+				{"response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
+				{"messages", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}
+{{- range .Messages }}
+{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
+{{- end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant", Content: "Hello human!"},
+					{Role: "user", Content: "What is your name?"},
+				},
+			},
+			`[INST] Hello friend![/INST] Hello human![INST] What is your name?[/INST] `,
+		},
+		{
+			"mistral system",
+			[]template{
+				{"no response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] `},
+				{"response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
+				{"messages", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}
+{{- range .Messages }}
+{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
+{{- end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant!"},
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant", Content: "Hello human!"},
+					{Role: "user", Content: "What is your name?"},
+				},
+			},
+			`[INST] You are a helpful assistant!
+
+Hello friend![/INST] Hello human![INST] What is your name?[/INST] `,
+		},
+		{
+			"mistral duplicates",
+			[]template{
+				{"no response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] `},
+				{"response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
+				{"messages", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}
+{{- range .Messages }}
+{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
+{{- end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant", Content: "Hello human!"},
+					{Role: "user", Content: "What is your name?"},
+					{Role: "user", Content: "What is your name?"},
+				},
+				DropConsecutiveDuplicates: true,
+			},
+			`[INST] Hello friend![/INST] Hello human![INST] What is your name?[/INST] `,
+		},
+		{
+			"mistral empty turns",
+			[]template{
+				{"response", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}{{ .Prompt }}[/INST] {{ .Response }}`},
+				{"messages", `[INST] {{ if .System }}{{ .System }}
+
+{{ end }}
+{{- range .Messages }}
+{{- if eq .Role "user" }}{{ .Content }}[/INST] {{ else if eq .Role "assistant" }}{{ .Content }}[INST] {{ end }}
+{{- end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant"},
+					{Role: "user"},
+					{Role: "assistant", Content: "Hello human!"},
+					{Role: "user", Content: "What is your name?"},
+				},
+				RenderEmptyTurns: true,
+			},
+			`[INST] Hello friend![/INST] [INST] [/INST] Hello human![INST] What is your name?[/INST] `,
+		},
+		{
+			"chatml",
+			[]template{
+				// this does not have a "no response" test because it's impossible to render the same output
+				{"response", `{{ if .System }}<|im_start|>system
+{{ .System }}<|im_end|>
+{{ end }}{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`},
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant!"},
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant", Content: "Hello human!"},
+					{Role: "user", Content: "What is your name?"},
+				},
+			},
+			`<|im_start|>system
+You are a helpful assistant!<|im_end|>
+<|im_start|>user
+Hello friend!<|im_end|>
+<|im_start|>assistant
+Hello human!<|im_end|>
+<|im_start|>user
+What is your name?<|im_end|>
+<|im_start|>assistant
+`,
+		},
+		{
+			"chatml response prefix",
+			[]template{
+				{"response", `{{ if .System }}<|im_start|>system
+{{ .System }}<|im_end|>
+{{ end }}{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`},
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "List three colors as JSON."},
+				},
+				ResponsePrefix: "```json\n",
+			},
+			"<|im_start|>user\nList three colors as JSON.<|im_end|>\n<|im_start|>assistant\n```json\n",
+		},
+		{
+			"chatml default image tag",
+			[]template{
+				{"response", `{{ if .System }}<|im_start|>system
+{{ .System }}<|im_end|>
+{{ end }}{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`},
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Compare these.", Images: []api.ImageData{[]byte("a"), []byte("b")}},
+				},
+			},
+			"<|im_start|>user\n[img-0] [img-1] Compare these.<|im_end|>\n<|im_start|>assistant\n",
+		},
+		{
+			"chatml image tag",
+			[]template{
+				{"response", `{{ if .System }}<|im_start|>system
+{{ .System }}<|im_end|>
+{{ end }}{{ if .Prompt }}<|im_start|>user
+{{ .Prompt }}<|im_end|>
+{{ end }}<|im_start|>assistant
+{{ .Response }}<|im_end|>
+`},
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Compare these.", Images: []api.ImageData{[]byte("a"), []byte("b")}},
+				},
+				ImageTag: "<image-%d>",
+			},
+			"<|im_start|>user\n<image-0> <image-1> Compare these.<|im_end|>\n<|im_start|>assistant\n",
+		},
+		{
+			"chatml end marker",
+			[]template{
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello friend!"},
+					{Role: "assistant", Content: "Hello human!"},
+				},
+				AppendEndMarker: "<|endoftext|>",
+			},
+			`<|im_start|>user
+Hello friend!<|im_end|>
+<|im_start|>assistant
+Hello human!<|im_end|>
+<|endoftext|>`,
+		},
+		{
+			"moondream",
+			[]template{
+				// this does not have a "no response" test because it's impossible to render the same output
+				{"response", `{{ if .Prompt }}Question: {{ .Prompt }}
+
+{{ end }}Answer: {{ .Response }}
+
+`},
+				{"messages", `
+{{- range .Messages }}
+{{- if eq .Role "user" }}Question: {{ .Content }}
+
+{{ else if eq .Role "assistant" }}Answer: {{ .Content }}
+
+{{ end }}
+{{- end }}Answer: `},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "What's in this image?", Images: []api.ImageData{[]byte("")}},
+					{Role: "assistant", Content: "It's a hot dog."},
+					{Role: "user", Content: "What's in _this_ image?"},
+					{Role: "user", Images: []api.ImageData{[]byte("")}},
+					{Role: "user", Content: "Is it a hot dog?"},
+				},
+			},
+			`Question: [img-0] What's in this image?
+
+Answer: It's a hot dog.
+
+Question: What's in _this_ image?
+
+[img-1]
+
+Is it a hot dog?
+
+Answer: `,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, ttt := range tt.templates {
+				t.Run(ttt.name, func(t *testing.T) {
+					tmpl, err := Parse(ttt.template)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					var b bytes.Buffer
+					if err := tmpl.Execute(&b, tt.values); err != nil {
+						t.Fatal(err)
+					}
+
+					if diff := cmp.Diff(b.String(), tt.expected); diff != "" {
+						t.Errorf("mismatch (-got +want):\n%s", diff)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{`{{ add 2 3 }}`, "5"},
+		{`{{ sub 2 3 }}`, "-1"},
+		{`{{ mul 2 3 }}`, "6"},
+		{`{{ div 7 2 }}`, "3"},
+		{`{{ mod 7 2 }}`, "1"},
+		{`{{ if gt (add 1 1) 1 }}yes{{ end }}`, "yes"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("division by zero", func(t *testing.T) {
+		for _, s := range []string{`{{ div 1 0 }}`, `{{ mod 1 0 }}`} {
+			tmpl, err := Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tmpl.Execute(io.Discard, Values{}); err == nil || !strings.Contains(err.Error(), "division by zero") {
+				t.Errorf("%s: expected division by zero error, got %v", s, err)
+			}
+		}
+	})
+
+	t.Run("last message", func(t *testing.T) {
+		v := Values{
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello friend!"},
+				{Role: "assistant", Content: "Hello human!"},
+				{Role: "user", Content: "What is your name?"},
+			},
+		}
+
+		render := func(s string) string {
+			tmpl, err := Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, v); err != nil {
+				t.Fatal(err)
+			}
+
+			return b.String()
+		}
+
+		add := render(`{{ range $index, $_ := .Messages }}{{ .Content }}{{ if eq (add $index 1) (len $.Messages) }} [LAST]{{ end }};{{ end }}`)
+		slice := render(`{{ range $index, $_ := .Messages }}{{ .Content }}{{ if eq (len (slice $.Messages $index)) 1 }} [LAST]{{ end }};{{ end }}`)
+		if diff := cmp.Diff(slice, add); diff != "" {
+			t.Errorf("mismatch (-slice +add):\n%s", diff)
+		}
+
+		if diff := cmp.Diff("Hello friend!;Hello human!;What is your name? [LAST];", add); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		isLast := render(`{{ range $index, $_ := .Messages }}{{ .Content }}{{ if isLast $index $.Messages }} [LAST]{{ end }};{{ end }}`)
+		if diff := cmp.Diff(slice, isLast); diff != "" {
+			t.Errorf("mismatch (-slice +isLast):\n%s", diff)
+		}
+	})
+
+	t.Run("isLast not a list", func(t *testing.T) {
+		tmpl, err := Parse(`{{ if isLast 0 1 }}last{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tmpl.Execute(io.Discard, Values{}); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestToolChoice(t *testing.T) {
+	tmpl, err := Parse(`{{ range .Tools }}{{ .Function.Name }};{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tools []api.Tool
+	for _, name := range []string{"get_current_weather", "get_current_time"} {
+		var tool api.Tool
+		tool.Type = "function"
+		tool.Function.Name = name
+		tools = append(tools, tool)
+	}
+
+	cases := []struct {
+		name     string
+		choice   *api.ToolChoice
+		expected string
+	}{
+		{"nil", nil, "get_current_weather;get_current_time;Hello!"},
+		{"auto", &api.ToolChoice{Mode: "auto"}, "get_current_weather;get_current_time;Hello!"},
+		{"required", &api.ToolChoice{Mode: "required"}, "get_current_weather;get_current_time;Hello!"},
+		{"none", &api.ToolChoice{Mode: "none"}, "Hello!"},
+		{"function", &api.ToolChoice{Mode: "function", Name: "get_current_time"}, "get_current_time;Hello!"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{
+				Messages:   []api.Message{{Role: "user", Content: "Hello!"}},
+				Tools:      tools,
+				ToolChoice: tt.choice,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestToolFuncs(t *testing.T) {
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[
+		{"type": "function", "function": {"name": "get_current_weather", "description": "Get the current weather", "parameters": {"type": "object", "required": ["location"], "properties": {"location": {"type": "string", "description": "The city"}, "format": {"type": "string", "description": "The unit", "enum": ["celsius", "fahrenheit"]}}}}},
+		{"type": "function", "function": {"name": "get_time", "description": "Get the time", "parameters": {"type": "object"}}}
+	]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"toolSignatures", `{{ toolSignatures .Tools }}`, `def get_current_weather(format: string, location: string) -> List[Dict]:
+    """Get the current weather
+
+    Args:
+        format (string): The unit
+        location (string): The city
+    """
+    pass
+
+def get_time() -> List[Dict]:
+    """Get the time
+    """
+    pass`},
+		{"toolsJSON", `{{ toolsJSON .Tools }}`, `[{"function":{"description":"Get the current weather","name":"get_current_weather","parameters":{"properties":{"format":{"description":"The unit","enum":["celsius","fahrenheit"],"type":"string"},"location":{"description":"The city","type":"string"}},"required":["location"],"type":"object"}},"type":"function"},{"function":{"description":"Get the time","name":"get_time","parameters":{"properties":null,"required":null,"type":"object"}},"type":"function"}]`},
+		{"toolNames", `{{ range toolNames .Tools }}{{ . }};{{ end }}`, "get_current_weather;get_time;"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template + `{{ range .Messages }}{{ end }}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			render := func() string {
+				var b bytes.Buffer
+				if err := tmpl.Execute(&b, Values{Tools: tools}); err != nil {
+					t.Fatal(err)
+				}
+
+				return b.String()
+			}
+
+			first := render()
+			if diff := cmp.Diff(tt.expected, first); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			for range 10 {
+				if second := render(); second != first {
+					t.Fatalf("expected identical output\nfirst: %q\n then: %q", first, second)
+				}
+			}
+		})
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	tmpl, err := Parse(`{{- if .Documents }}Documents:
+{{ range .Documents }}[{{ .Index }}] {{ .Title }}: {{ .Content }}
+{{ end }}
+{{ end }}
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tmpl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{{Role: "user", Content: "Why is the sky blue? Cite your sources."}}
+	docs := []Document{
+		{Title: "Rayleigh scattering", Content: "Shorter wavelengths scatter more."},
+		{Title: "Sunsets", Content: "Light travels further through the atmosphere."},
+		{Title: "Ozone", Content: "Ozone absorbs some red light."},
+	}
+
+	render := func(docs []Document) string {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs, Documents: docs}); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.String()
+	}
+
+	if diff := cmp.Diff(`Documents:
+[1] Rayleigh scattering: Shorter wavelengths scatter more.
+[2] Sunsets: Light travels further through the atmosphere.
+[3] Ozone: Ozone absorbs some red light.
+
+user: Why is the sky blue? Cite your sources.
+`, render(docs)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// the index follows the order the documents are given in
+	reversed := slices.Clone(docs)
+	slices.Reverse(reversed)
+	if !strings.HasPrefix(render(reversed), "Documents:\n[1] Ozone: ") {
+		t.Errorf("expected the first document to be cited as [1], got %q", render(reversed))
+	}
+
+	if diff := cmp.Diff("user: Why is the sky blue? Cite your sources.\n", render(nil)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWordwrap(t *testing.T) {
+	cases := []struct {
+		name     string
+		width    int
+		input    string
+		expected string
+	}{
+		{"short", 20, "Get the weather", "Get the weather"},
+		{"wrap", 10, "Get the current weather for a city", "Get the\ncurrent\nweather\nfor a city"},
+		{"exact", 7, "Get the weather", "Get the\nweather"},
+		{"long word", 8, "See https://example.com/weather for details", "See\nhttps://\nexample.\ncom/weat\nher for\ndetails"},
+		{"long first word", 4, "abcdefghij k", "abcd\nefgh\nij k"},
+		{"line breaks", 12, "Get the current weather.\n\nLocation is a city name.", "Get the\ncurrent\nweather.\n\nLocation is\na city name."},
+		{"unicode", 5, "héllo wörld ünïcode", "héllo\nwörld\nünïco\nde"},
+		{"no width", 0, "Get the current weather", "Get the current weather"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.expected, wordwrap(tt.width, tt.input)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("template", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Tools }}{{ wordwrap 20 .Function.Description }}{{ end }}{{ range .Messages }}{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tool api.Tool
+		tool.Function.Description = "Get the current weather for a location given as a city and country"
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Tools: []api.Tool{tool}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("Get the current\nweather for a\nlocation given as a\ncity and country", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestToolCallArgumentsOrder(t *testing.T) {
+	var msg api.Message
+	if err := json.Unmarshal([]byte(`{"role":"assistant","tool_calls":[{"function":{"name":"f","arguments":{"b":1,"a":"x","c":{"z":true,"y":[{"q":1,"p":2}]}}}}]}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"json", `{{ json .Function.Arguments }}`, `{"b":1,"a":"x","c":{"z":true,"y":[{"q":1,"p":2}]}}`},
+		{"range", `{{ range $k, $v := .Function.Arguments }}{{ $k }}={{ $v }};{{ end }}`, `a=x;b=1;c=map[y:[map[p:2 q:1]] z:true];`},
+		{"range keys", `{{ $args := .Function.Arguments }}{{ range $args.Keys }}{{ . }}={{ json ($args.Get .) }};{{ end }}`, `b=1;a="x";c={"z":true,"y":[{"q":1,"p":2}]};`},
+		{"index", `{{ index .Function.Arguments "a" }}`, `x`},
+		{"field", `{{ .Function.Arguments.a }} {{ .Function.Arguments.c.z }}`, `x true`},
+		{"print", `{{ .Function.Arguments }}`, `map[a:x b:1 c:map[y:[map[p:2 q:1]] z:true]]`},
+		{"message json", `{{ json (index $.Messages 0).ToolCalls }}`, `[{"id":"","type":"","function":{"name":"f","arguments":{"b":1,"a":"x","c":{"z":true,"y":[{"q":1,"p":2}]}}}}]`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(`{{ range .Messages }}{{ range .ToolCalls }}` + tt.template + `{{ end }}{{ end }}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: []api.Message{msg}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollateWithBudget(t *testing.T) {
+	words := func(s string) int {
+		return len(strings.Fields(s))
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "What's the capital of France?"},
+		{Role: "assistant", Content: "Paris."},
+		{Role: "system", Content: "Answer in one word."},
+		{Role: "user", Content: "And of Japan?"},
+		{Role: "assistant", Content: "Tokyo."},
+		{Role: "user", Content: "Thanks!"},
+		{Role: "assistant", Content: "You're welcome"},
+	}
+
+	roles := func(msgs []api.Message) []string {
+		var s []string
+		for _, m := range msgs {
+			s = append(s, m.Role+": "+m.Content)
+		}
+
+		return s
+	}
+
+	cases := []struct {
+		name    string
+		budget  int
+		kept    []string
+		dropped []string
+	}{
+		{
+			"fits",
+			30,
+			roles(msgs),
+			nil,
+		},
+		{
+			"oldest first",
+			20,
+			[]string{
+				"system: You are a helpful assistant.",
+				"system: Answer in one word.",
+				"user: And of Japan?",
+				"assistant: Tokyo.",
+				"user: Thanks!",
+				"assistant: You're welcome",
+			},
+			[]string{
+				"user: What's the capital of France?",
+				"assistant: Paris.",
+			},
+		},
+		{
+			"system and final turn",
+			1,
+			[]string{
+				"system: You are a helpful assistant.",
+				"system: Answer in one word.",
+				"user: Thanks!",
+				"assistant: You're welcome",
+			},
+			[]string{
+				"user: What's the capital of France?",
+				"assistant: Paris.",
+				"user: And of Japan?",
+				"assistant: Tokyo.",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, dropped := collateWithBudget(msgs, words, tt.budget)
+			if diff := cmp.Diff(tt.kept, roles(kept)); diff != "" {
+				t.Errorf("kept mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.dropped, roles(dropped)); diff != "" {
+				t.Errorf("dropped mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("execute", func(t *testing.T) {
+		tmpl, err := Parse(`{{ range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: msgs[:7], TokenBudget: 12, CountTokens: words}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(`system: You are a helpful assistant.
+
+Answer in one word.
+user: Thanks!
+`, b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestExecuteChan(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello!"},
+		{Role: "assistant", Content: "Hi! How can I help?"},
+		{Role: "user", Content: "What's the weather like in Paris?"},
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		values   Values
+	}{
+		{"legacy", `{{ if .System }}<<SYS>>{{ .System }}<</SYS>>{{ end }}[INST] {{ .Prompt }} [/INST] {{ .Response }}`, Values{Messages: msgs}},
+		{"messages", `{{ range .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`, Values{Messages: msgs}},
+		{"round separator", `{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}`, Values{Messages: msgs, RoundSeparator: "<|round|>", ResponsePrefix: "Sure"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var expect bytes.Buffer
+			if err := tmpl.Execute(&expect, tt.values); err != nil {
+				t.Fatal(err)
+			}
+
+			chunks, errc := tmpl.ExecuteChan(context.Background(), tt.values)
+
+			var actual bytes.Buffer
+			var n int
+			for chunk := range chunks {
+				actual.Write(chunk)
+				n++
+			}
+
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(expect.String(), actual.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if n < 2 {
+				t.Errorf("expected the prompt in more than one chunk, got %d", n)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		tmpl, err := Parse(cases[0].template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		chunks, errc := tmpl.ExecuteChan(ctx, Values{Messages: msgs})
+		<-chunks
+		cancel()
+
+		for range chunks {
+		}
+
+		if err := <-errc; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestExecutePrivateUseContent(t *testing.T) {
+	tmpl, err := Parse(`{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{{Role: "user", Content: "a\ue003b"}}
+	expect := "<|user|>a\ue003b"
+	for _, v := range []Values{{Messages: msgs}, {Messages: msgs, RoundSeparator: "<|round|>"}} {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, v); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	chunks, errc := tmpl.ExecuteChan(context.Background(), Values{Messages: msgs})
+
+	var actual bytes.Buffer
+	for chunk := range chunks {
+		actual.Write(chunk)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(expect, actual.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestHashFuncs(t *testing.T) {
+	content := "Why is the sky blue?"
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{`{{ sha256 .Prompt }}`, digest},
+		{`{{ shortHash 8 .Prompt }}`, digest[:8]},
+		{`{{ shortHash 0 .Prompt }}`, ""},
+		{`{{ shortHash 100 .Prompt }}`, digest},
+		{`{{ range .Messages }}[{{ shortHash 12 .Content }}]{{ end }}`, "[" + digest[:12] + "]"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: []api.Message{{Role: "user", Content: content}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("negative", func(t *testing.T) {
+		tmpl, err := Parse(`{{ shortHash -1 .Prompt }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tmpl.Execute(io.Discard, Values{Messages: []api.Message{{Role: "user", Content: content}}}); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestLint(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		expected []Warning
+	}{
+		{"clean", `{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}{{ end }}`, nil},
+		{"clean legacy", `{{ if .System }}{{ .System }} {{ end }}{{ .Prompt }} {{ .Response }}`, nil},
+		{"implicit response", `{{ .Prompt }}`, []Warning{{Code: "implicit-response", Message: "template never renders .Response or .Messages so .Response is added at its end"}}},
+		{"no message content", `{{ range .Messages }}<|{{ .Role }}|>{{ end }}`, []Warning{{Code: "no-message-content", Message: "template never renders message content", Pos: "1:9"}}},
+		{"message content in variable", `{{ range $i, $m := .Messages }}<|{{ $m.Role }}|>{{ $m.Content }}{{ end }}`, nil},
+		{"incomplete tool calls", `{{ range .Messages }}{{ .Content }}
+{{ range .ToolCalls }}{"name": "{{ .Function.Name }}"}{{ end }}{{ end }}`, []Warning{{Code: "incomplete-tool-calls", Message: "template renders tool calls without both their name and arguments", Pos: "2:9"}}},
+		{"system in messages", `{{ if .System }}{{ .System }}{{ end }}{{ range .Messages }}{{ if eq .Role "user" }}{{ $.System }} {{ end }}{{ .Content }}{{ end }}`, []Warning{{Code: "system-in-messages", Message: "template renders .System inside the range over .Messages so the system prompt may be rendered twice", Pos: "1:87"}}},
+		{"defined", `{{ define "turn" }}{{ .Role }}{{ end }}{{ range .Messages }}{{ template "turn" . }}{{ end }}`, []Warning{{Code: "no-message-content", Message: "template never renders message content", Pos: "1:48"}}},
+		{"content in defined", `{{ define "turn" }}{{ .Role }}: {{ .Content }}{{ end }}{{ range .Messages }}{{ template "turn" . }}{{ end }}`, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, tmpl.Lint()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("named", func(t *testing.T) {
+		templates, err := templatesOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, n := range templates {
+			tmpl, err := n.Parsed()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if warnings := tmpl.Lint(); len(warnings) > 0 {
+				t.Errorf("%s: %v", n.Name, warnings)
+			}
+		}
+	})
+}
+
+func TestFIM(t *testing.T) {
+	prompt, suffix := "def fib(n):\n    ", "\n    return fib(n-1) + fib(n-2)"
+
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"codellama", "<PRE> " + prompt + " <SUF>" + suffix + " <MID>"},
+		{"deepseek-coder", "<｜fim▁begin｜>" + prompt + "<｜fim▁hole｜>" + suffix + "<｜fim▁end｜>"},
+		{"starcoder2", "<fim_prefix>" + prompt + "<fim_suffix>" + suffix + "<fim_middle>"},
+		{"qwen2.5-coder", "<|fim_prefix|>" + prompt + "<|fim_suffix|>" + suffix + "<|fim_middle|>"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := FIM(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tmpl.Capabilities().Insert {
+				t.Error("expected template to support insert")
+			}
+
+			if err := tmpl.Validate(); err != nil {
+				t.Error(err)
+			}
+
+			if warnings := tmpl.Lint(); len(warnings) > 0 {
+				t.Errorf("unexpected warnings %v", warnings)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Prompt: prompt, Suffix: suffix}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected, b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("chat and infill", func(t *testing.T) {
+		tmpl, err := Parse(`{{ if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>{{ else }}[INST] {{ .Prompt }} [/INST]{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{Messages: []api.Message{{Role: "user", Content: "Write fib in Python"}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("[INST] Write fib in Python [/INST]", b.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no suffix", func(t *testing.T) {
+		tmpl, err := Parse(`[INST] {{ .Prompt }} [/INST]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tmpl.Execute(io.Discard, Values{Prompt: prompt, Suffix: suffix}); !errors.Is(err, ErrNoSuffix) {
+			t.Errorf("expected ErrNoSuffix, got %v", err)
+		}
+	})
+
+	if _, err := FIM("missing"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[
+		{"type": "function", "function": {"name": "get_current_weather", "description": "Get the current weather", "category": "weather"}},
+		{"type": "function", "function": {"name": "send_email", "description": "Send an email", "category": "communication"}},
+		{"type": "function", "function": {"name": "get_forecast", "description": "Get the forecast", "category": "weather"}},
+		{"type": "function", "function": {"name": "get_time", "description": "Get the time"}}
+	]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := Parse(`{{ range $category, $tools := groupBy "category" .Tools }}## {{ $category }}
+{{ range $tools }}- {{ .Function.Name }}: {{ .Function.Description }}
+{{ end }}{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, Values{Tools: tools, Messages: []api.Message{{Role: "user", Content: "What's the weather like?"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(`## communication
+- send_email: Send an email
+## default
+- get_time: Get the time
+## weather
+- get_current_weather: Get the current weather
+- get_forecast: Get the forecast
+What's the weather like?`, b.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	chatml, err := os.ReadFile("chatml.gotmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		values   Values
+		code     string
+	}{
+		{
+			"valid",
+			string(chatml),
+			Values{Messages: []api.Message{{Role: "user", Content: "What's in this image?", Images: []api.ImageData{[]byte("a")}}}},
+			"",
+		},
+		{
+			"empty",
+			`{{ if .System }}{{ .System }}{{ end }}`,
+			Values{Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			"empty",
+		},
+		{
+			"no assistant opener",
+			`{{ range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}{{ if not .Tools }}assistant:{{ end }}`,
+			Values{Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Tools: []api.Tool{{Type: "function"}}},
+			"no-assistant-opener",
+		},
+		{
+			"braces in content",
+			string(chatml),
+			Values{Messages: []api.Message{{Role: "system", Content: "You are {{ .Name }}."}, {Role: "user", Content: "Hello!"}}},
+			"",
+		},
+		{
+			"braces in tools",
+			`{{ if .Tools }}{{ json .Tools }}
+{{ end }}{{ range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}assistant:`,
+			Values{Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Tools: []api.Tool{{Type: "function"}}},
+			"",
+		},
+		{
+			"template artifact",
+			`{{ range .Messages }}{{ .Role }}: {{ .Content }}}}
+{{ end }}assistant:`,
+			Values{Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			"template-artifact",
+		},
+		{
+			"image tag without image",
+			string(chatml),
+			Values{Messages: []api.Message{{Role: "user", Content: "What's in [img]?"}}},
+			"image-tag",
+		},
+		{
+			"image index without image",
+			string(chatml),
+			Values{Messages: []api.Message{{Role: "user", Content: "Compare [img-0] and [img-1]", Images: []api.ImageData{[]byte("a")}}}},
+			"image-tag",
+		},
+	}
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			for _, ttt := range tt.templates {
-				t.Run(ttt.name, func(t *testing.T) {
-					tmpl, err := Parse(ttt.template)
-					if err != nil {
-						t.Fatal(err)
-					}
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-					var b bytes.Buffer
-					if err := tmpl.Execute(&b, tt.values); err != nil {
-						t.Fatal(err)
-					}
+			// rendering isn't checked unless ValidateOutput is set
+			if err := tmpl.Execute(io.Discard, tt.values); err != nil {
+				t.Fatal(err)
+			}
 
-					if diff := cmp.Diff(b.String(), tt.expected); diff != "" {
-						t.Errorf("mismatch (-got +want):\n%s", diff)
-					}
-				})
+			tt.values.ValidateOutput = true
+
+			var b bytes.Buffer
+			err = tmpl.Execute(&b, tt.values)
+
+			var oerr *OutputError
+			if tt.code == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			} else if tt.code != "" && (!errors.As(err, &oerr) || oerr.Code != tt.code) {
+				t.Fatalf("expected %s error, got %v", tt.code, err)
+			}
+
+			if tt.code != "" && b.Len() > 0 {
+				t.Errorf("expected nothing written, got %q", b.String())
+			}
+		})
+	}
+}
+
+func TestThinking(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "user", Content: "What's 2 + 2?"},
+		{Role: "assistant", Thinking: "2 + 2 is 4.", Content: "4"},
+		{Role: "user", Content: "And 3 + 3?"},
+		{Role: "assistant", Thinking: "3 + 3 is 6."},
+	}
+
+	deepseek := `{{ range .Messages }}{{ if eq .Role "user" }}<|User|>{{ .Content }}{{ else if eq .Role "assistant" }}<|Assistant|>{{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}{{ end }}{{ end }}`
+
+	cases := []struct {
+		name     string
+		template string
+		msgs     []api.Message
+		expected string
+	}{
+		{
+			"previous turns dropped",
+			deepseek + "<|Assistant|>",
+			msgs[:3],
+			"<|User|>What's 2 + 2?<|Assistant|>4<|User|>And 3 + 3?<|Assistant|>",
+		},
+		{
+			"last turn kept",
+			deepseek,
+			msgs,
+			"<|User|>What's 2 + 2?<|Assistant|>4<|User|>And 3 + 3?<|Assistant|><think>3 + 3 is 6.</think>",
+		},
+		{
+			"keep thinking",
+			"{{ $keepThinking := true }}" + deepseek + "<|Assistant|>",
+			msgs[:3],
+			"<|User|>What's 2 + 2?<|Assistant|><think>2 + 2 is 4.</think>4<|User|>And 3 + 3?<|Assistant|>",
+		},
+		{
+			"ignored",
+			`{{ range .Messages }}[{{ .Role }}] {{ .Content }} {{ end }}`,
+			msgs[:3],
+			"[user] What's 2 + 2? [assistant] 4 [user] And 3 + 3? ",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: tt.msgs, AppendEndMarker: "\n"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expected+"\n", b.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		_, collated, _ := collate([]api.Message{
+			{Role: "assistant", Content: "Hello"},
+			{Role: "assistant", Thinking: "The user said nothing.", Content: "Anyone there?"},
+		}, false, false, true, "[img-%d]")
+
+		if diff := cmp.Diff("The user said nothing.", collated[0].Thinking); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestThinkingTags(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		open     string
+		close    string
+		ok       bool
+	}{
+		{"if", `{{ range .Messages }}{{ if .Thinking }}<think>
+{{ .Thinking }}
+</think>
+
+{{ end }}{{ .Content }}{{ end }}`, "<think>", "</think>", true},
+		{"with", `{{ range .Messages }}{{ with .Thinking }}[THINK]{{ . }}[/THINK]{{ end }}{{ .Content }}{{ end }}`, "[THINK]", "[/THINK]", true},
+		{"untagged", `{{ range .Messages }}{{ if .Thinking }}{{ .Thinking }}{{ end }}{{ .Content }}{{ end }}`, "", "", false},
+		{"none", `{{ range .Messages }}{{ .Content }}{{ end }}`, "", "", false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			openTag, closeTag, ok := tmpl.ThinkingTags()
+			if openTag != tt.open || closeTag != tt.close || ok != tt.ok {
+				t.Errorf("expected %q, %q, %t, got %q, %q, %t", tt.open, tt.close, tt.ok, openTag, closeTag, ok)
+			}
+		})
+	}
+}
+
+func TestToolCallMarker(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		marker   string
+		err      error
+	}{
+		{"mistral", `{{ range .Messages }}{{ if .ToolCalls }}[TOOL_CALLS] [{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}]</s>{{ else }}{{ .Content }}{{ end }}{{ end }}`, "[TOOL_CALLS]", nil},
+		{"functools", `{{ range .Messages }}{{ if .ToolCalls }}functools[{{ range $i, $c := .ToolCalls }}{{ if $i }}, {{ end }}{"name": "{{ $c.Function.Name }}", "arguments": {{ json $c.Function.Arguments }}}{{ end }}]{{ end }}{{ end }}`, "functools", nil},
+		{"action", "{{ range .Messages }}{{ with .ToolCalls }}Action: ```json\n{{ range . }}{\"name\": \"{{ .Function.Name }}\", \"arguments\": {{ json .Function.Arguments }}}\n{{ end }}```{{ end }}{{ end }}", "Action: ```json", nil},
+		{"tagged", `{{ range .Messages }}{{ range .ToolCalls }}<tool_call>
+{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}
+</tool_call>{{ end }}{{ end }}`, "<tool_call>", nil},
+		{"python", `{{ range .Messages }}{{ if .ToolCalls }}<|python_tag|>{{ range .ToolCalls }}{{ .Function.Name }}(){{ end }}{{ end }}{{ end }}`, "<|python_tag|>", nil},
+		{"unmarked", `{{ range .Messages }}{{ if .ToolCalls }}[{{ range .ToolCalls }}{"name": "{{ .Function.Name }}"}{{ end }}]{{ end }}{{ end }}`, "", ErrNoToolCallMarker},
+		{"none", `{{ range .Messages }}{{ .Content }}{{ end }}`, "", ErrNoToolCallMarker},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			marker, err := tmpl.ToolCallMarker()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if marker != tt.marker {
+				t.Errorf("expected %q, got %q", tt.marker, marker)
+			}
+		})
+	}
+}
+
+func TestExecuteWith(t *testing.T) {
+	tmpl, err := Parse(`{{ range .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	draft, err := Parse(`{{ if .System }}{{ .System }}
+{{ end }}{{ if .Prompt }}User: {{ .Prompt }}
+{{ end }}Assistant: {{ .Response }}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		values Values
+		main   string
+		draft  string
+	}{
+		{
+			name: "messages",
+			values: Values{Messages: []api.Message{
+				{Role: "system", Content: "You are a helpful assistant."},
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Hi! How can I help?"},
+				{Role: "user", Content: "What's 2+2?"},
+			}},
+			main: `<|im_start|>system
+You are a helpful assistant.<|im_end|>
+<|im_start|>user
+Hello!<|im_end|>
+<|im_start|>assistant
+Hi! How can I help?<|im_end|>
+<|im_start|>user
+What's 2+2?<|im_end|>
+<|im_start|>assistant
+`,
+			draft: `You are a helpful assistant.
+User: Hello!
+Assistant: Hi! How can I help?
+User: What's 2+2?
+Assistant: `,
+		},
+		{
+			name: "prefill",
+			values: Values{Messages: []api.Message{
+				{Role: "user", Content: "What's 2+2?"},
+				{Role: "assistant", Content: "The answer is"},
+			}},
+			main: `<|im_start|>user
+What's 2+2?<|im_end|>
+<|im_start|>assistant
+The answer is`,
+			draft: `User: What's 2+2?
+Assistant: The answer is`,
+		},
+		{
+			name: "budget",
+			values: Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "Tell me a long story about a dragon."},
+					{Role: "assistant", Content: "Once upon a time there was a dragon."},
+					{Role: "user", Content: "Shorter."},
+				},
+				TokenBudget: 2,
+				CountTokens: func(s string) int { return len(strings.Fields(s)) },
+			},
+			main: `<|im_start|>user
+Shorter.<|im_end|>
+<|im_start|>assistant
+`,
+			draft: `User: Shorter.
+Assistant: `,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			main, draftOut, err := tmpl.ExecuteWith(draft, tt.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.main, main); diff != "" {
+				t.Errorf("main mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.draft, draftOut); diff != "" {
+				t.Errorf("draft mismatch (-want +got):\n%s", diff)
+			}
+
+			// both match rendering with each template on its own
+			var b strings.Builder
+			if err := tmpl.Execute(&b, tt.values); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), main); diff != "" {
+				t.Errorf("main differs from Execute (-want +got):\n%s", diff)
+			}
+
+			b.Reset()
+			if err := draft.Execute(&b, tt.values); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), draftOut); diff != "" {
+				t.Errorf("draft differs from Execute (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	var call api.ToolCall
+	call.Function.Name = "get_current_weather"
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What's the weather?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		expect   SourceError
+	}{
+		{
+			name:     "first line",
+			template: `{{ if .System }}{{ .System }} {{ end }}{{ .Prompt.Text }}`,
+			expect:   SourceError{Line: 1, Column: 50, Action: "<.Prompt.Text>", Source: `{{ if .System }}{{ .System }} {{ end }}{{ .Prompt.Text }}`},
+		},
+		{
+			name: "mid template",
+			template: `{{ range .Messages }}<|{{ .Role }}|>
+{{ .Content }}{{ .Foo }}
+{{ end }}<|assistant|>`,
+			expect: SourceError{Line: 2, Column: 18, Action: "<.Foo>", Source: `{{ .Content }}{{ .Foo }}`},
+		},
+		{
+			name: "nested range",
+			template: `{{ range .Messages }}{{ if .ToolCalls }}
+{{ range .ToolCalls }}
+	{{ .Function.Name }}({{ .Function.Args }})
+{{ end }}{{ end }}{{ end }}`,
+			expect: SourceError{Line: 3, Column: 35, Action: "<.Function.Args>", Source: "\t{{ .Function.Name }}({{ .Function.Args }})"},
+		},
+		{
+			name: "parse",
+			template: `{{ range .Messages }}
+{{ .Content }
+{{ end }}`,
+			expect: SourceError{Line: 2, Source: `{{ .Content }`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err == nil {
+				err = tmpl.Execute(io.Discard, Values{Messages: msgs})
+			}
+
+			var serr *SourceError
+			if !errors.As(err, &serr) {
+				t.Fatalf("expected a SourceError, got %v", err)
+			}
+
+			if serr.Message == "" || serr.Err == nil {
+				t.Errorf("expected the underlying error, got %#v", serr)
+			}
+
+			got := *serr
+			got.Message, got.Err = "", nil
+			if diff := cmp.Diff(tt.expect, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
+
+	t.Run("caret", func(t *testing.T) {
+		err := SourceError{Line: 3, Column: 5, Action: "<.Foo>", Message: "can't evaluate field Foo", Source: "\t{{ .Foo }}"}
+		expect := "template: line 3, column 5 at <.Foo>: can't evaluate field Foo\n\t{{ .Foo }}\n\t   ^"
+		if diff := cmp.Diff(expect, err.Error()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
 }
@@ -0,0 +1,49 @@
+package tools_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/tools"
+)
+
+func ExampleParser_Parse() {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ if .ToolCalls }}[TOOL_CALLS] [
+{{- range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}
+{{- end }}]{{ else }}{{ .Content }}{{ end }}{{ end }}`)
+	if err != nil {
+		panic(err)
+	}
+
+	p, err := tools.NewParser(tmpl)
+	if err != nil {
+		panic(err)
+	}
+
+	calls, err := p.Parse(`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"location": "Paris"}}]`)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, call := range calls {
+		fmt.Println(call.Function.Name, call.Function.Arguments.Get("location"))
+	}
+
+	// Output:
+	// get_current_weather Paris
+}
+
+func ExampleNewParser() {
+	tmpl, err := template.Parse(`{{ .System }} {{ .Prompt }}`)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := tools.NewParser(tmpl); errors.Is(err, tools.ErrNoToolCalls) {
+		fmt.Println("model doesn't support tools")
+	}
+
+	// Output:
+	// model doesn't support tools
+}
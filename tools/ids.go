@@ -0,0 +1,65 @@
+package tools
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+const (
+	// idAlphabet is the URL-safe base64 alphabet
+	idAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	idLength   = 24
+)
+
+// IDGenerator generates the IDs of the tool calls in a response. IDs have the
+// form "call_" followed by 24 URL-safe characters and are unique within the
+// generator so a tool result can refer to the call it answers
+type IDGenerator struct {
+	// key is the seed and request IDs are derived from, if any
+	key []byte
+
+	n    int
+	seen map[string]bool
+}
+
+// NewIDGenerator returns an IDGenerator which generates random IDs
+func NewIDGenerator() *IDGenerator {
+	return &IDGenerator{seen: make(map[string]bool)}
+}
+
+// NewSeededIDGenerator returns an IDGenerator which derives each ID from seed,
+// the request, e.g. its prompt, and the ID's index so a request can be
+// replayed with the same IDs while other requests with the same seed, such as
+// the following turns of a conversation, get different IDs
+func NewSeededIDGenerator(seed int64, request string) *IDGenerator {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s", seed, request)
+	return &IDGenerator{key: h.Sum(nil), seen: make(map[string]bool)}
+}
+
+// Next returns the next ID
+func (g *IDGenerator) Next() string {
+	for {
+		b := make([]byte, idLength)
+		if g.key != nil {
+			sum := sha256.Sum256(fmt.Appendf(g.key[:len(g.key):len(g.key)], ":%d", g.n))
+			copy(b, sum[:])
+		} else if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+
+		g.n++
+
+		for i := range b {
+			// 64 divides 256 so every character is equally likely
+			b[i] = idAlphabet[b[i]&63]
+		}
+
+		id := "call_" + string(b)
+		if !g.seen[id] {
+			g.seen[id] = true
+			return id
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package tools
+
+import (
+	"regexp"
+	"testing"
+)
+
+var idPattern = regexp.MustCompile(`^call_[A-Za-z0-9_-]{24}$`)
+
+func TestIDGenerator(t *testing.T) {
+	for name, g := range map[string]*IDGenerator{
+		"random": NewIDGenerator(),
+		"seeded": NewSeededIDGenerator(42, "Hello!"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			for range 1000 {
+				id := g.Next()
+				if !idPattern.MatchString(id) {
+					t.Fatalf("unexpected id format %q", id)
+				}
+
+				if seen[id] {
+					t.Fatalf("duplicate id %q", id)
+				}
+
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestSeededIDGenerator(t *testing.T) {
+	a, b := NewSeededIDGenerator(42, "Hello!"), NewSeededIDGenerator(42, "Hello!")
+	for i := range 10 {
+		if x, y := a.Next(), b.Next(); x != y {
+			t.Errorf("id %d: expected the same id for the same seed and request, got %q and %q", i, x, y)
+		}
+	}
+
+	if x, y := NewSeededIDGenerator(1, "Hello!").Next(), NewSeededIDGenerator(2, "Hello!").Next(); x == y {
+		t.Errorf("expected different ids for different seeds, got %q", x)
+	}
+
+	// later turns of a conversation don't reuse the ids of earlier ones
+	if x, y := NewSeededIDGenerator(1, "Hello!").Next(), NewSeededIDGenerator(1, "Hello! Hi!").Next(); x == y {
+		t.Errorf("expected different ids for different requests, got %q", x)
+	}
+}
@@ -0,0 +1,309 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/api"
+)
+
+// pythonCall matches the start of a Python function call
+var pythonCall = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*\(`)
+
+// decodePython decodes tool calls written as Python function calls with
+// keyword arguments, e.g. get_current_weather(location="Paris"). calls may be
+// separated by semicolons or newlines. arguments are Python literals which are
+// converted to their JSON equivalents. the calls span s[start:end]
+func decodePython(s string) ([]map[string]any, int, int, error) {
+	loc := pythonCall.FindStringIndex(s)
+	if loc == nil {
+		return nil, 0, len(s), nil
+	}
+
+	d := pythonDecoder{s: s[loc[0]:]}
+
+	var calls []map[string]any
+	for {
+		name, args, err := d.call()
+		if err != nil {
+			return calls, loc[0], len(s), fmt.Errorf("tool call %d: %w", len(calls), err)
+		}
+
+		calls = append(calls, map[string]any{"name": name, "arguments": args})
+		end := len(s) - len(d.s)
+
+		d.skipSpace()
+		if d.consume(';') {
+			d.skipSpace()
+		}
+
+		// anything other than another call ends the list of calls
+		if next := pythonCall.FindStringIndex(d.s); next == nil || next[0] != 0 {
+			return calls, loc[0], end, nil
+		}
+	}
+}
+
+type pythonDecoder struct {
+	s string
+}
+
+func (d *pythonDecoder) peek() rune {
+	r, _ := utf8.DecodeRuneInString(d.s)
+	return r
+}
+
+func (d *pythonDecoder) consume(r rune) bool {
+	if d.s != "" && d.peek() == r {
+		d.s = d.s[utf8.RuneLen(r):]
+		return true
+	}
+
+	return false
+}
+
+func (d *pythonDecoder) skipSpace() {
+	d.s = strings.TrimLeftFunc(d.s, unicode.IsSpace)
+}
+
+func (d *pythonDecoder) ident() string {
+	i := strings.IndexFunc(d.s, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if i < 0 {
+		i = len(d.s)
+	}
+
+	ident := d.s[:i]
+	d.s = d.s[i:]
+	return ident
+}
+
+func (d *pythonDecoder) call() (string, api.ToolCallFunctionArguments, error) {
+	name := d.ident()
+	if !d.consume('(') {
+		return "", api.ToolCallFunctionArguments{}, fmt.Errorf("expected ( after %s", name)
+	}
+
+	args := api.NewToolCallFunctionArguments(nil)
+	for {
+		d.skipSpace()
+		if d.consume(')') {
+			return name, args, nil
+		} else if d.s == "" {
+			return "", api.ToolCallFunctionArguments{}, io.ErrUnexpectedEOF
+		}
+
+		key := d.ident()
+		d.skipSpace()
+		if key == "" || !d.consume('=') {
+			return "", api.ToolCallFunctionArguments{}, fmt.Errorf("%s: positional arguments aren't supported", name)
+		}
+
+		d.skipSpace()
+		v, err := d.value()
+		if err != nil {
+			return "", api.ToolCallFunctionArguments{}, fmt.Errorf("%s: argument %s: %w", name, key, err)
+		}
+
+		args.Set(key, v)
+
+		d.skipSpace()
+		if !d.consume(',') && d.peek() != ')' {
+			if d.s == "" {
+				return "", api.ToolCallFunctionArguments{}, io.ErrUnexpectedEOF
+			}
+
+			return "", api.ToolCallFunctionArguments{}, fmt.Errorf("%s: expected , or ) after argument %s", name, key)
+		}
+	}
+}
+
+func (d *pythonDecoder) value() (any, error) {
+	switch r := d.peek(); {
+	case d.s == "":
+		return nil, io.ErrUnexpectedEOF
+	case r == '"' || r == '\'':
+		return d.string()
+	case r == '[':
+		d.consume('[')
+		return d.list()
+	case r == '{':
+		d.consume('{')
+		return d.dict()
+	case r == '-' || r == '+' || r == '.' || unicode.IsDigit(r):
+		return d.number()
+	case r == '_' || unicode.IsLetter(r):
+		switch ident := d.ident(); {
+		case ident == "True":
+			return true, nil
+		case ident == "False":
+			return false, nil
+		case ident == "None":
+			return nil, nil
+		case d.peek() == '(':
+			return nil, fmt.Errorf("nested call to %s isn't supported", ident)
+		default:
+			return nil, fmt.Errorf("unexpected identifier %s", ident)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected character %q", r)
+	}
+}
+
+func (d *pythonDecoder) list() ([]any, error) {
+	list := []any{}
+	for {
+		d.skipSpace()
+		if d.consume(']') {
+			return list, nil
+		}
+
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, v)
+
+		d.skipSpace()
+		if !d.consume(',') && d.peek() != ']' {
+			if d.s == "" {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, errors.New("expected , or ] in list")
+		}
+	}
+}
+
+// dict decodes a dict as api.ToolCallFunctionArguments to keep its order
+func (d *pythonDecoder) dict() (any, error) {
+	dict := api.NewToolCallFunctionArguments(nil)
+	for {
+		d.skipSpace()
+		if d.consume('}') {
+			return dict, nil
+		}
+
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key %v isn't a string", k)
+		}
+
+		d.skipSpace()
+		if !d.consume(':') {
+			return nil, fmt.Errorf("expected : after dict key %q", key)
+		}
+
+		d.skipSpace()
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		dict.Set(key, v)
+
+		d.skipSpace()
+		if !d.consume(',') && d.peek() != '}' {
+			if d.s == "" {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, errors.New("expected , or } in dict")
+		}
+	}
+}
+
+// number decodes an integer or float as a float64 like encoding/json
+func (d *pythonDecoder) number() (float64, error) {
+	i := strings.IndexFunc(d.s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789+-.eE_", r)
+	})
+
+	if i < 0 {
+		i = len(d.s)
+	}
+
+	literal := d.s[:i]
+	d.s = d.s[i:]
+
+	f, err := strconv.ParseFloat(strings.ReplaceAll(literal, "_", ""), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", literal)
+	}
+
+	return f, nil
+}
+
+// string decodes a single or double quoted string
+func (d *pythonDecoder) string() (string, error) {
+	quote := d.peek()
+	d.consume(quote)
+
+	var sb strings.Builder
+	for {
+		r, n := utf8.DecodeRuneInString(d.s)
+		if n == 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+
+		d.s = d.s[n:]
+		switch r {
+		case quote:
+			return sb.String(), nil
+		case '\\':
+			escape, n := utf8.DecodeRuneInString(d.s)
+			if n == 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+
+			d.s = d.s[n:]
+			switch escape {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			case 'r':
+				sb.WriteRune('\r')
+			case '\\', '\'', '"':
+				sb.WriteRune(escape)
+			case 'u', 'x':
+				size := 4
+				if escape == 'x' {
+					size = 2
+				}
+
+				if len(d.s) < size {
+					return "", io.ErrUnexpectedEOF
+				}
+
+				code, err := strconv.ParseUint(d.s[:size], 16, 32)
+				if err != nil {
+					return "", fmt.Errorf("invalid escape \\%c%s", escape, d.s[:size])
+				}
+
+				sb.WriteRune(rune(code))
+				d.s = d.s[size:]
+			default:
+				// unknown escapes are kept as is like in Python
+				sb.WriteRune('\\')
+				sb.WriteRune(escape)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
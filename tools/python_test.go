@@ -0,0 +1,206 @@
+package tools
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+func TestParsePython(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ if .ToolCalls }}Call: {{ range $i, $call := .ToolCalls }}{{ if $i }}; {{ end }}{{ .Function.Name }}(
+{{- $args := .Function.Arguments }}{{ range $args.Keys }}{{ . }}={{ json ($args.Get .) }}, {{ end }}){{ end }}<bot_end>{{ else }}{{ .Content }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.python {
+		t.Fatal("expected a python parser")
+	}
+
+	type call struct {
+		Name      string
+		Arguments map[string]any
+	}
+
+	cases := []struct {
+		name   string
+		input  string
+		expect []call
+		err    string
+	}{
+		{
+			"single",
+			`Call: get_current_weather(location="San Francisco, CA", format="fahrenheit")<bot_end>`,
+			[]call{{"get_current_weather", map[string]any{"location": "San Francisco, CA", "format": "fahrenheit"}}},
+			"",
+		},
+		{
+			"multiple",
+			"get_current_weather(location='Paris'); get_current_weather(location='London')\nget_time(timezone='CET',)",
+			[]call{
+				{"get_current_weather", map[string]any{"location": "Paris"}},
+				{"get_current_weather", map[string]any{"location": "London"}},
+				{"get_time", map[string]any{"timezone": "CET"}},
+			},
+			"",
+		},
+		{
+			"literals",
+			`search(query="it's \"quoted\"\n", limit=10, threshold=-0.5, exact=True, fuzzy=False, after=None, tags=['a', "b"], scale=1e3, empty=[])`,
+			[]call{{"search", map[string]any{
+				"query":     "it's \"quoted\"\n",
+				"limit":     float64(10),
+				"threshold": -0.5,
+				"exact":     true,
+				"fuzzy":     false,
+				"after":     nil,
+				"tags":      []any{"a", "b"},
+				"scale":     float64(1000),
+				"empty":     []any{},
+			}}},
+			"",
+		},
+		{
+			"nested dict",
+			`book(trip={'from': 'Paris', 'to': {'city': "Tokyo", 'airports': ['HND', 'NRT']}, 'nights': 3})`,
+			[]call{{"book", map[string]any{"trip": map[string]any{
+				"from":   "Paris",
+				"to":     map[string]any{"city": "Tokyo", "airports": []any{"HND", "NRT"}},
+				"nights": float64(3),
+			}}}},
+			"",
+		},
+		{
+			"unicode",
+			`translate(text="こんにちは、世界", target='Ελληνικά', emoji="☃ 🌍")`,
+			[]call{{"translate", map[string]any{"text": "こんにちは、世界", "target": "Ελληνικά", "emoji": "☃ 🌍"}}},
+			"",
+		},
+		{
+			"no arguments",
+			`get_time()`,
+			[]call{{"get_time", map[string]any{}}},
+			"",
+		},
+		{
+			"text",
+			"The weather in Paris is sunny (22°C).",
+			nil,
+			"",
+		},
+		{
+			"nested call",
+			`get_time(); get_current_weather(location=get_location())`,
+			[]call{{"get_time", map[string]any{}}},
+			"tool call 1: get_current_weather: argument location: nested call to get_location isn't supported",
+		},
+		{
+			"positional",
+			`get_current_weather("Paris")`,
+			nil,
+			"tool call 0: get_current_weather: positional arguments aren't supported",
+		},
+		{
+			"truncated",
+			`get_current_weather(location="Par`,
+			nil,
+			"tool call 0: get_current_weather: argument location: unexpected EOF",
+		},
+		{
+			"bad dict key",
+			`f(x={1: 'a'})`,
+			nil,
+			"dict key 1 isn't a string",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, err := p.Parse(tt.input)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+
+			var actual []call
+			for _, c := range calls {
+				actual = append(actual, call{c.Function.Name, c.Function.Arguments.Map()})
+			}
+
+			if diff := cmp.Diff(tt.expect, actual); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewParserPythonRange(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ range .ToolCalls }}{{ .Function.Name }}({{ range $k, $v := .Function.Arguments }}{{ $k }}={{ json $v }}, {{ end }})
+{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.python {
+		t.Fatal("expected a python parser")
+	}
+}
+
+func TestParsePythonRoundTrip(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ range .ToolCalls }}{{ .Function.Name }}({{ $args := .Function.Arguments }}{{ range $args.Keys }}{{ . }}={{ json ($args.Get .) }}, {{ end }})
+{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var call api.ToolCall
+	call.Function.Name = "get_current_weather"
+	call.Function.Arguments.Set("location", "Zürich")
+	call.Function.Arguments.Set("days", float64(3))
+	call.Function.Arguments.Set("units", []any{"metric"})
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, template.Values{Messages: []api.Message{{Role: "assistant", ToolCalls: []api.ToolCall{call, call}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := p.Parse(b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(calls))
+	}
+
+	if actual := calls[0].Function.Arguments.Keys(); !slices.Equal(actual, []string{"location", "days", "units"}) {
+		t.Errorf("expected arguments in order, got %v", actual)
+	}
+
+	for _, c := range calls {
+		if diff := cmp.Diff(call.Function, c.Function); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+// Package tools parses tool calls from model output. The format of the tool
+// calls, e.g. the keys holding the function name and arguments, is taken from
+// how the model's template renders .ToolCalls.
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template/parse"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+// ErrNoToolCalls is returned by NewParser for templates that don't render
+// tool calls
+var ErrNoToolCalls = errors.New("template doesn't render tool calls")
+
+// Parser parses tool calls in the format of a template
+type Parser struct {
+	// IDs generates the IDs of parsed tool calls. Each call to Parse uses a
+	// new random IDGenerator if it's nil
+	IDs *IDGenerator
+
+	// name and arguments are the keys of the function name and arguments
+	name, arguments string
+
+	// python is set for templates which render tool calls as Python function
+	// calls rather than JSON
+	python bool
+
+	// open and close are the tags some templates wrap around each tool call,
+	// e.g. <tool_call></tool_call>
+	open, close string
+}
+
+// NewParser returns a Parser for the tool calls rendered by tmpl. Tool calls
+// are parsed as JSON unless tmpl renders them as Python function calls, e.g.
+// get_current_weather(location="Paris"). It returns ErrNoToolCalls if tmpl
+// doesn't range over .ToolCalls
+func NewParser(tmpl *template.Template) (*Parser, error) {
+	// create a subtree from the node that ranges over .ToolCalls
+	sub := tmpl.Subtree(func(n parse.Node) bool {
+		if t, ok := n.(*parse.RangeNode); ok {
+			return slices.Contains(template.Identifiers(t.Pipe), "ToolCalls")
+		}
+
+		return false
+	})
+
+	if sub == nil {
+		return nil, ErrNoToolCalls
+	}
+
+	// templates rendering Python function calls usually range over the
+	// arguments to render each as a keyword argument so they're given as a map
+	var b bytes.Buffer
+	if err := sub.Execute(&b, placeholders(map[string]any{"@@argument@@": "@@value@@"})); err == nil && strings.Contains(b.String(), "@@name@@(") {
+		return &Parser{name: "name", arguments: "arguments", python: true}, nil
+	}
+
+	b.Reset()
+	if err := sub.Execute(&b, placeholders("@@arguments@@")); err != nil {
+		return nil, err
+	}
+
+	// some templates wrap each tool call in tags like <tool_call></tool_call>
+	p := Parser{open: "<tool_call>", close: "</tool_call>"}
+	placeholder := b.String()
+	if openTag, closeTag, ok := tags(placeholder); ok {
+		p.open, p.close = openTag, closeTag
+	}
+
+	if blocks, _, _ := toolCallBlocks(placeholder, p.open, p.close); len(blocks) > 0 {
+		placeholder = blocks[0]
+	}
+
+	// the template may render other fields which aren't necessarily strings
+	var kv map[string]any
+	// execute the subtree with placeholders to identify the keys
+	if err := json.Unmarshal([]byte(placeholder), &kv); err != nil {
+		return nil, fmt.Errorf("template tool call format: %w", err)
+	}
+
+	// find the keys that correspond to the name and arguments fields
+	for k, v := range kv {
+		switch v {
+		case "@@name@@":
+			p.name = k
+		case "@@arguments@@":
+			p.arguments = k
+		}
+	}
+
+	if p.name == "" {
+		return nil, errors.New("template tool call format: name not found")
+	}
+
+	return &p, nil
+}
+
+// placeholders is the data for executing the subtree of a template which
+// ranges over .ToolCalls with a single tool call named @@name@@
+func placeholders(arguments any) map[string][]map[string]any {
+	return map[string][]map[string]any{
+		"ToolCalls": {
+			{
+				"Function": map[string]any{
+					"Name":      "@@name@@",
+					"Arguments": arguments,
+				},
+			},
+		},
+	}
+}
+
+// Parse returns the tool calls in s. Tool calls decoded before any malformed
+// one are returned along with an error describing the failure. No tool calls
+// and a nil error are returned if s doesn't contain any tool calls. Each tool
+// call is given an ID from p.IDs
+func (p *Parser) Parse(s string) ([]api.ToolCall, error) {
+	r, err := p.ParseContent(s)
+	return r.ToolCalls, err
+}
+
+// Result is a response split around its tool calls
+type Result struct {
+	// Prefix is the text before the tool calls, or all of the response if it
+	// has no tool calls. Text on the same line as the start of the tool calls,
+	// e.g. a marker like [TOOL_CALLS], isn't included
+	Prefix string
+
+	ToolCalls []api.ToolCall
+
+	// Suffix is the text after the tool calls
+	Suffix string
+}
+
+// Content returns the text of the response around its tool calls, e.g. the
+// reasoning some models write before calling tools
+func (r Result) Content() string {
+	return strings.TrimSpace(r.Prefix + "\n\n" + r.Suffix)
+}
+
+// ParseContent is like Parse but also returns the text around the tool calls.
+// Prefix and Suffix are trimmed of surrounding whitespace
+func (p *Parser) ParseContent(s string) (Result, error) {
+	decode := p.decodeJSON
+	if p.python {
+		decode = decodePython
+	}
+
+	sm, start, end, err := decode(s)
+	if len(sm) == 0 {
+		return Result{Prefix: strings.TrimSpace(s)}, err
+	}
+
+	ids := p.IDs
+	if ids == nil {
+		ids = NewIDGenerator()
+	}
+
+	r := Result{
+		// drop the rest of the line the tool calls start on
+		Prefix: strings.TrimSpace(s[:strings.LastIndex(s[:start], "\n")+1]),
+		Suffix: strings.TrimSpace(s[end:]),
+	}
+
+	for _, kv := range sm {
+		call := api.ToolCall{
+			ID:   ids.Next(),
+			Type: "function",
+		}
+
+		for k, v := range kv {
+			switch k {
+			case p.name:
+				call.Function.Name, _ = v.(string)
+			case p.arguments:
+				call.Function.Arguments, _ = v.(api.ToolCallFunctionArguments)
+			}
+		}
+
+		r.ToolCalls = append(r.ToolCalls, call)
+	}
+
+	return r, err
+}
+
+// Start returns the offset of the earliest point in s where tool calls may
+// start, or -1 if s doesn't contain the start of any. It's used to hold back
+// streamed text which may turn out to be part of a tool call so it can err on
+// the early side, e.g. at any [ or { for templates rendering JSON
+func (p *Parser) Start(s string) int {
+	var starts []int
+	if p.python {
+		if loc := pythonCall.FindStringIndex(s); loc != nil {
+			starts = append(starts, loc[0])
+		}
+	} else {
+		starts = append(starts, strings.IndexAny(s, "[{"), strings.Index(s, "```"))
+		if p.open != "" {
+			starts = append(starts, strings.Index(s, p.open))
+		}
+	}
+
+	start := -1
+	for _, i := range starts {
+		if i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+
+	return start
+}
+
+// decodeJSON decodes the tool calls in s as JSON objects. the tool calls span
+// s[start:end]
+func (p *Parser) decodeJSON(s string) ([]map[string]any, int, int, error) {
+	var sm []map[string]any
+	var errs []error
+	if blocks, start, end := toolCallBlocks(s, p.open, p.close); len(blocks) > 0 {
+		// decode each block into a single tool call so a malformed one
+		// doesn't discard the rest
+		for i, block := range blocks {
+			// a block usually holds a single tool call but some templates
+			// write several, one per line
+			decoder := json.NewDecoder(strings.NewReader(block))
+			for {
+				call, err := decodeObject(decoder)
+				if errors.Is(err, io.EOF) {
+					break
+				} else if err != nil {
+					errs = append(errs, fmt.Errorf("tool call %d: %w", i, err))
+					break
+				}
+
+				if name, ok := call[p.name].(string); !ok || name == "" {
+					errs = append(errs, fmt.Errorf("tool call %d: missing name", i))
+					continue
+				}
+
+				sm = append(sm, call)
+			}
+		}
+
+		return sm, start, end, errors.Join(errs...)
+	}
+
+	// offset is the position of s in the original string
+	var offset int
+	start, end := -1, len(s)
+
+	// strip a markdown code fence, with or without a language hint, that some
+	// models wrap around their tool calls. fences inside the JSON, e.g. in
+	// markdown passed as an argument, are skipped
+	if i := strings.Index(s, "```"); i >= 0 && !inJSON(s, i) {
+		rest := strings.TrimLeftFunc(s[i+3:], func(r rune) bool {
+			return !unicode.IsSpace(r) && r != '[' && r != '{'
+		})
+
+		start, offset = i, len(s)-len(rest)
+
+		var skip int
+		if k := strings.IndexAny(rest, "[{"); k >= 0 {
+			if n := jsonEnd(rest[k:]); n >= 0 {
+				skip = k + n
+			}
+		}
+
+		if j := strings.Index(rest[skip:], "```"); j >= 0 {
+			end = offset + skip + j + 3
+			rest = rest[:skip+j]
+		}
+
+		s = rest
+	}
+
+	for len(s) > 0 {
+		// incrementally decode the JSON into a list of JSON objects
+		// skipping over any invalid tokens
+		objs, n, err := decodeObjects(s)
+		if len(objs) == 0 && errors.As(err, new(*json.SyntaxError)) {
+			// skip ahead to the next list or object rather than a byte at a
+			// time, which is quadratic in the length of the text before it
+			i := strings.IndexAny(s[1:], "[{")
+			if i < 0 {
+				break
+			}
+
+			s = s[1+i:]
+			offset += 1 + i
+			continue
+		} else if len(objs) == 0 && err == nil {
+			// some models write one tool call per line rather than a list
+			objs, n = p.decodeLines(s)
+		}
+
+		// stop as soon as a list has been decoded, even partially
+		sm = objs
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tool call %d: %w", len(objs), err))
+		}
+
+		if start < 0 {
+			start, end = offset, offset+n
+		}
+
+		break
+	}
+
+	return sm, max(start, 0), end, errors.Join(errs...)
+}
+
+// inJSON reports whether s[i] is inside a JSON list or object in s. spans
+// which aren't terminated are ignored
+func inJSON(s string, i int) bool {
+	for k := 0; k < i; {
+		j := strings.IndexAny(s[k:i], "[{")
+		if j < 0 {
+			return false
+		}
+
+		k += j
+		n := jsonEnd(s[k:])
+		if n < 0 {
+			return false
+		} else if k+n > i {
+			return true
+		}
+
+		k += n
+	}
+
+	return false
+}
+
+// jsonEnd returns the length of the JSON list or object at the start of s by
+// balancing its brackets and braces outside of strings, or -1 if it isn't
+// terminated. the JSON itself isn't validated
+func jsonEnd(s string) int {
+	var depth int
+	var quoted, escaped bool
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return -1
+}
+
+// decodeLines decodes tool calls written as one JSON object per line from the
+// start of s. lines are decoded until one isn't an object with the name and
+// arguments keys so other JSON isn't mistaken for tool calls. the length of
+// the decoded lines in s is also returned
+func (p *Parser) decodeLines(s string) ([]map[string]any, int) {
+	var objs []map[string]any
+	var n int
+	for rest := s; rest != ""; {
+		line, after, _ := strings.Cut(rest, "\n")
+		if strings.TrimSpace(line) != "" {
+			obj, err := decodeObject(json.NewDecoder(strings.NewReader(line)))
+			if err != nil {
+				break
+			}
+
+			if name, ok := obj[p.name].(string); !ok || name == "" {
+				break
+			}
+
+			if _, ok := obj[p.arguments].(api.ToolCallFunctionArguments); p.arguments != "" && !ok {
+				break
+			}
+
+			objs = append(objs, obj)
+			n = len(s) - len(rest) + len(line)
+		}
+
+		rest = after
+	}
+
+	return objs, n
+}
+
+// decodeObjects decodes a JSON list of objects from the start of s. objects
+// decoded before an error are returned along with the error. the length of
+// the list in s is also returned, or that of s if the list isn't terminated
+func decodeObjects(s string) ([]map[string]any, int, error) {
+	decoder := json.NewDecoder(strings.NewReader(s))
+	t, err := decoder.Token()
+	if errors.Is(err, io.EOF) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	if t != json.Delim('[') {
+		// not a list so there are no tool calls
+		return nil, 0, nil
+	}
+
+	// decode each element separately since some templates render the list
+	// without commas between objects
+	rest := s[decoder.InputOffset():]
+
+	var objs []map[string]any
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if len(objs) > 0 {
+			rest = strings.TrimLeftFunc(strings.TrimPrefix(rest, ","), unicode.IsSpace)
+		}
+
+		if strings.HasPrefix(rest, "]") {
+			return objs, len(s) - len(rest) + 1, nil
+		} else if rest == "" {
+			return objs, len(s), io.ErrUnexpectedEOF
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(rest))
+
+		obj, err := decodeObject(decoder)
+		if err != nil {
+			return objs, len(s), err
+		}
+
+		objs = append(objs, obj)
+		rest = rest[decoder.InputOffset():]
+	}
+}
+
+// decodeObject decodes the next JSON object from decoder. objects nested in it,
+// e.g. the arguments of a tool call, keep the order of their keys
+func decodeObject(decoder *json.Decoder) (map[string]any, error) {
+	var obj api.ToolCallFunctionArguments
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+
+	kv := make(map[string]any, obj.Len())
+	for _, k := range obj.Keys() {
+		kv[k] = obj.Get(k)
+	}
+
+	return kv, nil
+}
+
+// tags returns the tags around the single tool call rendered in s, e.g.
+// <tool_call> and </tool_call>, if it's wrapped in XML-like tags
+func tags(s string) (string, string, bool) {
+	i, j := strings.Index(s, "{"), strings.LastIndex(s, "}")
+	if i < 0 || j < i {
+		return "", "", false
+	}
+
+	openTag, closeTag := strings.TrimSpace(s[:i]), strings.TrimSpace(s[j+1:])
+	isTag := func(s string) bool {
+		return len(s) > 2 && strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") && !strings.ContainsAny(s[1:len(s)-1], "<>")
+	}
+
+	return openTag, closeTag, isTag(openTag) && isTag(closeTag)
+}
+
+// toolCallBlocks returns the trimmed blocks of s delimited by the tags
+// along with the span of s they cover. a block also ends where the next one
+// opens, and the last block is kept even if it isn't closed, e.g. when the
+// model stopped before writing the closing tag
+func toolCallBlocks(s, openTag, closeTag string) ([]string, int, int) {
+	start := strings.Index(s, openTag)
+	if start < 0 {
+		return nil, 0, 0
+	}
+
+	var blocks []string
+	var end int
+	for i := start + len(openTag); ; {
+		rest := s[i:]
+		c, o := strings.Index(rest, closeTag), strings.Index(rest, openTag)
+		switch {
+		case c >= 0 && (o < 0 || c < o):
+			blocks = append(blocks, strings.TrimSpace(rest[:c]))
+			i += c + len(closeTag)
+		case o >= 0:
+			blocks = append(blocks, strings.TrimSpace(rest[:o]))
+			i += o
+		default:
+			blocks = append(blocks, strings.TrimSpace(rest))
+			i = len(s)
+		}
+
+		end = i
+		o = strings.Index(s[i:], openTag)
+		if o < 0 {
+			return blocks, start, end
+		}
+
+		i += o + len(openTag)
+	}
+}
@@ -0,0 +1,304 @@
+package tools
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/template"
+)
+
+func TestNewParser(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		err      string
+	}{
+		{"no tool calls", `{{ range .Messages }}{{ .Content }}{{ end }}`, ErrNoToolCalls.Error()},
+		{"not json", `{{ range .ToolCalls }}{{ .Function.Name }}: {{ .Function.Arguments }}{{ end }}`, "template tool call format"},
+		{"no name", `{{ range .ToolCalls }}{"arguments": {{ json .Function.Arguments }}}{{ end }}`, "template tool call format: name not found"},
+		{"valid", `{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}`, ""},
+		{"defined", `{{ define "toolcalls" }}{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}{{ end }}{{ range .Messages }}{{ template "toolcalls" . }}{{ end }}`, ""},
+		{"recursive", `{{ define "a" }}{{ template "b" . }}{{ end }}{{ define "b" }}{{ template "a" . }}{{ end }}{{ template "a" . }}`, ErrNoToolCalls.Error()},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = NewParser(tmpl)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("is", func(t *testing.T) {
+		tmpl, err := template.Parse(`{{ .Prompt }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewParser(tmpl); !errors.Is(err, ErrNoToolCalls) {
+			t.Errorf("expected %v, got %v", ErrNoToolCalls, err)
+		}
+	})
+}
+
+func TestParseIDs(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := `[{"name": "a", "arguments": {}}, {"name": "a", "arguments": {}}]`
+
+	var ids [][]string
+	for range 2 {
+		p.IDs = NewSeededIDGenerator(7, s)
+		calls, err := p.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, []string{calls[0].ID, calls[1].ID})
+	}
+
+	if diff := cmp.Diff(ids[0], ids[1]); diff != "" {
+		t.Errorf("expected the same ids for the same seed (-first +second):\n%s", diff)
+	}
+
+	if ids[0][0] == ids[0][1] {
+		t.Errorf("expected distinct ids, got %q", ids[0][0])
+	}
+}
+
+func TestParse(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ if .ToolCalls }}[TOOL_CALLS] [{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}]{{ else }}{{ .Content }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		input  string
+		expect []string
+		err    bool
+	}{
+		{"list", `[TOOL_CALLS] [{"name": "a", "arguments": {}}, {"name": "b", "arguments": {}}]`, []string{"a", "b"}, false},
+		{"no commas", `[TOOL_CALLS] [{"name": "a", "arguments": {}}{"name": "b", "arguments": {}}]`, []string{"a", "b"}, false},
+		{"blocks", "<tool_call>\n{\"name\": \"a\", \"arguments\": {}}\n</tool_call>", []string{"a"}, false},
+		{"fenced", "```json\n[{\"name\": \"a\", \"arguments\": {}}]\n```", []string{"a"}, false},
+		{"truncated", `[{"name": "a", "arguments": {}}, {"name": "b", "argu`, []string{"a"}, true},
+		{"text", "The weather is nice.", nil, false},
+		{"long text", strings.Repeat("The weather is nice. ", 50000) + `[{"name": "a", "arguments": {}}]`, []string{"a"}, false},
+		{"lines", "[TOOL_CALLS] {\"name\": \"a\", \"arguments\": {}}\n{\"name\": \"b\", \"arguments\": {\"location\": \"Paris\"}}\n", []string{"a", "b"}, false},
+		{"lines with text", "{\"name\": \"a\", \"arguments\": {}}\n\nThe weather is nice.", []string{"a"}, false},
+		{"json object", `{"name": "Paris", "country": "France"}`, nil, false},
+		{"json lines", "{\"name\": \"Paris\"}\n{\"name\": \"a\", \"arguments\": {}}", nil, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, err := p.Parse(tt.input)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %t, got %v", tt.err, err)
+			}
+
+			var names []string
+			for _, call := range calls {
+				if !idPattern.MatchString(call.ID) || call.Type != "function" {
+					t.Errorf("unexpected id %q or type %q", call.ID, call.Type)
+				}
+
+				names = append(names, call.Function.Name)
+			}
+
+			if diff := cmp.Diff(tt.expect, names); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseFencedArguments(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ if .ToolCalls }}[TOOL_CALLS] [{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}]{{ else }}{{ .Content }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := "```go\nfunc main() { fmt.Println(\"}\") }\n```"
+	call := `{"name": "run", "arguments": {"code": "` + strings.NewReplacer("\n", `\n`, `"`, `\"`).Replace(code) + `"}}`
+
+	cases := []struct {
+		name    string
+		input   string
+		content string
+	}{
+		{"marker", "[TOOL_CALLS] [" + call + "]", ""},
+		{"text", "Let me run it.\n[TOOL_CALLS] [" + call + "]\nDone.", "Let me run it.\n\nDone."},
+		{"fenced", "```json\n[" + call + "]\n```", ""},
+		{"fenced text", "Let me run it.\n```json\n[" + call + "]\n```\nDone.", "Let me run it.\n\nDone."},
+		{"lines", call + "\n", ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := p.ParseContent(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(r.ToolCalls) != 1 {
+				t.Fatalf("expected 1 tool call, got %d", len(r.ToolCalls))
+			}
+
+			if diff := cmp.Diff(code, r.ToolCalls[0].Function.Arguments.Get("code")); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.content, r.Content()); diff != "" {
+				t.Errorf("content mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParserStart(t *testing.T) {
+	jsonTmpl, err := template.Parse(`{{ range .Messages }}{{ if .ToolCalls }}[TOOL_CALLS] [{{ range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}{{ end }}]{{ else }}{{ .Content }}{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pythonTmpl, err := template.Parse(`{{ range .Messages }}{{ range .ToolCalls }}{{ .Function.Name }}({{ $args := .Function.Arguments }}{{ range $args.Keys }}{{ . }}={{ json ($args.Get .) }}{{ end }}){{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		tmpl  *template.Template
+		input string
+		start int
+	}{
+		{"text", jsonTmpl, "Let me check.\n", -1},
+		{"marker", jsonTmpl, "Let me check.\n[TOOL_CALLS] [", 14},
+		{"object", jsonTmpl, "Sure: {", 6},
+		{"fence", jsonTmpl, "Sure:\n```json\n[", 6},
+		{"tag", jsonTmpl, "Sure: <tool_call>", 6},
+		{"python text", pythonTmpl, "Let me check [the weather].", -1},
+		{"python", pythonTmpl, "Let me check.\nget_weather(", 14},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewParser(tt.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if start := p.Start(tt.input); start != tt.start {
+				t.Errorf("expected %d, got %d", tt.start, start)
+			}
+		})
+	}
+}
+
+func TestJSONEnd(t *testing.T) {
+	cases := []struct {
+		s   string
+		end int
+	}{
+		{`{}`, 2},
+		{`[{"a": "}"}] rest`, 12},
+		{`{"a": "\"}"} rest`, 12},
+		{`{"a": {"b": [1, 2]}}`, 20},
+		{`{"a": "`, -1},
+		{`[{}`, -1},
+	}
+
+	for _, tt := range cases {
+		if end := jsonEnd(tt.s); end != tt.end {
+			t.Errorf("%s: expected %d, got %d", tt.s, tt.end, end)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ range .ToolCalls }}<function_call>
+{"name": "{{ .Function.Name }}", "arguments": {{ json .Function.Arguments }}}
+</function_call>
+{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewParser(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		input  string
+		expect []string
+		err    bool
+	}{
+		{"tags", "<function_call>\n{\"name\": \"a\", \"arguments\": {}}\n</function_call>\n<function_call>{\"name\": \"b\", \"arguments\": {}}</function_call>", []string{"a", "b"}, false},
+		{"not closed before next", `<function_call>{"name": "a", "arguments": {}}<function_call>{"name": "b", "arguments": {}}</function_call>`, []string{"a", "b"}, false},
+		{"malformed", `<function_call>{"name": "a", "argu</function_call><function_call>{"name": "b", "arguments": {}}</function_call>`, []string{"b"}, true},
+		{"unclosed", `<function_call>{"name": "a", "arguments": {}}</function_call><function_call>{"name": "b", "arguments": {}}`, []string{"a", "b"}, false},
+		{"truncated", `<function_call>{"name": "a", "arguments": {}}</function_call><function_call>{"name": "b", "argu`, []string{"a"}, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, err := p.Parse(tt.input)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %t, got %v", tt.err, err)
+			}
+
+			var names []string
+			for _, call := range calls {
+				names = append(names, call.Function.Name)
+			}
+
+			if diff := cmp.Diff(tt.expect, names); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("content", func(t *testing.T) {
+		r, err := p.ParseContent("Let me check.\n<function_call>{\"name\": \"a\", \"arguments\": {}}</function_call>\nDone.")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Prefix != "Let me check." || r.Suffix != "Done." {
+			t.Errorf("unexpected prefix %q or suffix %q", r.Prefix, r.Suffix)
+		}
+	})
+}